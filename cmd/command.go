@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+)
+
+// runCommand run subcommand from command line arguments, args[0] is name of the command.
+// Subcommands use config and storage of the proxy, but doesn't start it.
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "revoke":
+		return revokeCommand(ctx, args[1:])
+	case "certs":
+		return certsCommand(ctx, args[1:])
+	case "account":
+		return accountCommand(ctx, args[1:])
+	default:
+		return xerrors.Errorf("unknown command '%v', allowed: revoke, certs, account", args[0])
+	}
+}
+
+// openStorage read config, init logger and open certificates storage for command
+func openStorage(ctx context.Context) (context.Context, *configType, cache.Bytes, error) {
+	config := getConfig(ctx)
+	logger := initLogger(config.Log)
+	ctx = zc.WithLogger(ctx, logger)
+
+	storage, err := config.Storage.CreateStorage(ctx, config.General.StorageDir)
+	log.InfoError(logger, err, "Create storage", zap.String("type", config.Storage.Type))
+	if err != nil {
+		return ctx, nil, nil, xerrors.Errorf("create storage: %w", err)
+	}
+	return ctx, config, storage, nil
+}
+
+// newCommandCertManager create certificate manager for operations with storage, it doesn't start background tasks.
+// acmeManagers may be empty for commands without requests to acme server.
+func newCommandCertManager(config *configType, storage cache.Bytes, acmeManagers []*acme_client_manager.AcmeManager) (*cert_manager.Manager, error) {
+	var clientManager cert_manager.AcmeClientManager
+	if len(acmeManagers) > 0 {
+		clientManager = acmeManagers[0]
+	}
+	certManager := cert_manager.New(clientManager, storage, nil)
+	if len(acmeManagers) > 1 {
+		for _, fallbackClientManager := range acmeManagers[1:] {
+			certManager.FallbackAcmeClientManagers = append(certManager.FallbackAcmeClientManagers, fallbackClientManager)
+		}
+	}
+
+	certManager.SaveJSONMeta = config.General.StoreJSONMetadata
+	certManager.AllowECDSACert = config.General.AllowECDSACert
+	certManager.AllowRSACert = config.General.AllowRSACert
+	certManager.AutoSubdomains = autoSubdomains(config.General.Subdomains)
+	err := certManager.SetWildcardZones(config.General.WildcardZones)
+	if err != nil {
+		return nil, xerrors.Errorf("set wildcard zones: %w", err)
+	}
+	return certManager, nil
+}
+
+// parseCommandFlags parse flags, mixed with positional arguments, and return positional arguments
+func parseCommandFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// parseKeyTypeArg return key types from key type argument.
+// Empty argument mean all key types, all is true for the case.
+func parseKeyTypeArg(name string) (keyTypes []cert_manager.KeyType, all bool, err error) {
+	switch keyType := cert_manager.KeyType(strings.ToLower(strings.TrimSpace(name))); keyType {
+	case "":
+		return []cert_manager.KeyType{cert_manager.KeyRSA, cert_manager.KeyECDSA}, true, nil
+	case cert_manager.KeyRSA, cert_manager.KeyECDSA:
+		return []cert_manager.KeyType{keyType}, false, nil
+	default:
+		return nil, false, xerrors.Errorf("unknown key type '%v'", name)
+	}
+}
+
+type revokeArgs struct {
+	domain   domain.DomainName
+	keyTypes []cert_manager.KeyType
+	reason   acme.CRLReasonCode
+
+	// allKeyTypes is true if key type not set and command must revoke stored certificates of any key type
+	allKeyTypes bool
+}
+
+func parseRevokeArgs(args []string) (revokeArgs, error) {
+	flags := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	domainName := flags.String("domain", "", "Domain of revoked certificate, required.")
+	keyTypeName := flags.String("key-type", "", "Key type of revoked certificate: rsa or ecdsa. Revoke certificates of all key types by default.")
+	reasonName := flags.String("reason", cert_manager.RevocationReasonName(acme.CRLReasonUnspecified),
+		"Revocation reason: "+strings.Join(cert_manager.RevocationReasonNames(), ", ")+".")
+
+	var res revokeArgs
+	if err := flags.Parse(args); err != nil {
+		return res, err
+	}
+	if flags.NArg() > 0 {
+		return res, xerrors.Errorf("unexpected arguments: %v", flags.Args())
+	}
+	if *domainName == "" {
+		return res, xerrors.New("domain is required")
+	}
+
+	var err error
+	res.domain, err = domain.NormalizeDomain(*domainName)
+	if err != nil {
+		return res, xerrors.Errorf("bad domain '%v': %w", *domainName, err)
+	}
+
+	res.keyTypes, res.allKeyTypes, err = parseKeyTypeArg(*keyTypeName)
+	if err != nil {
+		return res, err
+	}
+
+	res.reason, err = cert_manager.ParseRevocationReason(*reasonName)
+	return res, err
+}
+
+// revokeCommand revoke certificate of the domain by acme server and remove it from storage.
+// Certificate will be issued again with new key on next request, if the domain allowed.
+func revokeCommand(ctx context.Context, args []string) error {
+	revoke, err := parseRevokeArgs(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, config, storage, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+
+	acmeManagers := createAcmeManagers(ctx, config, storage)
+	defer func() {
+		for _, acmeManager := range acmeManagers {
+			log.DebugErrorCtx(ctx, acmeManager.Close(), "Close acme manager")
+		}
+	}()
+
+	certManager, err := newCommandCertManager(config, storage, acmeManagers)
+	if err != nil {
+		return err
+	}
+
+	var revoked int
+	for _, keyType := range revoke.keyTypes {
+		err = certManager.RevokeCertificate(ctx, revoke.domain, keyType, revoke.reason)
+		if revoke.allKeyTypes && xerrors.Is(err, cache.ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			return xerrors.Errorf("revoke %v certificate: %w", keyType, err)
+		}
+		revoked++
+		fmt.Printf("Revoked %v certificate for %v\n", keyType, revoke.domain)
+	}
+	if revoked == 0 {
+		return xerrors.Errorf("certificate for '%v' not found", revoke.domain)
+	}
+	return nil
+}
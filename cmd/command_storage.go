@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"golang.org/x/xerrors"
+)
+
+const storageFileMode = 0600
+
+// certsCommand manage certificates in storage without start proxy and requests to acme server:
+//
+//	certs list
+//	certs show <domain> [--key-type=rsa|ecdsa]
+//	certs import <cert-file> <key-file> [--lock]
+//	certs export <domain> [--key-type=rsa|ecdsa] [--cert-file=<file>] [--key-file=<file>]
+//	certs delete <domain> [--key-type=rsa|ecdsa]
+func certsCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return xerrors.New("certs command need operation: list, show, import, export, delete")
+	}
+
+	ctx, config, storage, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	certManager, err := newCommandCertManager(config, storage, nil)
+	if err != nil {
+		return err
+	}
+	return runCertsCommand(ctx, certManager, args, os.Stdout)
+}
+
+func runCertsCommand(ctx context.Context, certManager *cert_manager.Manager, args []string, out io.Writer) error {
+	operation := args[0]
+	switch operation {
+	case "list", "show", "import", "export", "delete":
+		// pass
+	default:
+		return xerrors.Errorf("unknown certs operation '%v', allowed: list, show, import, export, delete", operation)
+	}
+
+	flags := flag.NewFlagSet("certs "+operation, flag.ContinueOnError)
+	keyTypeName := flags.String("key-type", "", "Key type of certificate: rsa or ecdsa. All key types by default.")
+	var lock *bool
+	var certFile, keyFile *string
+	switch operation {
+	case "import":
+		lock = flags.Bool("lock", false, "Lock imported certificate, it will be used as is without renew.")
+	case "export":
+		certFile = flags.String("cert-file", "", "Write certificate chain to the file instead of stdout.")
+		keyFile = flags.String("key-file", "", "Write private key to the file instead of stdout.")
+	}
+
+	positional, err := parseCommandFlags(flags, args[1:])
+	if err != nil {
+		return err
+	}
+	keyTypes, allKeyTypes, err := parseKeyTypeArg(*keyTypeName)
+	if err != nil {
+		return err
+	}
+
+	switch operation {
+	case "list":
+		if len(positional) != 0 {
+			return xerrors.New("usage: certs list")
+		}
+		return certsList(ctx, certManager, out)
+	case "import":
+		if len(positional) != 2 {
+			return xerrors.New("usage: certs import <cert-file> <key-file> [--lock]")
+		}
+		return certsImport(ctx, certManager, positional[0], positional[1], *lock, out)
+	}
+
+	if len(positional) != 1 {
+		return xerrors.Errorf("usage: certs %v <domain> [--key-type=rsa|ecdsa]", operation)
+	}
+	d, err := domain.NormalizeDomain(positional[0])
+	if err != nil {
+		return xerrors.Errorf("bad domain '%v': %w", positional[0], err)
+	}
+
+	switch operation {
+	case "show":
+		return certsShow(ctx, certManager, d, keyTypes, out)
+	case "export":
+		return certsExport(ctx, certManager, d, keyTypes, allKeyTypes, *certFile, *keyFile, out)
+	default: // delete
+		for _, keyType := range keyTypes {
+			if err = certManager.DeleteCertificate(ctx, d, keyType); err != nil {
+				return xerrors.Errorf("delete %v certificate: %w", keyType, err)
+			}
+			_, _ = fmt.Fprintf(out, "Deleted %v certificate for %v\n", keyType, d)
+		}
+		return nil
+	}
+}
+
+func certsList(ctx context.Context, certManager *cert_manager.Manager, out io.Writer) error {
+	certificates, err := certManager.ListCertificates(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tKEY TYPE\tEXPIRE\tLOCKED\tDOMAINS")
+	for _, info := range certificates {
+		expire := "-"
+		if info.Stored {
+			expire = info.Expire.Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", info.Name, info.KeyType, expire, info.Locked,
+			strings.Join(info.Domains, ","))
+	}
+	return w.Flush()
+}
+
+func certsShow(ctx context.Context, certManager *cert_manager.Manager, d domain.DomainName, keyTypes []cert_manager.KeyType, out io.Writer) error {
+	var certificates []cert_manager.CertificateInfo
+	for _, keyType := range keyTypes {
+		info, err := certManager.CertificateInfo(ctx, d, keyType)
+		if err == cache.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, info)
+	}
+	if len(certificates) == 0 {
+		return xerrors.Errorf("certificate for '%v' not found", d)
+	}
+	return writeCommandJSON(out, certificates)
+}
+
+func certsImport(ctx context.Context, certManager *cert_manager.Manager, certFile, keyFile string, lock bool, out io.Writer) error {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return xerrors.Errorf("read certificate: %w", err)
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return xerrors.Errorf("read private key: %w", err)
+	}
+
+	info, err := certManager.ImportCertificate(ctx, certPEM, keyPEM, lock)
+	if err != nil {
+		return err
+	}
+	return writeCommandJSON(out, []cert_manager.CertificateInfo{info})
+}
+
+// certsExport write certificate and key of first stored key type
+func certsExport(ctx context.Context, certManager *cert_manager.Manager, d domain.DomainName, keyTypes []cert_manager.KeyType,
+	allKeyTypes bool, certFile, keyFile string, out io.Writer) error {
+	for _, keyType := range keyTypes {
+		certPEM, keyPEM, err := certManager.ExportCertificate(ctx, d, keyType)
+		if allKeyTypes && err == cache.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return xerrors.Errorf("export %v certificate: %w", keyType, err)
+		}
+
+		if certFile == "" {
+			_, err = out.Write(certPEM)
+		} else {
+			err = ioutil.WriteFile(certFile, certPEM, storageFileMode)
+		}
+		if err != nil {
+			return xerrors.Errorf("write certificate: %w", err)
+		}
+
+		if keyFile == "" {
+			_, err = out.Write(keyPEM)
+		} else {
+			err = ioutil.WriteFile(keyFile, keyPEM, storageFileMode)
+		}
+		if err != nil {
+			return xerrors.Errorf("write private key: %w", err)
+		}
+		return nil
+	}
+	return xerrors.Errorf("certificate for '%v' not found", d)
+}
+
+// accountCommand show acme accounts from storage without requests to acme server:
+//
+//	account show
+func accountCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] != "show" {
+		return xerrors.New("usage: account show")
+	}
+
+	ctx, config, storage, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+
+	directoryURLs := []string{config.General.AcmeServer}
+	for _, fallback := range config.General.FallbackAcmeServers {
+		directoryURLs = append(directoryURLs, fallback.DirectoryURL)
+	}
+	return accountShow(ctx, storage, directoryURLs, os.Stdout)
+}
+
+// accountsInfo is stored accounts of acme server
+type accountsInfo struct {
+	DirectoryURL string                            `json:"directory_url"`
+	Accounts     []acme_client_manager.AccountInfo `json:"accounts"`
+}
+
+func accountShow(ctx context.Context, storage cache.Bytes, directoryURLs []string, out io.Writer) error {
+	res := make([]accountsInfo, 0, len(directoryURLs))
+	for _, directoryURL := range directoryURLs {
+		accounts, err := acme_client_manager.StoredAccounts(ctx, storage, directoryURL)
+		if err != nil && err != cache.ErrCacheMiss {
+			return xerrors.Errorf("load accounts of '%v': %w", directoryURL, err)
+		}
+		if accounts == nil {
+			accounts = []acme_client_manager.AccountInfo{}
+		}
+		res = append(res, accountsInfo{DirectoryURL: directoryURL, Accounts: accounts})
+	}
+	return writeCommandJSON(out, res)
+}
+
+func writeCommandJSON(out io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func createTestCertFiles(t *testing.T, dir string, domains ...string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     domains,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestRunCertsCommand(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	dir := t.TempDir()
+	certFile, keyFile := createTestCertFiles(t, dir, "test.ru", "www.test.ru")
+
+	certManager := cert_manager.New(nil, cache.NewMemoryCache("test"), nil)
+	certManager.AutoSubdomains = []string{"www."}
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runCertsCommand(ctx, certManager, args, &out)
+		return out.String(), err
+	}
+
+	_, err := run("unknown")
+	e.CmpError(err)
+	_, err = run("import", certFile)
+	e.CmpError(err)
+
+	out, err := run("import", certFile, keyFile, "--lock")
+	e.CmpNoError(err)
+	var certificates []cert_manager.CertificateInfo
+	e.CmpNoError(json.Unmarshal([]byte(out), &certificates))
+	e.Len(certificates, 1)
+	e.Cmp(certificates[0].Name, "test.ru")
+	e.Cmp(certificates[0].KeyType, cert_manager.KeyECDSA)
+	e.True(certificates[0].Locked)
+
+	out, err = run("list")
+	e.CmpNoError(err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	e.Len(lines, 2)
+	e.True(strings.HasPrefix(lines[1], "test.ru"))
+	e.True(strings.Contains(lines[1], "test.ru,www.test.ru"))
+
+	out, err = run("show", "www.test.ru")
+	e.CmpNoError(err)
+	e.CmpNoError(json.Unmarshal([]byte(out), &certificates))
+	e.Len(certificates, 1)
+
+	_, err = run("show", "test.ru", "--key-type=rsa")
+	e.CmpError(err)
+
+	out, err = run("export", "test.ru")
+	e.CmpNoError(err)
+	certPEM, _ := ioutil.ReadFile(certFile)
+	e.True(strings.HasPrefix(out, string(certPEM)))
+	e.True(strings.Contains(out, "EC PRIVATE KEY"))
+
+	exportKeyFile := filepath.Join(dir, "export.key")
+	out, err = run("export", "--key-file", exportKeyFile, "test.ru")
+	e.CmpNoError(err)
+	e.Cmp(out, string(certPEM))
+	keyPEM, _ := ioutil.ReadFile(keyFile)
+	exportedKeyPEM, _ := ioutil.ReadFile(exportKeyFile)
+	e.Cmp(exportedKeyPEM, keyPEM)
+
+	_, err = run("delete", "test.ru", "--key-type", "ecdsa")
+	e.CmpNoError(err)
+	_, err = run("export", "test.ru")
+	e.CmpError(err)
+}
+
+func TestAccountShow(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	var out bytes.Buffer
+	e.CmpNoError(accountShow(ctx, cache.NewMemoryCache("test"), []string{"https://acme.example.com/directory"}, &out))
+
+	var res []accountsInfo
+	e.CmpNoError(json.Unmarshal(out.Bytes(), &res))
+	e.Len(res, 1)
+	e.Cmp(res[0].DirectoryURL, "https://acme.example.com/directory")
+	e.Len(res[0].Accounts, 0)
+}
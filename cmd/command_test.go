@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"golang.org/x/crypto/acme"
+)
+
+func TestRunCommandUnknown(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	e.CmpError(runCommand(ctx, []string{"unknown"}))
+}
+
+func TestParseRevokeArgs(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	res, err := parseRevokeArgs([]string{"--domain", "Test.RU"})
+	e.CmpNoError(err)
+	e.Cmp(res.domain.String(), "test.ru")
+	e.Cmp(res.keyTypes, []cert_manager.KeyType{cert_manager.KeyRSA, cert_manager.KeyECDSA})
+	e.True(res.allKeyTypes)
+	e.Cmp(res.reason, acme.CRLReasonUnspecified)
+
+	res, err = parseRevokeArgs([]string{"--domain=test.ru", "--key-type=ecdsa", "--reason=keyCompromise"})
+	e.CmpNoError(err)
+	e.Cmp(res.keyTypes, []cert_manager.KeyType{cert_manager.KeyECDSA})
+	e.False(res.allKeyTypes)
+	e.Cmp(res.reason, acme.CRLReasonKeyCompromise)
+
+	_, err = parseRevokeArgs(nil)
+	e.CmpError(err)
+
+	_, err = parseRevokeArgs([]string{"--domain=test.ru", "--key-type=dsa"})
+	e.CmpError(err)
+
+	_, err = parseRevokeArgs([]string{"--domain=test.ru", "--reason=bad"})
+	e.CmpError(err)
+
+	_, err = parseRevokeArgs([]string{"--domain=test.ru", "other"})
+	e.CmpError(err)
+}
@@ -6,13 +6,16 @@ import (
 	_ "embed"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 
 	"github.com/BurntSushi/toml"
+	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
+	"github.com/rekby/lets-proxy2/internal/admin"
+	"github.com/rekby/lets-proxy2/internal/cache"
 	"github.com/rekby/lets-proxy2/internal/config"
+	"github.com/rekby/lets-proxy2/internal/dns_provider"
 	"github.com/rekby/lets-proxy2/internal/domain_checker"
 	"github.com/rekby/lets-proxy2/internal/log"
 	"github.com/rekby/lets-proxy2/internal/profiler"
@@ -20,6 +23,7 @@ import (
 	"github.com/rekby/lets-proxy2/internal/tlslistener"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
+	"golang.org/x/xerrors"
 )
 
 //go:embed static/default-config.toml
@@ -28,26 +32,48 @@ var defaultConfigContent []byte
 type configType struct {
 	General      configGeneral
 	Log          logConfig
+	Storage      cache.Config
 	Proxy        proxy.Config
 	CheckDomains domain_checker.Config
+	DNS01        dns_provider.Config
 	Listen       tlslistener.Config
 
 	Profiler profiler.Config
 	Metrics  config.Config
+	Admin    admin.Config
 }
 
 type configGeneral struct {
-	IssueTimeout            int
-	StorageDir              string
-	Subdomains              []string
-	AcmeServer              string
-	StoreJSONMetadata       bool
-	IncludeConfigs          []string
-	MaxConfigFilesRead      int
-	AllowRSACert            bool
-	AllowECDSACert          bool
-	AllowInsecureTLSChipers bool
-	MinTLSVersion           string
+	IssueTimeout                    int
+	IssueLock                       bool
+	IssueLockTTLSeconds             int
+	IssueLockPollSeconds            int
+	RenewBeforeExpirePercent        float64
+	RenewCheckIntervalSeconds       int
+	RenewConcurrency                int
+	RenewJitterSeconds              int
+	UseRenewalInfo                  bool
+	OCSPStapling                    bool
+	StorageDir                      string
+	StaticCertificatesDir           string
+	StaticCertificatesReloadSeconds int
+	Subdomains                      []string
+	AcmeServer                      string
+	AcmeEmail                       string
+	AcmeEABKeyID                    string
+	AcmeEABHMACKey                  string
+	FallbackAcmeServers             []acme_client_manager.Config
+	StoreJSONMetadata               bool
+	IncludeConfigs                  []string
+	MaxConfigFilesRead              int
+	AllowRSACert                    bool
+	AllowECDSACert                  bool
+	AllowInsecureTLSChipers         bool
+	MinTLSVersion                   string
+	ChallengeTypes                  []string
+	WildcardZones                   []string
+
+	GracefulShutdownTimeoutSeconds int
 }
 
 //nolint:maligned
@@ -55,6 +81,9 @@ type logConfig struct {
 	EnableLogToFile   bool
 	EnableLogToStdErr bool
 	LogLevel          string
+	Format            string
+	FileLogLevel      string
+	StdErrLogLevel    string
 	EnableAccessLog   bool
 	EnableRotate      bool
 	DeveloperMode     bool
@@ -63,6 +92,26 @@ type logConfig struct {
 	CompressRotated   bool
 	MaxDays           int
 	MaxCount          int
+
+	EnableSyslog   bool
+	SyslogNetwork  string
+	SyslogAddress  string
+	SyslogFacility string
+	SyslogTag      string
+	SyslogLogLevel string
+
+	EnableJournald     bool
+	JournaldSocket     string
+	JournaldIdentifier string
+	JournaldLogLevel   string
+
+	AccessLogFile           string
+	AccessLogFormat         string
+	AccessLogFields         []string
+	AccessLogSampleRate     float64
+	AccessLogRotateBySizeMB int
+	AccessLogMaxDays        int
+	AccessLogMaxCount       int
 }
 
 var (
@@ -72,23 +121,49 @@ var (
 
 func getConfig(ctx context.Context) *configType {
 	if _config == nil {
-		logger := zc.LNop(ctx).With(zap.String("config_file", *configFileP))
-		logger.Info("Read config")
-		_config = &configType{}
-		mergeConfigBytes(ctx, _config, defaultConfig(ctx), "default")
-		mergeConfigByTemplate(ctx, _config, *configFileP)
-		applyMoveConfigDetails(_config)
-		applyFlags(ctx, _config)
-		logger.Info("Parse configs finished", zap.Int("readed_files", parsedConfigFiles),
-			zap.Int("max_read_files", _config.General.MaxConfigFilesRead))
-
-		if *debugLog {
-			_config.Log.LogLevel = "debug"
-		}
+		config, err := readConfig(ctx)
+		log.InfoFatal(zc.L(ctx), err, "Read config")
+		_config = config
 	}
 	return _config
 }
 
+// readConfig read config from files from begin. It used on start and on config reload.
+func readConfig(ctx context.Context) (*configType, error) {
+	logger := zc.LNop(ctx).With(zap.String("config_file", *configFileP))
+	logger.Info("Read config")
+
+	parsedConfigFiles = 0
+	config := &configType{}
+	if err := mergeConfigBytes(ctx, config, defaultConfig(ctx), "default"); err != nil {
+		return nil, err
+	}
+	if err := mergeConfigByTemplate(ctx, config, *configFileP); err != nil {
+		return nil, err
+	}
+	applyMoveConfigDetails(config)
+	applyFlags(ctx, config)
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	logger.Info("Parse configs finished", zap.Int("readed_files", parsedConfigFiles),
+		zap.Int("max_read_files", config.General.MaxConfigFilesRead))
+
+	if *debugLog {
+		config.Log.LogLevel = "debug"
+	}
+	return config, nil
+}
+
+// validateConfig check settings, which can't work together
+func validateConfig(config *configType) error {
+	if config.General.UseRenewalInfo && config.General.RenewCheckIntervalSeconds <= 0 {
+		// renewal info requested by background renew scan only
+		return xerrors.New("UseRenewalInfo need background renew scan, set RenewCheckIntervalSeconds or disable UseRenewalInfo")
+	}
+	return nil
+}
+
 // Apply command line flags to config
 func applyFlags(ctx context.Context, config *configType) {
 	if *testAcmeServerP {
@@ -103,6 +178,7 @@ func applyFlags(ctx context.Context, config *configType) {
 
 func applyMoveConfigDetails(cfg *configType) {
 	cfg.Listen.MinTLSVersion = cfg.General.MinTLSVersion
+	cfg.Proxy.EnableAccessLog = cfg.Log.EnableAccessLog
 }
 
 func defaultConfig(ctx context.Context) []byte {
@@ -111,25 +187,31 @@ func defaultConfig(ctx context.Context) []byte {
 	return configBytes
 }
 
-func mergeConfigByTemplate(ctx context.Context, c *configType, filepathTemplate string) {
+func mergeConfigByTemplate(ctx context.Context, c *configType, filepathTemplate string) error {
 	logger := zc.LNop(ctx).With(zap.String("config_file", filepathTemplate))
 	if !hasMeta(filepathTemplate) {
-		mergeConfigByFilepath(ctx, c, filepathTemplate)
-		return
+		return mergeConfigByFilepath(ctx, c, filepathTemplate)
 	}
 
 	filenames, err := filepath.Glob(filepathTemplate)
-	log.DebugFatal(logger, err, "Expand config file template",
+	log.DebugError(logger, err, "Expand config file template",
 		zap.String("filepathTemplate", filepathTemplate), zap.Strings("files", filenames))
+	if err != nil {
+		return xerrors.Errorf("expand config file template '%v': %w", filepathTemplate, err)
+	}
 	for _, filename := range filenames {
-		mergeConfigByFilepath(ctx, c, filename)
+		if err = mergeConfigByFilepath(ctx, c, filename); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func mergeConfigByFilepath(ctx context.Context, c *configType, filename string) {
+func mergeConfigByFilepath(ctx context.Context, c *configType, filename string) error {
 	logger := zc.LNop(ctx).With(zap.String("config_file", filename))
 	if parsedConfigFiles > c.General.MaxConfigFilesRead {
-		logger.Fatal("Exceed max config files read count", zap.Int("MaxConfigFilesRead", c.General.MaxConfigFilesRead))
+		logger.Error("Exceed max config files read count", zap.Int("MaxConfigFilesRead", c.General.MaxConfigFilesRead))
+		return xerrors.Errorf("exceed max config files read count: %v", c.General.MaxConfigFilesRead)
 	}
 	parsedConfigFiles++
 
@@ -137,27 +219,21 @@ func mergeConfigByFilepath(ctx context.Context, c *configType, filename string)
 	if !filepath.IsAbs(filename) {
 		var filepathNew string
 		filepathNew, err = filepath.Abs(filename)
-		log.DebugFatal(logger, err, "Convert filepath to absolute",
+		log.DebugError(logger, err, "Convert filepath to absolute",
 			zap.String("old", filename), zap.String("new", filepathNew))
+		if err != nil {
+			return xerrors.Errorf("convert config filepath '%v' to absolute: %w", filename, err)
+		}
 		filename = filepathNew
 	}
 
 	content, err := ioutil.ReadFile(filename)
-	log.DebugFatal(logger, err, "Read filename")
-
-	dir, err := os.Getwd()
-	log.DebugFatal(logger, err, "Current workdir", zap.String("dir", dir))
-	fileDir := filepath.Dir(filename)
-	if dir != fileDir {
-		err = os.Chdir(fileDir)
-		log.DebugFatal(logger, err, "Chdir to config filename directory")
-		defer func() {
-			err = os.Chdir(dir)
-			log.DebugFatal(logger, err, "Restore workdir to", zap.String("dir", dir))
-		}()
+	log.DebugError(logger, err, "Read filename")
+	if err != nil {
+		return xerrors.Errorf("read config file: %w", err)
 	}
 
-	mergeConfigBytes(ctx, c, content, filename)
+	return mergeConfigBytes(ctx, c, content, filename)
 }
 
 // hasMeta reports whether path contains any of the magic characters
@@ -171,7 +247,7 @@ func hasMeta(path string) bool {
 	return strings.ContainsAny(path, magicChars)
 }
 
-func mergeConfigBytes(ctx context.Context, c *configType, content []byte, file string) {
+func mergeConfigBytes(ctx context.Context, c *configType, content []byte, file string) error {
 	// for prevent loop by existed included
 	c.General.IncludeConfigs = nil
 
@@ -179,12 +255,23 @@ func mergeConfigBytes(ctx context.Context, c *configType, content []byte, file s
 	if err == nil && len(meta.Undecoded()) > 0 {
 		err = fmt.Errorf("unknown fields: %v", meta.Undecoded())
 	}
-	log.InfoFatal(zc.L(ctx), err, "Parse config file", zap.String("config_file", file))
+	log.DebugError(zc.L(ctx), err, "Parse config file", zap.String("config_file", file))
+	if err != nil {
+		return xerrors.Errorf("parse config file '%v': %w", file, err)
+	}
 
 	if len(c.General.IncludeConfigs) > 0 {
 		includeConfigs := c.General.IncludeConfigs // need save because it will reset while merging
-		for _, file := range includeConfigs {
-			mergeConfigByTemplate(ctx, c, file)
+		for _, includeFile := range includeConfigs {
+			// relative includes resolve from dir of the config file without change process workdir
+			// because config can be re-read while the program work.
+			if !filepath.IsAbs(includeFile) && filepath.IsAbs(file) {
+				includeFile = filepath.Join(filepath.Dir(file), includeFile)
+			}
+			if err = mergeConfigByTemplate(ctx, c, includeFile); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
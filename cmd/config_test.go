@@ -64,3 +64,20 @@ func TestGetConfig(t *testing.T) {
 
 	e.NotNil(getConfig(ctx))
 }
+
+func TestValidateConfig(t *testing.T) {
+	_, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+
+	var config configType
+	td.CmpNoError(mergeConfigBytes(ctx, &config, defaultConfig(ctx), ""))
+	td.CmpNoError(validateConfig(&config))
+
+	config.General.RenewCheckIntervalSeconds = 0
+	td.CmpError(validateConfig(&config))
+
+	config.General.UseRenewalInfo = false
+	td.CmpNoError(validateConfig(&config))
+}
@@ -1,6 +1,10 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"fmt"
+	"os"
+)
 
 var (
 	configFileP      = flag.String("config", "config.tom[l]", "Path to config file. Internally expand glob syntax.")
@@ -10,3 +14,21 @@ var (
 	testAcmeServerP  = flag.Bool("test-acme-server", false, "Use test acme server, instead address from config")
 	manualAcmeServer = flag.String("acme-server", "", "Override acme server")
 )
+
+const commandsUsage = `
+Commands (use config and storage of the proxy, without start it):
+  revoke --domain <domain> [--key-type rsa|ecdsa] [--reason keyCompromise]
+  certs list
+  certs show <domain> [--key-type rsa|ecdsa]
+  certs import <cert-file> <key-file> [--lock]
+  certs export <domain> [--key-type rsa|ecdsa] [--cert-file <file>] [--key-file <file>]
+  certs delete <domain> [--key-type rsa|ecdsa]
+  account show
+`
+
+func usage() {
+	out := flag.CommandLine.Output()
+	_, _ = fmt.Fprintf(out, "Usage of %v: [flags] [command]\n", os.Args[0])
+	flag.PrintDefaults()
+	_, _ = fmt.Fprint(out, commandsUsage)
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"errors"
+	"io"
 	"math"
 	"strings"
 
+	"golang.org/x/xerrors"
 	"gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/proxy"
 
 	"go.uber.org/zap/zapcore"
 
@@ -23,21 +26,25 @@ func (w logWriteSyncer) Sync() error {
 }
 
 func initLogger(config logConfig) *zap.Logger {
-	var writers []zapcore.WriteSyncer
-	if config.EnableLogToFile {
-		lr := &lumberjack.Logger{
-			Filename: config.File,
-			Compress: config.CompressRotated,
-			MaxSize:  config.RotateBySizeMB, MaxAge: config.MaxDays,
-			MaxBackups: config.MaxCount,
-		}
+	logLevel, errLogLevel := parseLogLevel(config.LogLevel)
+	encoder, errFormat := newLogEncoder(config.Format)
 
-		if !config.EnableRotate {
-			lr.MaxSize = int(math.MaxInt32) // about 2 Petabytes. Really no reachable in this scenario.
+	var outputErrors []error
+	outputLevel := func(output, levelS string) zapcore.Level {
+		if levelS == "" {
+			return logLevel
+		}
+		level, err := parseLogLevel(levelS)
+		if err != nil {
+			outputErrors = append(outputErrors, xerrors.Errorf("level of %v output %q: %w", output, levelS, err))
 		}
+		return level
+	}
 
-		writeSyncer := logWriteSyncer{lr}
-		writers = append(writers, writeSyncer)
+	var cores []zapcore.Core
+	if config.EnableLogToFile {
+		writeSyncer := newRotateWriter(config, config.File, config.RotateBySizeMB, config.MaxDays, config.MaxCount)
+		cores = append(cores, zapcore.NewCore(encoder, writeSyncer, outputLevel("file", config.FileLogLevel)))
 	}
 
 	if config.EnableLogToStdErr {
@@ -46,10 +53,49 @@ func initLogger(config logConfig) *zap.Logger {
 			panic("Can't open stderr to log")
 		}
 
-		writers = append(writers, writer)
+		cores = append(cores, zapcore.NewCore(encoder, writer, outputLevel("stderr", config.StdErrLogLevel)))
+	}
+
+	if config.EnableSyslog {
+		core, err := log.NewSyslogCore(encoder.Clone(), outputLevel("syslog", config.SyslogLogLevel), log.SyslogConfig{
+			Network:  config.SyslogNetwork,
+			Address:  config.SyslogAddress,
+			Facility: config.SyslogFacility,
+			Tag:      config.SyslogTag,
+		})
+		if err == nil {
+			cores = append(cores, core)
+		} else {
+			outputErrors = append(outputErrors, err)
+		}
+	}
+
+	if config.EnableJournald {
+		core, err := log.NewJournaldCore(encoder.Clone(), outputLevel("journald", config.JournaldLogLevel),
+			config.JournaldSocket, config.JournaldIdentifier)
+		if err == nil {
+			cores = append(cores, core)
+		} else {
+			outputErrors = append(outputErrors, err)
+		}
+	}
+
+	logger := zap.New(zapcore.NewTee(cores...), getLogOptions(config)...)
+
+	log.InfoError(logger, errLogLevel, "Initialize log on level", zap.Stringer("level", logLevel))
+	if errFormat != nil {
+		logger.Error("Initialize log format", zap.String("format", config.Format), zap.Error(errFormat))
+	}
+	for _, err := range outputErrors {
+		logger.Error("Initialize log output", zap.Error(err))
 	}
 
-	encoder := zapcore.NewConsoleEncoder(zapcore.EncoderConfig{
+	return logger
+}
+
+// newLogEncoder return encoder for log format: console or json. For unknown format it return console encoder and error.
+func newLogEncoder(format string) (zapcore.Encoder, error) {
+	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:        "ts",
 		LevelKey:       "level",
 		NameKey:        "logger",
@@ -61,16 +107,41 @@ func initLogger(config logConfig) *zap.Logger {
 		EncodeTime:     zapcore.ISO8601TimeEncoder,
 		EncodeDuration: zapcore.SecondsDurationEncoder,
 		EncodeCaller:   zapcore.ShortCallerEncoder,
-	})
+	}
 
-	logLevel, errLogLevel := parseLogLevel(config.LogLevel)
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "console":
+		return zapcore.NewConsoleEncoder(encoderConfig), nil
+	case "json":
+		return zapcore.NewJSONEncoder(encoderConfig), nil
+	default:
+		return zapcore.NewConsoleEncoder(encoderConfig), errors.New("undefined log format")
+	}
+}
 
-	core := zapcore.NewCore(encoder, zap.CombineWriteSyncers(writers...), logLevel)
-	logger := zap.New(core, getLogOptions(config)...)
+// newRotateWriter create writer to file, which rotated by rotate settings of config
+func newRotateWriter(config logConfig, file string, rotateBySizeMB, maxDays, maxCount int) logWriteSyncer {
+	lr := &lumberjack.Logger{
+		Filename: file,
+		Compress: config.CompressRotated,
+		MaxSize:  rotateBySizeMB, MaxAge: maxDays,
+		MaxBackups: maxCount,
+	}
 
-	log.InfoError(logger, errLogLevel, "Initialize log on level", zap.Stringer("level", logLevel))
+	if !config.EnableRotate {
+		lr.MaxSize = int(math.MaxInt32) // about 2 Petabytes. Really no reachable in this scenario.
+	}
+	return logWriteSyncer{lr}
+}
 
-	return logger
+// initAccessLog create sink of access log. Without access log file records write to main log.
+func initAccessLog(config logConfig) (*proxy.AccessLog, error) {
+	var writer io.Writer
+	if config.AccessLogFile != "" {
+		writer = newRotateWriter(config, config.AccessLogFile, config.AccessLogRotateBySizeMB,
+			config.AccessLogMaxDays, config.AccessLogMaxCount)
+	}
+	return proxy.NewAccessLog(writer, config.AccessLogFormat, config.AccessLogSampleRate, config.AccessLogFields)
 }
 
 func parseLogLevel(logLevelS string) (zapcore.Level, error) {
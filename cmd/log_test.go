@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/rekby/lets-proxy2/internal/proxy"
 	"github.com/rekby/lets-proxy2/internal/th"
 
 	"github.com/maxatome/go-testdeep"
@@ -76,3 +81,104 @@ func TestInitLogger(t *testing.T) {
 		logger.DPanic(testError)
 	}, testError)
 }
+
+func TestInitLogger_FormatAndOutputLevels(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	tmpDir := th.TmpDir(e)
+
+	logFile := filepath.Join(tmpDir, "log.txt")
+	socket := filepath.Join(tmpDir, "log.sock")
+	syslog, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	e.CmpNoError(err)
+	defer func() { _ = syslog.Close() }()
+
+	logger := initLogger(logConfig{
+		LogLevel:        "info",
+		Format:          "json",
+		EnableLogToFile: true,
+		File:            logFile,
+		FileLogLevel:    "error",
+		EnableSyslog:    true,
+		SyslogNetwork:   "unix",
+		SyslogAddress:   socket,
+		SyslogFacility:  "daemon",
+		SyslogTag:       "lets-proxy",
+		SyslogLogLevel:  "debug",
+	})
+	logger.Debug("debugTest")
+	logger.Error("errorTest")
+	_ = logger.Sync()
+
+	fileBytes, err := ioutil.ReadFile(logFile)
+	e.CmpNoError(err)
+	lines := strings.Split(strings.TrimSpace(string(fileBytes)), "\n")
+	e.Len(lines, 1)
+	var record map[string]interface{}
+	e.CmpNoError(json.Unmarshal([]byte(lines[0]), &record))
+	e.Cmp(record, testdeep.SuperMapOf(map[string]interface{}{"level": "error", "msg": "errorTest"}, nil))
+
+	buf := make([]byte, 1000)
+	_ = syslog.SetReadDeadline(time.Now().Add(time.Second))
+	var syslogMessages []string
+	for i := 0; i < 3; i++ {
+		n, err := syslog.Read(buf)
+		e.CmpNoError(err)
+		syslogMessages = append(syslogMessages, string(buf[:n]))
+	}
+	e.True(strings.Contains(syslogMessages[0], `"msg":"Initialize log on level"`), syslogMessages[0])
+	e.True(strings.HasPrefix(syslogMessages[1], "<31>1 "), syslogMessages[1])
+	e.True(strings.HasSuffix(syslogMessages[1], `"msg":"debugTest"}`), syslogMessages[1])
+	e.True(strings.HasPrefix(syslogMessages[2], "<27>1 "), syslogMessages[2])
+}
+
+func TestNewLogEncoder(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	_, err := newLogEncoder("")
+	td.CmpNoError(err)
+	_, err = newLogEncoder("json")
+	td.CmpNoError(err)
+	_, err = newLogEncoder("xml")
+	td.CmpError(err)
+}
+
+func TestInitAccessLog(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	accessLog, err := initAccessLog(logConfig{})
+	e.CmpNoError(err)
+	e.NotNil(accessLog)
+
+	_, err = initAccessLog(logConfig{AccessLogFormat: "unknown"})
+	e.CmpError(err)
+
+	logFile := filepath.Join(th.TmpDir(e), "access.log")
+	accessLog, err = initAccessLog(logConfig{AccessLogFile: logFile, AccessLogFormat: "common"})
+	e.CmpNoError(err)
+
+	transport := proxy.TransportLogger{
+		Transport: roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok"))}, nil
+		}),
+		AccessLog: accessLog,
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/path", nil)
+	req.RemoteAddr = "1.2.3.4:1000"
+	resp, err := transport.RoundTrip(req)
+	e.CmpNoError(err)
+	_ = resp.Body.Close()
+
+	fileBytes, err := ioutil.ReadFile(logFile)
+	e.CmpNoError(err)
+	e.True(strings.HasPrefix(string(fileBytes), "1.2.3.4 - - ["), string(fileBytes))
+	e.True(strings.HasSuffix(string(fileBytes), "] \"GET /path HTTP/1.1\" 200 -\n"), string(fileBytes))
+}
+
+type roundTripperFunc func(request *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
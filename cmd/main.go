@@ -24,12 +24,16 @@ import (
 
 	"go.uber.org/zap/zapcore"
 
+	"github.com/rekby/lets-proxy2/internal/admin"
+	"github.com/rekby/lets-proxy2/internal/ari"
+	"github.com/rekby/lets-proxy2/internal/cache"
 	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/domain_checker"
+	"github.com/rekby/lets-proxy2/internal/lease"
 	"github.com/rekby/lets-proxy2/internal/profiler"
 
 	_ "github.com/kardianos/minwinsvc"
 	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
-	"github.com/rekby/lets-proxy2/internal/cache"
 	"github.com/rekby/lets-proxy2/internal/log"
 	"github.com/rekby/lets-proxy2/internal/proxy"
 	"github.com/rekby/lets-proxy2/internal/tlslistener"
@@ -39,9 +43,8 @@ import (
 
 var VERSION = "custom" // need be var because it redefine by --ldflags "-X main.VERSION" during autobuild
 
-const defaultDirMode = 0700
-
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
 	z, _ := zap.NewProduction()
@@ -59,6 +62,15 @@ func main() {
 		return
 	}
 
+	if flag.NArg() > 0 {
+		err := runCommand(globalContext, flag.Args())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	startProgram(getConfig(globalContext))
 }
 
@@ -115,38 +127,110 @@ func startProgram(config *configType) {
 	}
 
 	startProfiler(ctx, config.Profiler)
-	err := os.MkdirAll(config.General.StorageDir, defaultDirMode)
-	log.InfoFatal(logger, err, "Create storage dir", zap.String("dir", config.General.StorageDir))
+	storage, err := config.Storage.CreateStorage(ctx, config.General.StorageDir)
+	log.InfoFatal(logger, err, "Create storage", zap.String("type", config.Storage.Type))
 
-	storage := &cache.DiskCache{Dir: config.General.StorageDir}
-	clientManager := acme_client_manager.New(ctx, storage)
-
-	clientManager.DirectoryURL = config.General.AcmeServer
-	logger.Info("Acme directory", zap.String("url", config.General.AcmeServer))
+	acmeManagers := createAcmeManagers(ctx, config, storage)
+	clientManager := acmeManagers[0]
 
 	_, _, err = clientManager.GetClient(ctx)
 	log.InfoFatal(logger, err, "Get acme client")
 
 	certManager := cert_manager.New(clientManager, storage, registry)
+	for _, fallbackClientManager := range acmeManagers[1:] {
+		certManager.FallbackAcmeClientManagers = append(certManager.FallbackAcmeClientManagers, fallbackClientManager)
+	}
 	certManager.CertificateIssueTimeout = time.Duration(config.General.IssueTimeout) * time.Second
 	certManager.SaveJSONMeta = config.General.StoreJSONMetadata
 
+	if config.General.IssueLock {
+		atomicStorage, ok := storage.(cache.Atomic)
+		if !ok {
+			logger.Fatal("Storage doesn't support issue lock", zap.String("type", config.Storage.Type))
+		}
+		certManager.IssueLocker = lease.NewLocker(atomicStorage)
+		certManager.IssueLocker.TTL = time.Duration(config.General.IssueLockTTLSeconds) * time.Second
+		if config.General.IssueLockPollSeconds > 0 {
+			certManager.IssueLeasePollInterval = time.Duration(config.General.IssueLockPollSeconds) * time.Second
+		}
+		logger.Info("Enable issue lock", zap.String("owner", certManager.IssueLocker.Owner))
+	}
+
+	if config.General.RenewBeforeExpirePercent > 0 {
+		certManager.RenewBeforeExpireRatio = config.General.RenewBeforeExpirePercent / 100
+	}
+	certManager.RenewCheckInterval = time.Duration(config.General.RenewCheckIntervalSeconds) * time.Second
+	certManager.RenewConcurrency = config.General.RenewConcurrency
+	certManager.RenewJitter = time.Duration(config.General.RenewJitterSeconds) * time.Second
+	if config.General.UseRenewalInfo {
+		certManager.RenewalInfo = &ari.Client{DirectoryURL: config.General.AcmeServer}
+		if len(config.General.FallbackAcmeServers) > 0 {
+			// certificates of fallback acme servers need renewal info from the servers
+			certManager.RenewalInfoByServer = map[string]cert_manager.RenewalInfoGetter{
+				config.General.AcmeServer: certManager.RenewalInfo,
+			}
+			for _, fallbackConfig := range config.General.FallbackAcmeServers {
+				certManager.RenewalInfoByServer[fallbackConfig.DirectoryURL] = &ari.Client{DirectoryURL: fallbackConfig.DirectoryURL}
+			}
+		}
+	}
+
+	certManager.EnableOCSPStapling = config.General.OCSPStapling
+
+	if config.General.StaticCertificatesDir != "" {
+		certManager.StaticCertificates = cert_manager.NewStaticCertificates(config.General.StaticCertificatesDir)
+		err = certManager.StaticCertificates.Load(ctx)
+		log.InfoFatal(logger, err, "Load static certificates", zap.String("dir", config.General.StaticCertificatesDir))
+		if config.General.StaticCertificatesReloadSeconds > 0 {
+			certManager.StaticCertificates.StartAutoReload(ctx,
+				time.Duration(config.General.StaticCertificatesReloadSeconds)*time.Second)
+		}
+	}
+
 	certManager.AllowECDSACert = config.General.AllowECDSACert
 	certManager.AllowRSACert = config.General.AllowRSACert
 	certManager.AllowInsecureTLSChipers = config.General.AllowInsecureTLSChipers
 
-	for _, subdomain := range config.General.Subdomains {
-		subdomain = strings.TrimSpace(subdomain)
-		subdomain = strings.TrimSuffix(subdomain, ".") + "." // must ends with dot
-		certManager.AutoSubdomains = append(certManager.AutoSubdomains, subdomain)
+	certManager.DNSProvider, err = config.DNS01.CreateProvider(ctx)
+	log.InfoFatal(logger, err, "Create dns provider")
+	if certManager.DNSProvider != nil {
+		certManager.DNSPropagationResolvers, err = createDNSPropagationResolvers(ctx, config.CheckDomains)
+		log.InfoFatal(logger, err, "Create dns resolvers for check dns-01 records")
+		if config.DNS01.PropagationTimeoutSeconds > 0 {
+			certManager.DNSPropagationTimeout = time.Duration(config.DNS01.PropagationTimeoutSeconds) * time.Second
+		}
+		if config.DNS01.PropagationIntervalSeconds > 0 {
+			certManager.DNSPropagationInterval = time.Duration(config.DNS01.PropagationIntervalSeconds) * time.Second
+		}
+	}
+
+	err = certManager.SetChallengeTypes(config.General.ChallengeTypes)
+	log.InfoFatal(logger, err, "Set challenge types", zap.Strings("challenge_types", config.General.ChallengeTypes))
+
+	err = certManager.SetWildcardZones(config.General.WildcardZones)
+	log.InfoFatal(logger, err, "Set wildcard zones", zap.Strings("zones", config.General.WildcardZones))
+	if len(config.General.WildcardZones) > 0 && !certManager.EnableDNSValidation {
+		logger.Fatal("Wildcard certificates need dns-01 challenge type")
 	}
 
-	certManager.DomainChecker, err = config.CheckDomains.CreateDomainChecker(ctx)
+	certManager.AutoSubdomains = autoSubdomains(config.General.Subdomains)
+
+	checkerCtx, checkerCancel := context.WithCancel(ctx)
+	domainChecker, err := config.CheckDomains.CreateDomainChecker(checkerCtx)
 	log.DebugFatal(logger, err, "Config domain checkers.")
+	reloadableDomainChecker := domain_checker.NewReloadable(domainChecker)
+	certManager.DomainChecker = reloadableDomainChecker
+
+	if certManager.RenewCheckInterval > 0 {
+		err = certManager.StartRenewScheduler(ctx)
+		log.InfoFatal(logger, err, "Start background renew of certificates")
+	}
 
 	err = startMetrics(ctx, registry, config.Metrics, certManager.GetCertificate)
 	log.InfoFatalCtx(ctx, err, "start metrics")
 
+	startAdmin(ctx, config.Admin, certManager)
+
 	tlsListener := &tlslistener.ListenersHandler{
 		GetCertificate: certManager.GetCertificate,
 	}
@@ -154,26 +238,43 @@ func startProgram(config *configType) {
 	err = config.Listen.Apply(ctx, tlsListener)
 	log.DebugFatal(logger, err, "Config listeners")
 
+	tlslistener.CloseUnusedInheritedListeners(ctx)
+
 	err = tlsListener.Start(ctx, registry)
 	log.DebugFatal(logger, err, "StartAutoRenew tls listener")
 
-	config.Proxy.EnableAccessLog = config.Log.EnableAccessLog
 	p := proxy.NewHTTPProxy(ctx, tlsListener)
 	p.GetContext = func(req *http.Request) (i context.Context, e error) {
 		localAddr := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
 		return tlsListener.GetConnectionContext(req.RemoteAddr, localAddr.String())
 	}
+	if certManager.EnableHTTPValidation {
+		logger.Info("Enable http-01 validation handler")
+		p.HandleHTTPValidation = certManager.HandleHTTPValidation
+	}
 
 	err = config.Proxy.Apply(ctx, p)
 	log.InfoFatal(logger, err, "Apply proxy config")
-
-	go func() {
-		defer log.HandlePanic(logger)
-
-		<-ctx.Done()
-		err := p.Close()
-		log.DebugError(logger, err, "Stop proxy")
-	}()
+	p.AccessLog, err = initAccessLog(config.Log)
+	log.InfoFatal(logger, err, "Init access log", zap.String("file", config.Log.AccessLogFile))
+	p.InitMetrics(registry)
+
+	reloader := &configReloader{
+		startConfig:         config,
+		proxy:               p,
+		domainChecker:       reloadableDomainChecker,
+		domainCheckerCancel: checkerCancel,
+	}
+	reloader.Start(ctx)
+
+	shutdown := &gracefulShutdown{
+		Timeout:      time.Duration(config.General.GracefulShutdownTimeoutSeconds) * time.Second,
+		Proxy:        p,
+		CertManager:  certManager,
+		AcmeManagers: acmeManagers,
+		Storage:      storage,
+	}
+	shutdown.Start(ctx)
 
 	err = p.Start()
 	var effectiveError = err
@@ -181,6 +282,43 @@ func startProgram(config *configType) {
 		effectiveError = nil
 	}
 	log.DebugErrorCtx(ctx, effectiveError, "Handle request stopped")
+	if effectiveError == nil {
+		shutdown.Wait()
+	}
+}
+
+// createAcmeManagers create client managers of main acme server and fallback acme servers, main is first
+func createAcmeManagers(ctx context.Context, config *configType, storage cache.Bytes) []*acme_client_manager.AcmeManager {
+	logger := zc.L(ctx)
+
+	clientManager := acme_client_manager.New(ctx, storage)
+	err := acme_client_manager.Config{
+		DirectoryURL: config.General.AcmeServer,
+		Email:        config.General.AcmeEmail,
+		EABKeyID:     config.General.AcmeEABKeyID,
+		EABHMACKey:   config.General.AcmeEABHMACKey,
+	}.Apply(ctx, clientManager)
+	log.InfoFatal(logger, err, "Config acme server")
+
+	res := []*acme_client_manager.AcmeManager{clientManager}
+	for _, fallbackConfig := range config.General.FallbackAcmeServers {
+		fallbackClientManager := acme_client_manager.New(ctx, storage)
+		err = fallbackConfig.Apply(ctx, fallbackClientManager)
+		log.InfoFatal(logger, err, "Config fallback acme server")
+		res = append(res, fallbackClientManager)
+	}
+	return res
+}
+
+// autoSubdomains normalize subdomains from config, every subdomain ends with dot
+func autoSubdomains(subdomains []string) []string {
+	var res []string
+	for _, subdomain := range subdomains {
+		subdomain = strings.TrimSpace(subdomain)
+		subdomain = strings.TrimSuffix(subdomain, ".") + "." // must ends with dot
+		res = append(res, subdomain)
+	}
+	return res
 }
 
 func startProfiler(ctx context.Context, config profiler.Config) {
@@ -191,22 +329,83 @@ func startProfiler(ctx context.Context, config profiler.Config) {
 		return
 	}
 
+	// listen before CloseUnusedInheritedListeners, for inherit socket from parent process
+	listener, err := tlslistener.Listen(ctx, config.BindAddress)
+	log.DebugError(logger, err, "Start listen profiler", zap.String("bind_address", config.BindAddress))
+	if err != nil {
+		return
+	}
+
+	httpServer := http.Server{
+		Handler: profiler.New(logger.Named("profiler"), config),
+	}
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+
 	go func() {
 		defer log.HandlePanic(logger)
 
-		httpServer := http.Server{
-			Addr:    config.BindAddress,
-			Handler: profiler.New(logger.Named("profiler"), config),
+		logger.Info("Start profiler", zap.String("bind_address", config.BindAddress))
+		err := httpServer.Serve(listener)
+		var logLevel zapcore.Level
+		if err == http.ErrServerClosed {
+			logLevel = zapcore.InfoLevel
+		} else {
+			logLevel = zapcore.ErrorLevel
 		}
+		log.LevelParam(logger, logLevel, "Profiler stopped")
+	}()
+}
+
+func startAdmin(ctx context.Context, config admin.Config, certManager admin.CertManager) {
+	logger := zc.L(ctx)
+
+	if !config.Enable {
+		logger.Info("Admin api disabled")
+		return
+	}
+
+	// listen before CloseUnusedInheritedListeners, for inherit socket from parent process
+	listener, err := tlslistener.Listen(ctx, config.BindAddress)
+	log.DebugError(logger, err, "Start listen admin api", zap.String("bind_address", config.BindAddress))
+	if err != nil {
+		return
+	}
+
+	httpServer := http.Server{
+		Handler: admin.New(logger.Named("admin"), config, certManager),
+	}
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+
+	go func() {
+		defer log.HandlePanic(logger)
 
-		logger.Info("Start profiler", zap.String("bind_address", httpServer.Addr))
-		err := httpServer.ListenAndServe()
+		logger.Info("Start admin api", zap.String("bind_address", config.BindAddress))
+		err := httpServer.Serve(listener)
 		var logLevel zapcore.Level
 		if err == http.ErrServerClosed {
 			logLevel = zapcore.InfoLevel
 		} else {
 			logLevel = zapcore.ErrorLevel
 		}
-		log.LevelParam(logger, logLevel, "Profiler stopped")
+		log.LevelParam(logger, logLevel, "Admin api stopped", zap.Error(err))
 	}()
 }
+
+func createDNSPropagationResolvers(ctx context.Context, checkDomains domain_checker.Config) ([]cert_manager.DNSTXTResolver, error) {
+	resolvers, err := checkDomains.CreateTXTResolvers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]cert_manager.DNSTXTResolver, 0, len(resolvers))
+	for _, resolver := range resolvers {
+		res = append(res, resolver)
+	}
+	return res, nil
+}
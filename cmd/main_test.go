@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/admin"
+	"github.com/rekby/lets-proxy2/internal/profiler"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+)
+
+func TestStartProfilerAndAdminListeners(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	startProfiler(ctx, profiler.Config{Enable: true, BindAddress: "127.0.0.1:0"})
+	startAdmin(ctx, admin.Config{Enable: true, BindAddress: "localhost:0"}, nil)
+
+	// listeners must be passed to new process on upgrade
+	files, env, err := tlslistener.ListenerFiles()
+	e.CmpNoError(err)
+	for _, f := range files {
+		_ = f.Close()
+	}
+	e.Len(files, 2)
+	e.Cmp(env, "127.0.0.1:0,localhost:0")
+}
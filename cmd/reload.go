@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/rekby/lets-proxy2/internal/domain_checker"
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+)
+
+// reloadableConfigFields can be applied without restart. Section name without field - all fields of the section.
+// Other fields listed in restartRequiredConfigFields of tests, test fails if field is not in one of the sets.
+var reloadableConfigFields = map[string]bool{
+	"Proxy.DefaultTarget":                true,
+	"Proxy.TargetMap":                    true,
+	"Proxy.Routes":                       true,
+	"Proxy.Upstreams":                    true,
+	"Proxy.Headers":                      true,
+	"Proxy.HeadersByIP":                  true,
+	"Proxy.TrustedProxies":               true,
+	"Proxy.XForwardedFor":                true,
+	"Proxy.Forwarded":                    true,
+	"Proxy.HTTPSBackend":                 true,
+	"Proxy.HTTPSBackendIgnoreCert":       true,
+	"Proxy.RateLimit":                    true,
+	"Proxy.RateLimitTimeWindowMs":        true,
+	"Proxy.RateLimitBurst":               true,
+	"Proxy.RateLimitCacheSize":           true,
+	"Proxy.RateLimitIPv4Prefix":          true,
+	"Proxy.RateLimitIPv6Prefix":          true,
+	"Proxy.RateLimitExempt":              true,
+	"Proxy.RateLimitRules":               true,
+	"Proxy.RetryCount":                   true,
+	"Proxy.RetryTryTimeoutMs":            true,
+	"Proxy.RetryBudgetPercent":           true,
+	"Proxy.RetryBudgetMinPerSecond":      true,
+	"Proxy.BackendProxyProtocol":         true,
+	"Proxy.MaxBodyBytes":                 true,
+	"Proxy.ResponseHeaderTimeoutSeconds": true,
+	"CheckDomains":                       true,
+	"General.IncludeConfigs":             true,
+}
+
+// configReloader re-read config on SIGHUP and replace proxy directors, rate limiter and domain checker
+// without stop listeners and drop connections.
+type configReloader struct {
+	startConfig         *configType
+	proxy               *proxy.HTTPProxy
+	domainChecker       *domain_checker.Reloadable
+	domainCheckerCancel context.CancelFunc
+}
+
+func (r *configReloader) Start(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		logger := zc.L(ctx)
+		defer log.HandlePanic(logger)
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				logger.Info("Got SIGHUP, reload config")
+				err := r.Reload(ctx)
+				log.InfoError(logger, err, "Reload config")
+			}
+		}
+	}()
+}
+
+// Reload read config, validate it and replace reloadable parts.
+// If new config has errors - all work with old settings.
+func (r *configReloader) Reload(ctx context.Context) error {
+	logger := zc.L(ctx)
+
+	config, err := readConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	checkerCtx, checkerCancel := context.WithCancel(ctx)
+	checker, err := config.CheckDomains.CreateDomainChecker(checkerCtx)
+	if err != nil {
+		checkerCancel()
+		return err
+	}
+
+	if err = config.Proxy.Reload(ctx, r.proxy); err != nil {
+		checkerCancel()
+		return err
+	}
+
+	r.domainChecker.Set(checker)
+	r.domainCheckerCancel()
+	r.domainCheckerCancel = checkerCancel
+
+	for _, name := range configChangesNeedRestart(r.startConfig, config) {
+		logger.Warn("Changed config setting need restart for apply", zap.String("setting", name))
+	}
+	return nil
+}
+
+// configChangesNeedRestart return names of changed settings, which can't apply without restart.
+func configChangesNeedRestart(oldConfig, newConfig *configType) []string {
+	var res []string
+
+	oldValue := reflect.ValueOf(oldConfig).Elem()
+	newValue := reflect.ValueOf(newConfig).Elem()
+	configType := oldValue.Type()
+	for sectionIndex := 0; sectionIndex < configType.NumField(); sectionIndex++ {
+		sectionName := configType.Field(sectionIndex).Name
+		if reloadableConfigFields[sectionName] {
+			continue
+		}
+
+		oldSection := oldValue.Field(sectionIndex)
+		newSection := newValue.Field(sectionIndex)
+		sectionType := oldSection.Type()
+		for fieldIndex := 0; fieldIndex < sectionType.NumField(); fieldIndex++ {
+			field := sectionType.Field(fieldIndex)
+			name := sectionName + "." + field.Name
+			if field.PkgPath != "" || reloadableConfigFields[name] {
+				continue
+			}
+			if !reflect.DeepEqual(oldSection.Field(fieldIndex).Interface(), newSection.Field(fieldIndex).Interface()) {
+				res = append(res, name)
+			}
+		}
+	}
+	return res
+}
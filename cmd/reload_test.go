@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestConfigChangesNeedRestart(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	oldConfig := &configType{}
+	e.CmpNoError(mergeConfigBytes(ctx, oldConfig, defaultConfig(ctx), "default"))
+
+	newConfig := &configType{}
+	e.CmpNoError(mergeConfigBytes(ctx, newConfig, defaultConfig(ctx), "default"))
+	e.Len(configChangesNeedRestart(oldConfig, newConfig), 0)
+
+	newConfig.Proxy.DefaultTarget = ":8080"
+	newConfig.Proxy.RateLimit = 100
+	newConfig.CheckDomains.BlackList = "asd"
+	e.Len(configChangesNeedRestart(oldConfig, newConfig), 0)
+
+	newConfig.Listen.TLSAddresses = []string{":8443"}
+	newConfig.General.StorageDir = "other"
+	newConfig.Proxy.KeepAliveTimeoutSeconds = 1
+	e.Cmp(configChangesNeedRestart(oldConfig, newConfig),
+		[]string{"General.StorageDir", "Proxy.KeepAliveTimeoutSeconds", "Listen.TLSAddresses"})
+}
+
+func TestReadConfigError(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	config := &configType{}
+	e.CmpError(mergeConfigBytes(ctx, config, []byte("[General]\nUnknownField = 1\n"), "test"))
+	e.CmpError(mergeConfigByFilepath(ctx, config, "not-existed-file.toml"))
+}
+
+// restartRequiredConfigFields can't be applied by reload. Section name without field - all fields of the section.
+// New config fields must be added to the set or to reloadableConfigFields.
+var restartRequiredConfigFields = map[string]bool{
+	"General.IssueTimeout":                    true,
+	"General.IssueLock":                       true,
+	"General.IssueLockTTLSeconds":             true,
+	"General.IssueLockPollSeconds":            true,
+	"General.RenewBeforeExpirePercent":        true,
+	"General.RenewCheckIntervalSeconds":       true,
+	"General.RenewConcurrency":                true,
+	"General.RenewJitterSeconds":              true,
+	"General.UseRenewalInfo":                  true,
+	"General.OCSPStapling":                    true,
+	"General.StorageDir":                      true,
+	"General.StaticCertificatesDir":           true,
+	"General.StaticCertificatesReloadSeconds": true,
+	"General.Subdomains":                      true,
+	"General.AcmeServer":                      true,
+	"General.AcmeEmail":                       true,
+	"General.AcmeEABKeyID":                    true,
+	"General.AcmeEABHMACKey":                  true,
+	"General.FallbackAcmeServers":             true,
+	"General.StoreJSONMetadata":               true,
+	"General.MaxConfigFilesRead":              true,
+	"General.AllowRSACert":                    true,
+	"General.AllowECDSACert":                  true,
+	"General.AllowInsecureTLSChipers":         true,
+	"General.MinTLSVersion":                   true,
+	"General.ChallengeTypes":                  true,
+	"General.WildcardZones":                   true,
+	"General.GracefulShutdownTimeoutSeconds":  true,
+	"Log":                                     true,
+	"Storage":                                 true,
+	"Proxy.KeepAliveTimeoutSeconds":           true,
+	"Proxy.ReadHeaderTimeoutSeconds":          true,
+	"Proxy.ReadTimeoutSeconds":                true,
+	"Proxy.WriteTimeoutSeconds":               true,
+	"Proxy.MaxHeaderBytes":                    true,
+	"Proxy.EnableAccessLog":                   true,
+	"DNS01":                                   true,
+	"Listen":                                  true,
+	"Profiler":                                true,
+	"Metrics":                                 true,
+	"Admin":                                   true,
+}
+
+func TestReloadableConfigFields(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	known := map[string]bool{}
+	configType := reflect.TypeOf(configType{})
+	for sectionIndex := 0; sectionIndex < configType.NumField(); sectionIndex++ {
+		section := configType.Field(sectionIndex)
+		known[section.Name] = true
+		sectionReload := reloadableConfigFields[section.Name]
+		sectionRestart := restartRequiredConfigFields[section.Name]
+		e.False(sectionReload && sectionRestart, section.Name)
+
+		for fieldIndex := 0; fieldIndex < section.Type.NumField(); fieldIndex++ {
+			field := section.Type.Field(fieldIndex)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := section.Name + "." + field.Name
+			known[name] = true
+			reload := sectionReload || reloadableConfigFields[name]
+			restart := sectionRestart || restartRequiredConfigFields[name]
+			e.True(reload != restart, "config field must be in exactly one of reloadable or restart required sets: "+name)
+		}
+	}
+
+	for name := range reloadableConfigFields {
+		e.True(known[name], "unknown reloadable config field: "+name)
+	}
+	for name := range restartRequiredConfigFields {
+		e.True(known[name], "unknown restart required config field: "+name)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// new process must work the time after upgrade, before old process start shutdown
+const upgradeCheckDuration = 5 * time.Second
+
+// gracefulShutdown stop accept connections and wait in-flight requests and certificate issues on SIGTERM/SIGINT.
+// On upgrade signal it pass listeners to new process of the binary before shutdown.
+type gracefulShutdown struct {
+	Timeout      time.Duration
+	Proxy        *proxy.HTTPProxy
+	CertManager  *cert_manager.Manager
+	AcmeManagers []*acme_client_manager.AcmeManager
+	Storage      cache.Bytes
+
+	done chan struct{}
+}
+
+func (s *gracefulShutdown) Start(ctx context.Context) {
+	s.done = make(chan struct{})
+
+	shutdownSignals := make(chan os.Signal, 1)
+	signal.Notify(shutdownSignals, os.Interrupt, syscall.SIGTERM)
+
+	upgradeSignals := make(chan os.Signal, 1)
+	if len(upgradeSignalList) > 0 {
+		signal.Notify(upgradeSignals, upgradeSignalList...)
+	}
+
+	go func() {
+		logger := zc.L(ctx)
+		defer log.HandlePanic(logger)
+		defer signal.Stop(shutdownSignals)
+		defer signal.Stop(upgradeSignals)
+
+		for {
+			select {
+			case sig := <-shutdownSignals:
+				logger.Info("Got shutdown signal", zap.Stringer("signal", sig))
+				s.Shutdown(ctx)
+				return
+			case sig := <-upgradeSignals:
+				logger.Info("Got upgrade signal", zap.Stringer("signal", sig))
+				err := s.startNewProcess(ctx)
+				log.InfoError(logger, err, "Start new process for upgrade")
+				if err == nil {
+					s.Shutdown(ctx)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Wait return after shutdown finished
+func (s *gracefulShutdown) Wait() {
+	<-s.done
+}
+
+// Shutdown stop accept new connections, wait finish of in-flight requests and running certificate issues
+// not more then Timeout.
+func (s *gracefulShutdown) Shutdown(ctx context.Context) {
+	defer close(s.done)
+
+	logger := zc.L(ctx)
+	logger.Info("Start graceful shutdown", zap.Duration("timeout", s.Timeout))
+
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	err := s.Proxy.Shutdown(ctx)
+	log.InfoError(logger, err, "Finish in-flight requests")
+	if err != nil {
+		err = s.Proxy.Close()
+		log.DebugError(logger, err, "Force close connections")
+	}
+
+	err = s.CertManager.WaitIssues(ctx)
+	log.InfoError(logger, err, "Finish running certificate issues")
+
+	acmeManagerClosed := make(chan error, len(s.AcmeManagers))
+	for _, acmeManager := range s.AcmeManagers {
+		go func(acmeManager *acme_client_manager.AcmeManager) {
+			defer log.HandlePanic(logger)
+			acmeManagerClosed <- acmeManager.Close()
+		}(acmeManager)
+	}
+	for range s.AcmeManagers {
+		select {
+		case err = <-acmeManagerClosed:
+			log.DebugError(logger, err, "Close acme manager")
+		case <-ctx.Done():
+			logger.Warn("Timeout while close acme manager")
+		}
+	}
+
+	if closer, ok := s.Storage.(io.Closer); ok {
+		err = closer.Close()
+		log.DebugError(logger, err, "Close storage")
+	}
+
+	logger.Info("Graceful shutdown finished")
+}
+
+// startNewProcess start the binary with same arguments and pass listeners to it.
+// It return error if new process can't start or exit while upgradeCheckDuration.
+func (s *gracefulShutdown) startNewProcess(ctx context.Context) error {
+	logger := zc.L(ctx)
+
+	// use path from args instead of os.Executable, because it point to old binary, if it replaced by new file.
+	executable, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		executable, err = os.Executable()
+	}
+	if err != nil {
+		return xerrors.Errorf("get path to binary: %w", err)
+	}
+
+	files, listenersEnv, err := tlslistener.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	cmd := exec.Command(executable, os.Args[1:]...) //nolint:gosec
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, tlslistener.InheritListenersEnv+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env, tlslistener.InheritListenersEnv+"="+listenersEnv)
+
+	if err = cmd.Start(); err != nil {
+		return xerrors.Errorf("start new process: %w", err)
+	}
+	logger.Info("New process started", zap.String("binary", executable), zap.Int("pid", cmd.Process.Pid))
+
+	exited := make(chan error, 1)
+	go func() {
+		defer log.HandlePanic(logger)
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-exited:
+		return xerrors.Errorf("new process exited early, exit error: %v", err)
+	case <-time.After(upgradeCheckDuration):
+		return nil
+	}
+}
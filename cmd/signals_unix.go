@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// signals for start upgrade binary without stop listen ports
+var upgradeSignalList = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// upgrade with pass listeners to new process doesn't support on windows
+var upgradeSignalList []os.Signal
@@ -26,6 +26,8 @@ require (
 	github.com/hashicorp/golang-lru/v2 v2.0.1
 	github.com/jonboulle/clockwork v0.4.0
 	github.com/letsencrypt/pebble/v2 v2.4.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/rekby/fastuuid v0.9.0
 	golang.org/x/time v0.3.0
 )
@@ -38,6 +38,12 @@ type AcmeManager struct {
 	AgreeFunction        func(tosurl string) bool
 	RenewAccountInterval time.Duration
 
+	// Email used as contact of new accounts
+	Email string
+
+	// EAB is external account binding for register new accounts
+	EAB *acme.ExternalAccountBinding
+
 	ctx                   context.Context
 	ctxCancel             context.CancelFunc
 	ctxAutorenewCompleted context.Context
@@ -50,12 +56,17 @@ type AcmeManager struct {
 	accounts         []clientAccount
 	stateLoaded      bool
 	closed           bool
+
+	// unusedAccounts are stored accounts with other external account binding,
+	// they doesn't use but kept in state for doesn't lose their keys
+	unusedAccounts []acmeAccountState
 }
 
 type clientAccount struct {
-	client  *acme.Client
-	account *acme.Account
-	enabled bool
+	client   *acme.Client
+	account  *acme.Account
+	enabled  bool
+	eabKeyID string
 }
 
 func New(ctx context.Context, cache cache.Bytes) *AcmeManager {
@@ -238,16 +249,30 @@ func (m *AcmeManager) loadFromCache(ctx context.Context) (err error) {
 	if len(state.Accounts) == 0 {
 		return xerrors.Errorf("no accounts in state")
 	}
+	if state.DirectoryURL != "" && state.DirectoryURL != m.DirectoryURL {
+		return xerrors.Errorf("state of other acme directory: '%v'", state.DirectoryURL)
+	}
 
 	m.accounts = make([]clientAccount, 0, len(state.Accounts))
-	for index, stateAccount := range state.Accounts {
+	m.unusedAccounts = nil
+	for _, stateAccount := range state.Accounts {
+		if m.EAB != nil && stateAccount.EABKeyID != m.EAB.KID {
+			// account bound to other external account or registered without binding
+			zc.L(ctx).Info("Skip acme account with other external account binding",
+				zap.String("account_uri", stateAccount.AcmeAccount.URI), zap.String("eab_key_id", stateAccount.EABKeyID))
+			m.unusedAccounts = append(m.unusedAccounts, stateAccount)
+			continue
+		}
+
 		client := m.initClient()
 		client.Key = stateAccount.PrivateKey
 		acc := clientAccount{
-			client:  client,
-			account: stateAccount.AcmeAccount,
-			enabled: true,
+			client:   client,
+			account:  stateAccount.AcmeAccount,
+			enabled:  true,
+			eabKeyID: stateAccount.EABKeyID,
 		}
+		index := len(m.accounts)
 
 		m.background.Add(1)
 		// handlepanic inside accountRenewSelfSync
@@ -258,6 +283,9 @@ func (m *AcmeManager) loadFromCache(ctx context.Context) (err error) {
 		m.accounts = append(m.accounts, acc)
 	}
 
+	if len(m.accounts) == 0 {
+		return cache.ErrCacheMiss
+	}
 	return nil
 }
 
@@ -295,7 +323,7 @@ func (m *AcmeManager) registerAccount(ctx context.Context) (clientAccount, error
 	// create account
 	client := m.initClient()
 
-	account, err := createAcmeAccount(ctx, client, m.AgreeFunction)
+	account, err := createAcmeAccount(ctx, client, m.AgreeFunction, m.newAccountTemplate())
 	log.InfoErrorCtx(ctx, err, "Create acme account")
 	if err != nil {
 		return clientAccount{}, err
@@ -306,17 +334,26 @@ func (m *AcmeManager) registerAccount(ctx context.Context) (clientAccount, error
 		account: account,
 		enabled: true,
 	}
+	if m.EAB != nil {
+		acc.eabKeyID = m.EAB.KID
+	}
 
 	return acc, nil
 }
 
 func (m *AcmeManager) saveState(ctx context.Context) error {
 	var state acmeManagerState
-	state.Accounts = make([]acmeAccountState, 0, len(m.accounts))
+	state.DirectoryURL = m.DirectoryURL
+	state.Accounts = make([]acmeAccountState, 0, len(m.accounts)+len(m.unusedAccounts))
 
 	for _, acc := range m.accounts {
-		state.Accounts = append(state.Accounts, acmeAccountState{PrivateKey: acc.client.Key.(*rsa.PrivateKey), AcmeAccount: acc.account})
+		state.Accounts = append(state.Accounts, acmeAccountState{
+			PrivateKey:  acc.client.Key.(*rsa.PrivateKey),
+			AcmeAccount: acc.account,
+			EABKeyID:    acc.eabKeyID,
+		})
 	}
+	state.Accounts = append(state.Accounts, m.unusedAccounts...)
 
 	stateBytes, err := json.Marshal(state)
 	log.InfoPanicCtx(ctx, err, "Marshal account state to json")
@@ -331,15 +368,30 @@ func (m *AcmeManager) saveState(ctx context.Context) error {
 	return nil
 }
 
+// newAccountTemplate return account with contact and external account binding for register
+func (m *AcmeManager) newAccountTemplate() *acme.Account {
+	account := &acme.Account{}
+	if m.Email != "" {
+		account.Contact = []string{"mailto:" + m.Email}
+	}
+	if m.EAB != nil {
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: m.EAB.KID, Key: m.EAB.Key}
+	}
+	return account
+}
+
 // createAcmeAccount create account on acme server and store private key in client.Key
-func createAcmeAccount(ctx context.Context, client *acme.Client, agreeFunction func(tosurl string) bool) (*acme.Account, error) {
+func createAcmeAccount(ctx context.Context, client *acme.Client, agreeFunction func(tosurl string) bool, account *acme.Account) (*acme.Account, error) {
 	key, err := rsa.GenerateKey(rand.Reader, rsaKeyLength)
 	log.InfoDPanicCtx(ctx, err, "Generate account key")
 
 	client.Key = key
-	account := &acme.Account{}
 	account, err = client.Register(ctx, account, agreeFunction)
 	log.InfoErrorCtx(ctx, err, "Register acme account")
+	if account != nil {
+		// hmac key must not be saved to storage with account state
+		account.ExternalAccountBinding = nil
+	}
 	return account, err
 }
 
@@ -3,6 +3,7 @@ package acme_client_manager
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
 	"math/big"
@@ -120,6 +121,79 @@ func TestClientManagerGetFromCache(t *testing.T) {
 	e.Nil(client4)
 }
 
+func TestClientManagerGetFromCacheEAB(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+	ctx = zc.WithLogger(ctx, zap.NewNop().WithOptions(zap.Development()))
+
+	mc := minimock.NewController(e)
+	defer mc.Finish()
+
+	state := acmeManagerState{
+		DirectoryURL: "https://acme.example.com/directory",
+		Accounts: []acmeAccountState{
+			{
+				AcmeAccount: &acme.Account{URI: "without-eab"},
+				PrivateKey:  &rsa.PrivateKey{D: big.NewInt(123)},
+			},
+			{
+				AcmeAccount: &acme.Account{URI: "with-eab"},
+				PrivateKey:  &rsa.PrivateKey{D: big.NewInt(222)},
+				EABKeyID:    "kid",
+			},
+		},
+	}
+	stateBytes, _ := json.Marshal(state)
+
+	c := NewBytesMock(mc)
+	c.GetMock.Return(stateBytes, nil)
+
+	manager := New(ctx, c)
+	defer func() { _ = manager.Close() }()
+	manager.DirectoryURL = "https://acme.example.com/directory"
+	manager.EAB = &acme.ExternalAccountBinding{KID: "kid", Key: []byte{1, 2, 3}}
+
+	client, _, err := manager.GetClient(ctx)
+	e.CmpNoError(err)
+	e.CmpDeeply(client.Key, state.Accounts[1].PrivateKey)
+	client2, _, err := manager.GetClient(ctx)
+	e.CmpNoError(err)
+	e.True(client2 == client) // account without eab skipped
+
+	// skipped account kept in saved state
+	var savedState acmeManagerState
+	c.PutMock.Set(func(_ context.Context, _ string, data []byte) error {
+		return json.Unmarshal(data, &savedState)
+	})
+	e.CmpNoError(manager.saveState(ctx))
+	e.Len(savedState.Accounts, 2)
+	e.Cmp(savedState.Accounts[0].AcmeAccount.URI, "with-eab")
+	e.Cmp(savedState.Accounts[1].AcmeAccount.URI, "without-eab")
+	e.CmpDeeply(savedState.Accounts[1].PrivateKey.D, state.Accounts[0].PrivateKey.D)
+
+	// state of other acme server
+	otherManager := New(ctx, c)
+	defer func() { _ = otherManager.Close() }()
+	otherManager.DirectoryURL = "https://other.example.com/directory"
+	_, _, err = otherManager.GetClient(ctx)
+	e.CmpError(err)
+}
+
+func TestClientManager_newAccountTemplate(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	manager := New(ctx, nil)
+	e.Cmp(manager.newAccountTemplate(), &acme.Account{})
+
+	manager.Email = "admin@example.com"
+	manager.EAB = &acme.ExternalAccountBinding{KID: "kid", Key: []byte{1, 2, 3}}
+	e.Cmp(manager.newAccountTemplate(), &acme.Account{
+		Contact:                []string{"mailto:admin@example.com"},
+		ExternalAccountBinding: &acme.ExternalAccountBinding{KID: "kid", Key: []byte{1, 2, 3}},
+	})
+}
+
 func TestClientManager_nextEnabledClientIndex(t *testing.T) {
 	table := []struct {
 		name             string
@@ -229,3 +303,39 @@ func TestClientManagerStateMigration(t *testing.T) {
 		e.Cmp(state.Accounts[0].AcmeAccount.URI, "https://acme-v02.api.letsencrypt.org/acme/acct/485823100")
 	})
 }
+
+func TestStoredAccounts(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	e.CmpNoError(err)
+	state := acmeManagerState{
+		Version:      stateFormatVersion,
+		DirectoryURL: "https://acme.example.com/directory",
+		Accounts: []acmeAccountState{{
+			AcmeAccount: &acme.Account{URI: "https://acme.example.com/acct/1", Status: acme.StatusValid,
+				Contact: []string{"mailto:admin@example.com"}},
+			PrivateKey: key,
+			EABKeyID:   "kid",
+		}},
+	}
+	stateBytes, _ := json.Marshal(state)
+	storage := cache.NewMemoryCache("test")
+	e.CmpNoError(storage.Put(ctx, stateName(state.DirectoryURL), stateBytes))
+
+	thumbprint, err := acme.JWKThumbprint(key.Public())
+	e.CmpNoError(err)
+	accounts, err := StoredAccounts(ctx, storage, state.DirectoryURL)
+	e.CmpNoError(err)
+	e.Cmp(accounts, []AccountInfo{{
+		URI:           "https://acme.example.com/acct/1",
+		Status:        acme.StatusValid,
+		Contact:       []string{"mailto:admin@example.com"},
+		EABKeyID:      "kid",
+		KeyThumbprint: thumbprint,
+	}})
+
+	_, err = StoredAccounts(ctx, storage, "https://other.example.com/directory")
+	e.Cmp(err, cache.ErrCacheMiss)
+}
@@ -0,0 +1,65 @@
+//nolint:golint
+package acme_client_manager
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+)
+
+// Config of acme server and account registration
+type Config struct {
+	DirectoryURL string
+
+	// Email used as contact of registered accounts, optional
+	Email string
+
+	// EABKeyID and EABHMACKey are credentials of external account binding, need for register account
+	// on some acme servers (ZeroSSL, Google Trust Services, private acme servers).
+	// EABHMACKey is base64url encoded, as CA provide it.
+	EABKeyID   string
+	EABHMACKey string
+}
+
+// Apply config to acme manager
+func (c Config) Apply(ctx context.Context, m *AcmeManager) error {
+	logger := zc.L(ctx)
+
+	if c.DirectoryURL == "" {
+		return xerrors.New("empty acme directory url")
+	}
+	m.DirectoryURL = c.DirectoryURL
+	m.Email = strings.TrimSpace(c.Email)
+
+	eab, err := c.externalAccountBinding()
+	log.DebugError(logger, err, "Parse external account binding", zap.String("eab_key_id", c.EABKeyID))
+	if err != nil {
+		return err
+	}
+	m.EAB = eab
+
+	logger.Info("Acme directory", zap.String("url", m.DirectoryURL), zap.String("email", m.Email),
+		zap.String("eab_key_id", c.EABKeyID))
+	return nil
+}
+
+func (c Config) externalAccountBinding() (*acme.ExternalAccountBinding, error) {
+	switch {
+	case c.EABKeyID == "" && c.EABHMACKey == "":
+		return nil, nil
+	case c.EABKeyID == "" || c.EABHMACKey == "":
+		return nil, xerrors.New("external account binding need both key id and hmac key")
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(c.EABHMACKey), "="))
+	if err != nil {
+		return nil, xerrors.Errorf("decode eab hmac key as base64url: %w", err)
+	}
+	return &acme.ExternalAccountBinding{KID: c.EABKeyID, Key: key}, nil
+}
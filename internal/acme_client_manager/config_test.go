@@ -0,0 +1,31 @@
+//nolint:golint
+package acme_client_manager
+
+import (
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+	"golang.org/x/crypto/acme"
+)
+
+func TestConfig_Apply(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	m := New(ctx, nil)
+	e.CmpError(Config{}.Apply(ctx, m))
+	e.CmpError(Config{DirectoryURL: "https://acme.example.com", EABKeyID: "kid"}.Apply(ctx, m))
+	e.CmpError(Config{DirectoryURL: "https://acme.example.com", EABKeyID: "kid", EABHMACKey: "bad key!"}.Apply(ctx, m))
+
+	e.CmpNoError(Config{DirectoryURL: "https://acme.example.com", Email: " admin@example.com "}.Apply(ctx, m))
+	e.Cmp(m.DirectoryURL, "https://acme.example.com")
+	e.Cmp(m.Email, "admin@example.com")
+	e.Nil(m.EAB)
+
+	e.CmpNoError(Config{DirectoryURL: "https://acme.example.com", EABKeyID: "kid", EABHMACKey: "AQID_w"}.Apply(ctx, m))
+	e.Cmp(m.EAB, &acme.ExternalAccountBinding{KID: "kid", Key: []byte{1, 2, 3, 255}})
+
+	// padded base64url
+	e.CmpNoError(Config{DirectoryURL: "https://acme.example.com", EABKeyID: "kid", EABHMACKey: "AQID_w=="}.Apply(ctx, m))
+	e.Cmp(m.EAB.Key, []byte{1, 2, 3, 255})
+}
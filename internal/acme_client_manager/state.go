@@ -1,9 +1,11 @@
 package acme_client_manager
 
 import (
+	"context"
 	"crypto/rsa"
 	"encoding/json"
 
+	"github.com/rekby/lets-proxy2/internal/cache"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/xerrors"
 )
@@ -14,6 +16,9 @@ type acmeManagerState struct {
 	Accounts []acmeAccountState
 	Version  int
 
+	// DirectoryURL of acme server, every acme server has own state
+	DirectoryURL string `json:",omitempty"`
+
 	PrivateKeyDeprecated  *rsa.PrivateKey `json:"PrivateKey,omitempty"`
 	AcmeAccountDeprecated *acme.Account   `json:"AcmeAccount,omitempty"`
 }
@@ -91,4 +96,51 @@ func (state *acmeManagerState) migrate() (bool, error) {
 type acmeAccountState struct {
 	PrivateKey  *rsa.PrivateKey `json:"PrivateKey"`
 	AcmeAccount *acme.Account   `json:"AcmeAccount"`
+
+	// EABKeyID is key id of external account binding, used for register the account
+	EABKeyID string `json:",omitempty"`
+}
+
+// AccountInfo describe stored acme account without private key
+type AccountInfo struct {
+	URI            string   `json:"uri"`
+	Status         string   `json:"status,omitempty"`
+	Contact        []string `json:"contact,omitempty"`
+	EABKeyID       string   `json:"eab_key_id,omitempty"`
+	KeyThumbprint  string   `json:"key_thumbprint"`
+	AgreedTermsURL string   `json:"agreed_terms,omitempty"`
+}
+
+// StoredAccounts return accounts of acme server from storage without requests to the server.
+// It returns cache.ErrCacheMiss if storage has no accounts for the server.
+func StoredAccounts(ctx context.Context, storage cache.Bytes, directoryURL string) ([]AccountInfo, error) {
+	content, err := storage.Get(ctx, stateName(directoryURL))
+	if err != nil {
+		return nil, err
+	}
+
+	var state acmeManagerState
+	if _, err = state.Load(content); err != nil {
+		return nil, err
+	}
+
+	res := make([]AccountInfo, 0, len(state.Accounts))
+	for index, account := range state.Accounts {
+		if account.AcmeAccount == nil || account.PrivateKey == nil {
+			return nil, xerrors.Errorf("bad account in state: %v", index)
+		}
+		thumbprint, err := acme.JWKThumbprint(account.PrivateKey.Public())
+		if err != nil {
+			return nil, xerrors.Errorf("get thumbprint of account key %v: %w", index, err)
+		}
+		res = append(res, AccountInfo{
+			URI:            account.AcmeAccount.URI,
+			Status:         account.AcmeAccount.Status,
+			Contact:        account.AcmeAccount.Contact,
+			EABKeyID:       account.EABKeyID,
+			KeyThumbprint:  thumbprint,
+			AgreedTermsURL: account.AcmeAccount.AgreedTerms,
+		})
+	}
+	return res, nil
 }
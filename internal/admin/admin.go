@@ -0,0 +1,273 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/secrethandler"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+)
+
+const (
+	certificatesPath = "/certificates"
+	keyTypeArgName   = "key_type"
+	reasonArgName    = "reason"
+)
+
+var errBadKeyType = xerrors.New("unknown or not allowed key type")
+
+type Config struct {
+	secrethandler.Config
+
+	Enable      bool
+	BindAddress string
+}
+
+// CertManager is certificate operations, used by admin api
+type CertManager interface {
+	AllowedKeyTypes() []cert_manager.KeyType
+	ListCertificates(ctx context.Context) ([]cert_manager.CertificateInfo, error)
+	CertificateInfo(ctx context.Context, d domain.DomainName, keyType cert_manager.KeyType) (cert_manager.CertificateInfo, error)
+	RenewCertificate(ctx context.Context, d domain.DomainName, keyType cert_manager.KeyType) (cert_manager.CertificateInfo, error)
+	PreIssueCertificate(ctx context.Context, d domain.DomainName, keyType cert_manager.KeyType) (cert_manager.CertificateInfo, error)
+	DeleteCertificate(ctx context.Context, d domain.DomainName, keyType cert_manager.KeyType) error
+	LockCertificate(ctx context.Context, d domain.DomainName) error
+	UnlockCertificate(ctx context.Context, d domain.DomainName) error
+	RevokeCertificate(ctx context.Context, d domain.DomainName, keyType cert_manager.KeyType, reason acme.CRLReasonCode) error
+}
+
+// Admin is http api for list certificates and operations with them. All answers are json.
+//
+//	GET    /certificates                 - list of stored certificates
+//	GET    /certificates/<domain>        - certificates of the domain
+//	POST   /certificates/<domain>/issue  - issue certificate if domain hasn't valid certificate
+//	POST   /certificates/<domain>/renew  - issue new certificate even if current valid
+//	POST   /certificates/<domain>/lock   - lock certificate, it will used as is without renew
+//	POST   /certificates/<domain>/unlock - remove certificate lock
+//	POST   /certificates/<domain>/revoke - revoke certificate with reason from reason argument and delete it from storage
+//	DELETE /certificates/<domain>        - delete certificate from storage
+//
+// Operations with domain use all allowed key types or key type from key_type argument (rsa or ecdsa).
+type Admin struct {
+	secretHandler secrethandler.SecretHandler
+	certManager   CertManager
+	logger        *zap.Logger
+}
+
+type response struct {
+	Certificates []cert_manager.CertificateInfo `json:"certificates"`
+	Error        string                         `json:"error,omitempty"`
+}
+
+func New(logger *zap.Logger, config Config, certManager CertManager) *Admin {
+	res := &Admin{
+		certManager: certManager,
+		logger:      logger,
+	}
+	res.secretHandler = secrethandler.New(logger, config.Config, http.HandlerFunc(res.handle)).
+		WithMethods(http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete)
+	return res
+}
+
+func (a *Admin) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	a.secretHandler.ServeHTTP(resp, req)
+}
+
+func (a *Admin) handle(resp http.ResponseWriter, req *http.Request) {
+	ctx := zc.WithLogger(req.Context(), a.logger.With(zap.String("method", req.Method),
+		zap.String("path", req.URL.Path)))
+
+	path := strings.Trim(req.URL.Path, "/")
+	if path == strings.Trim(certificatesPath, "/") {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			a.writeError(ctx, resp, http.StatusMethodNotAllowed, xerrors.New("bad method"), nil)
+			return
+		}
+		certificates, err := a.certManager.ListCertificates(ctx)
+		a.writeResult(ctx, resp, certificates, err)
+		return
+	}
+
+	if !strings.HasPrefix(path, strings.Trim(certificatesPath, "/")+"/") {
+		a.writeError(ctx, resp, http.StatusNotFound, xerrors.New("not found"), nil)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(path, strings.Trim(certificatesPath, "/")+"/"), "/")
+
+	d, err := domain.NormalizeDomain(parts[0])
+	if err != nil {
+		a.writeError(ctx, resp, http.StatusBadRequest, xerrors.Errorf("bad domain: %w", err), nil)
+		return
+	}
+	ctx = zc.WithLogger(ctx, zc.L(ctx).With(domain.LogDomain(d)))
+
+	keyTypes, err := a.keyTypes(req)
+	if err != nil {
+		a.writeError(ctx, resp, http.StatusBadRequest, err, nil)
+		return
+	}
+
+	var operation string
+	if len(parts) > 1 {
+		operation = strings.Join(parts[1:], "/")
+	}
+
+	switch {
+	case operation == "" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		certificates := a.domainCertificates(ctx, d, keyTypes)
+		if len(certificates) == 0 {
+			a.writeError(ctx, resp, http.StatusNotFound, xerrors.New("certificate not found"), nil)
+			return
+		}
+		a.writeResult(ctx, resp, certificates, nil)
+	case operation == "" && req.Method == http.MethodDelete:
+		err = a.forKeyTypes(keyTypes, func(keyType cert_manager.KeyType) error {
+			return a.certManager.DeleteCertificate(ctx, d, keyType)
+		})
+		a.writeResult(ctx, resp, a.domainCertificates(ctx, d, keyTypes), err)
+	case operation == "issue" && req.Method == http.MethodPost:
+		a.issue(ctx, resp, d, keyTypes, a.certManager.PreIssueCertificate)
+	case operation == "renew" && req.Method == http.MethodPost:
+		a.issue(ctx, resp, d, keyTypes, a.certManager.RenewCertificate)
+	case operation == "lock" && req.Method == http.MethodPost:
+		err = a.certManager.LockCertificate(ctx, d)
+		a.writeResult(ctx, resp, a.domainCertificates(ctx, d, keyTypes), err)
+	case operation == "unlock" && req.Method == http.MethodPost:
+		err = a.certManager.UnlockCertificate(ctx, d)
+		a.writeResult(ctx, resp, a.domainCertificates(ctx, d, keyTypes), err)
+	case operation == "revoke" && req.Method == http.MethodPost:
+		a.revoke(ctx, resp, req, d, keyTypes)
+	case operation == "" || operation == "issue" || operation == "renew" || operation == "lock" || operation == "unlock" ||
+		operation == "revoke":
+		a.writeError(ctx, resp, http.StatusMethodNotAllowed, xerrors.New("bad method"), nil)
+	default:
+		a.writeError(ctx, resp, http.StatusNotFound, xerrors.Errorf("unknown operation: '%v'", operation), nil)
+	}
+}
+
+type issueFunc func(ctx context.Context, d domain.DomainName, keyType cert_manager.KeyType) (cert_manager.CertificateInfo, error)
+
+func (a *Admin) issue(ctx context.Context, resp http.ResponseWriter, d domain.DomainName, keyTypes []cert_manager.KeyType, f issueFunc) {
+	var certificates []cert_manager.CertificateInfo
+	err := a.forKeyTypes(keyTypes, func(keyType cert_manager.KeyType) error {
+		info, err := f(ctx, d, keyType)
+		certificates = append(certificates, info)
+		return err
+	})
+	a.writeResult(ctx, resp, certificates, err)
+}
+
+func (a *Admin) revoke(ctx context.Context, resp http.ResponseWriter, req *http.Request, d domain.DomainName, keyTypes []cert_manager.KeyType) {
+	reasonName := req.URL.Query().Get(reasonArgName)
+	if reasonName == "" {
+		reasonName = cert_manager.RevocationReasonName(acme.CRLReasonUnspecified)
+	}
+	reason, err := cert_manager.ParseRevocationReason(reasonName)
+	if err != nil {
+		a.writeError(ctx, resp, http.StatusBadRequest, err, nil)
+		return
+	}
+
+	// without key_type argument revoke stored certificates of all key types
+	if req.URL.Query().Get(keyTypeArgName) == "" {
+		keyTypes = nil
+		for _, info := range a.domainCertificates(ctx, d, a.certManager.AllowedKeyTypes()) {
+			if info.Stored {
+				keyTypes = append(keyTypes, info.KeyType)
+			}
+		}
+		if len(keyTypes) == 0 {
+			a.writeError(ctx, resp, http.StatusNotFound, xerrors.New("certificate not found"), nil)
+			return
+		}
+	}
+
+	err = a.forKeyTypes(keyTypes, func(keyType cert_manager.KeyType) error {
+		return a.certManager.RevokeCertificate(ctx, d, keyType, reason)
+	})
+	a.writeResult(ctx, resp, a.domainCertificates(ctx, d, keyTypes), err)
+}
+
+// forKeyTypes call f for every key type and return first error
+func (a *Admin) forKeyTypes(keyTypes []cert_manager.KeyType, f func(keyType cert_manager.KeyType) error) error {
+	var resErr error
+	for _, keyType := range keyTypes {
+		if err := f(keyType); err != nil && resErr == nil {
+			resErr = xerrors.Errorf("%v: %w", keyType, err)
+		}
+	}
+	return resErr
+}
+
+func (a *Admin) domainCertificates(ctx context.Context, d domain.DomainName, keyTypes []cert_manager.KeyType) []cert_manager.CertificateInfo {
+	var res []cert_manager.CertificateInfo
+	for _, keyType := range keyTypes {
+		info, err := a.certManager.CertificateInfo(ctx, d, keyType)
+		if err == cache.ErrCacheMiss {
+			continue
+		}
+		log.DebugError(zc.L(ctx), err, "Get certificate info", zap.Stringer("key_type", keyType))
+		res = append(res, info)
+	}
+	return res
+}
+
+func (a *Admin) keyTypes(req *http.Request) ([]cert_manager.KeyType, error) {
+	keyType := cert_manager.KeyType(req.URL.Query().Get(keyTypeArgName))
+	switch keyType {
+	case "":
+		return a.certManager.AllowedKeyTypes(), nil
+	default:
+		for _, allowed := range a.certManager.AllowedKeyTypes() {
+			if keyType == allowed {
+				return []cert_manager.KeyType{keyType}, nil
+			}
+		}
+		return nil, xerrors.Errorf("%w: '%v'", errBadKeyType, keyType)
+	}
+}
+
+func (a *Admin) writeResult(ctx context.Context, resp http.ResponseWriter, certificates []cert_manager.CertificateInfo, err error) {
+	if err != nil {
+		a.writeError(ctx, resp, errorStatus(err), err, certificates)
+		return
+	}
+	a.writeJSON(ctx, resp, http.StatusOK, response{Certificates: certificates})
+}
+
+func (a *Admin) writeError(ctx context.Context, resp http.ResponseWriter, status int, err error, certificates []cert_manager.CertificateInfo) {
+	zc.L(ctx).Warn("Admin request failed", zap.Int("status", status), zap.Error(err))
+	a.writeJSON(ctx, resp, status, response{Certificates: certificates, Error: err.Error()})
+}
+
+func (a *Admin) writeJSON(ctx context.Context, resp http.ResponseWriter, status int, res response) {
+	if res.Certificates == nil {
+		res.Certificates = []cert_manager.CertificateInfo{}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	err := json.NewEncoder(resp).Encode(res)
+	log.DebugError(zc.L(ctx), err, "Write admin answer")
+}
+
+func errorStatus(err error) int {
+	switch {
+	case xerrors.Is(err, cert_manager.ErrCertificateLocked):
+		return http.StatusConflict
+	case xerrors.Is(err, cert_manager.ErrStorageCantList):
+		return http.StatusNotImplemented
+	case xerrors.Is(err, cache.ErrCacheMiss):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
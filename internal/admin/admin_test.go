@@ -0,0 +1,185 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/secrethandler"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+)
+
+type testCertManager struct {
+	certificates map[string]cert_manager.CertificateInfo // key: domain/keyType
+	calls        []string
+}
+
+func (m *testCertManager) key(d domain.DomainName, keyType cert_manager.KeyType) string {
+	return d.String() + "/" + keyType.String()
+}
+
+func (m *testCertManager) AllowedKeyTypes() []cert_manager.KeyType {
+	return []cert_manager.KeyType{cert_manager.KeyRSA, cert_manager.KeyECDSA}
+}
+
+func (m *testCertManager) ListCertificates(_ context.Context) ([]cert_manager.CertificateInfo, error) {
+	m.calls = append(m.calls, "list")
+	var res []cert_manager.CertificateInfo
+	for _, info := range m.certificates {
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+func (m *testCertManager) CertificateInfo(_ context.Context, d domain.DomainName, keyType cert_manager.KeyType) (cert_manager.CertificateInfo, error) {
+	if info, ok := m.certificates[m.key(d, keyType)]; ok {
+		return info, nil
+	}
+	return cert_manager.CertificateInfo{}, cache.ErrCacheMiss
+}
+
+func (m *testCertManager) RenewCertificate(ctx context.Context, d domain.DomainName, keyType cert_manager.KeyType) (cert_manager.CertificateInfo, error) {
+	m.calls = append(m.calls, "renew "+m.key(d, keyType))
+	info, ok := m.certificates[m.key(d, keyType)]
+	if ok && info.Locked {
+		return info, cert_manager.ErrCertificateLocked
+	}
+	return m.PreIssueCertificate(ctx, d, keyType)
+}
+
+func (m *testCertManager) PreIssueCertificate(_ context.Context, d domain.DomainName, keyType cert_manager.KeyType) (cert_manager.CertificateInfo, error) {
+	m.calls = append(m.calls, "issue "+m.key(d, keyType))
+	info := cert_manager.CertificateInfo{Name: d.String(), KeyType: keyType, Stored: true, Domains: []string{d.String()}}
+	m.certificates[m.key(d, keyType)] = info
+	return info, nil
+}
+
+func (m *testCertManager) DeleteCertificate(_ context.Context, d domain.DomainName, keyType cert_manager.KeyType) error {
+	m.calls = append(m.calls, "delete "+m.key(d, keyType))
+	delete(m.certificates, m.key(d, keyType))
+	return nil
+}
+
+func (m *testCertManager) LockCertificate(_ context.Context, d domain.DomainName) error {
+	m.calls = append(m.calls, "lock "+d.String())
+	for _, keyType := range m.AllowedKeyTypes() {
+		if info, ok := m.certificates[m.key(d, keyType)]; ok {
+			info.Locked = true
+			m.certificates[m.key(d, keyType)] = info
+		}
+	}
+	return nil
+}
+
+func (m *testCertManager) UnlockCertificate(_ context.Context, d domain.DomainName) error {
+	m.calls = append(m.calls, "unlock "+d.String())
+	return xerrors.New("test error")
+}
+
+func (m *testCertManager) RevokeCertificate(ctx context.Context, d domain.DomainName, keyType cert_manager.KeyType, reason acme.CRLReasonCode) error {
+	m.calls = append(m.calls, "revoke "+m.key(d, keyType)+" "+cert_manager.RevocationReasonName(reason))
+	return m.DeleteCertificate(ctx, d, keyType)
+}
+
+func TestAdmin(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	certManager := &testCertManager{certificates: map[string]cert_manager.CertificateInfo{
+		"test.ru/rsa": {Name: "test.ru", KeyType: cert_manager.KeyRSA, Stored: true},
+	}}
+	admin := New(th.Logger(e), Config{Config: secrethandler.Config{Password: "123"}}, certManager)
+
+	query := func(method, path string) (int, response) {
+		t.Helper()
+		respWriter := httptest.NewRecorder()
+		admin.ServeHTTP(respWriter, httptest.NewRequest(method, "http://test"+path, nil))
+		resp := respWriter.Result()
+		defer func() { _ = resp.Body.Close() }()
+
+		var res response
+		if resp.Header.Get("Content-Type") == "application/json" {
+			e.CmpNoError(json.NewDecoder(resp.Body).Decode(&res))
+		}
+		return resp.StatusCode, res
+	}
+
+	status, _ := query(http.MethodGet, "/certificates")
+	e.Cmp(status, http.StatusForbidden)
+
+	status, res := query(http.MethodGet, "/certificates?password=123")
+	e.Cmp(status, http.StatusOK)
+	e.Len(res.Certificates, 1)
+	e.Cmp(res.Certificates[0].Name, "test.ru")
+
+	status, res = query(http.MethodGet, "/certificates/test.ru?password=123")
+	e.Cmp(status, http.StatusOK)
+	e.Len(res.Certificates, 1)
+
+	status, res = query(http.MethodGet, "/certificates/other.ru?password=123")
+	e.Cmp(status, http.StatusNotFound)
+	e.Cmp(res.Error, "certificate not found")
+
+	status, _ = query(http.MethodGet, "/certificates/test.ru?password=123&key_type=dsa")
+	e.Cmp(status, http.StatusBadRequest)
+
+	status, _ = query(http.MethodGet, "/certificates/test.ru/renew?password=123")
+	e.Cmp(status, http.StatusMethodNotAllowed)
+
+	status, _ = query(http.MethodPost, "/certificates/test.ru/unknown?password=123")
+	e.Cmp(status, http.StatusNotFound)
+
+	status, res = query(http.MethodPost, "/certificates/other.ru/issue?password=123&key_type=ecdsa")
+	e.Cmp(status, http.StatusOK)
+	e.Len(res.Certificates, 1)
+	e.Cmp(res.Certificates[0].KeyType, cert_manager.KeyECDSA)
+
+	status, res = query(http.MethodPost, "/certificates/test.ru/lock?password=123")
+	e.Cmp(status, http.StatusOK)
+	e.True(res.Certificates[0].Locked)
+
+	status, res = query(http.MethodPost, "/certificates/test.ru/renew?password=123&key_type=rsa")
+	e.Cmp(status, http.StatusConflict)
+	e.Cmp(res.Error, "rsa: certificate locked")
+
+	status, res = query(http.MethodPost, "/certificates/test.ru/unlock?password=123")
+	e.Cmp(status, http.StatusInternalServerError)
+	e.Cmp(res.Error, "test error")
+
+	status, res = query(http.MethodDelete, "/certificates/Test.RU?password=123")
+	e.Cmp(status, http.StatusOK)
+	e.Len(res.Certificates, 0)
+
+	status, _ = query(http.MethodPost, "/certificates/other.ru/revoke?password=123&reason=bad")
+	e.Cmp(status, http.StatusBadRequest)
+
+	status, _ = query(http.MethodGet, "/certificates/other.ru/revoke?password=123")
+	e.Cmp(status, http.StatusMethodNotAllowed)
+
+	status, res = query(http.MethodPost, "/certificates/other.ru/revoke?password=123&reason=keyCompromise")
+	e.Cmp(status, http.StatusOK)
+	e.Len(res.Certificates, 0)
+
+	status, res = query(http.MethodPost, "/certificates/other.ru/revoke?password=123")
+	e.Cmp(status, http.StatusNotFound)
+	e.Cmp(res.Error, "certificate not found")
+
+	e.Cmp(certManager.calls, []string{
+		"list",
+		"issue other.ru/ecdsa",
+		"lock test.ru",
+		"renew test.ru/rsa",
+		"unlock test.ru",
+		"delete test.ru/rsa",
+		"delete test.ru/ecdsa",
+		"revoke other.ru/ecdsa keyCompromise",
+		"delete other.ru/ecdsa",
+	})
+}
@@ -0,0 +1,200 @@
+// Package ari get renewal info from acme server: suggested by server window for renew certificate
+// (ACME Renewal Information, RFC 9773).
+package ari
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultRetryAfter = 6 * time.Hour
+	minRetryAfter     = time.Minute
+	maxRetryAfter     = 24 * time.Hour
+
+	// directoryTTL is interval of reload acme directory
+	directoryTTL = 24 * time.Hour
+
+	maxResponseSize = 1024 * 1024
+)
+
+// ErrNotSupported returned if acme directory doesn't advertise renewalInfo endpoint
+var ErrNotSupported = xerrors.New("acme server doesn't support renewal info")
+
+// Window is time interval, suggested for renew certificate
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// RenewalInfo is response of acme server for the certificate
+type RenewalInfo struct {
+	SuggestedWindow Window `json:"suggestedWindow"`
+	ExplanationURL  string `json:"explanationURL,omitempty"`
+
+	// RetryAfter is time, when renewal info should be requested again
+	RetryAfter time.Time `json:"-"`
+}
+
+// Client request renewal info from acme server with DirectoryURL.
+type Client struct {
+	DirectoryURL string
+	HTTPClient   *http.Client
+
+	mu               sync.Mutex
+	renewalInfoURL   string
+	directoryExpired time.Time
+
+	now func() time.Time
+}
+
+// GetRenewalInfo return renewal info for the certificate.
+// It return ErrNotSupported if the acme server doesn't support renewal info.
+func (c *Client) GetRenewalInfo(ctx context.Context, cert *x509.Certificate) (RenewalInfo, error) {
+	certID, err := CertID(cert)
+	if err != nil {
+		return RenewalInfo{}, err
+	}
+
+	renewalInfoURL, err := c.getRenewalInfoURL(ctx)
+	if err != nil {
+		return RenewalInfo{}, err
+	}
+
+	var info RenewalInfo
+	header, err := c.getJSON(ctx, strings.TrimSuffix(renewalInfoURL, "/")+"/"+certID, &info)
+	log.DebugErrorCtx(ctx, err, "Get renewal info", zap.String("cert_id", certID),
+		zap.Time("start", info.SuggestedWindow.Start), zap.Time("end", info.SuggestedWindow.End))
+	if err != nil {
+		return RenewalInfo{}, xerrors.Errorf("get renewal info: %w", err)
+	}
+	if info.SuggestedWindow.Start.IsZero() || !info.SuggestedWindow.End.After(info.SuggestedWindow.Start) {
+		return RenewalInfo{}, xerrors.Errorf("bad suggested window: %v - %v", info.SuggestedWindow.Start, info.SuggestedWindow.End)
+	}
+	info.RetryAfter = c.getNow().Add(parseRetryAfter(header.Get("Retry-After"), c.getNow()))
+	return info, nil
+}
+
+// CertID return identifier of certificate for renewal info request: base64url of authority key identifier
+// and serial number, separated by dot.
+func CertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", xerrors.New("certificate has no authority key identifier")
+	}
+	if cert.SerialNumber == nil || cert.SerialNumber.Sign() <= 0 {
+		return "", xerrors.New("certificate has bad serial number")
+	}
+
+	serial := cert.SerialNumber.Bytes()
+	if serial[0]&0x80 != 0 {
+		// der encoding of positive integer
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+func (c *Client) getRenewalInfoURL(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.getNow()
+	if now.Before(c.directoryExpired) {
+		if c.renewalInfoURL == "" {
+			return "", ErrNotSupported
+		}
+		return c.renewalInfoURL, nil
+	}
+
+	var directory struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	_, err := c.getJSON(ctx, c.DirectoryURL, &directory)
+	log.DebugErrorCtx(ctx, err, "Get acme directory for renewal info", zap.String("directory", c.DirectoryURL),
+		zap.String("renewal_info", directory.RenewalInfo))
+	if err != nil {
+		return "", xerrors.Errorf("get acme directory: %w", err)
+	}
+
+	c.renewalInfoURL = directory.RenewalInfo
+	c.directoryExpired = now.Add(directoryTTL)
+	if c.renewalInfoURL == "" {
+		return "", ErrNotSupported
+	}
+	return c.renewalInfoURL, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, url string, dst interface{}) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := resp.Body.Close()
+		log.DebugErrorCtx(ctx, err, "Close response body")
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("unexpected status code %v from '%v'", resp.StatusCode, url)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(body, dst); err != nil {
+		zc.L(ctx).Debug("Bad json response", zap.ByteString("body", body))
+		return nil, xerrors.Errorf("unmarshal response from '%v': %w", url, err)
+	}
+	return resp.Header, nil
+}
+
+func (c *Client) getNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// parseRetryAfter parse Retry-After header as seconds or http date and clamp result to reasonable interval
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	var res time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		res = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		res = t.Sub(now)
+	} else {
+		return defaultRetryAfter
+	}
+
+	switch {
+	case res < minRetryAfter:
+		return minRetryAfter
+	case res > maxRetryAfter:
+		return maxRetryAfter
+	default:
+		return res
+	}
+}
@@ -0,0 +1,112 @@
+package ari
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestCertID(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	// example from RFC 9773
+	aki, err := hex.DecodeString("69885B6B87464041E1B37B847BA0AE2CDE01C8D4")
+	e.CmpNoError(err)
+	cert := &x509.Certificate{AuthorityKeyId: aki, SerialNumber: big.NewInt(0x87654321)}
+	id, err := CertID(cert)
+	e.CmpNoError(err)
+	e.Cmp(id, "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE")
+
+	cert.SerialNumber = big.NewInt(0x12345)
+	id, err = CertID(cert)
+	e.CmpNoError(err)
+	e.Cmp(id, "aYhba4dGQEHhs3uEe6CuLN4ByNQ.ASNF")
+
+	_, err = CertID(&x509.Certificate{SerialNumber: big.NewInt(1)})
+	e.CmpError(err)
+}
+
+func TestClient_GetRenewalInfo(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	aki := []byte{1, 2, 3}
+	cert := &x509.Certificate{AuthorityKeyId: aki, SerialNumber: big.NewInt(10)}
+	certID, err := CertID(cert)
+	e.CmpNoError(err)
+
+	var directoryRequests int
+	var withRenewalInfo = true
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/directory":
+			directoryRequests++
+			if withRenewalInfo {
+				_, _ = w.Write([]byte(`{"newOrder": "` + server.URL + `/new-order", "renewalInfo": "` + server.URL + `/renewal-info/"}`))
+			} else {
+				_, _ = w.Write([]byte(`{"newOrder": "` + server.URL + `/new-order"}`))
+			}
+		case "/renewal-info/" + certID:
+			w.Header().Set("Retry-After", "3600")
+			_, _ = w.Write([]byte(`{"suggestedWindow": {"start": "2025-01-10T00:00:00Z", "end": "2025-01-12T00:00:00Z"}, ` +
+				`"explanationURL": "https://example.com/incident"}`))
+		case "/renewal-info/" + strings.Split(certID, ".")[0] + ".Cw":
+			_, _ = w.Write([]byte(`{"suggestedWindow": {"start": "2025-01-12T00:00:00Z", "end": "2025-01-10T00:00:00Z"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{DirectoryURL: server.URL + "/directory", now: func() time.Time { return now }}
+
+	info, err := client.GetRenewalInfo(ctx, cert)
+	e.CmpNoError(err)
+	e.Cmp(info.SuggestedWindow, Window{
+		Start: time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2025, 1, 12, 0, 0, 0, 0, time.UTC),
+	})
+	e.Cmp(info.ExplanationURL, "https://example.com/incident")
+	e.Cmp(info.RetryAfter, now.Add(time.Hour))
+
+	// bad window
+	_, err = client.GetRenewalInfo(ctx, &x509.Certificate{AuthorityKeyId: aki, SerialNumber: big.NewInt(11)})
+	e.CmpError(err)
+
+	// unknown certificate
+	_, err = client.GetRenewalInfo(ctx, &x509.Certificate{AuthorityKeyId: aki, SerialNumber: big.NewInt(12)})
+	e.CmpError(err)
+	e.Cmp(directoryRequests, 1)
+
+	// directory without renewal info, reloaded after ttl
+	withRenewalInfo = false
+	now = now.Add(directoryTTL)
+	_, err = client.GetRenewalInfo(ctx, cert)
+	e.Cmp(err, ErrNotSupported)
+	_, err = client.GetRenewalInfo(ctx, cert)
+	e.Cmp(err, ErrNotSupported)
+	e.Cmp(directoryRequests, 2)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	e.Cmp(parseRetryAfter("", now), defaultRetryAfter)
+	e.Cmp(parseRetryAfter("bad", now), defaultRetryAfter)
+	e.Cmp(parseRetryAfter("120", now), 2*time.Minute)
+	e.Cmp(parseRetryAfter("1", now), minRetryAfter)
+	e.Cmp(parseRetryAfter("1000000", now), maxRetryAfter)
+	e.Cmp(parseRetryAfter("Wed, 01 Jan 2025 02:00:00 GMT", now), 2*time.Hour)
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+var (
+	_ Atomic = &MemoryCache{}
+	_ Atomic = &DiskCache{}
+	_ Atomic = &SQLCache{}
+)
+
+func testAtomic(ctx context.Context, e *th.Env, c Atomic) {
+	const key = "test.lease"
+
+	e.CmpNoError(c.Create(ctx, key, []byte("1")))
+	e.Cmp(c.Create(ctx, key, []byte("2")), ErrKeyExists)
+	res, err := c.Get(ctx, key)
+	e.CmpNoError(err)
+	e.Cmp(res, []byte("1"))
+
+	e.Cmp(c.CompareAndSwap(ctx, key, []byte("2"), []byte("3")), ErrValueChanged)
+	e.CmpNoError(c.CompareAndSwap(ctx, key, []byte("1"), []byte("3")))
+	res, err = c.Get(ctx, key)
+	e.CmpNoError(err)
+	e.Cmp(res, []byte("3"))
+	e.Cmp(c.CompareAndSwap(ctx, "non-existed-key", []byte("1"), []byte("2")), ErrValueChanged)
+
+	e.Cmp(c.CompareAndDelete(ctx, key, []byte("1")), ErrValueChanged)
+	e.CmpNoError(c.CompareAndDelete(ctx, key, []byte("3")))
+	_, err = c.Get(ctx, key)
+	e.Cmp(err, ErrCacheMiss)
+	e.CmpNoError(c.CompareAndDelete(ctx, key, []byte("3")))
+
+	e.CmpNoError(c.Create(ctx, key, []byte("4")))
+}
+
+func TestMemoryCache_Atomic(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	testAtomic(ctx, e, NewMemoryCache("test"))
+}
+
+func TestDiskCache_Atomic(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	dir := th.TmpDir(e)
+	testAtomic(ctx, e, &DiskCache{Dir: dir})
+
+	// temporary files removed after create
+	files, err := ioutil.ReadDir(dir)
+	e.CmpNoError(err)
+	e.Len(files, 1)
+	e.Cmp(files[0].Name(), "test.lease")
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+const (
+	storageTypeDisk = "disk"
+	storageTypeSQL  = "sql"
+)
+
+const defaultDirMode = 0700
+
+type Config struct {
+	// disk | sql
+	Type string
+
+	SQLDriver string
+	SQLDSN    string
+	SQLTable  string
+}
+
+// CreateStorage return configured storage. storageDir used for disk storage.
+func (c *Config) CreateStorage(ctx context.Context, storageDir string) (Bytes, error) {
+	logger := zc.L(ctx)
+
+	storageType := strings.ToLower(strings.TrimSpace(c.Type))
+	switch storageType {
+	case "", storageTypeDisk:
+		logger.Info("Use disk storage", zap.String("dir", storageDir))
+		if err := os.MkdirAll(storageDir, defaultDirMode); err != nil {
+			return nil, xerrors.Errorf("create storage dir '%v': %w", storageDir, err)
+		}
+		return &DiskCache{Dir: storageDir}, nil
+	case storageTypeSQL:
+		logger.Info("Use sql storage", zap.String("driver", c.SQLDriver), zap.String("table", c.SQLTable))
+		return NewSQLCache(ctx, c.SQLDriver, c.SQLDSN, c.SQLTable)
+	default:
+		return nil, xerrors.Errorf("unknown storage type: '%v'", c.Type)
+	}
+}
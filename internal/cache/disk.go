@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"bytes"
 	"context"
 	"github.com/rekby/lets-proxy2/internal/log"
 	"go.uber.org/zap/zapcore"
@@ -72,6 +73,136 @@ func (c *DiskCache) Delete(ctx context.Context, key string) error {
 	return err
 }
 
+// Create write data to temporary file and link it to key file, it is atomic between processes on same file system:
+// other processes never see key file with partial data.
+func (c *DiskCache) Create(ctx context.Context, key string, data []byte) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zc.L(ctx).Debug("Create in disk cache", zap.String("dir", c.Dir), zap.String("key", key))
+	defer func() {
+		zc.L(ctx).Debug("Create in disk cache result.", zap.String("dir", c.Dir), zap.String("key", key),
+			zap.Error(err))
+	}()
+
+	tmpFile, err := ioutil.TempFile(c.Dir, diskCacheSanitizeKey(key)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Link(tmpFile.Name(), c.filepath(key))
+	if os.IsExist(err) {
+		return ErrKeyExists
+	}
+	return err
+}
+
+// CompareAndSwap is atomic inside the process only, between processes it is best effort:
+// new data write to temporary file and atomically rename to key file.
+func (c *DiskCache) CompareAndSwap(ctx context.Context, key string, oldData, newData []byte) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zc.L(ctx).Debug("Compare and swap in disk cache", zap.String("dir", c.Dir), zap.String("key", key))
+	defer func() {
+		zc.L(ctx).Debug("Compare and swap in disk cache result.", zap.String("dir", c.Dir), zap.String("key", key),
+			zap.Error(err))
+	}()
+
+	filePath := c.filepath(key)
+	current, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return ErrValueChanged
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, oldData) {
+		return ErrValueChanged
+	}
+
+	tmpFile, err := ioutil.TempFile(c.Dir, diskCacheSanitizeKey(key)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(newData)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filePath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// CompareAndDelete is atomic inside the process only, between processes it is best effort.
+func (c *DiskCache) CompareAndDelete(ctx context.Context, key string, oldData []byte) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zc.L(ctx).Debug("Compare and delete from disk cache", zap.String("dir", c.Dir), zap.String("key", key))
+	defer func() {
+		zc.L(ctx).Debug("Compare and delete from disk cache result.", zap.String("dir", c.Dir), zap.String("key", key),
+			zap.Error(err))
+	}()
+
+	filePath := c.filepath(key)
+	current, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, oldData) {
+		return ErrValueChanged
+	}
+
+	err = os.Remove(filePath)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// Keys return names of files in the dir. Names of files are sanitized keys.
+func (c *DiskCache) Keys(ctx context.Context) (keys []string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	defer func() {
+		zc.L(ctx).Debug("List keys of disk cache", zap.String("dir", c.Dir), zap.Int("keys_count", len(keys)),
+			zap.Error(err))
+	}()
+
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys = make([]string, 0, len(files))
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			keys = append(keys, file.Name())
+		}
+	}
+	return keys, nil
+}
+
 func diskCacheSanitizeKey(k string) string {
 	const placeholder = "___"
 	k = strings.Replace(k, "/", placeholder, -1)
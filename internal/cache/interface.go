@@ -6,6 +6,8 @@ import (
 )
 
 var ErrCacheMiss = errors.New("lets proxy: cache miss")
+var ErrKeyExists = errors.New("lets proxy: key exists")
+var ErrValueChanged = errors.New("lets proxy: value changed")
 
 type Bytes interface {
 	// Get returns a certificate data for the specified key.
@@ -22,6 +24,31 @@ type Bytes interface {
 	Delete(ctx context.Context, key string) error
 }
 
+// Atomic is optional interface of Bytes storage, need for locks between some lets-proxy instances
+// with shared storage.
+type Atomic interface {
+	Bytes
+
+	// Create stores the data only if the key doesn't exist.
+	// If the key exists, Create returns ErrKeyExists.
+	Create(ctx context.Context, key string, data []byte) error
+
+	// CompareAndSwap replace the data of key by newData only if current data equal to oldData.
+	// If current data differ or the key doesn't exist, CompareAndSwap returns ErrValueChanged.
+	CompareAndSwap(ctx context.Context, key string, oldData, newData []byte) error
+
+	// CompareAndDelete removes the key only if current data equal to oldData.
+	// If current data differ, CompareAndDelete returns ErrValueChanged.
+	// If there's no such key in the cache, CompareAndDelete returns nil.
+	CompareAndDelete(ctx context.Context, key string, oldData []byte) error
+}
+
+// Lister is optional interface of Bytes storage, need for list stored certificates.
+type Lister interface {
+	// Keys returns all keys of the storage in sorted order.
+	Keys(ctx context.Context) ([]string, error)
+}
+
 type Value interface {
 	// Get returns a certificate data for the specified key.
 	// If there's no such key, Get returns ErrCacheMiss.
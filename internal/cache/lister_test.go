@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+var (
+	_ Lister = &MemoryCache{}
+	_ Lister = &DiskCache{}
+	_ Lister = &SQLCache{}
+)
+
+func testLister(ctx context.Context, e *th.Env, c interface {
+	Bytes
+	Lister
+}) {
+	keys, err := c.Keys(ctx)
+	e.CmpNoError(err)
+	e.Len(keys, 0)
+
+	e.CmpNoError(c.Put(ctx, "b.rsa.cer", []byte("1")))
+	e.CmpNoError(c.Put(ctx, "a.rsa.cer", []byte("2")))
+	e.CmpNoError(c.Put(ctx, "a.rsa.key", []byte("3")))
+
+	keys, err = c.Keys(ctx)
+	e.CmpNoError(err)
+	e.Cmp(keys, []string{"a.rsa.cer", "a.rsa.key", "b.rsa.cer"})
+
+	e.CmpNoError(c.Delete(ctx, "a.rsa.key"))
+	keys, err = c.Keys(ctx)
+	e.CmpNoError(err)
+	e.Cmp(keys, []string{"a.rsa.cer", "b.rsa.cer"})
+}
+
+func TestMemoryCache_Keys(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	testLister(ctx, e, NewMemoryCache("test"))
+}
+
+func TestDiskCache_Keys(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	testLister(ctx, e, &DiskCache{Dir: th.TmpDir(e)})
+}
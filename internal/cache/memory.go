@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"bytes"
 	"context"
+	"sort"
 	"sync"
 
 	zc "github.com/rekby/zapcontext"
@@ -61,3 +63,72 @@ func (c *MemoryCache) Delete(ctx context.Context, key string) (err error) {
 
 	return nil
 }
+
+func (c *MemoryCache) Create(ctx context.Context, key string, data []byte) (err error) {
+	defer func() {
+		zc.L(ctx).Debug("Create in memory cache", zap.String("cache_name", c.Name),
+			zap.String("key", key), zap.Int("data_len", len(data)), zap.Error(err))
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exist := c.m[key]; exist {
+		return ErrKeyExists
+	}
+	c.m[key] = data
+	return nil
+}
+
+func (c *MemoryCache) CompareAndSwap(ctx context.Context, key string, oldData, newData []byte) (err error) {
+	defer func() {
+		zc.L(ctx).Debug("Compare and swap in memory cache", zap.String("cache_name", c.Name),
+			zap.String("key", key), zap.Int("data_len", len(newData)), zap.Error(err))
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if current, exist := c.m[key]; !exist || !bytes.Equal(current, oldData) {
+		return ErrValueChanged
+	}
+	c.m[key] = newData
+	return nil
+}
+
+func (c *MemoryCache) CompareAndDelete(ctx context.Context, key string, oldData []byte) (err error) {
+	defer func() {
+		zc.L(ctx).Debug("Compare and delete from memory cache", zap.String("cache_name", c.Name),
+			zap.String("key", key), zap.Error(err))
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, exist := c.m[key]
+	if !exist {
+		return nil
+	}
+	if !bytes.Equal(current, oldData) {
+		return ErrValueChanged
+	}
+	delete(c.m, key)
+	return nil
+}
+
+func (c *MemoryCache) Keys(ctx context.Context) (keys []string, err error) {
+	defer func() {
+		zc.L(ctx).Debug("List keys of memory cache", zap.String("cache_name", c.Name),
+			zap.Int("keys_count", len(keys)), zap.Error(err))
+	}()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys = make([]string, 0, len(c.m))
+	for key := range c.m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/xerrors"
+
+	// postgres driver for database/sql
+	_ "github.com/lib/pq"
+)
+
+const (
+	SQLDriverPostgres = "postgres"
+	SQLDriverSQLite   = "sqlite3"
+)
+
+const defaultSQLTable = "lets_proxy_storage"
+
+var sqlTableNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// SQLCache store data in sql database table. It allow to share certificates, locks and acme account state
+// between many lets-proxy instances.
+// Keys store as is, same as file names of DiskCache.
+type SQLCache struct {
+	db      *sql.DB
+	driver  string
+	table   string
+	queries sqlQueries
+}
+
+type sqlQueries struct {
+	createTable string
+	get         string
+	put         string
+	delete      string
+	keys        string
+
+	create           string
+	compareAndSwap   string
+	compareAndDelete string
+}
+
+// NewSQLCache open database and create storage table if need.
+// Supported drivers: postgres (with github.com/lib/pq) and sqlite3 (with github.com/mattn/go-sqlite3, need cgo).
+func NewSQLCache(ctx context.Context, driver, dsn, table string) (*SQLCache, error) {
+	if table == "" {
+		table = defaultSQLTable
+	}
+	if !sqlTableNameRegexp.MatchString(table) {
+		return nil, xerrors.Errorf("bad sql table name: '%v'", table)
+	}
+
+	queries, err := newSQLQueries(driver, table)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, xerrors.Errorf("open sql database with driver '%v': %w", driver, err)
+	}
+
+	c := &SQLCache{db: db, driver: driver, table: table, queries: queries}
+	if err = c.init(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newSQLQueries(driver, table string) (sqlQueries, error) {
+	var blobType string
+	var placeholder func(n int) string
+	switch driver {
+	case SQLDriverPostgres:
+		blobType = "BYTEA"
+		placeholder = func(n int) string { return "$" + strconv.Itoa(n) }
+	case SQLDriverSQLite:
+		blobType = "BLOB"
+		placeholder = func(int) string { return "?" }
+	default:
+		return sqlQueries{}, xerrors.Errorf("unsupported sql driver: '%v'", driver)
+	}
+
+	return sqlQueries{
+		createTable: "CREATE TABLE IF NOT EXISTS " + table + " (" +
+			"name VARCHAR(1024) NOT NULL PRIMARY KEY, " +
+			"data " + blobType + " NOT NULL, " +
+			"updated_at TIMESTAMP NOT NULL)",
+		get: "SELECT data FROM " + table + " WHERE name = " + placeholder(1),
+		put: "INSERT INTO " + table + " (name, data, updated_at) VALUES (" +
+			placeholder(1) + ", " + placeholder(2) + ", " + placeholder(3) + ") " +
+			"ON CONFLICT (name) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at",
+		delete: "DELETE FROM " + table + " WHERE name = " + placeholder(1),
+		keys:   "SELECT name FROM " + table + " ORDER BY name",
+		create: "INSERT INTO " + table + " (name, data, updated_at) VALUES (" +
+			placeholder(1) + ", " + placeholder(2) + ", " + placeholder(3) + ") " +
+			"ON CONFLICT (name) DO NOTHING",
+		compareAndSwap: "UPDATE " + table + " SET data = " + placeholder(1) + ", updated_at = " + placeholder(2) +
+			" WHERE name = " + placeholder(3) + " AND data = " + placeholder(4),
+		compareAndDelete: "DELETE FROM " + table + " WHERE name = " + placeholder(1) + " AND data = " + placeholder(2),
+	}, nil
+}
+
+func (c *SQLCache) init(ctx context.Context) error {
+	if err := c.db.PingContext(ctx); err != nil {
+		return xerrors.Errorf("connect to sql database: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, c.queries.createTable); err != nil {
+		return xerrors.Errorf("create sql storage table '%v': %w", c.table, err)
+	}
+	return nil
+}
+
+func (c *SQLCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var res []byte
+	err := c.db.QueryRowContext(ctx, c.queries.get, key).Scan(&res)
+
+	logLevel := zapcore.DebugLevel
+	switch {
+	case err == sql.ErrNoRows:
+		res, err = nil, ErrCacheMiss
+	case err != nil:
+		logLevel = zapcore.ErrorLevel
+	}
+
+	log.LevelParamCtx(ctx, logLevel, "Got from sql cache", zap.String("table", c.table), zap.String("key", key),
+		zap.Error(err))
+	return res, err
+}
+
+func (c *SQLCache) Put(ctx context.Context, key string, data []byte) error {
+	zc.L(ctx).Debug("Put to sql cache", zap.String("table", c.table), zap.String("key", key))
+	if data == nil {
+		data = []byte{}
+	}
+	_, err := c.db.ExecContext(ctx, c.queries.put, key, data, time.Now().UTC())
+	log.DebugErrorCtx(ctx, err, "Put to sql cache result.", zap.String("table", c.table), zap.String("key", key))
+	return err
+}
+
+func (c *SQLCache) Delete(ctx context.Context, key string) error {
+	zc.L(ctx).Debug("Delete from sql cache", zap.String("table", c.table), zap.String("key", key))
+	_, err := c.db.ExecContext(ctx, c.queries.delete, key)
+	log.DebugErrorCtx(ctx, err, "Delete from sql cache result", zap.String("table", c.table), zap.String("key", key))
+	return err
+}
+
+func (c *SQLCache) Create(ctx context.Context, key string, data []byte) error {
+	zc.L(ctx).Debug("Create in sql cache", zap.String("table", c.table), zap.String("key", key))
+	if data == nil {
+		data = []byte{}
+	}
+	changed, err := c.exec(ctx, c.queries.create, key, data, time.Now().UTC())
+	if err == nil && !changed {
+		err = ErrKeyExists
+	}
+	log.DebugErrorCtx(ctx, err, "Create in sql cache result.", zap.String("table", c.table), zap.String("key", key))
+	return err
+}
+
+func (c *SQLCache) CompareAndSwap(ctx context.Context, key string, oldData, newData []byte) error {
+	zc.L(ctx).Debug("Compare and swap in sql cache", zap.String("table", c.table), zap.String("key", key))
+	if newData == nil {
+		newData = []byte{}
+	}
+	if oldData == nil {
+		oldData = []byte{}
+	}
+	changed, err := c.exec(ctx, c.queries.compareAndSwap, newData, time.Now().UTC(), key, oldData)
+	if err == nil && !changed {
+		err = ErrValueChanged
+	}
+	log.DebugErrorCtx(ctx, err, "Compare and swap in sql cache result.", zap.String("table", c.table), zap.String("key", key))
+	return err
+}
+
+func (c *SQLCache) CompareAndDelete(ctx context.Context, key string, oldData []byte) error {
+	zc.L(ctx).Debug("Compare and delete from sql cache", zap.String("table", c.table), zap.String("key", key))
+	if oldData == nil {
+		oldData = []byte{}
+	}
+	changed, err := c.exec(ctx, c.queries.compareAndDelete, key, oldData)
+	if err == nil && !changed {
+		// deleted already or has other value
+		_, err = c.Get(ctx, key)
+		switch err {
+		case ErrCacheMiss:
+			err = nil
+		case nil:
+			err = ErrValueChanged
+		}
+	}
+	log.DebugErrorCtx(ctx, err, "Compare and delete from sql cache result.", zap.String("table", c.table), zap.String("key", key))
+	return err
+}
+
+func (c *SQLCache) Keys(ctx context.Context) (keys []string, err error) {
+	defer func() {
+		log.DebugErrorCtx(ctx, err, "List keys of sql cache", zap.String("table", c.table),
+			zap.Int("keys_count", len(keys)))
+	}()
+
+	rows, err := c.db.QueryContext(ctx, c.queries.keys)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// exec query and return true if it changed any row
+func (c *SQLCache) exec(ctx context.Context, query string, args ...interface{}) (bool, error) {
+	res, err := c.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// Close database connections
+func (c *SQLCache) Close() error {
+	return c.db.Close()
+}
@@ -0,0 +1,9 @@
+//go:build cgo
+// +build cgo
+
+package cache
+
+import (
+	// sqlite driver for database/sql, it need cgo
+	_ "github.com/mattn/go-sqlite3"
+)
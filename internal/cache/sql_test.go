@@ -0,0 +1,113 @@
+//go:build cgo
+// +build cgo
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestSQLCache(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	dsn := "file:" + filepath.Join(th.TmpDir(e), "storage.sqlite")
+	c, err := NewSQLCache(ctx, SQLDriverSQLite, dsn, "")
+	e.CmpNoError(err)
+	defer func() { _ = c.Close() }()
+
+	const key = "asd.ru.rsa.cer"
+	res, err := c.Get(ctx, key)
+	e.Len(res, 0)
+	e.Cmp(err, ErrCacheMiss)
+
+	e.CmpNoError(c.Put(ctx, key, []byte("aaa")))
+	res, err = c.Get(ctx, key)
+	e.CmpNoError(err)
+	e.Cmp(res, []byte("aaa"))
+
+	// overwrite
+	e.CmpNoError(c.Put(ctx, key, []byte("bbb")))
+	res, err = c.Get(ctx, key)
+	e.CmpNoError(err)
+	e.Cmp(res, []byte("bbb"))
+
+	// empty value is not cache miss
+	e.CmpNoError(c.Put(ctx, "empty", nil))
+	res, err = c.Get(ctx, "empty")
+	e.CmpNoError(err)
+	e.Len(res, 0)
+
+	e.CmpNoError(c.Delete(ctx, key))
+	e.CmpNoError(c.Delete(ctx, "non-existed-key"))
+
+	_, err = c.Get(ctx, key)
+	e.Cmp(err, ErrCacheMiss)
+
+	// data saved between connections
+	e.CmpNoError(c.Put(ctx, "_wildcard.asd.ru.lock", []byte("lock")))
+	c2, err := NewSQLCache(ctx, SQLDriverSQLite, dsn, "")
+	e.CmpNoError(err)
+	defer func() { _ = c2.Close() }()
+
+	res, err = c2.Get(ctx, "_wildcard.asd.ru.lock")
+	e.CmpNoError(err)
+	e.Cmp(res, []byte("lock"))
+}
+
+func TestSQLCache_Atomic(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	c, err := NewSQLCache(ctx, SQLDriverSQLite, "file:"+filepath.Join(th.TmpDir(e), "storage.sqlite"), "")
+	e.CmpNoError(err)
+	defer func() { _ = c.Close() }()
+
+	testAtomic(ctx, e, c)
+}
+
+func TestSQLCache_Keys(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	c, err := NewSQLCache(ctx, SQLDriverSQLite, "file:"+filepath.Join(th.TmpDir(e), "storage.sqlite"), "")
+	e.CmpNoError(err)
+	defer func() { _ = c.Close() }()
+
+	testLister(ctx, e, c)
+}
+
+func TestNewSQLCacheErrors(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	_, err := NewSQLCache(ctx, "unknown", "", "")
+	e.CmpError(err)
+
+	_, err = NewSQLCache(ctx, SQLDriverSQLite, ":memory:", "bad table")
+	e.CmpError(err)
+}
+
+func TestConfig_CreateStorage(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	dir := filepath.Join(th.TmpDir(e), "storage")
+	storage, err := (&Config{}).CreateStorage(ctx, dir)
+	e.CmpNoError(err)
+	e.Cmp(storage, &DiskCache{Dir: dir})
+	_, err = os.Stat(dir)
+	e.CmpNoError(err)
+
+	storage, err = (&Config{Type: "sql", SQLDriver: SQLDriverSQLite, SQLDSN: ":memory:"}).CreateStorage(ctx, dir)
+	e.CmpNoError(err)
+	e.Isa(storage, &SQLCache{})
+	_ = storage.(*SQLCache).Close()
+
+	_, err = (&Config{Type: "bad"}).CreateStorage(ctx, dir)
+	e.CmpError(err)
+}
@@ -120,3 +120,11 @@ func (s *certState) GetUseAsIs() bool {
 
 	return s.useAsIs
 }
+
+// IssueInfo return true if issue in process and error of last issue.
+func (s *certState) IssueInfo() (issuing bool, lastError error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.issueContext != nil, s.lastError
+}
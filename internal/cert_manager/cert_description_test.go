@@ -25,6 +25,12 @@ func TestCertDescription_KeyStoreName(t *testing.T) {
 	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}.KeyStoreName(), "asd.ru.rsa.key")
 }
 
+func TestCertDescription_IssueLeaseName(t *testing.T) {
+	td := testdeep.NewT(t)
+	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}.IssueLeaseName(), "asd.ru.rsa.issue.lease")
+	td.Cmp(CertDescription{MainDomain: "*.asd.ru", KeyType: KeyECDSA}.IssueLeaseName(), "_wildcard.asd.ru.ecdsa.issue.lease")
+}
+
 func TestCertDescription_LockName(t *testing.T) {
 	td := testdeep.NewT(t)
 	td.Cmp(CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}.LockName(), "asd.ru.lock")
@@ -45,3 +51,60 @@ func TestCertDescription_ZapField(t *testing.T) {
 	cd := CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}
 	td.Cmp(cd.ZapField(), zap.Stringer("cert_name", cd))
 }
+
+func TestCertDescription_Wildcard(t *testing.T) {
+	td := testdeep.NewT(t)
+	cd := CertDescription{MainDomain: "*.asd.ru", KeyType: KeyRSA}
+	td.True(cd.IsWildcard())
+	td.Cmp(cd.CertStoreName(), "_wildcard.asd.ru.rsa.cer")
+	td.Cmp(cd.KeyStoreName(), "_wildcard.asd.ru.rsa.key")
+	td.Cmp(cd.MetaStoreName(), "_wildcard.asd.ru.rsa.json")
+	td.Cmp(cd.LockName(), "_wildcard.asd.ru.lock")
+	td.Cmp(cd.String(), "*.asd.ru.rsa")
+	td.Cmp(cd.DomainNames(), []domain.DomainName{"*.asd.ru"})
+
+	td.False(CertDescription{MainDomain: "asd.ru"}.IsWildcard())
+}
+
+func TestCertDescriptionFromDomain(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	subdomains := []string{"www."}
+	zones := []string{"zone.ru"}
+
+	td.Cmp(CertDescriptionFromDomain("asd.ru", KeyRSA, subdomains, zones),
+		CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA, Subdomains: subdomains})
+	td.Cmp(CertDescriptionFromDomain("www.asd.ru", KeyECDSA, subdomains, zones),
+		CertDescription{MainDomain: "asd.ru", KeyType: KeyECDSA, Subdomains: subdomains})
+	td.Cmp(CertDescriptionFromDomain("test.zone.ru", KeyRSA, subdomains, zones),
+		CertDescription{MainDomain: "*.zone.ru", KeyType: KeyRSA})
+	td.Cmp(CertDescriptionFromDomain("www.zone.ru", KeyRSA, subdomains, zones),
+		CertDescription{MainDomain: "*.zone.ru", KeyType: KeyRSA})
+
+	// wildcard doesn't cover zone itself and second level subdomains
+	td.Cmp(CertDescriptionFromDomain("zone.ru", KeyRSA, subdomains, zones),
+		CertDescription{MainDomain: "zone.ru", KeyType: KeyRSA, Subdomains: subdomains})
+	td.Cmp(CertDescriptionFromDomain("www.test.zone.ru", KeyRSA, subdomains, zones),
+		CertDescription{MainDomain: "test.zone.ru", KeyType: KeyRSA, Subdomains: subdomains})
+	td.Cmp(CertDescriptionFromDomain("testzone.ru", KeyRSA, subdomains, zones),
+		CertDescription{MainDomain: "testzone.ru", KeyType: KeyRSA, Subdomains: subdomains})
+}
+
+func TestCertDescriptionFromCertStoreName(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	for _, cd := range []CertDescription{
+		{MainDomain: "asd.ru", KeyType: KeyRSA, Subdomains: []string{"www."}},
+		{MainDomain: "asd.ru", KeyType: KeyECDSA, Subdomains: []string{"www."}},
+		{MainDomain: "*.asd.ru", KeyType: KeyRSA},
+	} {
+		res, ok := certDescriptionFromCertStoreName(cd.CertStoreName(), []string{"www."})
+		td.True(ok, cd.String())
+		td.Cmp(res, cd)
+	}
+
+	for _, name := range []string{"asd.ru.rsa.key", "asd.ru.lock", "asd.ru.dsa.cer", "rsa.cer", "asd.ru.rsa.json"} {
+		_, ok := certDescriptionFromCertStoreName(name, nil)
+		td.False(ok, name)
+	}
+}
@@ -9,6 +9,13 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	wildcardPrefix = "*."
+
+	// wildcardStorePrefix replace "*." in store names, because star symbol not allowed in filenames on some systems
+	wildcardStorePrefix = "_wildcard."
+)
+
 type CertDescription struct {
 	MainDomain string
 	KeyType    KeyType
@@ -16,7 +23,7 @@ type CertDescription struct {
 }
 
 func (n CertDescription) CertStoreName() string {
-	return n.MainDomain + "." + n.KeyType.String() + ".cer"
+	return n.storeName() + "." + n.KeyType.String() + ".cer"
 }
 
 func (n CertDescription) DomainNames() []domain.DomainName {
@@ -29,15 +36,64 @@ func (n CertDescription) DomainNames() []domain.DomainName {
 }
 
 func (n CertDescription) KeyStoreName() string {
-	return n.MainDomain + "." + n.KeyType.String() + ".key"
+	return n.storeName() + "." + n.KeyType.String() + ".key"
+}
+
+// IssueLeaseName is key of distributed lease, which hold while certificate issue in process
+func (n CertDescription) IssueLeaseName() string {
+	return n.storeName() + "." + n.KeyType.String() + ".issue.lease"
 }
 
 func (n CertDescription) LockName() string {
-	return n.MainDomain + ".lock"
+	return n.storeName() + ".lock"
+}
+
+// OCSPStoreName is key of last ocsp response for the certificate
+func (n CertDescription) OCSPStoreName() string {
+	return n.storeName() + "." + n.KeyType.String() + ".ocsp"
 }
 
 func (n CertDescription) MetaStoreName() string {
-	return n.MainDomain + "." + n.KeyType.String() + ".json"
+	return n.storeName() + "." + n.KeyType.String() + ".json"
+}
+
+// IsWildcard return true for description of wildcard certificate for a zone
+func (n CertDescription) IsWildcard() bool {
+	return strings.HasPrefix(n.MainDomain, wildcardPrefix)
+}
+
+func (n CertDescription) storeName() string {
+	if n.IsWildcard() {
+		return wildcardStorePrefix + strings.TrimPrefix(n.MainDomain, wildcardPrefix)
+	}
+	return n.MainDomain
+}
+
+// certDescriptionFromCertStoreName parse name of stored certificate, reverse of CertStoreName.
+// It return false if the name isn't name of certificate.
+func certDescriptionFromCertStoreName(name string, autoSubdomains []string) (CertDescription, bool) {
+	const certSuffix = ".cer"
+	if !strings.HasSuffix(name, certSuffix) {
+		return CertDescription{}, false
+	}
+	name = strings.TrimSuffix(name, certSuffix)
+
+	dotIndex := strings.LastIndex(name, ".")
+	if dotIndex <= 0 {
+		return CertDescription{}, false
+	}
+	mainDomain, keyType := name[:dotIndex], KeyType(name[dotIndex+1:])
+	if keyType != KeyRSA && keyType != KeyECDSA {
+		return CertDescription{}, false
+	}
+
+	if strings.HasPrefix(mainDomain, wildcardStorePrefix) {
+		return CertDescription{
+			MainDomain: wildcardPrefix + strings.TrimPrefix(mainDomain, wildcardStorePrefix),
+			KeyType:    keyType,
+		}, true
+	}
+	return CertDescription{MainDomain: mainDomain, KeyType: keyType, Subdomains: autoSubdomains}, true
 }
 
 func (n CertDescription) String() string {
@@ -48,8 +104,19 @@ func (n CertDescription) ZapField() zap.Field {
 	return zap.Stringer("cert_name", n)
 }
 
-func CertDescriptionFromDomain(domain domain.DomainName, keyType KeyType, autoSubDomains []string) CertDescription {
+// CertDescriptionFromDomain return description of certificate for the domain.
+// Domains from one of wildcardZones (without "*." prefix) map to shared wildcard certificate of the zone.
+func CertDescriptionFromDomain(domain domain.DomainName, keyType KeyType, autoSubDomains []string, wildcardZones []string) CertDescription {
 	mainDomain := domain.String()
+	for _, zone := range wildcardZones {
+		if isDomainInWildcardZone(mainDomain, zone) {
+			return CertDescription{
+				MainDomain: wildcardPrefix + zone,
+				KeyType:    keyType,
+			}
+		}
+	}
+
 	for _, subdomain := range autoSubDomains {
 		if strings.HasPrefix(mainDomain, subdomain) {
 			mainDomain = strings.TrimPrefix(mainDomain, subdomain)
@@ -62,3 +129,22 @@ func CertDescriptionFromDomain(domain domain.DomainName, keyType KeyType, autoSu
 		Subdomains: autoSubDomains,
 	}
 }
+
+// isDomainInWildcardZone return true if wildcard certificate for zone is valid for the domain.
+// Wildcard valid for one label only: *.example.com valid for test.example.com, but not for example.com
+// and www.test.example.com
+func isDomainInWildcardZone(domain, zone string) bool {
+	if zone == "" || !strings.HasSuffix(domain, "."+zone) {
+		return false
+	}
+	label := strings.TrimSuffix(domain, "."+zone)
+	return label != "" && !strings.Contains(label, ".")
+}
+
+// isWildcardCoverDomain return true if wildcard name (as *.example.com) is valid for the domain
+func isWildcardCoverDomain(wildcard, name domain.DomainName) bool {
+	if !strings.HasPrefix(wildcard.String(), wildcardPrefix) {
+		return false
+	}
+	return isDomainInWildcardZone(name.String(), strings.TrimPrefix(wildcard.String(), wildcardPrefix))
+}
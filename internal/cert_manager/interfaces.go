@@ -4,7 +4,9 @@ package cert_manager
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 
+	"github.com/rekby/lets-proxy2/internal/ari"
 	"golang.org/x/crypto/acme"
 )
 
@@ -19,6 +21,7 @@ type AcmeClient interface {
 	Accept(ctx context.Context, chal *acme.Challenge) (*acme.Challenge, error)
 	AuthorizeOrder(ctx context.Context, id []acme.AuthzID, opt ...acme.OrderOption) (*acme.Order, error)
 	CreateOrderCert(ctx context.Context, url string, csr []byte, bundle bool) (der [][]byte, certURL string, err error)
+	DNS01ChallengeRecord(token string) (string, error)
 	GetAuthorization(ctx context.Context, url string) (*acme.Authorization, error)
 	HTTP01ChallengeResponse(token string) (string, error)
 	RevokeAuthorization(ctx context.Context, url string) error
@@ -27,6 +30,26 @@ type AcmeClient interface {
 	WaitOrder(ctx context.Context, url string) (*acme.Order, error)
 }
 
+// DNSProvider publish and remove TXT records for dns-01 challenge
+type DNSProvider interface {
+	// Present create TXT record with value for fqdn
+	Present(ctx context.Context, fqdn, value string) error
+
+	// CleanUp remove TXT record, created by Present
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// DNSTXTResolver used for check dns-01 record propagation
+type DNSTXTResolver interface {
+	LookupTXT(ctx context.Context, host string) ([]string, error)
+}
+
+// RenewalInfoGetter return renewal window of the certificate, suggested by acme server (ARI, RFC 9773)
+type RenewalInfoGetter interface {
+	// GetRenewalInfo must return ari.ErrNotSupported if acme server doesn't support renewal info
+	GetRenewalInfo(ctx context.Context, cert *x509.Certificate) (ari.RenewalInfo, error)
+}
+
 type AcmeClientManager interface {
 	Close() error
 	GetClient(ctx context.Context) (client *acme.Client, clientDisableFunc func(), err error)
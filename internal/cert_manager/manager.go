@@ -32,6 +32,7 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/lease"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/rekby/lets-proxy2/internal/log"
@@ -44,7 +45,11 @@ import (
 const (
 	tlsAlpn01     = "tls-alpn-01"
 	http01        = "http-01"
+	dns01         = "dns-01"
 	httpWellKnown = "/.well-known/acme-challenge/"
+	dnsRecordName = "_acme-challenge."
+
+	acmeErrorPrefix = "urn:ietf:params:acme:error:"
 )
 
 var (
@@ -60,14 +65,28 @@ func init() {
 }
 
 const domainKeyRSALength = 2048
+const defaultRenewBeforeExpireRatio = 1.0 / 3
+
+// renewBeforeExpire used instead of ratio if lifetime of certificate unknown
 const renewBeforeExpire = time.Hour * 24 * 30
 const revokeAuthorizationTimeout = 5 * time.Minute
 const cleanupTimeout = time.Minute
+const defaultDNSPropagationTimeout = 2 * time.Minute
+const defaultDNSPropagationInterval = 5 * time.Second
+const defaultIssueLeasePollInterval = 5 * time.Second
+
+// wildcardDomainAllowedTTL is time of cache decision of domain checker for domains with wildcard certificate
+const wildcardDomainAllowedTTL = time.Minute
 
 var errHaveNoCert = errors.New("have no certificate for domain") // may return for any internal error
 var errRSADenied = xerrors.New("RSA certificate denied by config")
 var errECDSADenied = xerrors.New("ECDSA certificate denied by config")
 var errCertTypeUnknown = xerrors.New("unknown cert type")
+var errChallengeTypeUnknown = xerrors.New("unknown challenge type")
+
+var errDNSProviderNotSet = xerrors.New("dns provider doesn't set")
+
+var defaultChallengeTypesOrder = []string{tlsAlpn01, http01, dns01}
 
 type GetContext interface {
 	GetContext() context.Context
@@ -102,10 +121,16 @@ type Manager struct {
 	// Every subdomain must have suffix dot. For example: "www."
 	AutoSubdomains []string
 
-	acmeClientManager       AcmeClientManager
+	acmeClientManager AcmeClientManager
+
+	// FallbackAcmeClientManagers are clients of other acme servers. They tried in same order
+	// if acme server rejects order or returns rate limit error.
+	FallbackAcmeClientManagers []AcmeClientManager
+
 	DomainChecker           DomainChecker
 	EnableHTTPValidation    bool
 	EnableTLSValidation     bool
+	EnableDNSValidation     bool
 	SaveJSONMeta            bool
 	AllowECDSACert          bool
 	AllowRSACert            bool
@@ -118,9 +143,75 @@ type Manager struct {
 
 	httpTokens cache.Bytes
 
+	// DNSProvider used for publish dns-01 records, dns-01 validation disabled if nil
+	DNSProvider DNSProvider
+
+	// DNSPropagationResolvers must see dns-01 record before accept challenge.
+	// Check skipped if empty.
+	DNSPropagationResolvers []DNSTXTResolver
+	DNSPropagationTimeout   time.Duration
+	DNSPropagationInterval  time.Duration
+
+	// order of try challenges, nil mean default order
+	challengeTypesOrder []string
+
+	// normalized zones for wildcard certificates, without "*." prefix
+	wildcardZones []string
+
+	// wildcardDomainAllowed cache decisions of DomainChecker for domains with wildcard certificate,
+	// for doesn't check domain on every handshake
+	wildcardDomainAllowed cache.Value
+
+	// IssueLocker take lease in shared storage before issue certificate, for prevent issue same certificate
+	// by some lets-proxy instances. Disabled if nil.
+	IssueLocker *lease.Locker
+
+	// Interval for check storage for certificate, issued by other instance
+	IssueLeasePollInterval time.Duration
+
+	// RenewBeforeExpireRatio is part of certificate lifetime before expire, when certificate need renew.
+	// For example 0.33 for certificate, valid 90 days, mean renew 30 days before expire.
+	RenewBeforeExpireRatio float64
+
+	// RenewCheckInterval, RenewConcurrency and RenewJitter are settings of background renew scheduler,
+	// see StartRenewScheduler
+	RenewCheckInterval time.Duration
+	RenewConcurrency   int
+	RenewJitter        time.Duration
+
+	renewSchedulerStarted int32
+
+	// RenewalInfo used by background renew scheduler for get renew window, suggested by acme server.
+	// Renew window calculated by RenewBeforeExpireRatio if RenewalInfo is nil or acme server doesn't support it.
+	RenewalInfo RenewalInfoGetter
+
+	// RenewalInfoByServer are renewal info getters by directory url of acme server, for certificates,
+	// issued by fallback acme servers. If it set - acme server of issued certificates saved in json metadata
+	// and renewal info requested from the server. RenewalInfo used for certificates with unknown acme server.
+	RenewalInfoByServer map[string]RenewalInfoGetter
+
+	renewalSchedule cache.Value
+
+	// StaticCertificates used before issued certificates if it has valid certificate for the domain
+	StaticCertificates *StaticCertificates
+
+	// EnableOCSPStapling fetch ocsp responses for certificates in background and attach them to tls handshakes
+	EnableOCSPStapling bool
+	OCSPHTTPClient     *http.Client
+
+	ocspStaples cache.Value
+	ocspUpdates ocspUpdates
+
+	issuesMu      sync.Mutex
+	issuesRunning int
+	issuesIdle    chan struct{} // closed when no running issues
+
 	// metrics
 	handleCertStart, certRequestStart   metrics.ProcessStartFunc
 	handleCertFinish, certRequestFinish metrics.ProcessFinishFunc
+	ocspRequestStart                    metrics.ProcessStartFunc
+	ocspRequestFinish                   metrics.ProcessFinishFunc
+	ocspStapleStatus                    *prometheus.CounterVec
 }
 
 func New(acmeClientManager AcmeClientManager, c cache.Bytes, r prometheus.Registerer) *Manager {
@@ -128,6 +219,9 @@ func New(acmeClientManager AcmeClientManager, c cache.Bytes, r prometheus.Regist
 	res.acmeClientManager = acmeClientManager
 	res.certForDomainAuthorize = cache.NewMemoryValueLRU("authcert")
 	res.certState = cache.NewMemoryValueLRU("certstate")
+	res.renewalSchedule = cache.NewMemoryValueLRU("renewalschedule")
+	res.wildcardDomainAllowed = cache.NewMemoryValueLRU("wildcarddomainallowed")
+	res.ocspStaples = cache.NewMemoryValueLRU("ocspstaples")
 	res.CertificateIssueTimeout = time.Minute
 	res.httpTokens = cache.NewMemoryCache("Http validation tokens")
 	res.Cache = c
@@ -135,6 +229,12 @@ func New(acmeClientManager AcmeClientManager, c cache.Bytes, r prometheus.Regist
 	res.DomainChecker = managerDefaults{}
 	res.AllowRSACert = true
 	res.AllowECDSACert = true
+	res.DNSPropagationTimeout = defaultDNSPropagationTimeout
+	res.DNSPropagationInterval = defaultDNSPropagationInterval
+	res.IssueLeasePollInterval = defaultIssueLeasePollInterval
+	res.RenewBeforeExpireRatio = defaultRenewBeforeExpireRatio
+	res.RenewCheckInterval = defaultRenewCheckInterval
+	res.RenewConcurrency = defaultRenewConcurrency
 
 	res.initMetrics(r)
 	return &res
@@ -167,6 +267,11 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (resultCert *tls.Ce
 		return m.handleTLSALPN(ctx, needDomain)
 	}
 
+	if cert := m.StaticCertificates.GetCertificate(needDomain, supportsECDSA(hello)); cert != nil {
+		logger.Debug("Use static certificate", log.Cert(cert))
+		return cert, nil
+	}
+
 	certType := KeyRSA
 	if supportsECDSA(hello) {
 		certType = KeyECDSA
@@ -184,31 +289,37 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (resultCert *tls.Ce
 
 //nolint:funlen,gocognit
 func (m *Manager) getCertificate(ctx context.Context, needDomain domain.DomainName, certType KeyType) (resultCert *tls.Certificate, err error) {
-	switch certType {
-	case KeyRSA:
-		if !m.AllowRSACert {
-			return nil, errRSADenied
-		}
-	case KeyECDSA:
-		if !m.AllowECDSACert {
-			return nil, errECDSADenied
-		}
-	default:
-		return nil, errCertTypeUnknown
+	if err = m.checkKeyTypeAllowed(certType); err != nil {
+		return nil, err
 	}
 
-	certDescription := CertDescriptionFromDomain(needDomain, certType, m.AutoSubdomains)
+	certDescription := CertDescriptionFromDomain(needDomain, certType, m.AutoSubdomains, m.wildcardZones)
 
 	logger := zc.L(ctx).With(certDescription.ZapField())
 	ctx = zc.WithLogger(ctx, zc.L(ctx).With(certDescription.ZapField()))
 
 	now := time.Now()
 
+	if certDescription.IsWildcard() {
+		// shared wildcard certificate must not be used for domains, denied by checker
+		allowed, err := m.isDomainAllowedForWildcard(ctx, needDomain, now)
+		log.DebugError(logger, err, "Check if domain allowed for wildcard certificate", zap.Bool("allowed", allowed))
+		if err != nil || !allowed {
+			return nil, errHaveNoCert
+		}
+	}
+
 	var locked = false
 	var lockedChecked = false
 
 	defer func() {
-		if isNeedRenew(resultCert, now) {
+		if err == nil {
+			resultCert = m.attachOCSPStaple(ctx, certDescription, resultCert)
+		}
+	}()
+
+	defer func() {
+		if m.isCertNeedRenew(ctx, certDescription, resultCert, now) && !m.isRenewSchedulerStarted() {
 			if !lockedChecked {
 				locked, err = isCertLocked(ctx, m.Cache, certDescription)
 				log.DebugError(logger, err, "Check locked before renew", zap.Bool("locked", locked))
@@ -340,13 +451,20 @@ func filterDomains(ctx context.Context, checker DomainChecker, originalDomains [
 			defer wg.Done()
 			defer log.HandlePanic(logger)
 
-			allow, err := checker.IsDomainAllowed(ctx, d.ASCII())
+			var allow bool
+			var err error
+			if isWildcardCoverDomain(d, needDomain) {
+				// wildcard can't be checked itself, it allowed by checked need domain
+				allow = true
+			} else {
+				allow, err = checker.IsDomainAllowed(ctx, d.ASCII())
+			}
 			logger.Debug("Check domain", domain.LogDomain(d), zap.Bool("allowed", allow), zap.Error(err))
 			if !allow {
 				return
 			}
 
-			if d == needDomain {
+			if d == needDomain || isWildcardCoverDomain(d, needDomain) {
 				hasNeedDomain = true
 			}
 
@@ -368,6 +486,32 @@ func filterDomains(ctx context.Context, checker DomainChecker, originalDomains [
 	return res, nil
 }
 
+// domainAllowedDecision is cached result of DomainChecker
+type domainAllowedDecision struct {
+	allowed bool
+	expire  time.Time
+}
+
+// isDomainAllowedForWildcard check domain by DomainChecker and cache the decision for wildcardDomainAllowedTTL.
+// Errors of checker doesn't cached.
+func (m *Manager) isDomainAllowedForWildcard(ctx context.Context, needDomain domain.DomainName, now time.Time) (bool, error) {
+	key := needDomain.ASCII()
+	if cached, err := m.wildcardDomainAllowed.Get(ctx, key); err == nil {
+		decision := cached.(domainAllowedDecision)
+		if now.Before(decision.expire) {
+			return decision.allowed, nil
+		}
+	}
+
+	allowed, err := m.DomainChecker.IsDomainAllowed(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	err = m.wildcardDomainAllowed.Put(ctx, key, domainAllowedDecision{allowed: allowed, expire: now.Add(wildcardDomainAllowedTTL)})
+	log.DebugError(zc.L(ctx), err, "Cache domain allowed decision")
+	return allowed, nil
+}
+
 func (m *Manager) certStateGet(ctx context.Context, cd CertDescription) *certState {
 	m.certStateMu.Lock()
 	defer m.certStateMu.Unlock()
@@ -396,15 +540,59 @@ func (m *Manager) createCertificateForDomains(ctx context.Context, cd CertDescri
 		logger.Debug("Certificate issue in process already - wait result")
 		return certState.WaitFinishIssue(waitTimeout)
 	}
+	m.issueStarted()
+	defer m.issueFinished()
+
 	// outer func need for get argument values in defer time
 	defer func() {
 		certState.FinishIssue(ctx, res, err)
 	}()
 
+	issueCtx := ctx
+	if m.IssueLocker != nil {
+		issueLease, cert, err := m.acquireIssueLease(ctx, cd, domainNames)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			logger.Info("Got certificate, issued by other instance", log.Cert(cert))
+			return cert, nil
+		}
+		defer m.releaseIssueLease(ctx, issueLease)
+		issueCtx = issueLease.Context()
+	}
+
 	logger.Debug("Start issue process")
 
+	clientManagers := append([]AcmeClientManager{m.acmeClientManager}, m.FallbackAcmeClientManagers...)
+	for index, clientManager := range clientManagers {
+		hasFallback := index < len(clientManagers)-1
+		serverCtx := zc.WithLogger(issueCtx, logger.With(zap.Int("acme_server_index", index)))
+
+		res, err := m.createCertificateByAcmeServer(serverCtx, clientManager, cd, domainNames, hasFallback)
+		switch {
+		case err == nil:
+			return res, nil
+		case hasFallback && (isErrTooManyOrders(err) || isErrOrderRejected(err)):
+			logger.Warn("Acme server rejected order, try next acme server", zap.Int("acme_server_index", index),
+				zap.Error(err))
+			continue
+		default:
+			return nil, err
+		}
+	}
+	return nil, xerrors.New("no acme servers")
+}
+
+// createCertificateByAcmeServer issue certificate by acme server of the clientManager.
+// It try next account of the server if current account has too many orders.
+// If stopOnTooManyOrders - return error instead of try next account.
+func (m *Manager) createCertificateByAcmeServer(ctx context.Context, clientManager AcmeClientManager, cd CertDescription,
+	domainNames []domain.DomainName, stopOnTooManyOrders bool) (*tls.Certificate, error) {
+	logger := zc.L(ctx)
+
 	for {
-		acmeClient, acmeClientDisableFunc, err := m.acmeClientManager.GetClient(ctx)
+		acmeClient, acmeClientDisableFunc, err := clientManager.GetClient(ctx)
 		log.DebugError(logger, err, "Get acme client")
 		if err != nil {
 			return nil, xerrors.Errorf("failed to get acme client: %w", err)
@@ -413,10 +601,18 @@ func (m *Manager) createCertificateForDomains(ctx context.Context, cd CertDescri
 		res, err := m.createOrderAndCertificate(ctx, acmeClient, cd, domainNames)
 		switch {
 		case err == nil:
+			if m.SaveJSONMeta || m.RenewalInfoByServer != nil {
+				if err = storeCertificateMeta(ctx, m.Cache, cd, res, acmeClient.DirectoryURL); err != nil {
+					return nil, err
+				}
+			}
 			return res, nil
 		case isErrTooManyOrders(err):
-			logger.Info("Too many orders, try next client")
 			acmeClientDisableFunc()
+			if stopOnTooManyOrders {
+				return nil, err
+			}
+			logger.Info("Too many orders, try next client")
 			continue
 		default:
 			return nil, err
@@ -424,13 +620,108 @@ func (m *Manager) createCertificateForDomains(ctx context.Context, cd CertDescri
 	}
 }
 
+func (m *Manager) issueStarted() {
+	m.issuesMu.Lock()
+	defer m.issuesMu.Unlock()
+
+	if m.issuesRunning == 0 {
+		m.issuesIdle = make(chan struct{})
+	}
+	m.issuesRunning++
+}
+
+func (m *Manager) issueFinished() {
+	m.issuesMu.Lock()
+	defer m.issuesMu.Unlock()
+
+	m.issuesRunning--
+	if m.issuesRunning == 0 {
+		close(m.issuesIdle)
+	}
+}
+
+// WaitIssues wait while all running certificate issues finished, or ctx done.
+// It used for graceful shutdown.
+func (m *Manager) WaitIssues(ctx context.Context) error {
+	m.issuesMu.Lock()
+	running := m.issuesRunning
+	idle := m.issuesIdle
+	m.issuesMu.Unlock()
+
+	if running == 0 {
+		return nil
+	}
+
+	zc.L(ctx).Info("Wait running certificate issues", zap.Int("count", running))
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return xerrors.Errorf("wait running certificate issues: %w", ctx.Err())
+	}
+}
+
+// acquireIssueLease take distributed lease for issue the certificate.
+// If other instance hold the lease - wait while it store certificate and return the certificate.
+func (m *Manager) acquireIssueLease(ctx context.Context, cd CertDescription, domainNames []domain.DomainName) (*lease.Lease, *tls.Certificate, error) {
+	logger := zc.L(ctx)
+
+	for {
+		issueLease, err := m.IssueLocker.TryAcquire(ctx, cd.IssueLeaseName())
+		switch {
+		case err == nil:
+			// other instance could store certificate between check storage and acquire lease
+			if cert := m.loadFreshCertificate(ctx, cd, domainNames); cert != nil {
+				m.releaseIssueLease(ctx, issueLease)
+				return nil, cert, nil
+			}
+			return issueLease, nil, nil
+		case err != lease.ErrLocked:
+			return nil, nil, xerrors.Errorf("acquire issue lease: %w", err)
+		}
+
+		logger.Debug("Certificate issue in process by other instance - wait result")
+		if cert := m.loadFreshCertificate(ctx, cd, domainNames); cert != nil {
+			return nil, cert, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, xerrors.Errorf("wait certificate from other instance: %w", ctx.Err())
+		case <-time.After(m.IssueLeasePollInterval):
+		}
+	}
+}
+
+func (m *Manager) releaseIssueLease(ctx context.Context, issueLease *lease.Lease) {
+	releaseCtx, cancel := context.WithTimeout(contexthelper.DropCancelContext(ctx), cleanupTimeout)
+	defer cancel()
+
+	_ = issueLease.Release(releaseCtx)
+}
+
+// loadFreshCertificate return certificate from storage if it valid for all domains and doesn't need renew
+func (m *Manager) loadFreshCertificate(ctx context.Context, cd CertDescription, domainNames []domain.DomainName) *tls.Certificate {
+	cert, err := loadCertificateFromCache(ctx, m.Cache, cd)
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	cert, err = validCertDer(domainNames, cert.Certificate, cert.PrivateKey, false, now)
+	if err != nil || isNeedRenew(cert, now, m.RenewBeforeExpireRatio) || m.isOCSPRevoked(ctx, cd, cert.Leaf) {
+		return nil
+	}
+	return cert
+}
+
 func (m *Manager) createOrderAndCertificate(ctx context.Context, acmeClient AcmeClient, cd CertDescription, domainNames []domain.DomainName) (*tls.Certificate, error) {
 	logger := zc.L(ctx)
 
 	order, err := m.createOrderForDomains(ctx, acmeClient, domainNames...)
 	log.DebugWarning(logger, err, "Domains authorized")
 	if err != nil {
-		return nil, errors.New("order authorization error")
+		return nil, xerrors.Errorf("order authorization error: %w", err)
 	}
 
 	res, err := m.issueCertificate(ctx, acmeClient, cd, order)
@@ -438,13 +729,101 @@ func (m *Manager) createOrderAndCertificate(ctx context.Context, acmeClient Acme
 	return res, err
 }
 
+// SetChallengeTypes enable challenge types from list and disable all other.
+// Challenges will be tried in same order as in the list.
+func (m *Manager) SetChallengeTypes(challengeTypes []string) error {
+	if len(challengeTypes) == 0 {
+		return xerrors.New("empty challenge types list")
+	}
+
+	var enableTLS, enableHTTP, enableDNS bool
+	order := make([]string, 0, len(challengeTypes))
+	for _, challengeType := range challengeTypes {
+		challengeType = strings.ToLower(strings.TrimSpace(challengeType))
+		switch challengeType {
+		case tlsAlpn01:
+			if enableTLS {
+				continue
+			}
+			enableTLS = true
+		case http01:
+			if enableHTTP {
+				continue
+			}
+			enableHTTP = true
+		case dns01:
+			if enableDNS {
+				continue
+			}
+			if m.DNSProvider == nil {
+				return xerrors.Errorf("%w: '%v'", errDNSProviderNotSet, challengeType)
+			}
+			enableDNS = true
+		default:
+			return xerrors.Errorf("%w: '%v'", errChallengeTypeUnknown, challengeType)
+		}
+		order = append(order, challengeType)
+	}
+
+	m.EnableTLSValidation = enableTLS
+	m.EnableHTTPValidation = enableHTTP
+	m.EnableDNSValidation = enableDNS
+	m.challengeTypesOrder = order
+	return nil
+}
+
+// SetWildcardZones set zones for issue wildcard certificates.
+// Every domain from a zone will use shared wildcard certificate of the zone instead of own certificate.
+// Zone can be set with or without "*." prefix. Wildcard certificates need dns-01 challenge.
+func (m *Manager) SetWildcardZones(zones []string) error {
+	res := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		zone = strings.TrimPrefix(strings.TrimSpace(zone), wildcardPrefix)
+		normalized, err := domain.NormalizeDomain(zone)
+		if err != nil {
+			return xerrors.Errorf("normalize wildcard zone '%v': %w", zone, err)
+		}
+		if normalized == "" {
+			return xerrors.New("empty wildcard zone")
+		}
+		res = append(res, normalized.String())
+	}
+	m.wildcardZones = res
+	return nil
+}
+
+func (m *Manager) checkKeyTypeAllowed(keyType KeyType) error {
+	switch keyType {
+	case KeyRSA:
+		if !m.AllowRSACert {
+			return errRSADenied
+		}
+	case KeyECDSA:
+		if !m.AllowECDSACert {
+			return errECDSADenied
+		}
+	default:
+		return errCertTypeUnknown
+	}
+	return nil
+}
+
 func (m *Manager) supportedChallenges() []string {
-	var allowedChallenges []string
-	if m.EnableTLSValidation {
-		allowedChallenges = append(allowedChallenges, tlsAlpn01)
+	order := m.challengeTypesOrder
+	if order == nil {
+		order = defaultChallengeTypesOrder
 	}
-	if m.EnableHTTPValidation {
-		allowedChallenges = append(allowedChallenges, http01)
+
+	var allowedChallenges []string
+	for _, challengeType := range order {
+		switch {
+		case challengeType == tlsAlpn01 && m.EnableTLSValidation:
+			allowedChallenges = append(allowedChallenges, tlsAlpn01)
+		case challengeType == http01 && m.EnableHTTPValidation:
+			allowedChallenges = append(allowedChallenges, http01)
+		case challengeType == dns01 && m.EnableDNSValidation && m.DNSProvider != nil:
+			allowedChallenges = append(allowedChallenges, dns01)
+		}
 	}
 	return allowedChallenges
 }
@@ -562,6 +941,9 @@ authorizeOrderLoop:
 				if err != nil {
 					continue authorizeOrderLoop
 				}
+
+				// domain authorized, doesn't need try other challenge types
+				continue authDomainLoop
 			}
 			if !hasCompatibleChallenge {
 				logger.Error("No compatible challenges")
@@ -620,12 +1002,6 @@ func (m *Manager) issueCertificate(ctx context.Context, acmeClient AcmeClient, c
 	if err != nil {
 		return nil, err
 	}
-	if m.SaveJSONMeta {
-		err = storeCertificateMeta(ctx, m.Cache, cd, cert)
-		if err != nil {
-			return nil, err
-		}
-	}
 	return cert, nil
 }
 
@@ -724,15 +1100,109 @@ func (m *Manager) fulfill(ctx context.Context, acmeClient AcmeClient, challenge
 		} else {
 			return nil, err
 		}
+	case dns01:
+		return m.fulfillDNS01(ctx, acmeClient, challenge, domain)
 	default:
 		logger.Error("Unknow challenge type", zap.Reflect("challenge", challenge))
 		return nil, errors.New("unknown challenge type")
 	}
 }
 
+func (m *Manager) fulfillDNS01(ctx context.Context, acmeClient AcmeClient, challenge *acme.Challenge, domain domain.DomainName) (func(context.Context), error) {
+	logger := zc.L(ctx)
+
+	if m.DNSProvider == nil {
+		return nil, errDNSProviderNotSet
+	}
+
+	value, err := acmeClient.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	fqdn := dnsChallengeFQDN(domain)
+	err = m.DNSProvider.Present(ctx, fqdn, value)
+	log.DebugError(logger, err, "Present dns-01 record", zap.String("fqdn", fqdn))
+	if err != nil {
+		return nil, err
+	}
+
+	cleanup := func(localContext context.Context) {
+		err := m.DNSProvider.CleanUp(localContext, fqdn, value)
+		log.DebugError(zc.L(localContext), err, "Clean up dns-01 record", zap.String("fqdn", fqdn))
+	}
+
+	if err = m.waitDNSPropagation(ctx, fqdn, value); err != nil {
+		cleanupCtx, cancel := context.WithTimeout(contexthelper.DropCancelContext(ctx), cleanupTimeout)
+		defer cancel()
+		cleanup(cleanupCtx)
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// waitDNSPropagation wait until all propagation resolvers see the value in TXT records of fqdn
+func (m *Manager) waitDNSPropagation(ctx context.Context, fqdn, value string) error {
+	if len(m.DNSPropagationResolvers) == 0 {
+		return nil
+	}
+
+	logger := zc.L(ctx)
+	ctx, cancel := context.WithTimeout(ctx, m.DNSPropagationTimeout)
+	defer cancel()
+
+	interval := m.DNSPropagationInterval
+	if interval <= 0 {
+		interval = defaultDNSPropagationInterval
+	}
+
+	for {
+		propagated := true
+		for _, resolver := range m.DNSPropagationResolvers {
+			if !m.isTXTRecordVisible(ctx, resolver, fqdn, value) {
+				propagated = false
+				break
+			}
+		}
+		if propagated {
+			logger.Debug("dns-01 record propagated", zap.String("fqdn", fqdn))
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Warn("dns-01 record doesn't propagated", zap.String("fqdn", fqdn), zap.Duration("timeout", m.DNSPropagationTimeout))
+			return xerrors.Errorf("wait propagation of dns record %q: %w", fqdn, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (m *Manager) isTXTRecordVisible(ctx context.Context, resolver DNSTXTResolver, fqdn, value string) bool {
+	records, err := resolver.LookupTXT(ctx, fqdn)
+	log.DebugError(zc.L(ctx), err, "Lookup dns-01 record", zap.String("fqdn", fqdn), zap.Strings("records", records))
+	if err != nil {
+		return false
+	}
+	for _, record := range records {
+		if record == value {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsChallengeFQDN return name of TXT record for dns-01 challenge of the domain
+func dnsChallengeFQDN(domain domain.DomainName) string {
+	name := strings.TrimPrefix(domain.ASCII(), "*.")
+	return dnsRecordName + name + "."
+}
+
 func (m *Manager) initMetrics(r prometheus.Registerer) {
 	m.handleCertStart, m.handleCertFinish = metrics.ToefCounters(r, "handle_cert", "handled certificates")
 	m.certRequestStart, m.certRequestFinish = metrics.ToefCounters(r, "cert_request", "request certificates from lets-encrypt")
+	m.ocspRequestStart, m.ocspRequestFinish = metrics.ToefCounters(r, "ocsp_request", "requests to ocsp responders")
+	m.ocspStapleStatus = metrics.CounterVec(r, "ocsp_staple", "ocsp staple status of handled certificates", "status")
 }
 
 func (m *Manager) isHTTPValidationRequest(r *http.Request) bool {
@@ -797,6 +1267,17 @@ func storeCertificate(ctx context.Context, cache cache.Bytes, cd CertDescription
 		return xerrors.New("Try save to locked certificate")
 	}
 
+	certBytes, privateKeyBytes, err := encodeCertificate(ctx, cert)
+	if err != nil {
+		return err
+	}
+	return putCertificate(ctx, cache, cd, certBytes, privateKeyBytes)
+}
+
+// encodeCertificate return pem encoded certificate chain and private key
+func encodeCertificate(ctx context.Context, cert *tls.Certificate) (certBytes, privateKeyBytes []byte, err error) {
+	logger := zc.L(ctx)
+
 	var keyType = getKeyType(cert)
 
 	var certBuf bytes.Buffer
@@ -805,12 +1286,10 @@ func storeCertificate(ctx context.Context, cache cache.Bytes, cd CertDescription
 		err := pem.Encode(&certBuf, &pem.Block{Type: "CERTIFICATE", Bytes: block})
 		if err != nil {
 			logger.DPanic("Can't encode pem block of certificate", zap.Error(err), zap.Binary("block", block))
-			return err
+			return nil, nil, err
 		}
 	}
 
-	var privateKeyBytes []byte
-
 	switch keyType {
 	case KeyRSA:
 		privateKey := cert.PrivateKey.(*rsa.PrivateKey)
@@ -820,18 +1299,24 @@ func storeCertificate(ctx context.Context, cache cache.Bytes, cd CertDescription
 		privateKey := cert.PrivateKey.(*ecdsa.PrivateKey)
 		keyBytes, err := x509.MarshalECPrivateKey(privateKey)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		privateKeyBytes = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
 	default:
 		logger.DPanic("Unknow private key type", zap.String("type", reflect.TypeOf(cert.PrivateKey).String()))
-		return errors.New("unknow private key type")
+		return nil, nil, errors.New("unknow private key type")
 	}
+	return certBuf.Bytes(), privateKeyBytes, nil
+}
+
+// putCertificate save encoded certificate and key to storage without checks
+func putCertificate(ctx context.Context, cache cache.Bytes, cd CertDescription, certBytes, privateKeyBytes []byte) error {
+	logger := zc.L(ctx)
 
 	certKeyName := cd.CertStoreName()
 	keyKeyName := cd.KeyStoreName()
 
-	err = cache.Put(ctx, certKeyName, certBuf.Bytes())
+	err := cache.Put(ctx, certKeyName, certBytes)
 	zc.InfoError(logger, err, "Store certificate file", zap.String("cert_key", certKeyName))
 	if err != nil {
 		return err
@@ -846,14 +1331,42 @@ func storeCertificate(ctx context.Context, cache cache.Bytes, cd CertDescription
 	return nil
 }
 
-func storeCertificateMeta(ctx context.Context, storage cache.Bytes, cd CertDescription, certificate *tls.Certificate) error {
-	info := struct {
-		Domains    []string
-		ExpireDate time.Time
-	}{
+// certificateMeta is content of json metadata file of certificate
+type certificateMeta struct {
+	Domains    []string
+	ExpireDate time.Time
+	Revocation *certificateRevocation `json:",omitempty"`
+
+	// AcmeServer is directory url of acme server, which issued the certificate
+	AcmeServer string `json:",omitempty"`
+}
+
+// certificateRevocation describe revocation of the certificate
+type certificateRevocation struct {
+	Date   time.Time
+	Reason string
+	Serial string
+}
+
+func storeCertificateMeta(ctx context.Context, storage cache.Bytes, cd CertDescription, certificate *tls.Certificate, acmeServer string) error {
+	return storeCertificateMetaInfo(ctx, storage, cd, certificateMeta{
 		Domains:    certificate.Leaf.DNSNames,
 		ExpireDate: certificate.Leaf.NotAfter,
+		AcmeServer: acmeServer,
+	})
+}
+
+func loadCertificateMeta(ctx context.Context, storage cache.Bytes, cd CertDescription) (certificateMeta, error) {
+	var res certificateMeta
+	infoBytes, err := storage.Get(ctx, cd.MetaStoreName())
+	if err != nil {
+		return res, err
 	}
+	err = json.Unmarshal(infoBytes, &res)
+	return res, err
+}
+
+func storeCertificateMetaInfo(ctx context.Context, storage cache.Bytes, cd CertDescription, info certificateMeta) error {
 	infoBytes, _ := json.MarshalIndent(info, "", "    ")
 	err := storage.Put(ctx, cd.MetaStoreName(), infoBytes)
 	log.DebugDPanicCtx(ctx, err, "Save cert metadata")
@@ -992,11 +1505,27 @@ func parsePrivateKey(keyPEMBlock []byte) (crypto.Signer, error) {
 	return nil, errors.New("tls: failed to parse private key")
 }
 
-func isNeedRenew(cert *tls.Certificate, now time.Time) bool {
+func isNeedRenew(cert *tls.Certificate, now time.Time, ratio float64) bool {
 	if cert == nil || cert.Leaf == nil {
 		return false
 	}
-	return cert.Leaf.NotAfter.Add(-renewBeforeExpire).Before(now)
+	return isLeafNeedRenew(cert.Leaf, now, ratio)
+}
+
+func isLeafNeedRenew(leaf *x509.Certificate, now time.Time, ratio float64) bool {
+	return leaf.NotAfter.Add(-renewBefore(leaf, ratio)).Before(now)
+}
+
+// renewBefore return duration before expire of the certificate, when it need renew.
+func renewBefore(leaf *x509.Certificate, ratio float64) time.Duration {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	if leaf.NotBefore.IsZero() || lifetime <= 0 {
+		return renewBeforeExpire
+	}
+	if ratio <= 0 {
+		ratio = defaultRenewBeforeExpireRatio
+	}
+	return time.Duration(float64(lifetime) * ratio)
 }
 
 func isCertLocked(ctx context.Context, storage cache.Bytes, certName CertDescription) (bool, error) {
@@ -1013,6 +1542,24 @@ func isCertLocked(ctx context.Context, storage cache.Bytes, certName CertDescrip
 	}
 }
 
+// isErrOrderRejected return true if acme server rejected order by policy or rate limit, other acme server may accept it.
+func isErrOrderRejected(err error) bool {
+	var acmeErr *acme.Error
+	if !errors.As(err, &acmeErr) {
+		return false
+	}
+	switch acmeErr.ProblemType {
+	case acmeErrorPrefix + "rejectedIdentifier",
+		acmeErrorPrefix + "unauthorized",
+		acmeErrorPrefix + "caa",
+		acmeErrorPrefix + "rateLimited",
+		acmeErrorPrefix + "externalAccountRequired",
+		acmeErrorPrefix + "unsupportedIdentifier":
+		return true
+	}
+	return acmeErr.StatusCode == http.StatusTooManyRequests
+}
+
 func isErrTooManyOrders(err error) bool {
 	if err == nil {
 		return false
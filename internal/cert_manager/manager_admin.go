@@ -0,0 +1,465 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+)
+
+// ErrCertificateLocked returned for operations, which can't be done with locked certificate
+var ErrCertificateLocked = xerrors.New("certificate locked")
+
+// ErrStorageCantList returned if storage doesn't implement cache.Lister
+var ErrStorageCantList = xerrors.New("storage doesn't support list of keys")
+
+// errOtherAcmeServer returned if acme server didn't issue the certificate
+var errOtherAcmeServer = xerrors.New("certificate issued by other acme server")
+
+// revocationReasons is reasons of certificate revocation, allowed by acme servers. Names from RFC 5280.
+var revocationReasons = map[string]acme.CRLReasonCode{
+	"unspecified":          acme.CRLReasonUnspecified,
+	"keyCompromise":        acme.CRLReasonKeyCompromise,
+	"affiliationChanged":   acme.CRLReasonAffiliationChanged,
+	"superseded":           acme.CRLReasonSuperseded,
+	"cessationOfOperation": acme.CRLReasonCessationOfOperation,
+}
+
+// CertificateInfo describe certificate state for admin interface
+type CertificateInfo struct {
+	Name      string    `json:"name"`
+	KeyType   KeyType   `json:"key_type"`
+	Stored    bool      `json:"stored"`
+	Domains   []string  `json:"domains"`
+	NotBefore time.Time `json:"not_before"`
+	Expire    time.Time `json:"expire"`
+	Locked    bool      `json:"locked"`
+	Issuing   bool      `json:"issuing"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// AllowedKeyTypes return key types of certificates, allowed by settings
+func (m *Manager) AllowedKeyTypes() []KeyType {
+	var res []KeyType
+	if m.AllowRSACert {
+		res = append(res, KeyRSA)
+	}
+	if m.AllowECDSACert {
+		res = append(res, KeyECDSA)
+	}
+	return res
+}
+
+// ListCertificates return info about all certificates from storage
+func (m *Manager) ListCertificates(ctx context.Context) ([]CertificateInfo, error) {
+	lister, ok := m.Cache.(cache.Lister)
+	if !ok {
+		return nil, ErrStorageCantList
+	}
+
+	keys, err := lister.Keys(ctx)
+	log.DebugError(zc.L(ctx), err, "List storage keys", zap.Int("keys_count", len(keys)))
+	if err != nil {
+		return nil, xerrors.Errorf("list storage keys: %w", err)
+	}
+
+	res := make([]CertificateInfo, 0, len(keys))
+	for _, key := range keys {
+		cd, ok := certDescriptionFromCertStoreName(key, m.AutoSubdomains)
+		if !ok {
+			continue
+		}
+		info, err := m.certificateInfo(ctx, cd)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+// CertificateInfo return info about certificate for the domain.
+// It returns cache.ErrCacheMiss if the certificate not stored and never issued.
+func (m *Manager) CertificateInfo(ctx context.Context, d domain.DomainName, keyType KeyType) (CertificateInfo, error) {
+	cd := CertDescriptionFromDomain(d, keyType, m.AutoSubdomains, m.wildcardZones)
+	info, err := m.certificateInfo(ctx, cd)
+	if err == nil && !info.Stored && !info.Issuing && info.LastError == "" {
+		err = cache.ErrCacheMiss
+	}
+	return info, err
+}
+
+// RenewCertificate issue new certificate for the domain, even if current certificate valid.
+func (m *Manager) RenewCertificate(ctx context.Context, d domain.DomainName, keyType KeyType) (CertificateInfo, error) {
+	if err := m.checkKeyTypeAllowed(keyType); err != nil {
+		return CertificateInfo{}, err
+	}
+
+	cd := CertDescriptionFromDomain(d, keyType, m.AutoSubdomains, m.wildcardZones)
+	ctx = zc.WithLogger(ctx, zc.L(ctx).With(cd.ZapField(), domain.LogDomain(d)))
+
+	locked, err := isCertLocked(ctx, m.Cache, cd)
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+	if locked {
+		return CertificateInfo{}, ErrCertificateLocked
+	}
+
+	zc.L(ctx).Info("Force renew certificate")
+	_, err = m.issueNewCert(ctx, d, cd)
+	return m.infoAfterIssue(ctx, cd, err)
+}
+
+// PreIssueCertificate issue certificate for the domain if it hasn't valid certificate, same as on first request.
+func (m *Manager) PreIssueCertificate(ctx context.Context, d domain.DomainName, keyType KeyType) (CertificateInfo, error) {
+	if err := m.checkKeyTypeAllowed(keyType); err != nil {
+		return CertificateInfo{}, err
+	}
+
+	cd := CertDescriptionFromDomain(d, keyType, m.AutoSubdomains, m.wildcardZones)
+	ctx = zc.WithLogger(ctx, zc.L(ctx).With(domain.LogDomain(d)))
+
+	zc.L(ctx).Info("Pre-issue certificate")
+	_, err := m.getCertificate(ctx, d, keyType)
+	return m.infoAfterIssue(ctx, cd, err)
+}
+
+// DeleteCertificate remove certificate, key, metadata and ocsp response from storage and drop local state of the certificate.
+// Next request for the domain will issue new certificate.
+func (m *Manager) DeleteCertificate(ctx context.Context, d domain.DomainName, keyType KeyType) error {
+	cd := CertDescriptionFromDomain(d, keyType, m.AutoSubdomains, m.wildcardZones)
+	logger := zc.L(ctx).With(cd.ZapField())
+
+	for _, name := range []string{cd.CertStoreName(), cd.KeyStoreName(), cd.MetaStoreName(), cd.OCSPStoreName()} {
+		err := m.Cache.Delete(ctx, name)
+		log.InfoError(logger, err, "Delete from storage", zap.String("key", name))
+		if err != nil {
+			return xerrors.Errorf("delete '%v' from storage: %w", name, err)
+		}
+	}
+	m.certStateDelete(ctx, cd)
+	return nil
+}
+
+// RevokeCertificate revoke certificate of the domain by acme server, then remove it from storage same as
+// DeleteCertificate and save revocation info to metadata file of the certificate.
+// Revoke request signed by key of the certificate, so certificates issued by any account can be revoked.
+// Request sent to acme server, which issued the certificate, if it saved in metadata of the certificate.
+// Else it try fallback acme servers if main server can't revoke the certificate.
+// Next request for the domain will issue new certificate with new key.
+func (m *Manager) RevokeCertificate(ctx context.Context, d domain.DomainName, keyType KeyType, reason acme.CRLReasonCode) error {
+	cd := CertDescriptionFromDomain(d, keyType, m.AutoSubdomains, m.wildcardZones)
+	ctx = zc.WithLogger(ctx, zc.L(ctx).With(cd.ZapField(), domain.LogDomain(d)))
+	logger := zc.L(ctx)
+
+	locked, err := isCertLocked(ctx, m.Cache, cd)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return ErrCertificateLocked
+	}
+
+	cert, err := loadCertificateFromCache(ctx, m.Cache, cd)
+	log.DebugError(logger, err, "Load certificate for revoke")
+	if err != nil {
+		return xerrors.Errorf("load certificate '%v': %w", cd, err)
+	}
+	certKey, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return xerrors.Errorf("private key of certificate '%v' can't sign revoke request", cd)
+	}
+
+	reasonName := RevocationReasonName(reason)
+	logger.Info("Revoke certificate", log.Cert(cert), zap.String("reason", reasonName))
+
+	// metadata saved for certificates, issued with SaveJSONMeta or renewal info by acme server only
+	meta, metaErr := loadCertificateMeta(ctx, m.Cache, cd)
+	log.DebugInfo(logger, metaErr, "Load certificate meta for revoke", zap.String("acme_server", meta.AcmeServer))
+
+	err = xerrors.Errorf("acme server '%v', which issued the certificate, isn't configured", meta.AcmeServer)
+	clientManagers := append([]AcmeClientManager{m.acmeClientManager}, m.FallbackAcmeClientManagers...)
+	for index, clientManager := range clientManagers {
+		revokeErr := revokeCertificateByAcmeServer(ctx, clientManager, meta.AcmeServer, certKey, cert.Certificate[0], reason)
+		if revokeErr == errOtherAcmeServer {
+			continue
+		}
+		err = revokeErr
+		log.InfoError(logger, err, "Revoke certificate by acme server", zap.Int("acme_server_index", index))
+		if err == nil || meta.AcmeServer != "" {
+			break
+		}
+	}
+	if err != nil {
+		return xerrors.Errorf("revoke certificate '%v': %w", cd, err)
+	}
+
+	if err = m.DeleteCertificate(ctx, d, keyType); err != nil {
+		return err
+	}
+	return storeCertificateMetaInfo(ctx, m.Cache, cd, certificateMeta{
+		Domains:    cert.Leaf.DNSNames,
+		ExpireDate: cert.Leaf.NotAfter,
+		Revocation: &certificateRevocation{
+			Date:   time.Now(),
+			Reason: reasonName,
+			Serial: cert.Leaf.SerialNumber.String(),
+		},
+		AcmeServer: meta.AcmeServer,
+	})
+}
+
+// revokeCertificateByAcmeServer send revoke request to acme server of the clientManager.
+// It returns errOtherAcmeServer without request if issuerServer isn't empty and it is other server.
+func revokeCertificateByAcmeServer(ctx context.Context, clientManager AcmeClientManager, issuerServer string,
+	certKey crypto.Signer, der []byte, reason acme.CRLReasonCode) error {
+	acmeClient, _, err := clientManager.GetClient(ctx)
+	if err != nil {
+		return xerrors.Errorf("failed to get acme client: %w", err)
+	}
+	if issuerServer != "" && acmeClient.DirectoryURL != issuerServer {
+		return errOtherAcmeServer
+	}
+	return acmeClient.RevokeCert(ctx, certKey, der, reason)
+}
+
+// ParseRevocationReason return revocation reason code by name from RFC 5280 (keyCompromise, superseded, ...).
+// Name compared case insensitive.
+func ParseRevocationReason(name string) (acme.CRLReasonCode, error) {
+	for reasonName, reason := range revocationReasons {
+		if strings.EqualFold(reasonName, strings.TrimSpace(name)) {
+			return reason, nil
+		}
+	}
+	return 0, xerrors.Errorf("unknown revocation reason '%v', allowed: %v", name,
+		strings.Join(RevocationReasonNames(), ", "))
+}
+
+// RevocationReasonName return name of revocation reason from RFC 5280
+func RevocationReasonName(reason acme.CRLReasonCode) string {
+	for reasonName, code := range revocationReasons {
+		if code == reason {
+			return reasonName
+		}
+	}
+	return strconv.Itoa(int(reason))
+}
+
+// RevocationReasonNames return sorted names of revocation reasons
+func RevocationReasonNames() []string {
+	res := make([]string, 0, len(revocationReasons))
+	for reasonName := range revocationReasons {
+		res = append(res, reasonName)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ImportCertificate save certificate chain and private key in pem format to storage with name of the certificate,
+// which used for the first domain of certificate. If lock - certificate will be locked and used as is.
+// Not locked certificate must be valid now.
+func (m *Manager) ImportCertificate(ctx context.Context, certPEM, keyPEM []byte, lock bool) (CertificateInfo, error) {
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return CertificateInfo{}, xerrors.Errorf("parse private key: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return CertificateInfo{}, xerrors.Errorf("parse certificate: %w", err)
+	}
+	cert.PrivateKey = key
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return CertificateInfo{}, xerrors.Errorf("parse leaf certificate: %w", err)
+	}
+
+	cd, err := m.certDescriptionForLeaf(cert.Leaf, getKeyType(&cert))
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+	logger := zc.L(ctx).With(cd.ZapField())
+	ctx = zc.WithLogger(ctx, logger)
+
+	locked, err := isCertLocked(ctx, m.Cache, cd)
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+	if _, err = validCertTLS(&cert, nil, lock || locked, time.Now()); err != nil {
+		return CertificateInfo{}, xerrors.Errorf("check certificate: %w", err)
+	}
+
+	certBytes, keyBytes, err := encodeCertificate(ctx, &cert)
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+	if err = putCertificate(ctx, m.Cache, cd, certBytes, keyBytes); err != nil {
+		return CertificateInfo{}, err
+	}
+	if m.SaveJSONMeta {
+		_ = storeCertificateMeta(ctx, m.Cache, cd, &cert, "")
+	}
+	logger.Info("Import certificate", log.Cert(&cert), zap.Bool("lock", lock))
+
+	if lock && !locked {
+		err = m.Cache.Put(ctx, cd.LockName(), []byte{})
+		log.InfoError(logger, err, "Lock certificate", zap.String("lock", cd.LockName()))
+		if err != nil {
+			return CertificateInfo{}, err
+		}
+	}
+	m.certStateDeleteAllKeyTypes(ctx, cd)
+	return m.certificateInfo(ctx, cd)
+}
+
+// ExportCertificate return stored certificate chain and private key of the domain in pem format
+func (m *Manager) ExportCertificate(ctx context.Context, d domain.DomainName, keyType KeyType) (certPEM, keyPEM []byte, err error) {
+	cd := CertDescriptionFromDomain(d, keyType, m.AutoSubdomains, m.wildcardZones)
+	certPEM, err = m.Cache.Get(ctx, cd.CertStoreName())
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = m.Cache.Get(ctx, cd.KeyStoreName())
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// certDescriptionForLeaf return description of certificate, which used for first domain of the leaf
+func (m *Manager) certDescriptionForLeaf(leaf *x509.Certificate, keyType KeyType) (CertDescription, error) {
+	name := leaf.Subject.CommonName
+	if len(leaf.DNSNames) > 0 {
+		name = leaf.DNSNames[0]
+	}
+	if strings.HasPrefix(name, wildcardPrefix) {
+		zone, err := domain.NormalizeDomain(strings.TrimPrefix(name, wildcardPrefix))
+		if err != nil {
+			return CertDescription{}, xerrors.Errorf("bad domain of certificate '%v': %w", name, err)
+		}
+		return CertDescription{MainDomain: wildcardPrefix + zone.String(), KeyType: keyType}, nil
+	}
+
+	d, err := domain.NormalizeDomain(name)
+	if err != nil {
+		return CertDescription{}, xerrors.Errorf("bad domain of certificate '%v': %w", name, err)
+	}
+	return CertDescriptionFromDomain(d, keyType, m.AutoSubdomains, m.wildcardZones), nil
+}
+
+// LockCertificate create lock file for certificate of the domain. Locked certificate used as is,
+// without renew and internal checks.
+func (m *Manager) LockCertificate(ctx context.Context, d domain.DomainName) error {
+	cd := CertDescriptionFromDomain(d, KeyRSA, m.AutoSubdomains, m.wildcardZones)
+	err := m.Cache.Put(ctx, cd.LockName(), []byte{})
+	log.InfoError(zc.L(ctx), err, "Lock certificate", zap.String("lock", cd.LockName()))
+	if err != nil {
+		return err
+	}
+	m.certStateDeleteAllKeyTypes(ctx, cd)
+	return nil
+}
+
+// UnlockCertificate remove lock file of certificate of the domain.
+func (m *Manager) UnlockCertificate(ctx context.Context, d domain.DomainName) error {
+	cd := CertDescriptionFromDomain(d, KeyRSA, m.AutoSubdomains, m.wildcardZones)
+	err := m.Cache.Delete(ctx, cd.LockName())
+	log.InfoError(zc.L(ctx), err, "Unlock certificate", zap.String("lock", cd.LockName()))
+	if err != nil {
+		return err
+	}
+	m.certStateDeleteAllKeyTypes(ctx, cd)
+	return nil
+}
+
+// infoAfterIssue return info of certificate and issue error with details from last error of issue
+func (m *Manager) infoAfterIssue(ctx context.Context, cd CertDescription, issueErr error) (CertificateInfo, error) {
+	info, err := m.certificateInfo(ctx, cd)
+	if issueErr != nil {
+		if info.LastError != "" {
+			issueErr = xerrors.Errorf("last issue error '%v': %w", info.LastError, issueErr)
+		}
+		return info, issueErr
+	}
+	return info, err
+}
+
+func (m *Manager) certificateInfo(ctx context.Context, cd CertDescription) (CertificateInfo, error) {
+	info := CertificateInfo{Name: cd.MainDomain, KeyType: cd.KeyType}
+
+	locked, err := isCertLocked(ctx, m.Cache, cd)
+	if err != nil {
+		return info, xerrors.Errorf("check lock of '%v': %w", cd, err)
+	}
+	info.Locked = locked
+
+	leaf, err := loadCertificateLeaf(ctx, m.Cache, cd)
+	switch {
+	case err == nil:
+		info.Stored = true
+		info.Domains = leaf.DNSNames
+		info.NotBefore = leaf.NotBefore
+		info.Expire = leaf.NotAfter
+	case err == cache.ErrCacheMiss:
+		// pass
+	default:
+		info.LastError = err.Error()
+	}
+
+	if state, _ := m.certState.Get(ctx, cd.String()); state != nil {
+		var lastError error
+		info.Issuing, lastError = state.(*certState).IssueInfo()
+		if lastError != nil {
+			info.LastError = lastError.Error()
+		}
+	}
+	return info, nil
+}
+
+func (m *Manager) certStateDelete(ctx context.Context, cd CertDescription) {
+	m.certStateMu.Lock()
+	defer m.certStateMu.Unlock()
+
+	err := m.certState.Delete(ctx, cd.String())
+	log.DebugDPanicCtx(ctx, err, "Delete cert state")
+}
+
+func (m *Manager) certStateDeleteAllKeyTypes(ctx context.Context, cd CertDescription) {
+	for _, keyType := range []KeyType{KeyRSA, KeyECDSA} {
+		cd.KeyType = keyType
+		m.certStateDelete(ctx, cd)
+	}
+}
+
+// loadCertificateLeaf parse first certificate from storage without validate it
+func loadCertificateLeaf(ctx context.Context, storage cache.Bytes, cd CertDescription) (*x509.Certificate, error) {
+	certBytes, err := storage.Get(ctx, cd.CertStoreName())
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, certBytes = pem.Decode(certBytes)
+		if block == nil {
+			return nil, xerrors.Errorf("no certificate in '%v'", cd.CertStoreName())
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
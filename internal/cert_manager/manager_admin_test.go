@@ -0,0 +1,293 @@
+package cert_manager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"golang.org/x/crypto/acme"
+)
+
+func TestManager_CertificatesAdmin(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := cache.NewMemoryCache("test")
+	m := New(nil, storage, nil)
+	m.AutoSubdomains = []string{"www."}
+	e.CmpNoError(m.SetWildcardZones([]string{"zone.ru"}))
+	e.Cmp(m.AllowedKeyTypes(), []KeyType{KeyRSA, KeyECDSA})
+
+	now := time.Now()
+	certBytes, keyBytes := fastCreateTestCert([]string{"test.ru", "www.test.ru"}, now)
+	e.CmpNoError(storage.Put(ctx, "test.ru.rsa.cer", certBytes))
+	e.CmpNoError(storage.Put(ctx, "test.ru.rsa.key", keyBytes))
+	e.CmpNoError(storage.Put(ctx, "test.ru.rsa.json", []byte("{}")))
+	wildcardCertBytes, _ := fastCreateTestCert([]string{"*.zone.ru"}, now)
+	e.CmpNoError(storage.Put(ctx, "_wildcard.zone.ru.rsa.cer", wildcardCertBytes))
+
+	list, err := m.ListCertificates(ctx)
+	e.CmpNoError(err)
+	e.Len(list, 2)
+	e.Cmp(list[0].Name, "*.zone.ru")
+	e.Cmp(list[0].Domains, []string{"*.zone.ru"})
+	e.Cmp(list[1].Name, "test.ru")
+	e.Cmp(list[1].KeyType, KeyRSA)
+	e.True(list[1].Stored)
+	e.Cmp(list[1].Domains, []string{"test.ru", "www.test.ru"})
+	e.Cmp(list[1].Expire.Unix(), now.Add(time.Hour).Unix())
+
+	info, err := m.CertificateInfo(ctx, "www.test.ru", KeyRSA)
+	e.CmpNoError(err)
+	e.Cmp(info.Name, "test.ru")
+	e.False(info.Locked)
+
+	info, err = m.CertificateInfo(ctx, "sub.zone.ru", KeyRSA)
+	e.CmpNoError(err)
+	e.Cmp(info.Name, "*.zone.ru")
+
+	_, err = m.CertificateInfo(ctx, "test.ru", KeyECDSA)
+	e.Cmp(err, cache.ErrCacheMiss)
+
+	// last issue error from local state
+	cd := CertDescription{MainDomain: "other.ru", KeyType: KeyECDSA, Subdomains: m.AutoSubdomains}
+	state := m.certStateGet(ctx, cd)
+	state.StartIssue(ctx)
+	info, err = m.CertificateInfo(ctx, "other.ru", KeyECDSA)
+	e.CmpNoError(err)
+	e.True(info.Issuing)
+	state.FinishIssue(ctx, nil, errors.New("test error"))
+	info, err = m.CertificateInfo(ctx, "other.ru", KeyECDSA)
+	e.CmpNoError(err)
+	e.False(info.Stored)
+	e.False(info.Issuing)
+	e.Cmp(info.LastError, "test error")
+
+	// lock
+	e.CmpNoError(m.LockCertificate(ctx, "test.ru"))
+	info, err = m.CertificateInfo(ctx, "test.ru", KeyRSA)
+	e.CmpNoError(err)
+	e.True(info.Locked)
+	_, err = m.RenewCertificate(ctx, "test.ru", KeyRSA)
+	e.Cmp(err, ErrCertificateLocked)
+
+	e.CmpNoError(m.UnlockCertificate(ctx, "test.ru"))
+	info, err = m.CertificateInfo(ctx, "test.ru", KeyRSA)
+	e.CmpNoError(err)
+	e.False(info.Locked)
+
+	// delete
+	e.CmpNoError(m.DeleteCertificate(ctx, domain.DomainName("test.ru"), KeyRSA))
+	_, err = m.CertificateInfo(ctx, "test.ru", KeyRSA)
+	e.Cmp(err, cache.ErrCacheMiss)
+	keys, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	e.Cmp(keys, []string{"_wildcard.zone.ru.rsa.cer"})
+
+	// key types
+	m.AllowECDSACert = false
+	e.Cmp(m.AllowedKeyTypes(), []KeyType{KeyRSA})
+	_, err = m.PreIssueCertificate(ctx, "test.ru", KeyECDSA)
+	e.Cmp(err, errECDSADenied)
+
+	// storage without list
+	m.Cache = NewBytesMock(e)
+	_, err = m.ListCertificates(ctx)
+	e.Cmp(err, ErrStorageCantList)
+}
+
+// newRevokeAcmeServer start acme server stub, which save payloads of revoke requests.
+// It answer with problem if problemType isn't empty.
+func newRevokeAcmeServer(t *testing.T, problemType string, payloads *[]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/directory":
+			_, _ = w.Write([]byte(`{"newNonce": "` + server.URL + `/nonce", "newOrder": "` + server.URL +
+				`/order", "revokeCert": "` + server.URL + `/revoke"}`))
+		case "/nonce":
+			w.WriteHeader(http.StatusOK)
+		case "/revoke":
+			var request struct{ Payload string }
+			body, _ := ioutil.ReadAll(r.Body)
+			_ = json.Unmarshal(body, &request)
+			payload, _ := base64.RawURLEncoding.DecodeString(request.Payload)
+			*payloads = append(*payloads, string(payload))
+			if problemType != "" {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"type": "` + problemType + `", "detail": "test reject"}`))
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestManager_RevokeCertificate(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	mc := th.MockController(e)
+
+	accountKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	e.CmpNoError(err)
+	clientManager := func(server *httptest.Server) *AcmeClientManagerMock {
+		res := NewAcmeClientManagerMock(mc)
+		res.GetClientMock.Set(func(ctx context.Context) (*acme.Client, func(), error) {
+			return &acme.Client{DirectoryURL: server.URL + "/directory", Key: accountKey}, func() {}, nil
+		})
+		return res
+	}
+
+	var rejected, revoked []string
+	rejectServer := newRevokeAcmeServer(t, acmeErrorPrefix+"malformed", &rejected)
+	revokeServer := newRevokeAcmeServer(t, "", &revoked)
+
+	storage := cache.NewMemoryCache("test")
+	m := New(clientManager(rejectServer), storage, nil)
+	m.AutoSubdomains = []string{"www."}
+
+	now := time.Now()
+	certBytes, keyBytes := fastCreateTestCert([]string{"test.ru", "www.test.ru"}, now)
+	e.CmpNoError(storage.Put(ctx, "test.ru.rsa.cer", certBytes))
+	e.CmpNoError(storage.Put(ctx, "test.ru.rsa.key", keyBytes))
+
+	// failed revoke keep certificate
+	err = m.RevokeCertificate(ctx, "www.test.ru", KeyRSA, acme.CRLReasonKeyCompromise)
+	e.CmpError(err)
+	e.Len(rejected, 1)
+	_, err = storage.Get(ctx, "test.ru.rsa.cer")
+	e.CmpNoError(err)
+
+	// revoke by fallback server
+	m.FallbackAcmeClientManagers = []AcmeClientManager{clientManager(revokeServer)}
+	e.CmpNoError(m.RevokeCertificate(ctx, "www.test.ru", KeyRSA, acme.CRLReasonKeyCompromise))
+	e.Len(rejected, 2)
+	e.Len(revoked, 1)
+	e.True(strings.Contains(revoked[0], `"reason":1`))
+
+	keys, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	e.Cmp(keys, []string{"test.ru.rsa.json"})
+
+	var meta certificateMeta
+	metaBytes, err := storage.Get(ctx, "test.ru.rsa.json")
+	e.CmpNoError(err)
+	e.CmpNoError(json.Unmarshal(metaBytes, &meta))
+	e.Cmp(meta.Domains, []string{"test.ru", "www.test.ru"})
+	e.NotNil(meta.Revocation)
+	e.Cmp(meta.Revocation.Reason, "keyCompromise")
+
+	// revoke by acme server, which issued the certificate
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyRSA}
+	storeIssued := func(acmeServer string) {
+		e.CmpNoError(storage.Put(ctx, "test.ru.rsa.cer", certBytes))
+		e.CmpNoError(storage.Put(ctx, "test.ru.rsa.key", keyBytes))
+		e.CmpNoError(storeCertificateMetaInfo(ctx, storage, cd, certificateMeta{AcmeServer: acmeServer}))
+	}
+
+	storeIssued(rejectServer.URL + "/directory")
+	e.CmpError(m.RevokeCertificate(ctx, "test.ru", KeyRSA, acme.CRLReasonSuperseded))
+	e.Len(rejected, 3)
+	e.Len(revoked, 1, "fallback server didn't issue the certificate")
+
+	storeIssued(revokeServer.URL + "/directory")
+	e.CmpNoError(m.RevokeCertificate(ctx, "test.ru", KeyRSA, acme.CRLReasonSuperseded))
+	e.Len(rejected, 3, "main server didn't issue the certificate")
+	e.Len(revoked, 2)
+	meta, err = loadCertificateMeta(ctx, storage, cd)
+	e.CmpNoError(err)
+	e.Cmp(meta.AcmeServer, revokeServer.URL+"/directory")
+	e.Cmp(meta.Revocation.Reason, "superseded")
+
+	storeIssued("https://unknown.example/directory")
+	e.CmpError(m.RevokeCertificate(ctx, "test.ru", KeyRSA, acme.CRLReasonSuperseded))
+	e.Len(rejected, 3)
+	e.Len(revoked, 2)
+	e.CmpNoError(m.DeleteCertificate(ctx, "test.ru", KeyRSA))
+
+	// no certificate
+	err = m.RevokeCertificate(ctx, "test.ru", KeyRSA, acme.CRLReasonUnspecified)
+	e.True(errors.Is(err, cache.ErrCacheMiss))
+
+	// locked certificate
+	e.CmpNoError(m.LockCertificate(ctx, "test.ru"))
+	e.Cmp(m.RevokeCertificate(ctx, "test.ru", KeyRSA, acme.CRLReasonUnspecified), ErrCertificateLocked)
+}
+
+func TestParseRevocationReason(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	reason, err := ParseRevocationReason("KeyCompromise")
+	e.CmpNoError(err)
+	e.Cmp(reason, acme.CRLReasonKeyCompromise)
+	e.Cmp(RevocationReasonName(reason), "keyCompromise")
+	e.Cmp(RevocationReasonName(acme.CRLReasonCertificateHold), "6")
+
+	_, err = ParseRevocationReason("caCompromise")
+	e.CmpError(err)
+	e.Cmp(RevocationReasonNames(), []string{"affiliationChanged", "cessationOfOperation", "keyCompromise",
+		"superseded", "unspecified"})
+}
+
+func TestManager_ImportExportCertificate(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := cache.NewMemoryCache("test")
+	m := New(nil, storage, nil)
+	m.AutoSubdomains = []string{"www."}
+
+	now := time.Now()
+	certBytes, keyBytes := fastCreateTestCert([]string{"www.test.ru", "test.ru"}, now)
+	info, err := m.ImportCertificate(ctx, certBytes, keyBytes, false)
+	e.CmpNoError(err)
+	e.Cmp(info.Name, "test.ru")
+	e.Cmp(info.KeyType, KeyRSA)
+	e.True(info.Stored)
+	e.False(info.Locked)
+
+	exportCert, exportKey, err := m.ExportCertificate(ctx, "test.ru", KeyRSA)
+	e.CmpNoError(err)
+	e.Cmp(exportCert, certBytes)
+	e.Cmp(exportKey, keyBytes)
+	_, _, err = m.ExportCertificate(ctx, "test.ru", KeyECDSA)
+	e.Cmp(err, cache.ErrCacheMiss)
+
+	// expired certificate can be imported with lock only
+	expiredCert, expiredKey := fastCreateTestCert([]string{"*.zone.ru"}, now.Add(-2*time.Hour))
+	_, err = m.ImportCertificate(ctx, expiredCert, expiredKey, false)
+	e.CmpError(err)
+	info, err = m.ImportCertificate(ctx, expiredCert, expiredKey, true)
+	e.CmpNoError(err)
+	e.Cmp(info.Name, "*.zone.ru")
+	e.True(info.Locked)
+
+	keys, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	e.Cmp(keys, []string{"_wildcard.zone.ru.lock", "_wildcard.zone.ru.rsa.cer", "_wildcard.zone.ru.rsa.key",
+		"test.ru.rsa.cer", "test.ru.rsa.key"})
+
+	// key of other certificate
+	_, err = m.ImportCertificate(ctx, certBytes, expiredKey, true)
+	e.CmpError(err)
+	_, err = m.ImportCertificate(ctx, certBytes, []byte("bad"), true)
+	e.CmpError(err)
+}
@@ -0,0 +1,100 @@
+package cert_manager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+)
+
+// newRejectOrderAcmeServer start acme server stub, which reject every new order with the problem type
+func newRejectOrderAcmeServer(t *testing.T, problemType string, orders *int32) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/directory":
+			_, _ = w.Write([]byte(`{"newNonce": "` + server.URL + `/nonce", "newAccount": "` + server.URL +
+				`/account", "newOrder": "` + server.URL + `/order"}`))
+		case "/nonce":
+			w.WriteHeader(http.StatusOK)
+		case "/account":
+			w.Header().Set("Location", server.URL+"/account/1")
+			_, _ = w.Write([]byte(`{"status": "valid"}`))
+		case "/order":
+			atomic.AddInt32(orders, 1)
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"type": "` + problemType + `", "detail": "test reject"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestManager_CreateCertificateFallback(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	mc := th.MockController(e)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	e.CmpNoError(err)
+	clientManager := func(server *httptest.Server) *AcmeClientManagerMock {
+		res := NewAcmeClientManagerMock(mc)
+		res.GetClientMock.Set(func(ctx context.Context) (*acme.Client, func(), error) {
+			return &acme.Client{DirectoryURL: server.URL + "/directory", Key: key}, func() {}, nil
+		})
+		return res
+	}
+
+	var rejectedOrders, malformedOrders int32
+	rejectServer := newRejectOrderAcmeServer(t, acmeErrorPrefix+"rejectedIdentifier", &rejectedOrders)
+	malformedServer := newRejectOrderAcmeServer(t, acmeErrorPrefix+"malformed", &malformedOrders)
+
+	domains := []domain.DomainName{"test.ru"}
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyRSA}
+
+	// fallback to next acme server if order rejected
+	m := New(clientManager(rejectServer), cache.NewMemoryCache("test"), nil)
+	m.FallbackAcmeClientManagers = []AcmeClientManager{clientManager(malformedServer), NewAcmeClientManagerMock(mc)}
+	_, err = m.createCertificateForDomains(ctx, cd, domains)
+	e.CmpError(err)
+	var acmeErr *acme.Error
+	e.True(xerrors.As(err, &acmeErr))
+	e.Cmp(acmeErr.ProblemType, acmeErrorPrefix+"malformed", "error without fallback stop try next servers")
+	e.Cmp(atomic.LoadInt32(&rejectedOrders), int32(1))
+	e.Cmp(atomic.LoadInt32(&malformedOrders), int32(1))
+
+	// last server error returned
+	m = New(clientManager(rejectServer), cache.NewMemoryCache("test"), nil)
+	m.FallbackAcmeClientManagers = []AcmeClientManager{clientManager(rejectServer)}
+	_, err = m.createCertificateForDomains(ctx, cd, domains)
+	e.True(xerrors.As(err, &acmeErr))
+	e.Cmp(acmeErr.ProblemType, acmeErrorPrefix+"rejectedIdentifier")
+	e.Cmp(atomic.LoadInt32(&rejectedOrders), int32(3))
+}
+
+func TestIsErrOrderRejected(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.False(isErrOrderRejected(nil))
+	e.False(isErrOrderRejected(errors.New("test")))
+	e.False(isErrOrderRejected(&acme.Error{ProblemType: acmeErrorPrefix + "malformed", StatusCode: http.StatusBadRequest}))
+	e.True(isErrOrderRejected(&acme.Error{ProblemType: acmeErrorPrefix + "rejectedIdentifier"}))
+	e.True(isErrOrderRejected(xerrors.Errorf("wrap: %w", &acme.Error{ProblemType: acmeErrorPrefix + "rateLimited"})))
+	e.True(isErrOrderRejected(&acme.Error{StatusCode: http.StatusTooManyRequests}))
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/gojuno/minimock/v3"
 	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/proxy"
 	"github.com/rekby/lets-proxy2/internal/th"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
@@ -88,6 +89,48 @@ func TestManager_GetCertificateHttp01(t *testing.T) {
 	getCertificatesTests(t, manager, ctx, logger)
 }
 
+func TestManager_GetCertificateHttp01Proxy(t *testing.T) {
+	env, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	th.Pebble(env)
+
+	t.Parallel()
+
+	logger := zc.L(ctx)
+
+	mc := minimock.NewController(t)
+	defer mc.Finish()
+
+	manager := New(createTestClientManager(env, t), newCacheMock(mc), nil)
+	manager.CertificateIssueTimeout = testCertIssueTimeout
+	manager.AutoSubdomains = []string{"www."}
+	err := manager.SetChallengeTypes([]string{http01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("http port", th.PebbleHTTPValidationPort(env))
+	lisneter, err := net.ListenTCP("tcp", &net.TCPAddr{Port: th.PebbleHTTPValidationPort(env)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := proxy.NewHTTPProxy(ctx, lisneter)
+	p.HandleHTTPValidation = manager.HandleHTTPValidation
+	p.Director = proxy.NewDirectorHost(th.NewFreeLocalTcpAddress(env).String())
+
+	//noinspection GoUnhandledErrorResult
+	defer p.Close()
+
+	go func() {
+		err := p.Start()
+		logger.Info("http proxy stopped", zap.Error(err))
+	}()
+
+	getCertificatesTests(t, manager, ctx, logger)
+}
+
 func TestManager_GetCertificateTls(t *testing.T) {
 	env, ctx, cancel := th.NewEnv(t)
 	defer cancel()
@@ -290,6 +333,7 @@ func getCertificatesTestsKeyType(t *testing.T, manager *Manager, keyType KeyType
 		certNumber := cert.Leaf.SerialNumber
 		newExpire := time.Now().Add(time.Hour)
 		cert.Leaf.NotAfter = newExpire
+		cert.Leaf.NotBefore = newExpire.Add(-90 * 24 * time.Hour) // renew window is part of lifetime
 
 		// get expired soon certificate and trigger reissue new
 		cert, err = manager.GetCertificate(createTLSHello(ctx, keyType, domain))
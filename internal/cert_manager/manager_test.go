@@ -10,13 +10,18 @@ import (
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"math"
+	"math/big"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/rekby/fixenv"
 	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/lease"
 
 	"go.uber.org/zap"
 
@@ -29,6 +34,7 @@ import (
 	"github.com/rekby/lets-proxy2/internal/th"
 
 	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
 )
 
 const rsaKeyLength = 2048
@@ -147,10 +153,22 @@ func TestIsNeedRenew(t *testing.T) {
 	td := testdeep.NewT(t)
 	var cert = &tls.Certificate{}
 	cert.Leaf = &x509.Certificate{NotAfter: time.Date(2000, 7, 31, 0, 0, 0, 0, time.UTC)}
-	td.True(isNeedRenew(cert, time.Date(2000, 7, 31, 0, 0, 0, 1, time.UTC)))
-	td.True(isNeedRenew(cert, time.Date(2000, 7, 1, 0, 0, 0, 1, time.UTC)))
-	td.False(isNeedRenew(cert, time.Date(2000, 7, 1, 0, 0, 0, 0, time.UTC)))
-	td.False(isNeedRenew(cert, time.Date(2000, 6, 30, 0, 0, 0, 0, time.UTC)))
+	td.True(isNeedRenew(cert, time.Date(2000, 7, 31, 0, 0, 0, 1, time.UTC), defaultRenewBeforeExpireRatio))
+	td.True(isNeedRenew(cert, time.Date(2000, 7, 1, 0, 0, 0, 1, time.UTC), defaultRenewBeforeExpireRatio))
+	td.False(isNeedRenew(cert, time.Date(2000, 7, 1, 0, 0, 0, 0, time.UTC), defaultRenewBeforeExpireRatio))
+	td.False(isNeedRenew(cert, time.Date(2000, 6, 30, 0, 0, 0, 0, time.UTC), defaultRenewBeforeExpireRatio))
+	td.False(isNeedRenew(nil, time.Date(2000, 7, 31, 0, 0, 0, 1, time.UTC), defaultRenewBeforeExpireRatio))
+
+	// part of lifetime: 90 days certificate with default ratio renew 30 days before expire
+	cert.Leaf.NotBefore = cert.Leaf.NotAfter.Add(-90 * 24 * time.Hour)
+	td.True(isNeedRenew(cert, time.Date(2000, 7, 1, 0, 0, 0, 1, time.UTC), defaultRenewBeforeExpireRatio))
+	td.False(isNeedRenew(cert, time.Date(2000, 7, 1, 0, 0, 0, 0, time.UTC), defaultRenewBeforeExpireRatio))
+	td.False(isNeedRenew(cert, time.Date(2000, 7, 1, 0, 0, 0, 0, time.UTC), 0), "default ratio for zero")
+
+	// short-lived 6 days certificate with half of lifetime
+	cert.Leaf.NotBefore = cert.Leaf.NotAfter.Add(-6 * 24 * time.Hour)
+	td.True(isNeedRenew(cert, time.Date(2000, 7, 28, 0, 0, 0, 1, time.UTC), 0.5))
+	td.False(isNeedRenew(cert, time.Date(2000, 7, 28, 0, 0, 0, 0, time.UTC), 0.5))
 }
 
 type testManagerContext struct {
@@ -199,6 +217,64 @@ func TestManager_CertForDenied(t *testing.T) {
 	td.CmpError(err)
 }
 
+func TestManager_WildcardCertForDenied(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+
+	td.CmpNoError(c.manager.SetWildcardZones([]string{"*.zone.ru"}))
+	c.domainChecker.IsDomainAllowedMock.Set(func(ctx context.Context, domain string) (bool, error) {
+		td.Cmp(domain, "test.zone.ru")
+		return false, nil
+	})
+
+	// cert state and storage must not be used for denied domain
+	res, err := c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: "test.zone.ru"})
+	td.Nil(res)
+	td.CmpError(err)
+
+	// decision cached
+	res, err = c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: "test.zone.ru"})
+	td.Nil(res)
+	td.CmpError(err)
+	td.Cmp(c.domainChecker.IsDomainAllowedAfterCounter(), uint64(1))
+}
+
+func TestManager_IsDomainAllowedForWildcard(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	mc := minimock.NewController(t)
+	defer mc.Finish()
+
+	checker := NewDomainCheckerMock(mc)
+	m := &Manager{DomainChecker: checker, wildcardDomainAllowed: cache.NewMemoryValueLRU("test")}
+	testDomain := domain.DomainName("test.zone.ru")
+	now := time.Now()
+
+	checker.IsDomainAllowedMock.Return(true, nil)
+	allowed, err := m.isDomainAllowedForWildcard(ctx, testDomain, now)
+	e.CmpNoError(err)
+	e.True(allowed)
+
+	allowed, err = m.isDomainAllowedForWildcard(ctx, testDomain, now.Add(wildcardDomainAllowedTTL/2))
+	e.CmpNoError(err)
+	e.True(allowed)
+	e.Cmp(checker.IsDomainAllowedAfterCounter(), uint64(1))
+
+	// check again after ttl, errors doesn't cached
+	checker.IsDomainAllowedMock.Return(false, xerrors.New("test"))
+	_, err = m.isDomainAllowedForWildcard(ctx, testDomain, now.Add(wildcardDomainAllowedTTL))
+	e.CmpError(err)
+	e.Cmp(checker.IsDomainAllowedAfterCounter(), uint64(2))
+
+	checker.IsDomainAllowedMock.Return(false, nil)
+	allowed, err = m.isDomainAllowedForWildcard(ctx, testDomain, now.Add(wildcardDomainAllowedTTL))
+	e.CmpNoError(err)
+	e.False(allowed)
+	e.Cmp(checker.IsDomainAllowedAfterCounter(), uint64(3))
+}
+
 func TestManagerFilterTlsHello(t *testing.T) {
 	t.Run("AllowInsecureChipers_True", func(t *testing.T) {
 		e, ctx, flush := th.NewEnv(t)
@@ -279,6 +355,7 @@ func createManager(t *testing.T) (res testManagerContext, cancel func()) {
 		certForDomainAuthorize:  res.certForDomainAuthorize,
 		certState:               res.certState,
 		httpTokens:              res.httpTokens,
+		wildcardDomainAllowed:   cache.NewMemoryValueLRU("wildcarddomainallowed"),
 	}
 	res.manager.initMetrics(nil)
 	return res, func() {
@@ -286,3 +363,265 @@ func createManager(t *testing.T) (res testManagerContext, cancel func()) {
 		ctxCancel()
 	}
 }
+
+func TestManager_SetChallengeTypes(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := Manager{EnableTLSValidation: true}
+	td.Cmp(m.supportedChallenges(), []string{tlsAlpn01})
+
+	m.EnableHTTPValidation = true
+	td.Cmp(m.supportedChallenges(), []string{tlsAlpn01, http01})
+
+	td.CmpNoError(m.SetChallengeTypes([]string{" HTTP-01", "tls-alpn-01", "http-01"}))
+	td.True(m.EnableHTTPValidation)
+	td.True(m.EnableTLSValidation)
+	td.Cmp(m.supportedChallenges(), []string{http01, tlsAlpn01})
+
+	td.CmpNoError(m.SetChallengeTypes([]string{"http-01"}))
+	td.True(m.EnableHTTPValidation)
+	td.False(m.EnableTLSValidation)
+	td.Cmp(m.supportedChallenges(), []string{http01})
+
+	err := m.SetChallengeTypes([]string{"http-01", "bad"})
+	td.True(xerrors.Is(err, errChallengeTypeUnknown))
+	td.Cmp(m.supportedChallenges(), []string{http01})
+
+	td.CmpError(m.SetChallengeTypes(nil))
+
+	err = m.SetChallengeTypes([]string{"dns-01"})
+	td.True(xerrors.Is(err, errDNSProviderNotSet))
+
+	m.DNSProvider = &testDNSProvider{}
+	td.CmpNoError(m.SetChallengeTypes([]string{"dns-01", "tls-alpn-01"}))
+	td.True(m.EnableDNSValidation)
+	td.True(m.EnableTLSValidation)
+	td.False(m.EnableHTTPValidation)
+	td.Cmp(m.supportedChallenges(), []string{dns01, tlsAlpn01})
+}
+
+func TestManager_SetWildcardZones(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := Manager{}
+	td.CmpNoError(m.SetWildcardZones([]string{"*.Zone.ru", " test.com "}))
+	td.Cmp(m.wildcardZones, []string{"zone.ru", "test.com"})
+
+	td.CmpError(m.SetWildcardZones([]string{"*."}))
+	td.CmpError(m.SetWildcardZones([]string{"bad domain.com"}))
+}
+
+func TestFilterDomainsWildcard(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	checker := NewDomainCheckerMock(mc)
+	checker.IsDomainAllowedMock.Set(func(ctx context.Context, domain string) (bool, error) {
+		td.Cmp(domain, "zone.ru", "wildcard must not be checked")
+		return false, nil
+	})
+
+	res, err := filterDomains(ctx, checker, []domain.DomainName{"*.zone.ru", "zone.ru"}, "test.zone.ru")
+	td.CmpNoError(err)
+	td.Cmp(res, []domain.DomainName{"*.zone.ru"})
+
+	// wildcard doesn't cover second level subdomain
+	denyChecker := NewDomainCheckerMock(mc)
+	denyChecker.IsDomainAllowedMock.Return(false, nil)
+	_, err = filterDomains(ctx, denyChecker, []domain.DomainName{"*.zone.ru"}, "www.test.zone.ru")
+	td.CmpError(err)
+}
+
+func TestManager_AcquireIssueLease(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := cache.NewMemoryCache("test")
+	m := New(nil, storage, nil)
+	m.IssueLocker = &lease.Locker{Storage: storage, Owner: "1", TTL: time.Minute}
+	m.IssueLeasePollInterval = 10 * time.Millisecond
+
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyRSA}
+	domains := []domain.DomainName{"test.ru"}
+
+	// no certificate and free lease
+	issueLease, cert, err := m.acquireIssueLease(ctx, cd, domains)
+	e.CmpNoError(err)
+	e.Nil(cert)
+	e.NotNil(issueLease)
+	e.CmpNoError(issueLease.Release(ctx))
+
+	// other instance hold lease and store certificate
+	otherLocker := &lease.Locker{Storage: storage, Owner: "2", TTL: time.Minute}
+	otherLease, err := otherLocker.TryAcquire(ctx, cd.IssueLeaseName())
+	e.CmpNoError(err)
+
+	now := time.Now()
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeyLength)
+	e.CmpNoError(err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(renewBeforeExpire * 2),
+		DNSNames:     []string{"test.ru"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	e.CmpNoError(err)
+	issuedCert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	issuedCert.Leaf, err = x509.ParseCertificate(der)
+	e.CmpNoError(err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = storeCertificate(ctx, storage, cd, issuedCert)
+		_ = otherLease.Release(ctx)
+	}()
+
+	issueLease, cert, err = m.acquireIssueLease(ctx, cd, domains)
+	e.CmpNoError(err)
+	e.Nil(issueLease)
+	e.Cmp(cert.Certificate, issuedCert.Certificate)
+}
+
+type testDNSProvider struct {
+	mu      sync.Mutex
+	records map[string][]string
+	err     error
+}
+
+func (p *testDNSProvider) Present(_ context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	if p.records == nil {
+		p.records = make(map[string][]string)
+	}
+	p.records[fqdn] = append(p.records[fqdn], value)
+	return nil
+}
+
+func (p *testDNSProvider) CleanUp(_ context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var res []string
+	for _, v := range p.records[fqdn] {
+		if v != value {
+			res = append(res, v)
+		}
+	}
+	p.records[fqdn] = res
+	return nil
+}
+
+func (p *testDNSProvider) LookupTXT(_ context.Context, host string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.records[host]...), nil
+}
+
+type testLaggedTXTResolver struct {
+	lookups int
+	lagged  int
+	next    DNSTXTResolver
+}
+
+func (r *testLaggedTXTResolver) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	r.lookups++
+	if r.lookups <= r.lagged {
+		return nil, xerrors.New("not found")
+	}
+	return r.next.LookupTXT(ctx, host)
+}
+
+func TestManager_WaitIssues(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	m := New(nil, cache.NewMemoryCache("test"), nil)
+	e.CmpNoError(m.WaitIssues(ctx))
+
+	m.issueStarted()
+	m.issueStarted()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	e.CmpError(m.WaitIssues(timeoutCtx))
+	cancel()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.issueFinished()
+		m.issueFinished()
+	}()
+	e.CmpNoError(m.WaitIssues(ctx))
+
+	// next issues after idle
+	m.issueStarted()
+	timeoutCtx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	e.CmpError(m.WaitIssues(timeoutCtx))
+	cancel()
+	m.issueFinished()
+	e.CmpNoError(m.WaitIssues(ctx))
+}
+
+func TestManager_FulfillDNS01(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	mc := minimock.NewController(t)
+	defer mc.Finish()
+
+	client := NewAcmeClientMock(mc)
+	client.DNS01ChallengeRecordMock.Expect("token").Return("record", nil)
+
+	provider := &testDNSProvider{}
+	resolver := &testLaggedTXTResolver{lagged: 2, next: provider}
+	m := New(nil, nil, nil)
+	m.DNSProvider = provider
+	m.DNSPropagationResolvers = []DNSTXTResolver{resolver}
+	m.DNSPropagationInterval = time.Millisecond
+
+	cleanup, err := m.fulfill(ctx, client, &acme.Challenge{Type: dns01, Token: "token"}, "*.example.com")
+	e.CmpNoError(err)
+	e.Cmp(resolver.lookups, 3)
+	e.CmpDeeply(provider.records["_acme-challenge.example.com."], []string{"record"})
+
+	cleanup(ctx)
+	e.Len(provider.records["_acme-challenge.example.com."], 0)
+
+	t.Run("PropagationTimeout", func(t *testing.T) {
+		e, ctx, flush := th.NewEnv(t)
+		defer flush()
+
+		client.DNS01ChallengeRecordMock.Expect("token2").Return("record2", nil)
+
+		resolver := &testLaggedTXTResolver{lagged: math.MaxInt32, next: provider}
+		m.DNSPropagationResolvers = []DNSTXTResolver{resolver}
+		m.DNSPropagationTimeout = 10 * time.Millisecond
+
+		_, err := m.fulfill(ctx, client, &acme.Challenge{Type: dns01, Token: "token2"}, "test.com")
+		e.True(xerrors.Is(err, context.DeadlineExceeded))
+		e.Len(provider.records["_acme-challenge.test.com."], 0)
+	})
+
+	t.Run("PresentError", func(t *testing.T) {
+		e, ctx, flush := th.NewEnv(t)
+		defer flush()
+
+		client.DNS01ChallengeRecordMock.Expect("token3").Return("record3", nil)
+
+		errProvider := &testDNSProvider{err: xerrors.New("test")}
+		m.DNSProvider = errProvider
+
+		_, err := m.fulfill(ctx, client, &acme.Challenge{Type: dns01, Token: "token3"}, "test.com")
+		e.CmpError(err)
+	})
+}
@@ -0,0 +1,284 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/contexthelper"
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/xerrors"
+)
+
+const (
+	ocspRequestTimeout  = 30 * time.Second
+	ocspRetryInterval   = 5 * time.Minute
+	ocspDefaultValidity = 12 * time.Hour
+	ocspMaxResponseSize = 1024 * 1024
+)
+
+// staple statuses for metrics
+const (
+	ocspStatusStapled     = "stapled"
+	ocspStatusMissed      = "missed"
+	ocspStatusExpired     = "expired"
+	ocspStatusNoResponder = "no_responder"
+	ocspStatusRevoked     = "revoked"
+)
+
+var errNoOCSPResponder = xerrors.New("certificate has no ocsp responder")
+
+// ocspStaple is ocsp response for the certificate
+type ocspStaple struct {
+	serial     string
+	response   []byte
+	nextUpdate time.Time
+	refreshAt  time.Time
+
+	// revoked is true if responder report the certificate revoked, the response doesn't attach to handshakes
+	revoked bool
+}
+
+// ocspUpdates is set of certificate names with ocsp update in progress
+type ocspUpdates struct {
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func (u *ocspUpdates) start(name string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.running == nil {
+		u.running = make(map[string]bool)
+	}
+	if u.running[name] {
+		return false
+	}
+	u.running[name] = true
+	return true
+}
+
+func (u *ocspUpdates) finish(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.running, name)
+}
+
+// attachOCSPStaple return copy of the certificate with ocsp staple if it known and valid.
+// It starts background update of the staple if it missed or need refresh.
+func (m *Manager) attachOCSPStaple(ctx context.Context, cd CertDescription, cert *tls.Certificate) *tls.Certificate {
+	if !m.EnableOCSPStapling || cert == nil || cert.Leaf == nil {
+		return cert
+	}
+	if len(cert.Leaf.OCSPServer) == 0 {
+		m.ocspStapleStatus.WithLabelValues(ocspStatusNoResponder).Inc()
+		return cert
+	}
+
+	now := time.Now()
+	staple := m.ocspStapleGet(ctx, cd, cert.Leaf)
+	if staple == nil || !now.Before(staple.refreshAt) {
+		m.startOCSPUpdate(ctx, cd, cert)
+	}
+
+	switch {
+	case staple == nil:
+		m.ocspStapleStatus.WithLabelValues(ocspStatusMissed).Inc()
+		return cert
+	case staple.revoked:
+		m.ocspStapleStatus.WithLabelValues(ocspStatusRevoked).Inc()
+		return cert
+	case !now.Before(staple.nextUpdate):
+		m.ocspStapleStatus.WithLabelValues(ocspStatusExpired).Inc()
+		return cert
+	default:
+		m.ocspStapleStatus.WithLabelValues(ocspStatusStapled).Inc()
+		certCopy := *cert
+		certCopy.OCSPStaple = staple.response
+		return &certCopy
+	}
+}
+
+// ocspStapleGet return staple from memory if it is for the certificate
+func (m *Manager) ocspStapleGet(ctx context.Context, cd CertDescription, leaf *x509.Certificate) *ocspStaple {
+	value, err := m.ocspStaples.Get(ctx, cd.String())
+	if err != nil {
+		return nil
+	}
+	staple := value.(*ocspStaple)
+	if staple.serial != leaf.SerialNumber.String() {
+		return nil
+	}
+	return staple
+}
+
+// isOCSPRevoked return true if ocsp responder reported, that the certificate revoked. Revoked certificate need renew.
+func (m *Manager) isOCSPRevoked(ctx context.Context, cd CertDescription, leaf *x509.Certificate) bool {
+	staple := m.ocspStapleGet(ctx, cd, leaf)
+	return staple != nil && staple.revoked
+}
+
+func (m *Manager) startOCSPUpdate(ctx context.Context, cd CertDescription, cert *tls.Certificate) {
+	if !m.ocspUpdates.start(cd.String()) {
+		return
+	}
+
+	// detach from handshake lifetime, but save log context
+	logger := zc.L(ctx).Named("ocsp")
+	ctx, cancel := context.WithTimeout(contexthelper.DropCancelContext(ctx), ocspRequestTimeout)
+	ctx = zc.WithLogger(ctx, logger)
+
+	go func() {
+		defer log.HandlePanic(logger)
+		defer cancel()
+		defer m.ocspUpdates.finish(cd.String())
+
+		err := m.updateOCSPStaple(ctx, cd, cert)
+		log.DebugWarning(logger, err, "Update ocsp staple")
+	}()
+}
+
+// updateOCSPStaple load ocsp response from storage or request it from responder if stored response need refresh.
+func (m *Manager) updateOCSPStaple(ctx context.Context, cd CertDescription, cert *tls.Certificate) error {
+	leaf := cert.Leaf
+	if len(leaf.OCSPServer) == 0 {
+		return errNoOCSPResponder
+	}
+	if len(cert.Certificate) < 2 {
+		return xerrors.New("certificate chain has no issuer")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return xerrors.Errorf("parse issuer certificate: %w", err)
+	}
+
+	now := time.Now()
+	oldStaple := m.ocspStapleGet(ctx, cd, leaf)
+
+	storedResponse, err := m.Cache.Get(ctx, cd.OCSPStoreName())
+	switch {
+	case err == nil:
+		staple, err := newOCSPStaple(storedResponse, leaf, issuer)
+		log.DebugError(zc.L(ctx), err, "Parse stored ocsp response")
+		if err == nil && now.Before(staple.refreshAt) {
+			m.ocspStaplePut(ctx, cd, staple)
+			logOCSPRevoked(ctx, staple, leaf)
+			return nil
+		}
+	case err != cache.ErrCacheMiss:
+		return xerrors.Errorf("get ocsp response from storage: %w", err)
+	}
+
+	response, err := m.requestOCSP(ctx, leaf, issuer)
+	var staple *ocspStaple
+	if err == nil {
+		staple, err = newOCSPStaple(response, leaf, issuer)
+	}
+	if err != nil {
+		// keep old staple while it valid and retry later
+		retryStaple := &ocspStaple{serial: leaf.SerialNumber.String(), refreshAt: now.Add(ocspRetryInterval)}
+		if oldStaple != nil {
+			retryStaple.response = oldStaple.response
+			retryStaple.nextUpdate = oldStaple.nextUpdate
+			retryStaple.revoked = oldStaple.revoked
+		}
+		m.ocspStaplePut(ctx, cd, retryStaple)
+		return xerrors.Errorf("request ocsp response: %w", err)
+	}
+
+	err = m.Cache.Put(ctx, cd.OCSPStoreName(), response)
+	log.DebugError(zc.L(ctx), err, "Store ocsp response", zap.String("key", cd.OCSPStoreName()))
+
+	m.ocspStaplePut(ctx, cd, staple)
+	logOCSPRevoked(ctx, staple, leaf)
+	return nil
+}
+
+func logOCSPRevoked(ctx context.Context, staple *ocspStaple, leaf *x509.Certificate) {
+	if staple.revoked {
+		zc.L(ctx).Error("Certificate revoked by ocsp responder, it will be renewed", log.CertX509(leaf))
+	}
+}
+
+func (m *Manager) ocspStaplePut(ctx context.Context, cd CertDescription, staple *ocspStaple) {
+	err := m.ocspStaples.Put(ctx, cd.String(), staple)
+	log.DebugDPanicCtx(ctx, err, "Put ocsp staple to memory cache", zap.Time("next_update", staple.nextUpdate),
+		zap.Time("refresh_at", staple.refreshAt))
+}
+
+func (m *Manager) requestOCSP(ctx context.Context, leaf, issuer *x509.Certificate) (_ []byte, err error) {
+	m.ocspRequestStart()
+	defer func() {
+		m.ocspRequestFinish(err)
+	}()
+
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("create ocsp request: %w", err)
+	}
+
+	responder := leaf.OCSPServer[0]
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, responder, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/ocsp-request")
+
+	httpClient := m.OCSPHTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(httpRequest)
+	log.DebugError(zc.L(ctx), err, "Request ocsp responder", zap.String("responder", responder))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		closeErr := resp.Body.Close()
+		log.DebugErrorCtx(ctx, closeErr, "Close ocsp response body")
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("unexpected status code from ocsp responder '%v': %v", responder, resp.StatusCode)
+	}
+	return ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, ocspMaxResponseSize))
+}
+
+// newOCSPStaple parse and check ocsp response for the certificate.
+// Staple refreshed in middle of response validity period.
+func newOCSPStaple(response []byte, leaf, issuer *x509.Certificate) (*ocspStaple, error) {
+	parsed, err := ocsp.ParseResponseForCert(response, leaf, issuer)
+	if err != nil {
+		return nil, xerrors.Errorf("parse ocsp response: %w", err)
+	}
+	if parsed.Status == ocsp.Unknown {
+		return nil, xerrors.New("ocsp responder doesn't know the certificate")
+	}
+
+	staple := &ocspStaple{
+		serial:     leaf.SerialNumber.String(),
+		response:   response,
+		nextUpdate: parsed.NextUpdate,
+		revoked:    parsed.Status == ocsp.Revoked,
+	}
+	if staple.nextUpdate.IsZero() {
+		staple.nextUpdate = parsed.ThisUpdate.Add(ocspDefaultValidity)
+	}
+	if !parsed.ThisUpdate.Before(staple.nextUpdate) {
+		return nil, xerrors.Errorf("bad ocsp response validity: %v - %v", parsed.ThisUpdate, staple.nextUpdate)
+	}
+	staple.refreshAt = parsed.ThisUpdate.Add(staple.nextUpdate.Sub(parsed.ThisUpdate) / 2)
+	return staple, nil
+}
@@ -0,0 +1,157 @@
+package cert_manager
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestManager_OCSPStapling(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	now := time.Now()
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	e.CmpNoError(err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	e.CmpNoError(err)
+	caCert, err := x509.ParseCertificate(caDer)
+	e.CmpNoError(err)
+
+	var responderRequests int32
+	var responderFail int32
+	var responderRevoked int32
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&responderRequests, 1)
+		if atomic.LoadInt32(&responderFail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now.Add(-time.Hour),
+			NextUpdate:   now.Add(2 * time.Hour),
+		}
+		if atomic.LoadInt32(&responderRevoked) == 1 {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = now.Add(-time.Minute)
+			template.RevocationReason = ocsp.KeyCompromise
+		}
+		resp, err := ocsp.CreateResponse(caCert, caCert, template, caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(resp)
+	}))
+	defer responder.Close()
+
+	leafKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	e.CmpNoError(err)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test.ru"},
+		DNSNames:     []string{"test.ru"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		OCSPServer:   []string{responder.URL},
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leafTemplate, caCert, leafKey.Public(), caKey)
+	e.CmpNoError(err)
+	leaf, err := x509.ParseCertificate(leafDer)
+	e.CmpNoError(err)
+	cert := &tls.Certificate{Certificate: [][]byte{leafDer, caDer}, PrivateKey: crypto.Signer(leafKey), Leaf: leaf}
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyRSA}
+
+	storage := cache.NewMemoryCache("test")
+	m := New(nil, storage, nil)
+
+	// disabled
+	e.True(m.attachOCSPStaple(ctx, cd, cert) == cert)
+	e.Cmp(atomic.LoadInt32(&responderRequests), int32(0))
+
+	m.EnableOCSPStapling = true
+	e.Nil(m.attachOCSPStaple(ctx, cd, cert).OCSPStaple, "staple requested in background")
+	for i := 0; i < 100 && m.ocspStapleGet(ctx, cd, leaf) == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stapled := m.attachOCSPStaple(ctx, cd, cert)
+	e.NotNil(stapled.OCSPStaple)
+	e.Nil(cert.OCSPStaple, "original certificate must not be changed")
+	e.Cmp(atomic.LoadInt32(&responderRequests), int32(1))
+
+	parsed, err := ocsp.ParseResponseForCert(stapled.OCSPStaple, leaf, caCert)
+	e.CmpNoError(err)
+	e.Cmp(parsed.Status, ocsp.Good)
+
+	stored, err := storage.Get(ctx, "test.ru.rsa.ocsp")
+	e.CmpNoError(err)
+	e.Cmp(stored, stapled.OCSPStaple)
+
+	// load fresh response from storage without request to responder
+	m = New(nil, storage, nil)
+	m.EnableOCSPStapling = true
+	e.CmpNoError(m.updateOCSPStaple(ctx, cd, cert))
+	e.Cmp(m.attachOCSPStaple(ctx, cd, cert).OCSPStaple, stored)
+	e.Cmp(atomic.LoadInt32(&responderRequests), int32(1))
+
+	// keep old staple if responder failed
+	atomic.StoreInt32(&responderFail, 1)
+	e.CmpNoError(storage.Delete(ctx, "test.ru.rsa.ocsp"))
+	e.CmpError(m.updateOCSPStaple(ctx, cd, cert))
+	e.Cmp(atomic.LoadInt32(&responderRequests), int32(2))
+	staple := m.ocspStapleGet(ctx, cd, leaf)
+	e.Cmp(staple.response, stored)
+	e.True(staple.refreshAt.After(time.Now()))
+
+	// revoked certificate doesn't staple and need renew
+	atomic.StoreInt32(&responderFail, 0)
+	atomic.StoreInt32(&responderRevoked, 1)
+	e.False(m.isCertNeedRenew(ctx, cd, cert, now))
+	e.CmpNoError(storeCertificate(ctx, storage, cd, cert))
+	e.NotNil(m.loadFreshCertificate(ctx, cd, []domain.DomainName{"test.ru"}))
+	m.ocspStaples = cache.NewMemoryValueLRU("ocspstaples")
+	e.CmpNoError(m.updateOCSPStaple(ctx, cd, cert))
+	e.Cmp(atomic.LoadInt32(&responderRequests), int32(3))
+	e.True(m.ocspStapleGet(ctx, cd, leaf).revoked)
+	e.True(m.attachOCSPStaple(ctx, cd, cert) == cert)
+	e.True(m.isCertNeedRenew(ctx, cd, cert, now))
+	e.Nil(m.loadFreshCertificate(ctx, cd, []domain.DomainName{"test.ru"}))
+
+	// certificate without responder
+	cert.Leaf = &x509.Certificate{SerialNumber: big.NewInt(3)}
+	e.True(m.attachOCSPStaple(ctx, cd, cert) == cert)
+	e.CmpError(m.updateOCSPStaple(ctx, cd, cert))
+}
@@ -0,0 +1,209 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+const defaultRenewCheckInterval = time.Hour
+const defaultRenewConcurrency = 1
+
+// renewCandidate is stored certificate, which need renew
+type renewCandidate struct {
+	cd     CertDescription
+	domain domain.DomainName
+	expire time.Time
+}
+
+// StartRenewScheduler start background scan of storage every RenewCheckInterval. Certificates in renew window
+// renew with random delay up to RenewJitter, no more then RenewConcurrency issues in same time.
+// Certificates doesn't renew by requests after start the scheduler.
+// It stops when ctx canceled.
+func (m *Manager) StartRenewScheduler(ctx context.Context) error {
+	if _, ok := m.Cache.(cache.Lister); !ok {
+		return ErrStorageCantList
+	}
+	if m.RenewCheckInterval <= 0 {
+		return xerrors.Errorf("bad renew check interval: %v", m.RenewCheckInterval)
+	}
+	if !atomic.CompareAndSwapInt32(&m.renewSchedulerStarted, 0, 1) {
+		return xerrors.New("renew scheduler started already")
+	}
+
+	logger := zc.L(ctx).Named("renew_scheduler")
+	logger.Info("Start renew scheduler", zap.Duration("interval", m.RenewCheckInterval),
+		zap.Int("concurrency", m.RenewConcurrency), zap.Duration("jitter", m.RenewJitter))
+
+	// handlepanic: in renewSchedulerLoop
+	go m.renewSchedulerLoop(zc.WithLogger(ctx, logger))
+	return nil
+}
+
+func (m *Manager) isRenewSchedulerStarted() bool {
+	return atomic.LoadInt32(&m.renewSchedulerStarted) == 1
+}
+
+func (m *Manager) renewSchedulerLoop(ctx context.Context) {
+	logger := zc.L(ctx)
+	defer log.HandlePanic(logger)
+	defer atomic.StoreInt32(&m.renewSchedulerStarted, 0)
+
+	ticker := time.NewTicker(m.RenewCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.renewStoredCertificates(ctx)
+
+		select {
+		case <-ctx.Done():
+			logger.Info("Renew scheduler stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewStoredCertificates renew all certificates from storage, which need renew, and wait while renew finished.
+func (m *Manager) renewStoredCertificates(ctx context.Context) {
+	logger := zc.L(ctx)
+
+	candidates, err := m.findCertificatesForRenew(ctx, time.Now())
+	log.DebugError(logger, err, "Find certificates for renew", zap.Int("count", len(candidates)))
+	if err != nil {
+		return
+	}
+
+	concurrency := m.RenewConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultRenewConcurrency
+	}
+	semaphore := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, candidate := range candidates {
+		select {
+		case <-ctx.Done():
+			return
+		case semaphore <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(candidate renewCandidate) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			defer log.HandlePanic(logger)
+
+			m.renewStoredCertificate(ctx, candidate)
+		}(candidate)
+	}
+}
+
+func (m *Manager) renewStoredCertificate(ctx context.Context, candidate renewCandidate) {
+	logger := zc.L(ctx).With(candidate.cd.ZapField(), zap.Time("expire", candidate.expire))
+	ctx = zc.WithLogger(ctx, logger)
+
+	if m.RenewJitter > 0 {
+		//nolint:gosec
+		delay := time.Duration(rand.Int63n(int64(m.RenewJitter)))
+		logger.Debug("Delay before renew", zap.Duration("delay", delay))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	logger.Info("Renew certificate by scheduler")
+	var err error
+	if candidate.cd.IsWildcard() {
+		// wildcard zones allowed by config and can't be checked by domain checker
+		issueCtx, cancel := context.WithTimeout(ctx, m.CertificateIssueTimeout)
+		_, err = m.createCertificateForDomains(issueCtx, candidate.cd, candidate.cd.DomainNames())
+		cancel()
+	} else {
+		_, err = m.issueNewCert(ctx, candidate.domain, candidate.cd)
+	}
+	log.InfoError(logger, err, "Renew certificate by scheduler finished")
+}
+
+// findCertificatesForRenew return stored certificates, which need renew at the time
+func (m *Manager) findCertificatesForRenew(ctx context.Context, now time.Time) ([]renewCandidate, error) {
+	lister, ok := m.Cache.(cache.Lister)
+	if !ok {
+		return nil, ErrStorageCantList
+	}
+
+	keys, err := lister.Keys(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("list storage keys: %w", err)
+	}
+
+	var res []renewCandidate
+	for _, key := range keys {
+		cd, ok := certDescriptionFromCertStoreName(key, m.AutoSubdomains)
+		if !ok {
+			continue
+		}
+		logger := zc.L(ctx).With(cd.ZapField())
+
+		if m.checkKeyTypeAllowed(cd.KeyType) != nil {
+			logger.Debug("Skip renew certificate with denied key type")
+			continue
+		}
+		if cd.IsWildcard() && !m.isWildcardZoneConfigured(cd) {
+			logger.Debug("Skip renew wildcard certificate of zone, removed from config")
+			continue
+		}
+
+		locked, err := isCertLocked(ctx, m.Cache, cd)
+		if err != nil {
+			return nil, xerrors.Errorf("check lock of '%v': %w", cd, err)
+		}
+		if locked {
+			continue
+		}
+
+		leaf, err := loadCertificateLeaf(ctx, m.Cache, cd)
+		if err != nil {
+			logger.Warn("Can't load stored certificate for check renew", zap.Error(err))
+			continue
+		}
+		if !m.isLeafNeedRenew(ctx, cd, leaf, now, true) {
+			continue
+		}
+
+		candidate := renewCandidate{cd: cd, domain: domain.DomainName(cd.MainDomain), expire: leaf.NotAfter}
+		if !cd.IsWildcard() && len(leaf.DNSNames) > 0 {
+			// main domain may be filtered out by domain checker while issue
+			candidate.domain, err = domain.NormalizeDomain(leaf.DNSNames[0])
+			if err != nil {
+				logger.Warn("Bad domain in stored certificate", zap.String("domain", leaf.DNSNames[0]), zap.Error(err))
+				continue
+			}
+		}
+		res = append(res, candidate)
+	}
+	return res, nil
+}
+
+func (m *Manager) isWildcardZoneConfigured(cd CertDescription) bool {
+	for _, zone := range m.wildcardZones {
+		if wildcardPrefix+zone == cd.MainDomain {
+			return true
+		}
+	}
+	return false
+}
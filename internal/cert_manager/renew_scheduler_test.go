@@ -0,0 +1,77 @@
+package cert_manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestManager_FindCertificatesForRenew(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := cache.NewMemoryCache("test")
+	m := New(nil, storage, nil)
+	m.AutoSubdomains = []string{"www."}
+	m.AllowECDSACert = false
+	e.CmpNoError(m.SetWildcardZones([]string{"zone.ru"}))
+
+	// test certificates valid from now-1h to now+1h
+	now := time.Now()
+	put := func(name string, domains ...string) {
+		certBytes, _ := fastCreateTestCert(domains, now)
+		e.CmpNoError(storage.Put(ctx, name, certBytes))
+	}
+	put("renew.ru.rsa.cer", "www.renew.ru", "renew.ru")
+	put("locked.ru.rsa.cer", "locked.ru")
+	e.CmpNoError(storage.Put(ctx, "locked.ru.lock", []byte{}))
+	put("ecdsa.ru.ecdsa.cer", "ecdsa.ru")
+	put("_wildcard.zone.ru.rsa.cer", "*.zone.ru")
+	put("_wildcard.old-zone.ru.rsa.cer", "*.old-zone.ru")
+	e.CmpNoError(storage.Put(ctx, "bad.ru.rsa.cer", []byte("bad")))
+	e.CmpNoError(storage.Put(ctx, "renew.ru.rsa.key", []byte("key")))
+
+	res, err := m.findCertificatesForRenew(ctx, now)
+	e.CmpNoError(err)
+	e.Len(res, 0)
+
+	res, err = m.findCertificatesForRenew(ctx, now.Add(time.Hour/2))
+	e.CmpNoError(err)
+	e.Len(res, 2)
+	e.Cmp(res[0].cd.MainDomain, "*.zone.ru")
+	e.Cmp(res[1].cd, CertDescription{MainDomain: "renew.ru", KeyType: KeyRSA, Subdomains: []string{"www."}})
+	e.Cmp(res[1].domain.String(), "www.renew.ru")
+
+	m.RenewBeforeExpireRatio = 0.1
+	res, err = m.findCertificatesForRenew(ctx, now.Add(time.Hour/2))
+	e.CmpNoError(err)
+	e.Len(res, 0)
+}
+
+func TestManager_StartRenewScheduler(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	m := New(nil, cache.NewMemoryCache("test"), nil)
+	m.RenewCheckInterval = 0
+	e.CmpError(m.StartRenewScheduler(ctx))
+	e.False(m.isRenewSchedulerStarted())
+
+	ctx, cancel := context.WithCancel(ctx)
+	m.RenewCheckInterval = time.Millisecond
+	e.CmpNoError(m.StartRenewScheduler(ctx))
+	e.True(m.isRenewSchedulerStarted())
+	e.CmpError(m.StartRenewScheduler(ctx))
+
+	cancel()
+	for i := 0; i < 100 && m.isRenewSchedulerStarted(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.False(m.isRenewSchedulerStarted())
+
+	m = New(nil, newCacheMock(t), nil)
+	e.Cmp(m.StartRenewScheduler(ctx), ErrStorageCantList)
+}
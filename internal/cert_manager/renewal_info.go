@@ -0,0 +1,123 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"math/rand"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/ari"
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// renewalSchedule is renew time of certificate, selected in window from renewal info
+type renewalSchedule struct {
+	window    ari.Window
+	renewAt   time.Time
+	nextCheck time.Time
+}
+
+func (m *Manager) isCertNeedRenew(ctx context.Context, cd CertDescription, cert *tls.Certificate, now time.Time) bool {
+	if cert == nil || cert.Leaf == nil {
+		return false
+	}
+	return m.isLeafNeedRenew(ctx, cd, cert.Leaf, now, false)
+}
+
+// isLeafNeedRenew check renew time by renewal info from acme server and by part of certificate lifetime
+// if renewal info unavailable. Renewal info requested from acme server, which issued certificate of cd,
+// if update is true, else used known info only. Certificate, revoked by ocsp responder, need renew immediately.
+func (m *Manager) isLeafNeedRenew(ctx context.Context, cd CertDescription, leaf *x509.Certificate, now time.Time, update bool) bool {
+	if m.isOCSPRevoked(ctx, cd, leaf) {
+		return true
+	}
+	if renewAt, ok := m.renewTimeByRenewalInfo(ctx, cd, leaf, now, update); ok {
+		return !now.Before(renewAt)
+	}
+	return isLeafNeedRenew(leaf, now, m.RenewBeforeExpireRatio)
+}
+
+// renewalInfoGetter return renewal info getter of acme server, which issued certificate of cd.
+// It returns nil if renewal info of the acme server unknown.
+func (m *Manager) renewalInfoGetter(ctx context.Context, cd CertDescription) RenewalInfoGetter {
+	if len(m.RenewalInfoByServer) == 0 {
+		return m.RenewalInfo
+	}
+	meta, err := loadCertificateMeta(ctx, m.Cache, cd)
+	if err != nil || meta.AcmeServer == "" {
+		// certificate issued before record of acme server
+		return m.RenewalInfo
+	}
+	return m.RenewalInfoByServer[meta.AcmeServer]
+}
+
+func (m *Manager) renewTimeByRenewalInfo(ctx context.Context, cd CertDescription, leaf *x509.Certificate, now time.Time, update bool) (time.Time, bool) {
+	if m.RenewalInfo == nil && len(m.RenewalInfoByServer) == 0 {
+		return time.Time{}, false
+	}
+
+	certID, err := ari.CertID(leaf)
+	if err != nil {
+		return time.Time{}, false
+	}
+	logger := zc.L(ctx).With(zap.String("cert_id", certID))
+
+	var schedule *renewalSchedule
+	if cached, err := m.renewalSchedule.Get(ctx, certID); err == nil {
+		schedule = cached.(*renewalSchedule)
+	}
+	if !update || (schedule != nil && now.Before(schedule.nextCheck)) {
+		if schedule == nil {
+			return time.Time{}, false
+		}
+		return schedule.renewAt, true
+	}
+
+	renewalInfo := m.renewalInfoGetter(ctx, cd)
+	if renewalInfo == nil {
+		logger.Debug("Unknown renewal info of acme server, which issued certificate")
+		return time.Time{}, false
+	}
+	info, err := renewalInfo.GetRenewalInfo(ctx, leaf)
+	if err != nil {
+		if xerrors.Is(err, ari.ErrNotSupported) {
+			logger.Debug("Acme server doesn't support renewal info")
+		} else {
+			logger.Warn("Can't get renewal info", zap.Error(err))
+		}
+		if schedule == nil {
+			return time.Time{}, false
+		}
+		return schedule.renewAt, true
+	}
+
+	newSchedule := &renewalSchedule{window: info.SuggestedWindow, nextCheck: info.RetryAfter}
+	if schedule != nil && schedule.window.Start.Equal(info.SuggestedWindow.Start) &&
+		schedule.window.End.Equal(info.SuggestedWindow.End) {
+		// keep selected time for same window
+		newSchedule.renewAt = schedule.renewAt
+	} else {
+		newSchedule.renewAt = selectRenewTime(info.SuggestedWindow)
+		logger.Info("Select renew time by renewal info", zap.Time("renew_at", newSchedule.renewAt),
+			zap.Time("window_start", info.SuggestedWindow.Start), zap.Time("window_end", info.SuggestedWindow.End),
+			zap.String("explanation", info.ExplanationURL))
+	}
+
+	err = m.renewalSchedule.Put(ctx, certID, newSchedule)
+	log.DebugDPanic(logger, err, "Put renewal schedule to cache")
+	return newSchedule.renewAt, true
+}
+
+// selectRenewTime return random time in the window, for spread renews of many certificates
+func selectRenewTime(window ari.Window) time.Time {
+	if !window.End.After(window.Start) {
+		return window.Start
+	}
+	//nolint:gosec
+	return window.Start.Add(time.Duration(rand.Int63n(int64(window.End.Sub(window.Start)))))
+}
@@ -0,0 +1,167 @@
+package cert_manager
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/ari"
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestManager_RenewByRenewalInfo(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	now := time.Now()
+	createLeaf := func(serial int64) *x509.Certificate {
+		key, err := rsa.GenerateKey(rand.Reader, 512)
+		e.CmpNoError(err)
+		template := x509.Certificate{
+			SerialNumber:   big.NewInt(serial),
+			AuthorityKeyId: []byte{1, 2, 3},
+			NotBefore:      now.Add(-time.Hour),
+			NotAfter:       now.Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+		e.CmpNoError(err)
+		leaf, err := x509.ParseCertificate(der)
+		e.CmpNoError(err)
+		return leaf
+	}
+	renewNow := createLeaf(1)
+	renewLater := createLeaf(2)
+	renewNowID, _ := ari.CertID(renewNow)
+	renewLaterID, _ := ari.CertID(renewLater)
+
+	var supportRenewalInfo = true
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeWindow := func(start, end time.Time) {
+			_, _ = w.Write([]byte(`{"suggestedWindow": {"start": "` + start.Format(time.RFC3339) +
+				`", "end": "` + end.Format(time.RFC3339) + `"}}`))
+		}
+		switch r.URL.Path {
+		case "/directory":
+			if supportRenewalInfo {
+				_, _ = w.Write([]byte(`{"renewalInfo": "` + server.URL + `/renewal-info"}`))
+			} else {
+				_, _ = w.Write([]byte(`{}`))
+			}
+		case "/renewal-info/" + renewNowID:
+			writeWindow(now.Add(-2*time.Hour), now.Add(-time.Hour))
+		case "/renewal-info/" + renewLaterID:
+			writeWindow(now.Add(24*time.Hour), now.Add(48*time.Hour))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m := New(nil, cache.NewMemoryCache("test"), nil)
+
+	// without renewal info
+	e.False(m.isLeafNeedRenew(ctx, CertDescription{}, renewNow, now, true))
+	e.True(m.isLeafNeedRenew(ctx, CertDescription{}, renewLater, now.Add(50*time.Minute), true))
+
+	m.RenewalInfo = &ari.Client{DirectoryURL: server.URL + "/directory"}
+
+	// known renewal info only
+	e.False(m.isCertNeedRenew(ctx, CertDescription{}, &tls.Certificate{Leaf: renewNow}, now))
+
+	e.True(m.isLeafNeedRenew(ctx, CertDescription{}, renewNow, now, true))
+	e.False(m.isLeafNeedRenew(ctx, CertDescription{}, renewLater, now.Add(50*time.Minute), true))
+	e.True(m.isLeafNeedRenew(ctx, CertDescription{}, renewLater, now.Add(49*time.Hour), true))
+
+	// use known renewal info without request to server
+	server.Close()
+	e.True(m.isCertNeedRenew(ctx, CertDescription{}, &tls.Certificate{Leaf: renewNow}, now))
+	e.False(m.isCertNeedRenew(ctx, CertDescription{}, &tls.Certificate{Leaf: renewLater}, now.Add(50*time.Minute)))
+
+	// fallback if acme server doesn't support renewal info
+	supportRenewalInfo = false
+	server = httptest.NewServer(server.Config.Handler)
+	defer server.Close()
+	m = New(nil, cache.NewMemoryCache("test"), nil)
+	m.RenewalInfo = &ari.Client{DirectoryURL: server.URL + "/directory"}
+	e.False(m.isLeafNeedRenew(ctx, CertDescription{}, renewNow, now, true))
+	e.True(m.isLeafNeedRenew(ctx, CertDescription{}, renewLater, now.Add(50*time.Minute), true))
+}
+
+func TestManager_RenewalInfoByServer(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	now := time.Now()
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	e.CmpNoError(err)
+	template := x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		AuthorityKeyId: []byte{1, 2, 3},
+		NotBefore:      now.Add(-time.Hour),
+		NotAfter:       now.Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	e.CmpNoError(err)
+	leaf, err := x509.ParseCertificate(der)
+	e.CmpNoError(err)
+	certID, _ := ari.CertID(leaf)
+
+	// acme server return renewal window in past (renew now) or in future (renew later)
+	newServer := func(renewNow bool) *httptest.Server {
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/directory":
+				_, _ = w.Write([]byte(`{"renewalInfo": "` + server.URL + `/renewal-info"}`))
+			case "/renewal-info/" + certID:
+				start := now.Add(24 * time.Hour)
+				if renewNow {
+					start = now.Add(-2 * time.Hour)
+				}
+				_, _ = w.Write([]byte(`{"suggestedWindow": {"start": "` + start.Format(time.RFC3339) +
+					`", "end": "` + start.Add(time.Hour).Format(time.RFC3339) + `"}}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	mainServer := newServer(false)
+	fallbackServer := newServer(true)
+
+	storage := cache.NewMemoryCache("test")
+	m := New(nil, storage, nil)
+	m.RenewalInfo = &ari.Client{DirectoryURL: mainServer.URL + "/directory"}
+	m.RenewalInfoByServer = map[string]RenewalInfoGetter{
+		mainServer.URL + "/directory":     m.RenewalInfo,
+		fallbackServer.URL + "/directory": &ari.Client{DirectoryURL: fallbackServer.URL + "/directory"},
+	}
+
+	mainCD := CertDescription{MainDomain: "main.ru", KeyType: KeyRSA}
+	fallbackCD := CertDescription{MainDomain: "fallback.ru", KeyType: KeyRSA}
+	unknownCD := CertDescription{MainDomain: "unknown.ru", KeyType: KeyRSA}
+	cert := &tls.Certificate{Leaf: leaf}
+	e.CmpNoError(storeCertificateMeta(ctx, storage, mainCD, cert, mainServer.URL+"/directory"))
+	e.CmpNoError(storeCertificateMeta(ctx, storage, fallbackCD, cert, fallbackServer.URL+"/directory"))
+	e.CmpNoError(storeCertificateMeta(ctx, storage, unknownCD, cert, "https://removed.example.com/directory"))
+
+	e.False(m.isLeafNeedRenew(ctx, mainCD, leaf, now, true))
+
+	// same certificate id, drop known schedule for request renewal info again
+	m.renewalSchedule = cache.NewMemoryValueLRU("renewalschedule")
+	e.True(m.isLeafNeedRenew(ctx, fallbackCD, leaf, now, true), "renewal info of fallback acme server")
+
+	// renew by part of lifetime without renewal info
+	m.renewalSchedule = cache.NewMemoryValueLRU("renewalschedule")
+	e.False(m.isLeafNeedRenew(ctx, unknownCD, leaf, now, true))
+	e.True(m.isLeafNeedRenew(ctx, unknownCD, leaf, now.Add(50*time.Minute), true))
+}
@@ -0,0 +1,265 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// StaticCertificates is manually provided certificates from directory, they used before issued certificates.
+// Certificates indexed by dns names (SAN), include wildcard names, or by common name if certificate has no dns names.
+// Certificate and private key paired by public key, so they can be in one file or in different files with any names.
+type StaticCertificates struct {
+	Dir string
+
+	mu        sync.RWMutex
+	byName    map[string][]*tls.Certificate
+	signature string
+}
+
+// NewStaticCertificates create empty certificates set for the directory, call Load for read certificates.
+func NewStaticCertificates(dir string) *StaticCertificates {
+	return &StaticCertificates{Dir: dir}
+}
+
+// Load read all certificates from the directory and replace previous loaded certificates.
+// Files with bad content and certificates without private key skipped with log message.
+func (s *StaticCertificates) Load(ctx context.Context) error {
+	logger := zc.L(ctx)
+
+	signature, err := s.dirSignature()
+	if err != nil {
+		return err
+	}
+
+	var chains []staticCertificateChain
+	keys := make(map[string]crypto.Signer)
+	err = s.walkFiles(func(path string, _ os.FileInfo) error {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return xerrors.Errorf("read static certificate file '%v': %w", path, err)
+		}
+		fileChain, fileKeys, err := parseStaticCertificateFile(content)
+		log.DebugWarning(logger, err, "Parse static certificate file", zap.String("file", path))
+		if err != nil {
+			return nil
+		}
+		if len(fileChain) > 0 {
+			chains = append(chains, staticCertificateChain{file: path, chain: fileChain})
+		}
+		for _, key := range fileKeys {
+			keyID, err := publicKeyID(key.Public())
+			if err != nil {
+				logger.Warn("Skip private key with unknown public key type", zap.String("file", path), zap.Error(err))
+				continue
+			}
+			keys[keyID] = key
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string][]*tls.Certificate)
+	for _, chain := range chains {
+		cert, err := chain.certificate(keys)
+		log.DebugWarning(logger, err, "Load static certificate", zap.String("file", chain.file))
+		if err != nil {
+			continue
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			byName[name] = append(byName[name], cert)
+		}
+		logger.Info("Static certificate loaded", zap.String("file", chain.file), log.Cert(cert))
+	}
+
+	s.mu.Lock()
+	s.byName = byName
+	s.signature = signature
+	s.mu.Unlock()
+
+	logger.Info("Static certificates loaded", zap.String("dir", s.Dir), zap.Int("names_count", len(byName)))
+	return nil
+}
+
+// StartAutoReload check files of the directory every interval and reload certificates if any file changed.
+// It stops when ctx cancelled.
+func (s *StaticCertificates) StartAutoReload(ctx context.Context, interval time.Duration) {
+	logger := zc.L(ctx)
+	go func() {
+		defer log.HandlePanic(logger)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := s.reloadIfChanged(ctx)
+				log.DebugError(logger, err, "Reload static certificates")
+			}
+		}
+	}()
+}
+
+// reloadIfChanged reload certificates if files of the directory changed since last load
+func (s *StaticCertificates) reloadIfChanged(ctx context.Context) (bool, error) {
+	signature, err := s.dirSignature()
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	changed := signature != s.signature
+	s.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+	zc.L(ctx).Info("Static certificates changed, reload them", zap.String("dir", s.Dir))
+	return true, s.Load(ctx)
+}
+
+// GetCertificate return valid certificate for the domain by exact name or wildcard name.
+// If some certificates valid for the domain - it prefer ECDSA certificate if preferECDSA and certificate
+// with latest expire. ECDSA certificates skipped if not preferECDSA, because client doesn't support them.
+// It returns nil if no valid certificate for the domain.
+func (s *StaticCertificates) GetCertificate(d domain.DomainName, preferECDSA bool) *tls.Certificate {
+	if s == nil {
+		return nil
+	}
+
+	name := d.ASCII()
+	s.mu.RLock()
+	candidates := s.byName[name]
+	if dotIndex := strings.Index(name, "."); dotIndex > 0 {
+		candidates = append(candidates[:len(candidates):len(candidates)], s.byName[wildcardPrefix+name[dotIndex+1:]]...)
+	}
+	s.mu.RUnlock()
+
+	now := time.Now()
+	var res *tls.Certificate
+	var resPreferred bool
+	for _, cert := range candidates {
+		if now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
+			continue
+		}
+		_, isECDSA := cert.PrivateKey.(*ecdsa.PrivateKey)
+		if isECDSA && !preferECDSA {
+			continue
+		}
+		preferred := isECDSA == preferECDSA
+		if res == nil || preferred && !resPreferred ||
+			preferred == resPreferred && cert.Leaf.NotAfter.After(res.Leaf.NotAfter) {
+			res = cert
+			resPreferred = preferred
+		}
+	}
+	return res
+}
+
+// dirSignature return string, which changed when any file of directory created, deleted or modified
+func (s *StaticCertificates) dirSignature() (string, error) {
+	var files []string
+	err := s.walkFiles(func(path string, info os.FileInfo) error {
+		files = append(files, fmt.Sprintf("%v|%v|%v", path, info.Size(), info.ModTime().UnixNano()))
+		return nil
+	})
+	sort.Strings(files)
+	return strings.Join(files, "\n"), err
+}
+
+func (s *StaticCertificates) walkFiles(f func(path string, info os.FileInfo) error) error {
+	err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return f(path, info)
+	})
+	if err != nil {
+		return xerrors.Errorf("read static certificates dir '%v': %w", s.Dir, err)
+	}
+	return nil
+}
+
+type staticCertificateChain struct {
+	file  string
+	chain [][]byte
+}
+
+// certificate return certificate with private key from keys, paired by public key
+func (c staticCertificateChain) certificate(keys map[string]crypto.Signer) (*tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(c.chain[0])
+	if err != nil {
+		return nil, xerrors.Errorf("parse certificate: %w", err)
+	}
+	keyID, err := publicKeyID(leaf.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, xerrors.New("no private key for certificate")
+	}
+	return &tls.Certificate{Certificate: c.chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// parseStaticCertificateFile return certificates chain and private keys from pem content.
+// First certificate of the chain is leaf certificate.
+func parseStaticCertificateFile(content []byte) (chain [][]byte, keys []crypto.Signer, err error) {
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return chain, keys, nil
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE":
+			chain = append(chain, block.Bytes)
+		case block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY"):
+			key, err := parsePrivateKey(pem.EncodeToMemory(block))
+			if err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+}
+
+func publicKeyID(publicKey crypto.PublicKey) (string, error) {
+	keyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", xerrors.Errorf("marshal public key: %w", err)
+	}
+	return string(keyBytes), nil
+}
@@ -5,4 +5,5 @@ type Label string
 const (
 	ConnectionID  Label = "connection_id"
 	TLSConnection Label = "tls"
+	ClientIP      Label = "client_ip"
 )
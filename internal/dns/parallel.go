@@ -13,6 +13,11 @@ type ResolverInterface interface {
 	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
 }
 
+type TXTResolverInterface interface {
+	// LookupTXT return txt records of domain. It MUST finish work when context canceled
+	LookupTXT(ctx context.Context, host string) ([]string, error)
+}
+
 type Parallel []ResolverInterface
 
 // NewParallel return parallel resolver
@@ -101,6 +101,24 @@ func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr,
 	return resultIPs, nil
 }
 
+// LookupTXT return TXT records of host. Strings of every record joined to one string.
+// It follow CNAME records and fallback to tcp for truncated answers.
+func (r *Resolver) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	logger := zc.L(ctx).With(zap.String("dns_server", r.server))
+	ctx = zc.WithLogger(ctx, logger)
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+
+	res, err := lookupTXTWithClient(ctx, host, r.server, r.maxDNSRecursionDeep, r.udp)
+	if err == errTruncatedResponse {
+		logger.Debug("fallback to tcp request")
+		res, err = lookupTXTWithClient(ctx, host, r.server, r.maxDNSRecursionDeep, r.tcp)
+	}
+	log.DebugError(logger, err, "TXT lookup", zap.String("host", host), zap.Strings("records", res))
+	return res, err
+}
+
 func (r *Resolver) lookup(ctx context.Context, host string, recordType uint16) ([]net.IPAddr, error) {
 	res, err := r.lookupWithClient(ctx, host, r.server, recordType, r.maxDNSRecursionDeep, r.udp)
 	if err == errTruncatedResponse {
@@ -110,10 +128,63 @@ func (r *Resolver) lookup(ctx context.Context, host string, recordType uint16) (
 	return res, err
 }
 
-//nolint:funlen
 func lookupWithClient(ctx context.Context, host string, server string, recordType uint16, recursion int, client mDNSClient) (ipResults []net.IPAddr, err error) {
 	logger := zc.L(ctx)
 
+	defer func() {
+		log.DebugError(logger, err, "Resolved ips", zap.Any("ipResults", ipResults),
+			zap.Uint16("record_type", recordType))
+	}()
+
+	dnsAnswer, err := exchangeWithClient(ctx, host, server, recordType, recursion, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var resIPs []net.IPAddr
+	for _, r := range dnsAnswer.Answer {
+		rType := r.Header().Rrtype
+
+		switch {
+		case rType == mdns.TypeA && rType == recordType:
+			resIPs = append(resIPs, net.IPAddr{IP: r.(*mdns.A).A})
+		case rType == mdns.TypeAAAA && rType == recordType:
+			resIPs = append(resIPs, net.IPAddr{IP: r.(*mdns.AAAA).AAAA})
+		case rType == mdns.TypeCNAME:
+			cname := r.(*mdns.CNAME)
+			zc.L(ctx).Debug("Receive CNAME record for domain.", zap.String("target", cname.Target))
+			return lookupWithClient(ctx, cname.Target, server, recordType, recursion-1, client)
+		default:
+			// pass
+		}
+	}
+	return resIPs, nil
+}
+
+func lookupTXTWithClient(ctx context.Context, host string, server string, recursion int, client mDNSClient) ([]string, error) {
+	dnsAnswer, err := exchangeWithClient(ctx, host, server, mdns.TypeTXT, recursion, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, r := range dnsAnswer.Answer {
+		switch rr := r.(type) {
+		case *mdns.TXT:
+			res = append(res, strings.Join(rr.Txt, ""))
+		case *mdns.CNAME:
+			zc.L(ctx).Debug("Receive CNAME record for domain.", zap.String("target", rr.Target))
+			return lookupTXTWithClient(ctx, rr.Target, server, recursion-1, client)
+		default:
+			// pass
+		}
+	}
+	return res, nil
+}
+
+func exchangeWithClient(ctx context.Context, host string, server string, recordType uint16, recursion int, client mDNSClient) (*mdns.Msg, error) {
+	logger := zc.L(ctx)
+
 	if recursion <= 0 {
 		logger.Error("Max recursion while resolve domain")
 		return nil, errors.New("max recursion while resolve domain")
@@ -124,11 +195,6 @@ func lookupWithClient(ctx context.Context, host string, server string, recordTyp
 		return nil, ctx.Err()
 	}
 
-	defer func() {
-		log.DebugError(logger, err, "Resolved ips", zap.Any("ipResults", ipResults),
-			zap.Uint16("record_type", recordType))
-	}()
-
 	var msdID uint16
 	for msdID == 0 {
 		msdID = mdns.Id()
@@ -171,24 +237,6 @@ func lookupWithClient(ctx context.Context, host string, server string, recordTyp
 		if answer.err != nil {
 			return nil, answer.err
 		}
-
-		var resIPs []net.IPAddr
-		for _, r := range dnsAnswer.Answer {
-			rType := r.Header().Rrtype
-
-			switch {
-			case rType == mdns.TypeA && rType == recordType:
-				resIPs = append(resIPs, net.IPAddr{IP: r.(*mdns.A).A})
-			case rType == mdns.TypeAAAA && rType == recordType:
-				resIPs = append(resIPs, net.IPAddr{IP: r.(*mdns.AAAA).AAAA})
-			case rType == mdns.TypeCNAME:
-				cname := r.(*mdns.CNAME)
-				zc.L(ctx).Debug("Receive CNAME record for domain.", zap.String("target", cname.Target))
-				return lookupWithClient(ctx, cname.Target, server, recordType, recursion-1, client)
-			default:
-				// pass
-			}
-		}
-		return resIPs, nil
+		return dnsAnswer, nil
 	}
 }
@@ -16,7 +16,9 @@ import (
 )
 
 var (
-	_ ResolverInterface = &Resolver{}
+	_ ResolverInterface    = &Resolver{}
+	_ TXTResolverInterface = &Resolver{}
+	_ TXTResolverInterface = net.DefaultResolver
 )
 
 func TestNewResolver(t *testing.T) {
@@ -218,6 +220,58 @@ func TestLookupWithClient(t *testing.T) {
 	td.Nil(ips)
 }
 
+func TestLookupTXTWithClient(t *testing.T) {
+	ctx, cancel := th.TestContext(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	client := NewMDNSClientMock(mc)
+	client.ExchangeMock.Set(func(m *mdns.Msg, address string) (r *mdns.Msg, rtt time.Duration, err error) {
+		td.CmpDeeply(address, "1.2.3.4:53")
+		td.CmpDeeply(m.Question[0].Qtype, mdns.TypeTXT)
+		switch m.Question[0].Name {
+		case "_acme-challenge.alias.com.":
+			return &mdns.Msg{
+				MsgHdr: mdns.MsgHdr{Id: m.Id},
+				Answer: []mdns.RR{
+					&mdns.CNAME{Hdr: mdns.RR_Header{Rrtype: mdns.TypeCNAME}, Target: "_acme-challenge.target.com."},
+				},
+			}, 0, nil
+		case "_acme-challenge.target.com.":
+			return &mdns.Msg{
+				MsgHdr: mdns.MsgHdr{Id: m.Id},
+				Answer: []mdns.RR{
+					&mdns.TXT{Hdr: mdns.RR_Header{Rrtype: mdns.TypeTXT}, Txt: []string{"part1", "part2"}},
+					&mdns.TXT{Hdr: mdns.RR_Header{Rrtype: mdns.TypeTXT}, Txt: []string{"other"}},
+				},
+			}, 0, nil
+		case "truncated.com.":
+			return &mdns.Msg{MsgHdr: mdns.MsgHdr{Id: m.Id, Truncated: true}}, 0, nil
+		default:
+			return nil, 0, errors.New("unexpected domain")
+		}
+	})
+
+	res, err := lookupTXTWithClient(ctx, "_acme-challenge.alias.com.", "1.2.3.4:53", 2, client)
+	td.CmpNoError(err)
+	td.CmpDeeply(res, []string{"part1part2", "other"})
+
+	res, err = lookupTXTWithClient(ctx, "_acme-challenge.alias.com.", "1.2.3.4:53", 1, client)
+	td.CmpError(err)
+	td.Nil(res)
+
+	res, err = lookupTXTWithClient(ctx, "truncated.com.", "1.2.3.4:53", 1, client)
+	td.CmpDeeply(err, errTruncatedResponse)
+	td.Nil(res)
+
+	res, err = lookupTXTWithClient(ctx, "unknown.com.", "1.2.3.4:53", 1, client)
+	td.CmpError(err)
+	td.Nil(res)
+}
+
 func TestResolver_Lookup(t *testing.T) {
 	ctx, cancel := th.TestContext(t)
 	defer cancel()
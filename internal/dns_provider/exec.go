@@ -0,0 +1,63 @@
+//nolint:golint
+package dns_provider
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const (
+	execActionPresent = "present"
+	execActionCleanup = "cleanup"
+)
+
+// Exec manage TXT records by external command.
+// The command call with args: <present|cleanup> <fqdn> <value>
+// Exit code 0 mean success.
+type Exec struct {
+	Command string
+	Timeout time.Duration
+}
+
+func NewExec(command string) *Exec {
+	return &Exec{Command: command, Timeout: defaultExecTimeout}
+}
+
+func (p *Exec) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, execActionPresent, fqdn, value)
+}
+
+func (p *Exec) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, execActionCleanup, fqdn, value)
+}
+
+func (p *Exec) run(ctx context.Context, action, fqdn, value string) error {
+	logger := zc.L(ctx).With(zap.String("command", p.Command), zap.String("action", action),
+		zap.String("fqdn", fqdn), zap.String("value", value))
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Command, action, fqdn, value) //nolint:gosec
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	log.InfoError(logger, err, "Run dns hook", zap.ByteString("output", output.Bytes()))
+	if err != nil {
+		return xerrors.Errorf("run dns hook '%v %v': %w", p.Command, action, err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+//nolint:golint
+package dns_provider
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test use shell script")
+	}
+
+	e, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	dir := th.TmpDir(e)
+	outFile := filepath.Join(dir, "out.txt")
+	script := filepath.Join(dir, "hook.sh")
+	err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+if [ "$3" = "fail" ]; then
+	exit 1
+fi
+echo "$@" >> `+outFile+`
+`), 0700)
+	e.CmpNoError(err)
+
+	provider := NewExec(script)
+	e.CmpNoError(provider.Present(ctx, "_acme-challenge.example.com.", "value"))
+	e.CmpNoError(provider.CleanUp(ctx, "_acme-challenge.example.com.", "value"))
+	e.CmpError(provider.Present(ctx, "_acme-challenge.example.com.", "fail"))
+
+	content, err := ioutil.ReadFile(outFile)
+	e.CmpNoError(err)
+	e.CmpDeeply(string(content), "present _acme-challenge.example.com. value\ncleanup _acme-challenge.example.com. value\n")
+
+	provider = NewExec(script)
+	provider.Command = filepath.Join(dir, "not-exist.sh")
+	e.CmpError(provider.Present(ctx, "_acme-challenge.example.com.", "value"))
+
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nexec sleep 10\n"), 0700)
+	e.CmpNoError(err)
+	provider = NewExec(script)
+	provider.Timeout = time.Millisecond * 100
+	e.CmpError(provider.Present(ctx, "_acme-challenge.example.com.", "value"))
+}
@@ -0,0 +1,112 @@
+//nolint:golint
+package dns_provider
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+)
+
+const (
+	providerNone    = ""
+	providerRFC2136 = "rfc2136"
+	providerExec    = "exec"
+)
+
+const defaultTTL = 60
+const defaultExecTimeout = time.Minute
+
+// Provider create and remove TXT records for dns-01 challenges
+type Provider interface {
+	// Present create TXT record with value for fqdn.
+	// fqdn is full domain name of record, with dot at end. For example: _acme-challenge.example.com.
+	Present(ctx context.Context, fqdn, value string) error
+
+	// CleanUp remove TXT record, created by Present. It must not remove other values of the fqdn.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+//nolint:maligned
+type Config struct {
+	Provider string
+
+	PropagationTimeoutSeconds  int
+	PropagationIntervalSeconds int
+
+	RFC2136Server        string
+	RFC2136Zone          string
+	RFC2136TSIGKeyName   string
+	RFC2136TSIGAlgorithm string
+	RFC2136TSIGSecret    string
+	RFC2136TTL           int
+
+	ExecCommand        string
+	ExecTimeoutSeconds int
+}
+
+// CreateProvider return configured provider. It return nil, nil if provider disabled.
+func (c *Config) CreateProvider(ctx context.Context) (Provider, error) {
+	logger := zc.L(ctx)
+
+	providerName := strings.ToLower(strings.TrimSpace(c.Provider))
+	logger.Info("Create dns provider", zap.String("provider", providerName))
+
+	var provider Provider
+	var err error
+	switch providerName {
+	case providerNone:
+		return nil, nil
+	case providerRFC2136:
+		provider, err = c.createRFC2136()
+	case providerExec:
+		provider, err = c.createExec()
+	default:
+		err = xerrors.Errorf("unknown dns provider: '%v'", c.Provider)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+func (c *Config) createRFC2136() (*RFC2136, error) {
+	if strings.TrimSpace(c.RFC2136Server) == "" {
+		return nil, xerrors.New("empty rfc2136 dns server address")
+	}
+
+	res := NewRFC2136(c.RFC2136Server)
+	res.Zone = c.RFC2136Zone
+	if c.RFC2136TTL > 0 {
+		res.TTL = uint32(c.RFC2136TTL)
+	}
+
+	if c.RFC2136TSIGKeyName != "" {
+		if c.RFC2136TSIGSecret == "" {
+			return nil, xerrors.New("empty tsig secret for rfc2136 dns provider")
+		}
+		res.TSIGKeyName = c.RFC2136TSIGKeyName
+		res.TSIGSecret = c.RFC2136TSIGSecret
+		if c.RFC2136TSIGAlgorithm != "" {
+			res.TSIGAlgorithm = c.RFC2136TSIGAlgorithm
+		}
+	}
+	return res, nil
+}
+
+func (c *Config) createExec() (*Exec, error) {
+	if strings.TrimSpace(c.ExecCommand) == "" {
+		return nil, xerrors.New("empty command for exec dns provider")
+	}
+
+	res := NewExec(c.ExecCommand)
+	if c.ExecTimeoutSeconds > 0 {
+		res.Timeout = time.Duration(c.ExecTimeoutSeconds) * time.Second
+	}
+	return res, nil
+}
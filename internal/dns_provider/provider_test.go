@@ -0,0 +1,80 @@
+//nolint:golint
+package dns_provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestConfig_CreateProvider(t *testing.T) {
+	e, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	table := []struct {
+		name     string
+		config   Config
+		expected interface{}
+		err      bool
+	}{
+		{name: "none", config: Config{}, expected: nil},
+		{name: "unknown", config: Config{Provider: "unknown"}, err: true},
+		{name: "rfc2136-no-server", config: Config{Provider: "rfc2136"}, err: true},
+		{
+			name:   "rfc2136-defaults",
+			config: Config{Provider: "RFC2136", RFC2136Server: "127.0.0.1:53"},
+			expected: testdeep.Struct(&RFC2136{}, testdeep.StructFields{
+				"Server":        "127.0.0.1:53",
+				"TTL":           uint32(defaultTTL),
+				"TSIGKeyName":   "",
+				"TSIGAlgorithm": "hmac-sha256.",
+			}),
+		},
+		{
+			name: "rfc2136-full",
+			config: Config{Provider: "rfc2136", RFC2136Server: "127.0.0.1:53", RFC2136Zone: "example.com",
+				RFC2136TTL: 10, RFC2136TSIGKeyName: "key", RFC2136TSIGSecret: "secret", RFC2136TSIGAlgorithm: "hmac-sha512"},
+			expected: testdeep.Struct(&RFC2136{}, testdeep.StructFields{
+				"Server":        "127.0.0.1:53",
+				"Zone":          "example.com",
+				"TTL":           uint32(10),
+				"TSIGKeyName":   "key",
+				"TSIGSecret":    "secret",
+				"TSIGAlgorithm": "hmac-sha512",
+			}),
+		},
+		{name: "rfc2136-no-secret", config: Config{Provider: "rfc2136", RFC2136Server: "127.0.0.1:53", RFC2136TSIGKeyName: "key"}, err: true},
+		{name: "exec-no-command", config: Config{Provider: "exec"}, err: true},
+		{
+			name:     "exec",
+			config:   Config{Provider: "exec", ExecCommand: "/bin/true", ExecTimeoutSeconds: 5},
+			expected: &Exec{Command: "/bin/true", Timeout: 5 * time.Second},
+		},
+		{
+			name:     "exec-default-timeout",
+			config:   Config{Provider: "exec", ExecCommand: "/bin/true"},
+			expected: &Exec{Command: "/bin/true", Timeout: defaultExecTimeout},
+		},
+	}
+
+	for _, test := range table {
+		e.Run(test.name, func(t *testing.T) {
+			td := testdeep.NewT(t)
+			provider, err := test.config.CreateProvider(ctx)
+			if test.err {
+				td.CmpError(err)
+				td.Nil(provider)
+				return
+			}
+			td.CmpNoError(err)
+			if test.expected == nil {
+				td.Nil(provider)
+			} else {
+				td.Cmp(provider, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+//nolint:golint
+package dns_provider
+
+import (
+	"context"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const tsigFudgeSeconds = 300
+
+type dnsExchanger interface {
+	ExchangeContext(ctx context.Context, m *mdns.Msg, address string) (r *mdns.Msg, rtt time.Duration, err error)
+}
+
+// RFC2136 manage TXT records by dynamic dns updates (RFC 2136), optionally signed by TSIG.
+type RFC2136 struct {
+	// Server - ip:port of dns server, which accept updates
+	Server string
+
+	// Zone for update. If empty - detect by SOA request to the Server.
+	Zone string
+
+	TTL           uint32
+	TSIGKeyName   string
+	TSIGAlgorithm string
+	TSIGSecret    string // base64 encoded
+
+	client dnsExchanger
+}
+
+func NewRFC2136(server string) *RFC2136 {
+	return &RFC2136{
+		Server:        server,
+		TTL:           defaultTTL,
+		TSIGAlgorithm: mdns.HmacSHA256,
+	}
+}
+
+func (p *RFC2136) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+func (p *RFC2136) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+func (p *RFC2136) update(ctx context.Context, fqdn, value string, insert bool) error {
+	fqdn = mdns.Fqdn(fqdn)
+	logger := zc.L(ctx).With(zap.String("fqdn", fqdn), zap.String("value", value), zap.Bool("insert", insert))
+
+	zone, err := p.getZone(ctx, fqdn)
+	log.DebugError(logger, err, "Get zone for update", zap.String("zone", zone))
+	if err != nil {
+		return err
+	}
+
+	rr := &mdns.TXT{
+		Hdr: mdns.RR_Header{Name: fqdn, Rrtype: mdns.TypeTXT, Class: mdns.ClassINET, Ttl: p.TTL},
+		Txt: splitTXTValue(value),
+	}
+
+	msg := new(mdns.Msg)
+	msg.SetUpdate(zone)
+	if insert {
+		msg.Insert([]mdns.RR{rr})
+	} else {
+		msg.Remove([]mdns.RR{rr})
+	}
+
+	answer, err := p.exchange(ctx, msg)
+	log.DebugError(logger, err, "Send dns update")
+	if err != nil {
+		return err
+	}
+	if answer.Rcode != mdns.RcodeSuccess {
+		return xerrors.Errorf("dns update failed with rcode: %v", mdns.RcodeToString[answer.Rcode])
+	}
+	return nil
+}
+
+func (p *RFC2136) getZone(ctx context.Context, fqdn string) (string, error) {
+	if p.Zone != "" {
+		return mdns.Fqdn(p.Zone), nil
+	}
+
+	msg := new(mdns.Msg)
+	msg.SetQuestion(fqdn, mdns.TypeSOA)
+	answer, err := p.exchange(ctx, msg)
+	if err != nil {
+		return "", xerrors.Errorf("query soa for detect zone: %w", err)
+	}
+
+	for _, section := range [][]mdns.RR{answer.Answer, answer.Ns} {
+		for _, rr := range section {
+			if soa, ok := rr.(*mdns.SOA); ok {
+				return soa.Hdr.Name, nil
+			}
+		}
+	}
+	return "", xerrors.Errorf("can't detect zone for domain: '%v'", fqdn)
+}
+
+func (p *RFC2136) exchange(ctx context.Context, msg *mdns.Msg) (*mdns.Msg, error) {
+	client := p.client
+	if client == nil {
+		dnsClient := &mdns.Client{Net: "tcp"}
+		if p.TSIGKeyName != "" {
+			dnsClient.TsigSecret = map[string]string{mdns.Fqdn(p.TSIGKeyName): p.TSIGSecret}
+		}
+		client = dnsClient
+	}
+
+	if p.TSIGKeyName != "" {
+		msg.SetTsig(mdns.Fqdn(p.TSIGKeyName), mdns.Fqdn(p.TSIGAlgorithm), tsigFudgeSeconds, time.Now().Unix())
+	}
+
+	answer, _, err := client.ExchangeContext(ctx, msg, p.Server)
+	return answer, err
+}
+
+// splitTXTValue split value to 255 bytes parts, max length of one TXT string
+func splitTXTValue(value string) []string {
+	const maxLen = 255
+
+	var res []string
+	for len(value) > maxLen {
+		res = append(res, value[:maxLen])
+		value = value[maxLen:]
+	}
+	return append(res, value)
+}
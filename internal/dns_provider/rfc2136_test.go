@@ -0,0 +1,136 @@
+//nolint:golint
+package dns_provider
+
+import (
+	"sync"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+const (
+	testTSIGKeyName = "test-key."
+	testTSIGSecret  = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+)
+
+type testDNSServer struct {
+	mu      sync.Mutex
+	records map[string][]string
+	zones   []string
+	tsigErr error
+}
+
+func (s *testDNSServer) ServeDNS(w mdns.ResponseWriter, r *mdns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	answer := new(mdns.Msg)
+	answer.SetReply(r)
+	if r.IsTsig() != nil {
+		s.tsigErr = w.TsigStatus()
+		answer.SetTsig(r.Extra[len(r.Extra)-1].(*mdns.TSIG).Hdr.Name, mdns.HmacSHA256, tsigFudgeSeconds, int64(r.IsTsig().TimeSigned))
+	}
+
+	switch r.Opcode {
+	case mdns.OpcodeQuery:
+		for _, zone := range s.zones {
+			if mdns.IsSubDomain(zone, r.Question[0].Name) {
+				answer.Ns = append(answer.Ns, &mdns.SOA{Hdr: mdns.RR_Header{Name: zone, Rrtype: mdns.TypeSOA, Class: mdns.ClassINET},
+					Ns: "ns." + zone, Mbox: "admin." + zone})
+			}
+		}
+	case mdns.OpcodeUpdate:
+		if len(s.zones) > 0 && r.Question[0].Name != s.zones[0] {
+			answer.Rcode = mdns.RcodeNotZone
+			break
+		}
+		for _, rr := range r.Ns {
+			txt := rr.(*mdns.TXT)
+			name := txt.Hdr.Name
+			value := txt.Txt[0]
+			if txt.Hdr.Class == mdns.ClassNONE {
+				var newValues []string
+				for _, v := range s.records[name] {
+					if v != value {
+						newValues = append(newValues, v)
+					}
+				}
+				s.records[name] = newValues
+			} else {
+				s.records[name] = append(s.records[name], value)
+			}
+		}
+	}
+	_ = w.WriteMsg(answer)
+}
+
+func startTestDNSServer(e *th.Env, handler *testDNSServer) string {
+	listener := th.NewLocalTcpListener(e)
+	server := &mdns.Server{
+		Listener:   listener,
+		Handler:    handler,
+		TsigSecret: map[string]string{testTSIGKeyName: testTSIGSecret},
+		MsgAcceptFunc: func(dh mdns.Header) mdns.MsgAcceptAction {
+			return mdns.MsgAccept
+		},
+	}
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	e.T().Cleanup(func() { _ = server.Shutdown() })
+
+	return listener.Addr().String()
+}
+
+func TestRFC2136(t *testing.T) {
+	e, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	handler := &testDNSServer{records: map[string][]string{}, zones: []string{"example.com."}}
+	provider := NewRFC2136(startTestDNSServer(e, handler))
+	provider.TSIGKeyName = "test-key"
+	provider.TSIGSecret = testTSIGSecret
+
+	e.CmpNoError(provider.Present(ctx, "_acme-challenge.example.com.", "value1"))
+	e.CmpNoError(provider.Present(ctx, "_acme-challenge.example.com", "value2"))
+	e.CmpDeeply(handler.records["_acme-challenge.example.com."], []string{"value1", "value2"})
+	e.CmpNoError(handler.tsigErr)
+
+	e.CmpNoError(provider.CleanUp(ctx, "_acme-challenge.example.com.", "value1"))
+	e.CmpDeeply(handler.records["_acme-challenge.example.com."], []string{"value2"})
+
+	provider.Zone = "other.com"
+	e.CmpError(provider.Present(ctx, "_acme-challenge.example.com.", "value3"))
+	e.CmpDeeply(handler.records["_acme-challenge.example.com."], []string{"value2"})
+}
+
+func TestRFC2136_DetectZoneFailed(t *testing.T) {
+	e, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	handler := &testDNSServer{records: map[string][]string{}}
+	provider := NewRFC2136(startTestDNSServer(e, handler))
+
+	e.CmpError(provider.Present(ctx, "_acme-challenge.example.com.", "value1"))
+	e.Len(handler.records, 0)
+}
+
+func TestSplitTXTValue(t *testing.T) {
+	e, _, cancel := th.NewEnv(t)
+	defer cancel()
+
+	e.CmpDeeply(splitTXTValue(""), []string{""})
+	e.CmpDeeply(splitTXTValue("asd"), []string{"asd"})
+
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = 'a'
+	}
+	e.CmpDeeply(splitTXTValue(string(long)), []string{string(long[:255]), string(long[255:])})
+}
@@ -92,34 +92,66 @@ func (c *Config) CreateDomainChecker(ctx context.Context) (DomainChecker, error)
 	return res, nil
 }
 
+// CreateTXTResolvers return resolvers for check TXT records. One resolver for every configured dns server
+// or system resolver if no dns servers configured.
+func (c *Config) CreateTXTResolvers(ctx context.Context) ([]dns.TXTResolverInterface, error) {
+	addresses, err := c.resolverAddresses(zc.L(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return []dns.TXTResolverInterface{net.DefaultResolver}, nil
+	}
+
+	res := make([]dns.TXTResolverInterface, 0, len(addresses))
+	for _, addr := range addresses {
+		res = append(res, dns.NewResolver(addr))
+	}
+	return res, nil
+}
+
 func (c *Config) createResolver(logger *zap.Logger) (Resolver, error) {
-	var resolver Resolver
+	addresses, err := c.resolverAddresses(logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return net.DefaultResolver, nil
+	}
+
+	var resolvers = make([]dns.ResolverInterface, 0, len(addresses))
+	for _, addr := range addresses {
+		resolvers = append(resolvers, dns.NewResolver(addr))
+	}
+	return dns.NewParallel(resolvers...), nil
+}
+
+// resolverAddresses return parsed ip:port addresses of dns servers from config or empty slice for system resolver
+func (c *Config) resolverAddresses(logger *zap.Logger) ([]string, error) {
 	if strings.TrimSpace(c.Resolver) == "" {
-		resolver = net.DefaultResolver
-	} else {
-		stringAddresses := strings.Split(c.Resolver, ",")
-		var resolvers = make([]dns.ResolverInterface, 0, len(stringAddresses))
-		for _, addr := range stringAddresses {
-			addr = strings.TrimSpace(addr)
-			if addr == "" {
-				continue
-			}
-			tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
-			if err != nil {
-				logger.Error("Can't resolve dns server address string", zap.String("addr", addr), zap.Error(err))
-				return nil, err
-			}
-			if len(tcpAddr.IP) == 0 {
-				logger.Error("Can't resolve dns server address ip - it is empty.", zap.String("addr", addr))
-				return nil, errors.New("empty ip address")
-			}
-			if tcpAddr.Port == 0 {
-				tcpAddr.Port = 53 // default dns port
-			}
-			tcpAddrString := tcpAddr.String()
-			resolvers = append(resolvers, dns.NewResolver(tcpAddrString))
+		return nil, nil
+	}
+
+	stringAddresses := strings.Split(c.Resolver, ",")
+	var res = make([]string, 0, len(stringAddresses))
+	for _, addr := range stringAddresses {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
 		}
-		resolver = dns.NewParallel(resolvers...)
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			logger.Error("Can't resolve dns server address string", zap.String("addr", addr), zap.Error(err))
+			return nil, err
+		}
+		if len(tcpAddr.IP) == 0 {
+			logger.Error("Can't resolve dns server address ip - it is empty.", zap.String("addr", addr))
+			return nil, errors.New("empty ip address")
+		}
+		if tcpAddr.Port == 0 {
+			tcpAddr.Port = 53 // default dns port
+		}
+		res = append(res, tcpAddr.String())
 	}
-	return resolver, nil
+	return res, nil
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/gojuno/minimock/v3"
 
 	"github.com/maxatome/go-testdeep"
+	"github.com/rekby/lets-proxy2/internal/dns"
 	"github.com/rekby/lets-proxy2/internal/th"
 )
 
@@ -240,3 +241,25 @@ func TestConfig_CreateDomainCheckerComplex(t *testing.T) {
 	td.False(res)
 	td.CmpError(err)
 }
+
+func TestConfig_CreateTXTResolvers(t *testing.T) {
+	ctx, cancel := th.TestContext(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+
+	cfg := Config{}
+	resolvers, err := cfg.CreateTXTResolvers(ctx)
+	td.CmpNoError(err)
+	td.CmpDeeply(resolvers, []dns.TXTResolverInterface{net.DefaultResolver})
+
+	cfg = Config{Resolver: "1.2.3.4:53, [::1]:5353"}
+	resolvers, err = cfg.CreateTXTResolvers(ctx)
+	td.CmpNoError(err)
+	td.CmpDeeply(len(resolvers), 2)
+
+	cfg = Config{Resolver: "bad-address:asd"}
+	resolvers, err = cfg.CreateTXTResolvers(ctx)
+	td.CmpError(err)
+	td.Nil(resolvers)
+}
@@ -0,0 +1,31 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Reloadable proxy checks to inner checker, which can be replaced while the program work.
+type Reloadable struct {
+	checker atomic.Value // reloadableHolder
+}
+
+type reloadableHolder struct {
+	checker DomainChecker
+}
+
+func NewReloadable(checker DomainChecker) *Reloadable {
+	res := &Reloadable{}
+	res.Set(checker)
+	return res
+}
+
+// Set replace inner checker. Checks in progress finish with old checker.
+func (r *Reloadable) Set(checker DomainChecker) {
+	r.checker.Store(reloadableHolder{checker: checker})
+}
+
+func (r *Reloadable) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
+	return r.checker.Load().(reloadableHolder).checker.IsDomainAllowed(ctx, domain)
+}
@@ -0,0 +1,29 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+
+	"github.com/maxatome/go-testdeep"
+)
+
+func TestReloadable(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	var _ DomainChecker = &Reloadable{}
+
+	r := NewReloadable(True{})
+	res, err := r.IsDomainAllowed(ctx, "asd")
+	td.True(res)
+	td.CmpNoError(err)
+
+	r.Set(False{})
+	res, err = r.IsDomainAllowed(ctx, "asd")
+	td.False(res)
+	td.CmpNoError(err)
+}
@@ -0,0 +1,218 @@
+//nolint:golint
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rekby/fastuuid"
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/contexthelper"
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+const defaultTTL = time.Minute
+
+// ErrLocked returned if lease hold by other owner
+var ErrLocked = xerrors.New("lease locked by other owner")
+
+// Locker take leases in shared storage. Lease hold until release or TTL expired without renew.
+// Locker renew own leases in background every TTL/3.
+type Locker struct {
+	Storage cache.Atomic
+	Owner   string
+	TTL     time.Duration
+
+	now func() time.Time
+}
+
+type leaseData struct {
+	Owner  string    `json:"owner"`
+	Expire time.Time `json:"expire"`
+}
+
+// NewLocker create locker with random owner id
+func NewLocker(storage cache.Atomic) *Locker {
+	return &Locker{
+		Storage: storage,
+		Owner:   fastuuid.MustUUIDv4String(),
+		TTL:     defaultTTL,
+	}
+}
+
+// Lease is taken lock in storage.
+type Lease struct {
+	locker *Locker
+	key    string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	data     []byte
+	released bool
+	stopped  chan struct{}
+}
+
+// TryAcquire take lease with the key. It returns ErrLocked if lease hold by other owner and doesn't expired.
+// Context of returned lease canceled when parent context canceled, lease released or lost.
+func (l *Locker) TryAcquire(ctx context.Context, key string) (*Lease, error) {
+	logger := zc.L(ctx).With(zap.String("lease_key", key))
+
+	data, err := l.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	err = l.Storage.Create(ctx, key, data)
+	if err == cache.ErrKeyExists {
+		err = l.takeExpired(ctx, key, data)
+	}
+	log.DebugInfo(logger, err, "Try acquire lease")
+	if err != nil {
+		return nil, err
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	res := &Lease{
+		locker:  l,
+		key:     key,
+		ctx:     leaseCtx,
+		cancel:  cancel,
+		data:    data,
+		stopped: make(chan struct{}),
+	}
+	go res.renewLoop()
+	return res, nil
+}
+
+// takeExpired replace expired lease of other owner
+func (l *Locker) takeExpired(ctx context.Context, key string, newData []byte) error {
+	oldData, err := l.Storage.Get(ctx, key)
+	if err == cache.ErrCacheMiss {
+		// released between create and get
+		return l.Storage.Create(ctx, key, newData)
+	}
+	if err != nil {
+		return err
+	}
+
+	var old leaseData
+	if err = json.Unmarshal(oldData, &old); err != nil {
+		zc.L(ctx).Warn("Bad lease data, take it", zap.String("lease_key", key), zap.Error(err))
+	} else if l.getNow().Before(old.Expire) {
+		return ErrLocked
+	}
+
+	err = l.Storage.CompareAndSwap(ctx, key, oldData, newData)
+	if err == cache.ErrValueChanged {
+		return ErrLocked
+	}
+	return err
+}
+
+func (l *Locker) marshal() ([]byte, error) {
+	return json.Marshal(leaseData{Owner: l.Owner, Expire: l.getNow().Add(l.getTTL())})
+}
+
+func (l *Locker) getNow() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+func (l *Locker) getTTL() time.Duration {
+	if l.TTL > 0 {
+		return l.TTL
+	}
+	return defaultTTL
+}
+
+// Context canceled when lease released or lost
+func (l *Lease) Context() context.Context {
+	return l.ctx
+}
+
+// Release stop renew and remove lease from storage
+func (l *Lease) Release(ctx context.Context) error {
+	l.mu.Lock()
+	if l.released {
+		l.mu.Unlock()
+		return nil
+	}
+	l.released = true
+	l.mu.Unlock()
+
+	l.cancel()
+	<-l.stopped
+
+	l.mu.Lock()
+	data := l.data
+	l.mu.Unlock()
+
+	err := l.locker.Storage.CompareAndDelete(ctx, l.key, data)
+	if err == cache.ErrValueChanged {
+		// lease lost and taken by other owner
+		err = nil
+	}
+	log.DebugError(zc.L(ctx), err, "Release lease", zap.String("lease_key", l.key))
+	return err
+}
+
+func (l *Lease) renewLoop() {
+	logger := zc.L(l.ctx).With(zap.String("lease_key", l.key))
+	defer log.HandlePanic(logger)
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(l.locker.getTTL() / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+			err := l.renew()
+			switch {
+			case err == cache.ErrValueChanged:
+				logger.Warn("Lease lost")
+				l.cancel()
+				return
+			case err != nil:
+				// retry on next tick, lease alive until TTL
+				logger.Warn("Can't renew lease", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (l *Lease) renew() error {
+	newData, err := l.locker.marshal()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	oldData := l.data
+	l.mu.Unlock()
+
+	// renew must complete even if lease released in same time
+	ctx, cancel := context.WithTimeout(contexthelper.DropCancelContext(l.ctx), l.locker.getTTL()/3)
+	defer cancel()
+
+	err = l.locker.Storage.CompareAndSwap(ctx, l.key, oldData, newData)
+	log.DebugError(zc.L(l.ctx), err, "Renew lease", zap.String("lease_key", l.key))
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.data = newData
+	l.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,76 @@
+package lease
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestLocker(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := cache.NewMemoryCache("test")
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	getNow := func() time.Time { return now }
+
+	l1 := &Locker{Storage: storage, Owner: "1", TTL: time.Hour, now: getNow}
+	l2 := &Locker{Storage: storage, Owner: "2", TTL: time.Hour, now: getNow}
+
+	lease1, err := l1.TryAcquire(ctx, "key")
+	e.CmpNoError(err)
+
+	_, err = l2.TryAcquire(ctx, "key")
+	e.Cmp(err, ErrLocked)
+
+	e.CmpNoError(lease1.Release(ctx))
+	e.CmpError(lease1.Context().Err())
+	_, err = storage.Get(ctx, "key")
+	e.Cmp(err, cache.ErrCacheMiss)
+
+	lease2, err := l2.TryAcquire(ctx, "key")
+	e.CmpNoError(err)
+
+	// take expired lease
+	now = now.Add(2 * time.Hour)
+	lease1, err = l1.TryAcquire(ctx, "key")
+	e.CmpNoError(err)
+
+	// release of lost lease doesn't remove lease of other owner
+	e.CmpNoError(lease2.Release(ctx))
+	_, err = l2.TryAcquire(ctx, "key")
+	e.Cmp(err, ErrLocked)
+	e.CmpNoError(lease1.Release(ctx))
+}
+
+func TestLeaseRenew(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := cache.NewMemoryCache("test")
+	l := &Locker{Storage: storage, Owner: "1", TTL: 30 * time.Millisecond}
+
+	lease, err := l.TryAcquire(ctx, "key")
+	e.CmpNoError(err)
+
+	// lease alive after some TTL
+	time.Sleep(100 * time.Millisecond)
+	e.CmpNoError(lease.Context().Err())
+	_, err = (&Locker{Storage: storage, Owner: "2", TTL: time.Minute}).TryAcquire(ctx, "key")
+	e.Cmp(err, ErrLocked)
+
+	// lease lost if value changed
+	e.CmpNoError(storage.Put(ctx, "key", []byte("other")))
+	select {
+	case <-lease.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("lease context must be canceled after lost lease")
+	}
+	e.CmpNoError(lease.Release(ctx))
+
+	data, err := storage.Get(ctx, "key")
+	e.CmpNoError(err)
+	e.Cmp(data, []byte("other"))
+}
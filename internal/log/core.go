@@ -0,0 +1,73 @@
+package log
+
+import (
+	"bytes"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// entryWriter write one encoded log entry
+type entryWriter interface {
+	WriteEntry(entry zapcore.Entry, message []byte) error
+}
+
+// entryCore is zap core, which send every encoded entry with its level to entryWriter,
+// for outputs which need level of entry: syslog, journald.
+type entryCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	writer  entryWriter
+}
+
+func newEntryCore(encoder zapcore.Encoder, level zapcore.LevelEnabler, writer entryWriter) zapcore.Core {
+	return &entryCore{LevelEnabler: level, encoder: encoder, writer: writer}
+}
+
+func (c *entryCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := c.encoder.Clone()
+	for i := range fields {
+		fields[i].AddTo(encoder)
+	}
+	return &entryCore{LevelEnabler: c.LevelEnabler, encoder: encoder, writer: c.writer}
+}
+
+func (c *entryCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *entryCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+
+	return c.writer.WriteEntry(entry, bytes.TrimRight(buf.Bytes(), "\n"))
+}
+
+func (c *entryCore) Sync() error {
+	return nil
+}
+
+// severity return syslog severity of log level, journald use same values for priority
+func severity(level zapcore.Level) int {
+	switch level {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	case zapcore.DPanicLevel:
+		return 2
+	case zapcore.PanicLevel:
+		return 1
+	default:
+		return 0
+	}
+}
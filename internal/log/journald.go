@@ -0,0 +1,89 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/xerrors"
+)
+
+// DefaultJournaldSocket is path of socket for native journald protocol
+const DefaultJournaldSocket = "/run/systemd/journal/socket"
+
+// NewJournaldCore create zap core, which send log entries to journald by native protocol through socket.
+// identifier is SYSLOG_IDENTIFIER of entries.
+func NewJournaldCore(encoder zapcore.Encoder, level zapcore.LevelEnabler, socket, identifier string) (zapcore.Core, error) {
+	if socket == "" {
+		socket = DefaultJournaldSocket
+	}
+	addr, err := net.ResolveUnixAddr("unixgram", socket)
+	if err != nil {
+		return nil, xerrors.Errorf("resolve journald socket %q: %w", socket, err)
+	}
+	return newEntryCore(encoder, level, &journaldWriter{addr: addr, identifier: identifier}), nil
+}
+
+type journaldWriter struct {
+	addr       *net.UnixAddr
+	identifier string
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+func (w *journaldWriter) WriteEntry(entry zapcore.Entry, message []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+		if err != nil {
+			return xerrors.Errorf("open socket for journald: %w", err)
+		}
+		w.conn = conn
+	}
+
+	_, _, err := w.conn.WriteMsgUnix(journaldMessage(entry, message, w.identifier), nil, w.addr)
+	if err != nil {
+		// big messages must be sent through memfd, they are rare for this program and not supported
+		return xerrors.Errorf("write to journald: %w", err)
+	}
+	return nil
+}
+
+// journaldMessage return datagram of native journald protocol with fields of entry
+func journaldMessage(entry zapcore.Entry, message []byte, identifier string) []byte {
+	buf := &bytes.Buffer{}
+	writeJournaldField(buf, "MESSAGE", message)
+	writeJournaldField(buf, "PRIORITY", []byte(strconv.Itoa(severity(entry.Level))))
+	if identifier != "" {
+		writeJournaldField(buf, "SYSLOG_IDENTIFIER", []byte(identifier))
+	}
+	if entry.Caller.Defined {
+		writeJournaldField(buf, "CODE_FILE", []byte(entry.Caller.File))
+		writeJournaldField(buf, "CODE_LINE", []byte(strconv.Itoa(entry.Caller.Line)))
+	}
+	return buf.Bytes()
+}
+
+// writeJournaldField write field as KEY=VALUE line, or in binary form if value contains new line
+func writeJournaldField(buf *bytes.Buffer, name string, value []byte) {
+	buf.WriteString(name)
+	if bytes.IndexByte(value, '\n') == -1 {
+		buf.WriteByte('=')
+		buf.Write(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.WriteByte('\n')
+	buf.Write(size[:])
+	buf.Write(value)
+	buf.WriteByte('\n')
+}
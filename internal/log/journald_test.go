@@ -0,0 +1,44 @@
+package log
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestJournaldCore(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	socket := filepath.Join(th.TmpDir(e), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	e.CmpNoError(err)
+	defer func() { _ = conn.Close() }()
+
+	core, err := NewJournaldCore(testEncoder(), zapcore.InfoLevel, socket, "lets-proxy")
+	e.CmpNoError(err)
+	logger := zap.New(core)
+	logger.Debug("debug")
+	logger.Error("test")
+
+	buf := make([]byte, 1000)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	e.CmpNoError(err)
+	e.Cmp(string(buf[:n]), "MESSAGE={\"msg\":\"test\"}\nPRIORITY=3\nSYSLOG_IDENTIFIER=lets-proxy\n")
+}
+
+func TestJournaldMessage(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	entry := zapcore.Entry{Level: zapcore.WarnLevel, Caller: zapcore.NewEntryCaller(0, "file.go", 10, true)}
+	td.Cmp(string(journaldMessage(entry, []byte("a\nb"), "")),
+		"MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\nPRIORITY=4\nCODE_FILE=file.go\nCODE_LINE=10\n")
+}
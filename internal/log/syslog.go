@@ -0,0 +1,189 @@
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/xerrors"
+)
+
+const (
+	syslogTimeFormat   = "2006-01-02T15:04:05.000000Z07:00"
+	syslogDialTimeout  = time.Second
+	syslogWriteTimeout = time.Second
+
+	// entries are dropped after failed connect while backoff, it grow twice after every fail up to max
+	syslogMinBackoff = time.Second
+	syslogMaxBackoff = time.Minute
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig is settings of syslog output
+type SyslogConfig struct {
+	// Network is unix, udp or tcp
+	Network string
+
+	// Address is path of unix socket or host:port
+	Address string
+
+	// Facility is name of syslog facility: kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv,
+	// ftp, local0-local7
+	Facility string
+
+	// Tag is APP-NAME of messages
+	Tag string
+}
+
+// NewSyslogCore create zap core, which send log entries to syslog server in RFC 5424 format.
+// Connection opened on first message and reopened after write errors.
+func NewSyslogCore(encoder zapcore.Encoder, level zapcore.LevelEnabler, config SyslogConfig) (zapcore.Core, error) {
+	switch config.Network {
+	case "unix", "udp", "tcp":
+		// pass
+	default:
+		return nil, xerrors.Errorf("unknown syslog network: %q", config.Network)
+	}
+	facility, ok := syslogFacilities[strings.ToLower(config.Facility)]
+	if !ok {
+		return nil, xerrors.Errorf("unknown syslog facility: %q", config.Facility)
+	}
+
+	hostname, _ := os.Hostname()
+	writer := &syslogWriter{
+		network:  config.Network,
+		address:  config.Address,
+		facility: facility,
+		hostname: syslogHeaderValue(hostname),
+		tag:      syslogHeaderValue(config.Tag),
+		pid:      os.Getpid(),
+
+		dialTimeout: syslogDialTimeout,
+		now:         time.Now,
+	}
+	return newEntryCore(encoder, level, writer), nil
+}
+
+type syslogWriter struct {
+	network  string
+	address  string
+	facility int
+	hostname string
+	tag      string
+	pid      int
+
+	dialTimeout time.Duration
+	now         func() time.Time
+
+	mu           sync.Mutex
+	conn         net.Conn
+	stream       bool
+	backoff      time.Duration
+	backoffUntil time.Time
+}
+
+// WriteEntry send entry to syslog. If syslog unavailable - entries dropped while backoff,
+// for doesn't block logging goroutines by connect to unreachable server.
+func (w *syslogWriter) WriteEntry(entry zapcore.Entry, message []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil && w.now().Before(w.backoffUntil) {
+		return nil
+	}
+
+	err := w.write(entry, message)
+	if err != nil && w.conn != nil {
+		// reconnect once, for example after restart of syslog server
+		_ = w.conn.Close()
+		w.conn = nil
+		err = w.write(entry, message)
+	}
+
+	if err == nil {
+		w.backoff = 0
+		return nil
+	}
+	if w.conn != nil {
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+	w.backoff *= 2
+	if w.backoff < syslogMinBackoff {
+		w.backoff = syslogMinBackoff
+	}
+	if w.backoff > syslogMaxBackoff {
+		w.backoff = syslogMaxBackoff
+	}
+	w.backoffUntil = w.now().Add(w.backoff)
+	return xerrors.Errorf("drop syslog entries for %v: %w", w.backoff, err)
+}
+
+func (w *syslogWriter) write(entry zapcore.Entry, message []byte) error {
+	if w.conn == nil {
+		if err := w.dial(); err != nil {
+			return err
+		}
+	}
+
+	msg := w.format(entry, message)
+	if w.stream {
+		// octet counting framing, RFC 6587
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	_ = w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err := w.conn.Write([]byte(msg))
+	if err != nil {
+		return xerrors.Errorf("write to syslog: %w", err)
+	}
+	return nil
+}
+
+func (w *syslogWriter) dial() error {
+	var err error
+	switch w.network {
+	case "unix":
+		// local syslog usually listen datagram socket, but can listen stream socket
+		if w.conn, err = net.DialTimeout("unixgram", w.address, w.dialTimeout); err == nil {
+			w.stream = false
+			return nil
+		}
+		w.conn, err = net.DialTimeout("unix", w.address, w.dialTimeout)
+		w.stream = true
+	default:
+		w.conn, err = net.DialTimeout(w.network, w.address, w.dialTimeout)
+		w.stream = w.network == "tcp"
+	}
+	if err != nil {
+		w.conn = nil
+		return xerrors.Errorf("connect to syslog %v %v: %w", w.network, w.address, err)
+	}
+	return nil
+}
+
+// format return message in RFC 5424 format
+func (w *syslogWriter) format(entry zapcore.Entry, message []byte) string {
+	priority := w.facility*8 + severity(entry.Level)
+	return fmt.Sprintf("<%d>1 %s %s %s %d - - %s", priority, entry.Time.Format(syslogTimeFormat),
+		w.hostname, w.tag, w.pid, message)
+}
+
+// syslogHeaderValue return value for header field of message, it can't be empty and contain spaces
+func syslogHeaderValue(s string) string {
+	s = strings.Join(strings.Fields(s), "_")
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,160 @@
+package log
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func testEncoder() zapcore.Encoder {
+	return zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg", LineEnding: zapcore.DefaultLineEnding})
+}
+
+func TestSyslogCore(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	_, err := NewSyslogCore(testEncoder(), zapcore.InfoLevel, SyslogConfig{Network: "http", Facility: "daemon"})
+	e.CmpError(err)
+	_, err = NewSyslogCore(testEncoder(), zapcore.InfoLevel, SyslogConfig{Network: "udp", Facility: "unknown"})
+	e.CmpError(err)
+
+	header := `^<%v>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}\S+ \S+ lets-proxy ` + strconv.Itoa(os.Getpid()) + ` - - `
+
+	t.Run("udp", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		e.CmpNoError(err)
+		defer func() { _ = conn.Close() }()
+
+		core, err := NewSyslogCore(testEncoder(), zapcore.InfoLevel, SyslogConfig{
+			Network: "udp", Address: conn.LocalAddr().String(), Facility: "local0", Tag: "lets-proxy",
+		})
+		e.CmpNoError(err)
+		logger := zap.New(core)
+		logger.Debug("debug")
+		logger.Warn("test", zap.String("a", "b"))
+
+		buf := make([]byte, 1000)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		e.CmpNoError(err)
+		// local0*8 + warning
+		e.Re(string(buf[:n]), strings.Replace(header, "%v", "132", 1)+`\{"msg":"test","a":"b"\}$`, nil)
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		e.CmpNoError(err)
+		defer func() { _ = listener.Close() }()
+
+		core, err := NewSyslogCore(testEncoder(), zapcore.DebugLevel, SyslogConfig{
+			Network: "tcp", Address: listener.Addr().String(), Facility: "daemon", Tag: "lets-proxy",
+		})
+		e.CmpNoError(err)
+		logger := zap.New(core)
+		logger.Error("first")
+		logger.Info("second")
+
+		conn, err := listener.Accept()
+		e.CmpNoError(err)
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		reader := bufio.NewReader(conn)
+
+		readMessage := func() string {
+			lenS, err := reader.ReadString(' ')
+			e.CmpNoError(err)
+			size, err := strconv.Atoi(strings.TrimSpace(lenS))
+			e.CmpNoError(err)
+			buf := make([]byte, size)
+			_, err = reader.Read(buf)
+			e.CmpNoError(err)
+			return string(buf)
+		}
+		// daemon*8 + error
+		e.Re(readMessage(), strings.Replace(header, "%v", "27", 1)+`\{"msg":"first"\}$`, nil)
+		// daemon*8 + info
+		e.Re(readMessage(), strings.Replace(header, "%v", "30", 1)+`\{"msg":"second"\}$`, nil)
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		socket := filepath.Join(th.TmpDir(e), "log.sock")
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+		e.CmpNoError(err)
+		defer func() { _ = conn.Close() }()
+
+		core, err := NewSyslogCore(testEncoder(), zapcore.InfoLevel, SyslogConfig{
+			Network: "unix", Address: socket, Facility: "user", Tag: "lets-proxy",
+		})
+		e.CmpNoError(err)
+		zap.New(core).Info("test")
+
+		buf := make([]byte, 1000)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		e.CmpNoError(err)
+		e.Re(string(buf[:n]), strings.Replace(header, "%v", "14", 1)+`\{"msg":"test"\}$`, nil)
+	})
+}
+
+func TestSyslogCore_Unreachable(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	// address of closed listener, nobody accept connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	e.CmpNoError(err)
+	address := listener.Addr().String()
+	_ = listener.Close()
+
+	core, err := NewSyslogCore(testEncoder(), zapcore.InfoLevel, SyslogConfig{
+		Network: "tcp", Address: address, Facility: "daemon",
+	})
+	e.CmpNoError(err)
+	writer := core.(*entryCore).writer.(*syslogWriter)
+	writer.dialTimeout = 100 * time.Millisecond
+	now := time.Now()
+	writer.now = func() time.Time { return now }
+
+	start := time.Now()
+	e.CmpError(core.Write(zapcore.Entry{Message: "first"}, nil))
+	e.True(time.Since(start) < time.Second)
+	e.Cmp(writer.backoff, syslogMinBackoff)
+
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		e.CmpNoError(core.Write(zapcore.Entry{Message: "dropped"}, nil))
+	}
+	e.True(time.Since(start) < 50*time.Millisecond, "entries dropped without connect while backoff")
+
+	now = now.Add(syslogMinBackoff)
+	e.CmpError(core.Write(zapcore.Entry{Message: "retry"}, nil))
+	e.Cmp(writer.backoff, 2*syslogMinBackoff)
+}
+
+func TestSyslogHeaderValue(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	td.Cmp(syslogHeaderValue(""), "-")
+	td.Cmp(syslogHeaderValue("lets proxy"), "lets_proxy")
+}
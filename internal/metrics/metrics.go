@@ -45,6 +45,15 @@ func New(logger *zap.Logger, gatherer prometheus.Gatherer) *Metrics {
 	return &metrics
 }
 
+// CounterVec create counter with labels and register it if r not nil
+func CounterVec(r prometheus.Registerer, name, description string, labels ...string) *prometheus.CounterVec {
+	res := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: "Count of " + description}, labels)
+	if r != nil && !reflect.ValueOf(r).IsNil() {
+		r.MustRegister(res)
+	}
+	return res
+}
+
 func ToefCounters(r prometheus.Registerer, name, description string) (start ProcessStartFunc, finish ProcessFinishFunc) {
 	if r == nil || reflect.ValueOf(r).IsNil() {
 		return func() {}, func(error) {}
@@ -0,0 +1,66 @@
+// Package netlist contains list of ip networks for check client addresses: trusted proxies, exempt networks, etc.
+package netlist
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// List is list of ip networks
+type List []*net.IPNet
+
+// Parse parse networks in CIDR notation or single ip addresses.
+func Parse(networks []string) (List, error) {
+	res := make(List, 0, len(networks))
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, xerrors.Errorf("bad ip address '%v'", network)
+			}
+			bits := net.IPv6len * 8
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = net.IPv4len * 8
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, xerrors.Errorf("parse network '%v': %w", network, err)
+		}
+		res = append(res, ipNet)
+	}
+	return res, nil
+}
+
+// Contains return true if ip is in any network of list
+func (l List) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range l {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr return true if ip of address (ip or ip:port) is in any network of list
+func (l List) ContainsAddr(addr string) bool {
+	return l.Contains(ParseAddrIP(addr))
+}
+
+// ParseAddrIP return ip from ip:port or ip address, nil if it has no ip
+func ParseAddrIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
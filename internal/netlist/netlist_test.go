@@ -0,0 +1,36 @@
+package netlist
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestList(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	list, err := Parse([]string{"10.0.0.0/8", " 192.168.1.1 ", "fd00::/8", "::1"})
+	e.CmpNoError(err)
+	e.Len(list, 4)
+
+	e.True(list.Contains(net.ParseIP("10.1.2.3")))
+	e.True(list.Contains(net.ParseIP("192.168.1.1")))
+	e.True(list.Contains(net.ParseIP("::ffff:192.168.1.1")))
+	e.False(list.Contains(net.ParseIP("192.168.1.2")))
+	e.True(list.Contains(net.ParseIP("fd12::1")))
+	e.True(list.Contains(net.ParseIP("::1")))
+	e.False(list.Contains(net.ParseIP("::2")))
+	e.False(list.Contains(nil))
+
+	e.True(list.ContainsAddr("10.0.0.1:443"))
+	e.True(list.ContainsAddr("[::1]:443"))
+	e.True(list.ContainsAddr("10.0.0.1"))
+	e.False(list.ContainsAddr("example.com:443"))
+
+	_, err = Parse([]string{"10.0.0.0/33"})
+	e.CmpError(err)
+	_, err = Parse([]string{"example.com"})
+	e.CmpError(err)
+}
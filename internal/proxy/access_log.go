@@ -0,0 +1,356 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+)
+
+// Formats of access log
+const (
+	AccessLogJSON     = "json"
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogFields is names of all fields of access log record in json format
+var AccessLogFields = []string{
+	"duration", "duration_without_body", "initiator_addr", "client_ip", "method", "host", "path", "query", "proto",
+	"status_code", "request_content_length", "resp_content_length", "bytes_sent", "upstream",
+	"tls_version", "tls_cipher", "sni", "referer", "user_agent", "error_reason",
+}
+
+// AccessLog write records about requests to backend.
+type AccessLog struct {
+	format     string
+	sampleRate float64
+	fields     map[string]bool
+	random     func() float64
+
+	mu     sync.Mutex
+	writer io.Writer
+	logger *zap.Logger
+}
+
+// NewAccessLog create access log, which write records to writer in format.
+// If writer is nil - records write as fields to log of request context and format ignored.
+// sampleRate is part of requests, which write to log: 0 or 1 for all requests, failed requests are logged always.
+// fields is names of fields of json format from AccessLogFields, empty for all fields.
+func NewAccessLog(writer io.Writer, format string, sampleRate float64, fields []string) (*AccessLog, error) {
+	res := &AccessLog{
+		format:     strings.ToLower(strings.TrimSpace(format)),
+		sampleRate: sampleRate,
+		random:     rand.Float64,
+		writer:     writer,
+	}
+	if res.format == "" {
+		res.format = AccessLogJSON
+	}
+	switch res.format {
+	case AccessLogJSON, AccessLogCommon, AccessLogCombined:
+		// pass
+	default:
+		return nil, xerrors.Errorf("unknown access log format: %q", format)
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, xerrors.Errorf("access log sample rate must be between 0 and 1: %v", sampleRate)
+	}
+
+	if len(fields) > 0 {
+		res.fields = make(map[string]bool, len(fields))
+		for _, field := range fields {
+			if !isAccessLogField(field) {
+				return nil, xerrors.Errorf("unknown access log field: %q", field)
+			}
+			res.fields[field] = true
+		}
+	}
+
+	if writer != nil && res.format == AccessLogJSON {
+		encoder := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+			TimeKey:        "ts",
+			MessageKey:     "msg",
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeTime:     zapcore.ISO8601TimeEncoder,
+			EncodeDuration: zapcore.SecondsDurationEncoder,
+		})
+		res.logger = zap.New(zapcore.NewCore(encoder, zapcore.AddSync(writer), zapcore.DebugLevel))
+	}
+	return res, nil
+}
+
+func isAccessLogField(name string) bool {
+	for _, field := range AccessLogFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// accessLogRecordKey is context key of access log record, which filled while request handled
+type accessLogRecordKey struct{}
+
+// accessLogRecord is info about one request
+type accessLogRecord struct {
+	start                time.Time
+	duration             time.Duration
+	durationWithoutBody  time.Duration
+	initiatorAddr        string
+	clientIP             string
+	method               string
+	host                 string
+	path                 string
+	query                string
+	proto                string
+	statusCode           int
+	requestContentLength int64
+	respContentLength    int64
+	bytesSent            int64
+	upstream             string
+	tls                  *tls.ConnectionState
+	referer              string
+	userAgent            string
+	err                  error
+}
+
+func newAccessLogRecord(request *http.Request, start time.Time) *accessLogRecord {
+	return &accessLogRecord{
+		start:                start,
+		initiatorAddr:        request.RemoteAddr,
+		clientIP:             clientIP(request),
+		method:               request.Method,
+		host:                 request.Host,
+		path:                 request.URL.Path,
+		query:                request.URL.RawQuery,
+		proto:                request.Proto,
+		requestContentLength: request.ContentLength,
+		upstream:             request.URL.Host,
+		tls:                  request.TLS,
+		referer:              request.Referer(),
+		userAgent:            request.UserAgent(),
+	}
+}
+
+// setResponse fill record by result of round trip
+func (r *accessLogRecord) setResponse(resp *http.Response, err error) {
+	r.durationWithoutBody = time.Since(r.start)
+	r.duration = r.durationWithoutBody
+	r.err = err
+	if resp != nil {
+		r.statusCode = resp.StatusCode
+		r.respContentLength = resp.ContentLength
+		if resp.Request != nil && resp.Request.URL != nil {
+			r.upstream = resp.Request.URL.Host
+		}
+	}
+	if err != nil {
+		r.statusCode = errorStatus(err)
+	}
+}
+
+func (r *accessLogRecord) zapFields() []zap.Field {
+	var tlsVersion, tlsCipher, sni string
+	if r.tls != nil {
+		tlsVersion = tlsVersionName(r.tls.Version)
+		tlsCipher = tls.CipherSuiteName(r.tls.CipherSuite)
+		sni = r.tls.ServerName
+	}
+	return []zap.Field{
+		zap.Duration("duration", r.duration),
+		zap.Duration("duration_without_body", r.durationWithoutBody),
+		zap.String("initiator_addr", r.initiatorAddr),
+		zap.String("client_ip", r.clientIP),
+		zap.String("method", r.method),
+		zap.String("host", r.host),
+		zap.String("path", r.path),
+		zap.String("query", r.query),
+		zap.String("proto", r.proto),
+		zap.Int("status_code", r.statusCode),
+		zap.Int64("request_content_length", r.requestContentLength),
+		zap.Int64("resp_content_length", r.respContentLength),
+		zap.Int64("bytes_sent", r.bytesSent),
+		zap.String("upstream", r.upstream),
+		zap.String("tls_version", tlsVersion),
+		zap.String("tls_cipher", tlsCipher),
+		zap.String("sni", sni),
+		zap.String("referer", r.referer),
+		zap.String("user_agent", r.userAgent),
+		zap.String("error_reason", errorReason(r.err)),
+	}
+}
+
+// commonLogLine return record in Common Log Format, with referer and user agent for Combined Log Format
+func (r *accessLogRecord) commonLogLine(combined bool) string {
+	requestURI := r.path
+	if r.query != "" {
+		requestURI += "?" + r.query
+	}
+	bytesSent := "-"
+	if r.bytesSent > 0 {
+		bytesSent = strconv.FormatInt(r.bytesSent, 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] %s %d %s", clfValue(r.clientIP), r.start.Format(clfTimeFormat),
+		strconv.Quote(r.method+" "+requestURI+" "+r.proto), r.statusCode, bytesSent)
+	if combined {
+		line += " " + strconv.Quote(clfValue(r.referer)) + " " + strconv.Quote(clfValue(r.userAgent))
+	}
+	return line + "\n"
+}
+
+func clfValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// tlsVersionName return name of tls version, tls.VersionName need go 1.21
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
+
+// sampled return true if record must be written to log
+func (a *AccessLog) sampled(r *accessLogRecord) bool {
+	if r.err != nil || r.statusCode >= http.StatusInternalServerError {
+		return true
+	}
+	if a.sampleRate == 0 || a.sampleRate == 1 {
+		return true
+	}
+	return a.random() < a.sampleRate
+}
+
+func (a *AccessLog) write(request *http.Request, r *accessLogRecord) {
+	if a == nil {
+		log.InfoErrorCtx(request.Context(), r.err, "Request", r.zapFields()...)
+		return
+	}
+	if !a.sampled(r) {
+		return
+	}
+
+	if a.writer == nil {
+		log.InfoErrorCtx(request.Context(), r.err, "Request", a.filterFields(r.zapFields())...)
+		return
+	}
+
+	if a.logger != nil {
+		a.logger.Info("Request", a.filterFields(r.zapFields())...)
+		return
+	}
+
+	a.mu.Lock()
+	_, err := io.WriteString(a.writer, r.commonLogLine(a.format == AccessLogCombined))
+	a.mu.Unlock()
+	log.DebugError(zc.L(request.Context()), err, "Write access log")
+}
+
+func (a *AccessLog) filterFields(fields []zap.Field) []zap.Field {
+	if a.fields == nil {
+		return fields
+	}
+	res := fields[:0]
+	for _, field := range fields {
+		if a.fields[field.Key] {
+			res = append(res, field)
+		}
+	}
+	return res
+}
+
+// accessLogBody count bytes of response body and write access log record once, when body closed
+type accessLogBody struct {
+	io.ReadCloser
+	record *accessLogRecord
+	finish func()
+	once   sync.Once
+}
+
+func (b *accessLogBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.record.bytesSent += int64(n)
+	return n, err
+}
+
+func (b *accessLogBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.record.duration = time.Since(b.record.start)
+		b.finish()
+	})
+	return err
+}
+
+// accessLogResponseWriter count bytes of response, sent to client.
+// Bytes, sent through hijacked connection (websockets) doesn't counted.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	record      *accessLogRecord
+	wroteHeader bool
+}
+
+func (w *accessLogResponseWriter) WriteHeader(statusCode int) {
+	// informational responses can be sent before final status
+	if !w.wroteHeader && statusCode >= http.StatusOK {
+		w.wroteHeader = true
+		w.record.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *accessLogResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.record.statusCode = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.record.bytesSent += int64(n)
+	return n, err
+}
+
+func (w *accessLogResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, xerrors.New("response writer doesn't support hijack")
+}
+
+// Unwrap return original response writer for http.ResponseController
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
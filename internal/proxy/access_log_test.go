@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/netlist"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewAccessLog(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	_, err := NewAccessLog(nil, "", 0, nil)
+	td.CmpNoError(err)
+	_, err = NewAccessLog(nil, "Combined", 0.5, []string{"method", "bytes_sent"})
+	td.CmpNoError(err)
+
+	_, err = NewAccessLog(nil, "unknown", 0, nil)
+	td.CmpError(err)
+	_, err = NewAccessLog(nil, "json", 1.5, nil)
+	td.CmpError(err)
+	_, err = NewAccessLog(nil, "json", 0, []string{"metod"})
+	td.CmpError(err)
+}
+
+func TestTransportLogger_AccessLog(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	newTransport := func(accessLog *AccessLog, status int, err error) TransportLogger {
+		return TransportLogger{
+			Transport: roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+				if err != nil {
+					return nil, err
+				}
+				backendReq := request.Clone(request.Context())
+				backendReq.URL.Host = "10.0.0.1:80"
+				return &http.Response{StatusCode: status, Request: backendReq, ContentLength: -1,
+					Body: io.NopCloser(strings.NewReader("12345"))}, nil
+			}),
+			AccessLog: accessLog,
+		}
+	}
+	roundTrip := func(transport TransportLogger) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend/path?a=b", nil)
+		e.CmpNoError(err)
+		req.Host = "example.com"
+		req.RemoteAddr = "1.2.3.4:1000"
+		req.Header.Set("User-Agent", "test-agent")
+		req.TLS = &tls.ConnectionState{
+			Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, ServerName: "example.com",
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	t.Run("json", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		buf := &bytes.Buffer{}
+		accessLog, err := NewAccessLog(buf, AccessLogJSON, 0, nil)
+		e.CmpNoError(err)
+		roundTrip(newTransport(accessLog, http.StatusOK, nil))
+
+		var record map[string]interface{}
+		e.CmpNoError(json.Unmarshal(buf.Bytes(), &record))
+		e.Cmp(record, testdeep.SuperMapOf(map[string]interface{}{
+			"msg":          "Request",
+			"method":       "GET",
+			"host":         "example.com",
+			"path":         "/path",
+			"query":        "a=b",
+			"client_ip":    "1.2.3.4",
+			"status_code":  float64(http.StatusOK),
+			"bytes_sent":   float64(5),
+			"upstream":     "10.0.0.1:80",
+			"tls_version":  "TLS 1.3",
+			"tls_cipher":   "TLS_AES_128_GCM_SHA256",
+			"sni":          "example.com",
+			"user_agent":   "test-agent",
+			"error_reason": "",
+		}, nil))
+		e.Gte(record["duration"], record["duration_without_body"])
+	})
+
+	t.Run("fields", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		buf := &bytes.Buffer{}
+		accessLog, err := NewAccessLog(buf, AccessLogJSON, 0, []string{"method", "bytes_sent"})
+		e.CmpNoError(err)
+		roundTrip(newTransport(accessLog, http.StatusOK, nil))
+
+		var record map[string]interface{}
+		e.CmpNoError(json.Unmarshal(buf.Bytes(), &record))
+		e.Cmp(record, testdeep.SubMapOf(map[string]interface{}{
+			"ts": testdeep.Ignore(), "msg": "Request", "method": "GET", "bytes_sent": float64(5),
+		}, nil))
+	})
+
+	t.Run("combined", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		buf := &bytes.Buffer{}
+		accessLog, err := NewAccessLog(buf, AccessLogCombined, 0, nil)
+		e.CmpNoError(err)
+		roundTrip(newTransport(accessLog, http.StatusOK, nil))
+		e.Re(buf.String(), `^1\.2\.3\.4 - - \[[^\]]+\] "GET /path\?a=b HTTP/1\.1" 200 5 "-" "test-agent"\n$`, nil)
+
+		buf.Reset()
+		roundTrip(newTransport(accessLog, 0, errResponseHeaderTimeout))
+		e.Re(buf.String(), `"GET /path\?a=b HTTP/1\.1" 504 - "-" "test-agent"\n$`, nil)
+	})
+
+	t.Run("sample", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		buf := &bytes.Buffer{}
+		accessLog, err := NewAccessLog(buf, AccessLogCommon, 0.5, nil)
+		e.CmpNoError(err)
+		random := 0.7
+		accessLog.random = func() float64 { return random }
+
+		roundTrip(newTransport(accessLog, http.StatusOK, nil))
+		e.Cmp(buf.Len(), 0)
+
+		roundTrip(newTransport(accessLog, http.StatusServiceUnavailable, nil))
+		roundTrip(newTransport(accessLog, 0, errors.New("test")))
+		e.Cmp(strings.Count(buf.String(), "\n"), 2)
+
+		random = 0.3
+		roundTrip(newTransport(accessLog, http.StatusOK, nil))
+		e.Cmp(strings.Count(buf.String(), "\n"), 3)
+	})
+}
+
+func TestHTTPProxy_AccessLogHandler(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	buf := &bytes.Buffer{}
+	accessLog, err := NewAccessLog(buf, AccessLogJSON, 0, nil)
+	e.CmpNoError(err)
+
+	transport := TransportLogger{
+		Transport: roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Request: request, ContentLength: 3,
+				Body: io.NopCloser(strings.NewReader("123"))}, nil
+		}),
+		AccessLog: accessLog,
+	}
+	p := &HTTPProxy{GetContext: getContext, AccessLog: accessLog}
+
+	serveFrom := func(remoteAddr, forwardedFor string, handler http.HandlerFunc) map[string]interface{} {
+		buf.Reset()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/path", nil)
+		e.CmpNoError(err)
+		req.Host = "example.com"
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set(headerXForwardedFor, forwardedFor)
+		}
+		p.accessLogHandler(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+		var record map[string]interface{}
+		e.CmpNoError(json.Unmarshal(buf.Bytes(), &record))
+		return record
+	}
+	serve := func(handler http.HandlerFunc) map[string]interface{} {
+		return serveFrom("1.2.3.4:1000", "", handler)
+	}
+
+	// answered without backend, for example http-01 validation
+	record := serve(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusAccepted)
+		_, _ = writer.Write([]byte("ab"))
+	})
+	e.Cmp(record, testdeep.SuperMapOf(map[string]interface{}{
+		"host": "example.com", "path": "/path", "client_ip": "1.2.3.4",
+		"status_code": float64(http.StatusAccepted), "bytes_sent": float64(2), "upstream": "",
+	}, nil))
+
+	// bytes_sent is bytes, sent to client, instead of backend response size
+	record = serve(func(writer http.ResponseWriter, request *http.Request) {
+		backendReq := request.Clone(request.Context())
+		backendReq.URL.Host = "10.0.0.1:80"
+		resp, err := transport.RoundTrip(backendReq)
+		e.CmpNoError(err)
+		_ = resp.Body.Close()
+		_, _ = writer.Write([]byte("12345678"))
+	})
+	e.Cmp(record, testdeep.SuperMapOf(map[string]interface{}{
+		"status_code": float64(http.StatusOK), "resp_content_length": float64(3), "bytes_sent": float64(8),
+		"upstream": "10.0.0.1:80",
+	}, nil))
+	e.Gte(record["duration"], record["duration_without_body"])
+
+	// client ip from trusted proxy detected by directors
+	trusted, err := netlist.Parse([]string{"10.0.0.0/8"})
+	e.CmpNoError(err)
+	forwarded, err := NewDirectorForwarded(trusted, XForwardedForAppend, false)
+	e.CmpNoError(err)
+	record = serveFrom("10.0.0.1:1000", "5.6.7.8", func(writer http.ResponseWriter, request *http.Request) {
+		backendReq := request.Clone(request.Context())
+		e.CmpNoError(forwarded.Director(backendReq))
+		resp, err := transport.RoundTrip(backendReq)
+		e.CmpNoError(err)
+		_ = resp.Body.Close()
+	})
+	e.Cmp(record["client_ip"], "5.6.7.8")
+
+	record = serve(func(writer http.ResponseWriter, request *http.Request) {
+		errorHandler(writer, request, errResponseHeaderTimeout)
+	})
+	e.Cmp(record["status_code"], float64(http.StatusGatewayTimeout))
+
+	// reverse proxy abort handler by panic if copy of response body failed
+	e.CmpPanic(func() {
+		serve(func(writer http.ResponseWriter, request *http.Request) {
+			_, _ = writer.Write([]byte("123"))
+			panic(http.ErrAbortHandler)
+		})
+	}, http.ErrAbortHandler)
+	record = nil
+	e.CmpNoError(json.Unmarshal(buf.Bytes(), &record))
+	e.Cmp(record, testdeep.SuperMapOf(map[string]interface{}{
+		"status_code": float64(http.StatusOK), "bytes_sent": float64(3), "error_reason": "backend_error",
+	}, nil))
+}
+
+func TestAccessLogRecord_CommonLogLine(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	record := accessLogRecord{
+		start:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		clientIP: "1.2.3.4", method: http.MethodPost, path: "/", proto: "HTTP/2.0", statusCode: 201, bytesSent: 10,
+	}
+	td.Cmp(record.commonLogLine(false), "1.2.3.4 - - [02/Jan/2020:03:04:05 +0000] \"POST / HTTP/2.0\" 201 10\n")
+}
@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/netlist"
+	"github.com/rekby/lets-proxy2/internal/proxyprotocol"
 
 	"go.uber.org/zap"
 
@@ -24,21 +26,74 @@ type IPHeaders struct {
 
 //nolint:lll
 type Config struct {
-	DefaultTarget           string
-	TargetMap               []string
-	Headers                 []string
-	HeadersByIP             map[string][]string
-	KeepAliveTimeoutSeconds int
-	HTTPSBackend            bool
-	HTTPSBackendIgnoreCert  bool
-	EnableAccessLog         bool
-	RateLimit               int
-	RateLimitTimeWindowMs   int
-	RateLimitBurst          int
-	RateLimitCacheSize      int
+	DefaultTarget                string
+	TargetMap                    []string
+	Routes                       []Route
+	Upstreams                    []UpstreamPoolConfig
+	Headers                      []string
+	HeadersByIP                  map[string][]string
+	TrustedProxies               []string
+	XForwardedFor                string
+	Forwarded                    bool
+	KeepAliveTimeoutSeconds      int
+	ReadHeaderTimeoutSeconds     int
+	ReadTimeoutSeconds           int
+	WriteTimeoutSeconds          int
+	MaxHeaderBytes               int
+	MaxBodyBytes                 int64
+	ResponseHeaderTimeoutSeconds int
+	HTTPSBackend                 bool
+	HTTPSBackendIgnoreCert       bool
+	EnableAccessLog              bool
+	RateLimit                    int
+	RateLimitTimeWindowMs        int
+	RateLimitBurst               int
+	RateLimitCacheSize           int
+	RateLimitIPv4Prefix          int
+	RateLimitIPv6Prefix          int
+	RateLimitExempt              []string
+	RateLimitRules               []RateLimitRule
+	RetryCount                   int
+	RetryTryTimeoutMs            int
+	RetryBudgetPercent           int
+	RetryBudgetMinPerSecond      int
+	BackendProxyProtocol         string
 }
 
 func (c *Config) Apply(ctx context.Context, p *HTTPProxy) error {
+	director, transport, err := c.createHandlers(ctx)
+	p.HTTPTransport = transport
+	p.EnableAccessLog = c.EnableAccessLog
+	if err != nil {
+		return err
+	}
+
+	transport.Upstreams.Start(ctx)
+	p.Director = director
+	p.IdleTimeout = time.Duration(c.KeepAliveTimeoutSeconds) * time.Second
+	p.ReadHeaderTimeout = time.Duration(c.ReadHeaderTimeoutSeconds) * time.Second
+	p.ReadTimeout = time.Duration(c.ReadTimeoutSeconds) * time.Second
+	p.WriteTimeout = time.Duration(c.WriteTimeoutSeconds) * time.Second
+	p.MaxHeaderBytes = c.MaxHeaderBytes
+	return nil
+}
+
+// Reload create new director chain and transport with rate limiter from config and atomically replace it
+// in working proxy. Other settings need restart of proxy.
+func (c *Config) Reload(ctx context.Context, p *HTTPProxy) error {
+	director, transport, err := c.createHandlers(ctx)
+	if err != nil {
+		return err
+	}
+
+	oldTransport, _ := p.getHandlers().transport.(Transport)
+	transport.Upstreams.Start(ctx)
+	p.Reload(director, transport)
+	oldTransport.Upstreams.Stop()
+	return nil
+}
+
+func (c *Config) createHandlers(ctx context.Context) (Director, Transport, error) {
 	var resErr error
 
 	var chain []Director
@@ -52,33 +107,60 @@ func (c *Config) Apply(ctx context.Context, p *HTTPProxy) error {
 		chain = append(chain, director)
 	}
 
-	rateLimiter, resErr := NewRateLimiter(RateLimitParams{
-		RateLimit:  c.RateLimit,
-		TimeWindow: time.Duration(c.RateLimitTimeWindowMs) * time.Millisecond,
-		Burst:      c.RateLimitBurst,
-		CacheSize:  c.RateLimitCacheSize,
-	})
+	rateLimitExempt, resErr := netlist.Parse(c.RateLimitExempt)
+	var rateLimiter *RateLimiter
+	if resErr == nil {
+		rateLimiter, resErr = NewRateLimiter(RateLimitParams{
+			RateLimit:  c.RateLimit,
+			TimeWindow: time.Duration(c.RateLimitTimeWindowMs) * time.Millisecond,
+			Burst:      c.RateLimitBurst,
+			CacheSize:  c.RateLimitCacheSize,
+			IPv4Prefix: c.RateLimitIPv4Prefix,
+			IPv6Prefix: c.RateLimitIPv6Prefix,
+			Exempt:     rateLimitExempt,
+			Rules:      c.RateLimitRules,
+		})
+	}
 
+	// forwarded director must read headers before other directors change them
+	appendDirector(c.getForwardedDirector)
 	appendDirector(c.getDefaultTargetDirector)
 	appendDirector(c.getMapDirector)
 	appendDirector(c.getHeadersDirector)
 	appendDirector(c.getSchemaDirector)
 	appendDirector(c.getHeadersByIPDirector)
-	p.HTTPTransport = Transport{
+	appendDirector(c.getRoutesDirector)
+
+	var upstreams UpstreamPools
+	if resErr == nil {
+		upstreams, resErr = NewUpstreamPools(c.Upstreams, c.HTTPSBackendIgnoreCert)
+	}
+	if resErr == nil {
+		resErr = c.checkUpstreamTargets(upstreams)
+	}
+	var backendProxyProtocol int
+	if resErr == nil {
+		backendProxyProtocol, resErr = proxyprotocol.ParseVersion(c.BackendProxyProtocol)
+	}
+
+	transport := Transport{
 		IgnoreHTTPSCertificate: c.HTTPSBackendIgnoreCert,
 		RateLimiter:            rateLimiter,
+		Upstreams:              upstreams,
+		Retry:                  c.getRetryPolicy(),
+		BackendProxyProtocol:   backendProxyProtocol,
+		Limits: RequestLimits{
+			MaxBodyBytes:          c.MaxBodyBytes,
+			ResponseHeaderTimeout: time.Duration(c.ResponseHeaderTimeoutSeconds) * time.Second,
+		},
 	}
-	p.EnableAccessLog = c.EnableAccessLog
 
 	if resErr != nil {
 		zc.L(ctx).Error("Can't parse proxy config", zap.Error(resErr))
-		return resErr
+		return nil, transport, resErr
 	}
 
-	chainDirector := NewDirectorChain(chain...)
-	p.Director = chainDirector
-	p.IdleTimeout = time.Duration(c.KeepAliveTimeoutSeconds) * time.Second
-	return nil
+	return NewDirectorChain(chain...), transport, nil
 }
 
 func (c *Config) getDefaultTargetDirector(ctx context.Context) (Director, error) {
@@ -89,6 +171,10 @@ func (c *Config) getDefaultTargetDirector(ctx context.Context) (Director, error)
 	if s == "" {
 		return nil, errors.New("empty default target")
 	}
+	if _, ok := upstreamName(s); ok {
+		logger.Info("Create upstream pool director", zap.String("pool", s))
+		return NewDirectorHost(s), nil
+	}
 	defaultTarget, err := net.ResolveTCPAddr("tcp", c.DefaultTarget)
 	logger.Debug("Parse default target as tcp address", zap.Stringer("default_target", defaultTarget), zap.Error(err))
 
@@ -157,6 +243,78 @@ func (c *Config) getMapDirector(ctx context.Context) (Director, error) {
 	return NewDirectorDestMap(m), nil
 }
 
+// getRetryPolicy can return nil
+func (c *Config) getRetryPolicy() *RetryPolicy {
+	if c.RetryCount <= 0 && c.RetryTryTimeoutMs <= 0 {
+		return nil
+	}
+
+	policy := &RetryPolicy{
+		Count:      c.RetryCount,
+		TryTimeout: time.Duration(c.RetryTryTimeoutMs) * time.Millisecond,
+	}
+	if c.RetryBudgetPercent > 0 || c.RetryBudgetMinPerSecond > 0 {
+		policy.Budget = NewRetryBudget(c.RetryBudgetPercent, c.RetryBudgetMinPerSecond)
+	}
+	return policy
+}
+
+// checkUpstreamTargets check that upstream pools, used as targets, exist
+func (c *Config) checkUpstreamTargets(upstreams UpstreamPools) error {
+	targets := []string{strings.TrimSpace(c.DefaultTarget)}
+	for _, route := range c.Routes {
+		targets = append(targets, strings.TrimSpace(route.Target))
+	}
+
+	for _, target := range targets {
+		if name, ok := upstreamName(target); ok && upstreams[name] == nil {
+			return fmt.Errorf("unknown upstream pool '%v'", name)
+		}
+	}
+	return nil
+}
+
+// getRoutesDirector return director for select backend by host of request.
+// It placed after default target, map and schema directors for override them by matched route.
+// can return nil,nil
+func (c *Config) getRoutesDirector(ctx context.Context) (Director, error) {
+	if len(c.Routes) == 0 {
+		return nil, nil
+	}
+
+	director, err := NewDirectorRoutes(c.Routes)
+	if err != nil {
+		zc.L(ctx).Error("Can't parse routes", zap.Error(err))
+		return nil, err
+	}
+
+	zc.L(ctx).Info("Create routes director", zap.Int("routes_count", len(director)))
+	return director, nil
+}
+
+// can return nil, nil
+func (c *Config) getForwardedDirector(ctx context.Context) (Director, error) {
+	if len(c.TrustedProxies) == 0 && c.XForwardedFor == "" && !c.Forwarded {
+		return nil, nil
+	}
+
+	trustedProxies, err := netlist.Parse(c.TrustedProxies)
+	if err != nil {
+		zc.L(ctx).Error("Can't parse trusted proxies", zap.Error(err))
+		return nil, err
+	}
+
+	director, err := NewDirectorForwarded(trustedProxies, c.XForwardedFor, c.Forwarded)
+	if err != nil {
+		zc.L(ctx).Error("Can't create forwarded director", zap.Error(err))
+		return nil, err
+	}
+
+	zc.L(ctx).Info("Create forwarded director", zap.Strings("trusted_proxies", c.TrustedProxies),
+		zap.String("x_forwarded_for", c.XForwardedFor), zap.Bool("forwarded", c.Forwarded))
+	return director, nil
+}
+
 func (c *Config) getSchemaDirector(ctx context.Context) (Director, error) {
 	if c.HTTPSBackend {
 		return NewSetSchemeDirector(ProtocolHTTPS), nil
@@ -3,6 +3,7 @@ package proxy
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/rekby/lets-proxy2/internal/th"
 
@@ -226,6 +227,127 @@ func TestConfig_getSchemeDirector(t *testing.T) {
 	td.CmpDeeply(director, NewSetSchemeDirector(ProtocolHTTPS))
 }
 
+func TestConfig_getRoutesDirector(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := &Config{}
+	director, err := c.getRoutesDirector(ctx)
+	td.CmpNoError(err)
+	td.Nil(director)
+
+	c = &Config{Routes: []Route{{Host: "example.com", Target: "1.2.3.4:81"}}}
+	director, err = c.getRoutesDirector(ctx)
+	td.CmpNoError(err)
+	td.Cmp(director.(DirectorRoutes)[0].Target, "1.2.3.4:81")
+
+	c = &Config{Routes: []Route{{Host: "example.com"}}}
+	_, err = c.getRoutesDirector(ctx)
+	td.CmpError(err)
+}
+
+func TestConfig_checkUpstreamTargets(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	pools := UpstreamPools{"app": &UpstreamPool{Name: "app"}}
+
+	c := &Config{DefaultTarget: ":80", Routes: []Route{{Host: "example.com", Target: "upstream:app"}}}
+	td.CmpNoError(c.checkUpstreamTargets(pools))
+	td.CmpError(c.checkUpstreamTargets(nil))
+
+	c = &Config{DefaultTarget: "upstream:other"}
+	td.CmpError(c.checkUpstreamTargets(pools))
+
+	c = &Config{DefaultTarget: "upstream:app"}
+	director, err := c.getDefaultTargetDirector(ctx)
+	td.CmpNoError(err)
+	td.Cmp(director, NewDirectorHost("upstream:app"))
+
+	c = &Config{
+		DefaultTarget: "upstream:app",
+		Upstreams:     []UpstreamPoolConfig{{Name: "other", Targets: []string{"1.2.3.4:80"}}},
+	}
+	td.CmpError(c.Apply(ctx, &HTTPProxy{}))
+}
+
+func TestConfig_getForwardedDirector(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	director, err := (&Config{}).getForwardedDirector(ctx)
+	td.CmpNoError(err)
+	td.Nil(director)
+
+	director, err = (&Config{TrustedProxies: []string{"10.0.0.0/8"}, XForwardedFor: "replace"}).getForwardedDirector(ctx)
+	td.CmpNoError(err)
+	td.Cmp(director.(DirectorForwarded).XForwardedFor, XForwardedForReplace)
+
+	_, err = (&Config{TrustedProxies: []string{"bad"}}).getForwardedDirector(ctx)
+	td.CmpError(err)
+
+	_, err = (&Config{XForwardedFor: "bad"}).getForwardedDirector(ctx)
+	td.CmpError(err)
+}
+
+func TestConfig_ApplyLimits(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{
+		DefaultTarget:                ":80",
+		ReadHeaderTimeoutSeconds:     1,
+		ReadTimeoutSeconds:           2,
+		WriteTimeoutSeconds:          3,
+		MaxHeaderBytes:               4,
+		MaxBodyBytes:                 5,
+		ResponseHeaderTimeoutSeconds: 6,
+	}).Apply(ctx, p))
+	td.Cmp(p.ReadHeaderTimeout, time.Second)
+	td.Cmp(p.ReadTimeout, 2*time.Second)
+	td.Cmp(p.WriteTimeout, 3*time.Second)
+	td.Cmp(p.MaxHeaderBytes, 4)
+	td.Cmp(p.HTTPTransport.(Transport).Limits, RequestLimits{MaxBodyBytes: 5, ResponseHeaderTimeout: 6 * time.Second})
+}
+
+func TestConfig_BackendProxyProtocol(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80", BackendProxyProtocol: "v2"}).Apply(ctx, p))
+	td.Cmp(p.HTTPTransport.(Transport).BackendProxyProtocol, 2)
+
+	td.CmpError((&Config{DefaultTarget: ":80", BackendProxyProtocol: "v3"}).Apply(ctx, &HTTPProxy{}))
+	td.CmpError((&Config{DefaultTarget: ":80", RateLimitExempt: []string{"bad"}}).Apply(ctx, &HTTPProxy{}))
+}
+
+func TestConfig_getRetryPolicy(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	td.Nil((&Config{}).getRetryPolicy())
+
+	policy := (&Config{RetryCount: 2, RetryTryTimeoutMs: 1500}).getRetryPolicy()
+	td.Cmp(policy.Count, 2)
+	td.Cmp(policy.TryTimeout, 1500*time.Millisecond)
+	td.Nil(policy.Budget)
+
+	policy = (&Config{RetryCount: 1, RetryBudgetPercent: 20, RetryBudgetMinPerSecond: 10}).getRetryPolicy()
+	td.Cmp(policy.Budget.Percent, 20)
+	td.Cmp(policy.Budget.MinPerSecond, 10)
+}
+
 func TestConfig_Apply(t *testing.T) {
 	ctx, flush := th.TestContext(t)
 	defer flush()
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/netlist"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// Modes of X-Forwarded-For header handling
+const (
+	// XForwardedForAppend keep chain, received from trusted proxies, and append address of remote host
+	XForwardedForAppend = "append"
+
+	// XForwardedForReplace replace header by real client ip
+	XForwardedForReplace = "replace"
+)
+
+const (
+	headerForwarded     = "Forwarded"
+	headerXForwardedFor = "X-Forwarded-For"
+)
+
+type forwardedForContextKey struct{}
+
+// DirectorForwarded detect real client ip by X-Forwarded-For or Forwarded headers, received from TrustedProxies,
+// save it to request context (contextlabel.ClientIP) and set X-Forwarded-For and Forwarded (RFC 7239) headers
+// for backend. It must be first in director chain, because other directors can change the headers.
+// X-Forwarded-For, prepared by the director, replace value from other directors.
+type DirectorForwarded struct {
+	TrustedProxies netlist.List
+
+	// XForwardedFor is XForwardedForAppend, XForwardedForReplace or empty for leave the header as is
+	XForwardedFor string
+
+	// Forwarded enable set Forwarded header
+	Forwarded bool
+}
+
+// forwardedHop is one element of forwarding chain
+type forwardedHop struct {
+	ip net.IP
+
+	// forwarded is original element of Forwarded header, empty if the hop was received from X-Forwarded-For
+	forwarded string
+}
+
+func NewDirectorForwarded(trustedProxies netlist.List, xForwardedFor string, forwarded bool) (DirectorForwarded, error) {
+	switch xForwardedFor {
+	case "", XForwardedForAppend, XForwardedForReplace:
+		// pass
+	default:
+		return DirectorForwarded{}, xerrors.Errorf("unknown X-Forwarded-For mode: '%v'", xForwardedFor)
+	}
+	return DirectorForwarded{TrustedProxies: trustedProxies, XForwardedFor: xForwardedFor, Forwarded: forwarded}, nil
+}
+
+func (d DirectorForwarded) Director(request *http.Request) error {
+	ctx := request.Context()
+	remoteIP := netlist.ParseAddrIP(request.RemoteAddr)
+	if remoteIP == nil {
+		zc.L(ctx).Warn("Can't parse remote address for detect client ip", zap.String("remote_addr", request.RemoteAddr))
+		return nil
+	}
+
+	var hops []forwardedHop
+	if d.TrustedProxies.Contains(remoteIP) {
+		hops = parseForwardedHops(request.Header)
+	}
+	clientIndex := d.clientHopIndex(hops)
+	clientIP := remoteIP
+	if clientIndex < len(hops) {
+		clientIP = hops[clientIndex].ip
+	}
+	ctx = context.WithValue(ctx, contextlabel.ClientIP, clientIP.String())
+	zc.L(ctx).Debug("Detect client ip", zap.Stringer("client_ip", clientIP),
+		zap.Int("trusted_hops", len(hops)-clientIndex))
+
+	var chain []forwardedHop
+	switch d.XForwardedFor {
+	case XForwardedForReplace:
+		chain = []forwardedHop{{ip: clientIP}}
+		if clientIndex < len(hops) {
+			chain[0].forwarded = hops[clientIndex].forwarded
+		}
+	default:
+		chain = append(chain, hops[clientIndex:]...)
+		chain = append(chain, forwardedHop{ip: remoteIP})
+	}
+
+	if request.Header == nil {
+		request.Header = make(http.Header)
+	}
+	if d.XForwardedFor != "" {
+		ips := make([]string, len(chain))
+		for i := range chain {
+			ips[i] = chain[i].ip.String()
+		}
+
+		// ReverseProxy append remote address to X-Forwarded-For after directors and doesn't touch header
+		// with nil value. Real value will be restored by restoreXForwardedFor before send request.
+		request.Header[headerXForwardedFor] = nil
+		ctx = context.WithValue(ctx, forwardedForContextKey{}, strings.Join(ips, ", "))
+	}
+	if d.Forwarded {
+		request.Header.Set(headerForwarded, forwardedHeader(chain, request))
+	}
+
+	*request = *request.WithContext(ctx)
+	return nil
+}
+
+// clientHopIndex return index of first hop from end of chain, which isn't trusted proxy.
+// It returns len(hops) if chain is empty.
+func (d DirectorForwarded) clientHopIndex(hops []forwardedHop) int {
+	index := len(hops)
+	for i := len(hops) - 1; i >= 0; i-- {
+		index = i
+		if !d.TrustedProxies.Contains(hops[i].ip) {
+			break
+		}
+	}
+	return index
+}
+
+// parseForwardedHops parse chain from X-Forwarded-For or, if it is empty, from Forwarded header.
+// Chain truncated from start to first unparseable element.
+func parseForwardedHops(header http.Header) []forwardedHop {
+	var hops []forwardedHop
+	if values := header.Values(headerXForwardedFor); len(values) > 0 {
+		for _, item := range strings.Split(strings.Join(values, ","), ",") {
+			hops = append(hops, forwardedHop{ip: net.ParseIP(strings.TrimSpace(item))})
+		}
+	} else {
+		for _, item := range strings.Split(strings.Join(header.Values(headerForwarded), ","), ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			hops = append(hops, forwardedHop{ip: parseForwardedFor(item), forwarded: item})
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].ip == nil {
+			return hops[i+1:]
+		}
+	}
+	return hops
+}
+
+// parseForwardedFor return ip from "for" parameter of Forwarded header element or nil
+func parseForwardedFor(element string) net.IP {
+	for _, pair := range strings.Split(element, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !strings.EqualFold(name, "for") {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if strings.HasPrefix(value, "[") {
+			// [ipv6] or [ipv6]:port
+			value = strings.TrimPrefix(value, "[")
+			if end := strings.Index(value, "]"); end >= 0 {
+				value = value[:end]
+			}
+		} else if host, _, err := net.SplitHostPort(value); err == nil {
+			value = host
+		}
+		return net.ParseIP(value)
+	}
+	return nil
+}
+
+// forwardedHeader build value of Forwarded header. Last element describes request, received by lets-proxy.
+func forwardedHeader(chain []forwardedHop, request *http.Request) string {
+	elements := make([]string, len(chain))
+	for i, hop := range chain {
+		if hop.forwarded != "" {
+			elements[i] = hop.forwarded
+			continue
+		}
+		elements[i] = "for=" + forwardedNode(hop.ip)
+	}
+
+	last := len(elements) - 1
+	if chain[last].forwarded == "" {
+		elements[last] += ";host=" + forwardedValue(request.Host)
+		if tls, ok := request.Context().Value(contextlabel.TLSConnection).(bool); ok {
+			proto := ProtocolHTTP
+			if tls {
+				proto = ProtocolHTTPS
+			}
+			elements[last] += ";proto=" + proto
+		}
+	}
+	return strings.Join(elements, ", ")
+}
+
+func forwardedNode(ip net.IP) string {
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// forwardedValue return token or quoted string
+func forwardedValue(s string) string {
+	for _, r := range s {
+		if !isForwardedTokenChar(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+	}
+	return s
+}
+
+func isForwardedTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	default:
+		return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+	}
+}
+
+// restoreXForwardedFor set X-Forwarded-For header, prepared by DirectorForwarded
+func restoreXForwardedFor(request *http.Request) {
+	if value, ok := request.Context().Value(forwardedForContextKey{}).(string); ok {
+		request.Header.Set(headerXForwardedFor, value)
+	}
+}
+
+// clientIP return real client ip, detected by DirectorForwarded, or ip of remote address if it wasn't detected
+func clientIP(request *http.Request) string {
+	if ip, ok := request.Context().Value(contextlabel.ClientIP).(string); ok {
+		return ip
+	}
+	if ip, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return ip
+	}
+	return request.RemoteAddr
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/netlist"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestDirectorForwarded(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	trusted, err := netlist.Parse([]string{"10.0.0.0/8", "fd00::/8"})
+	e.CmpNoError(err)
+
+	_, err = NewDirectorForwarded(trusted, "bad", false)
+	e.CmpError(err)
+
+	ctx = context.WithValue(ctx, contextlabel.TLSConnection, true)
+	table := []struct {
+		name          string
+		mode          string
+		remoteAddr    string
+		header        http.Header
+		clientIP      string
+		xForwardedFor string
+		forwarded     string
+	}{
+		{
+			name:          "untrusted remote",
+			mode:          XForwardedForAppend,
+			remoteAddr:    "1.2.3.4:100",
+			header:        http.Header{"X-Forwarded-For": {"5.5.5.5"}, "Forwarded": {"for=5.5.5.5"}},
+			clientIP:      "1.2.3.4",
+			xForwardedFor: "1.2.3.4",
+			forwarded:     "for=1.2.3.4;host=example.com;proto=https",
+		},
+		{
+			name:          "append trusted chain",
+			mode:          XForwardedForAppend,
+			remoteAddr:    "10.0.0.1:100",
+			header:        http.Header{"X-Forwarded-For": {"5.5.5.5, 1.1.1.1", "10.0.0.2"}},
+			clientIP:      "1.1.1.1",
+			xForwardedFor: "1.1.1.1, 10.0.0.2, 10.0.0.1",
+			forwarded:     "for=1.1.1.1, for=10.0.0.2, for=10.0.0.1;host=example.com;proto=https",
+		},
+		{
+			name:          "replace",
+			mode:          XForwardedForReplace,
+			remoteAddr:    "10.0.0.1:100",
+			header:        http.Header{"X-Forwarded-For": {"1.1.1.1, 10.0.0.2"}},
+			clientIP:      "1.1.1.1",
+			xForwardedFor: "1.1.1.1",
+			forwarded:     "for=1.1.1.1;host=example.com;proto=https",
+		},
+		{
+			name:          "all hops trusted",
+			mode:          XForwardedForReplace,
+			remoteAddr:    "10.0.0.1:100",
+			header:        http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			clientIP:      "10.0.0.3",
+			xForwardedFor: "10.0.0.3",
+			forwarded:     "for=10.0.0.3;host=example.com;proto=https",
+		},
+		{
+			name:          "unparseable hop",
+			mode:          XForwardedForAppend,
+			remoteAddr:    "10.0.0.1:100",
+			header:        http.Header{"X-Forwarded-For": {"1.1.1.1, unknown, 10.0.0.2"}},
+			clientIP:      "10.0.0.2",
+			xForwardedFor: "10.0.0.2, 10.0.0.1",
+			forwarded:     "for=10.0.0.2, for=10.0.0.1;host=example.com;proto=https",
+		},
+		{
+			name:          "chain from forwarded header",
+			mode:          XForwardedForAppend,
+			remoteAddr:    "[fd00::1]:100",
+			header:        http.Header{"Forwarded": {`for="[2001:db8::1]:80";proto=http, For=10.0.0.2`}},
+			clientIP:      "2001:db8::1",
+			xForwardedFor: "2001:db8::1, 10.0.0.2, fd00::1",
+			forwarded:     `for="[2001:db8::1]:80";proto=http, For=10.0.0.2, for="[fd00::1]";host=example.com;proto=https`,
+		},
+		{
+			name:          "keep x-forwarded-for",
+			remoteAddr:    "10.0.0.1:100",
+			header:        http.Header{"X-Forwarded-For": {"1.1.1.1"}},
+			clientIP:      "1.1.1.1",
+			xForwardedFor: "1.1.1.1",
+			forwarded:     "for=1.1.1.1, for=10.0.0.1;host=example.com;proto=https",
+		},
+	}
+
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			e, _, flush := th.NewEnv(t)
+			defer flush()
+
+			d, err := NewDirectorForwarded(trusted, test.mode, true)
+			e.CmpNoError(err)
+
+			req := (&http.Request{RemoteAddr: test.remoteAddr, Host: "example.com", Header: test.header}).WithContext(ctx)
+			e.CmpNoError(d.Director(req))
+			restoreXForwardedFor(req)
+
+			e.Cmp(clientIP(req), test.clientIP)
+			e.Cmp(req.Header.Get("X-Forwarded-For"), test.xForwardedFor)
+			e.Cmp(req.Header.Get("Forwarded"), test.forwarded)
+		})
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.Cmp(forwardedValue("example.com"), "example.com")
+	e.Cmp(forwardedValue("example.com:8080"), `"example.com:8080"`)
+	e.Cmp(forwardedValue(`a"b`), `"a\"b"`)
+}
+
+func TestHttpProxy_XForwardedFor(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(request.Header.Get("X-Forwarded-For")))
+	}))
+	defer server.Close()
+
+	proxy, addr := httpProxy(e, server.URL)
+	serverURL, err := url.Parse(server.URL)
+	e.CmpNoError(err)
+
+	get := func() string {
+		req, err := http.NewRequest(http.MethodGet, addr, nil)
+		e.CmpNoError(err)
+		req.Header.Set("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+		resp, err := http.DefaultClient.Do(req)
+		e.CmpNoError(err)
+		body, err := io.ReadAll(resp.Body)
+		e.CmpNoError(err)
+		e.CmpNoError(resp.Body.Close())
+		return string(body)
+	}
+
+	// default ReverseProxy behaviour
+	e.Cmp(get(), "1.1.1.1, 2.2.2.2, 127.0.0.1")
+
+	trusted, err := netlist.Parse([]string{"127.0.0.1", "2.2.2.2"})
+	e.CmpNoError(err)
+	for mode, expected := range map[string]string{
+		XForwardedForAppend:  "1.1.1.1, 2.2.2.2, 127.0.0.1",
+		XForwardedForReplace: "1.1.1.1",
+	} {
+		forwarded, err := NewDirectorForwarded(trusted, mode, false)
+		e.CmpNoError(err)
+		proxy.Reload(NewDirectorChain(
+			forwarded,
+			DirectorHost(serverURL.Host),
+			DirectorSetScheme(serverURL.Scheme),
+			NewDirectorSetHeaders(map[string]string{"X-Forwarded-For": SourceIP}),
+		), nil)
+		e.Cmp(get(), expected, mode)
+	}
+}
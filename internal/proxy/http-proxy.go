@@ -6,8 +6,11 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rekby/lets-proxy2/internal/contexthelper"
 
 	"github.com/rekby/lets-proxy2/internal/contextlabel"
@@ -29,12 +32,26 @@ type HTTPProxy struct {
 	Director             Director // modify requests to backend.
 	HTTPTransport        http.RoundTripper
 	EnableAccessLog      bool
+	AccessLog            *AccessLog // sink of access log, nil - write to log of request context
 
 	logger           *zap.Logger
 	listener         net.Listener
 	httpReverseProxy httputil.ReverseProxy
 	IdleTimeout      time.Duration
 	httpServer       http.Server
+
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and MaxHeaderBytes are settings of http server, see http.Server
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	MaxHeaderBytes    int
+
+	handlers atomic.Value // proxyHandlers, can be replaced by Reload while proxy work
+}
+
+type proxyHandlers struct {
+	director  Director
+	transport http.RoundTripper
 }
 
 func NewHTTPProxy(ctx context.Context, listener net.Listener) *HTTPProxy {
@@ -53,6 +70,27 @@ func NewHTTPProxy(ctx context.Context, listener net.Listener) *HTTPProxy {
 	return res
 }
 
+// Reload atomically replace director and transport of started proxy.
+// Requests in progress finish with old handlers, new requests use new handlers.
+func (p *HTTPProxy) Reload(director Director, transport http.RoundTripper) {
+	p.handlers.Store(proxyHandlers{director: director, transport: transport})
+	p.logger.Info("Proxy handlers reloaded")
+}
+
+// InitMetrics register metrics of upstream pools, r can be nil.
+func (p *HTTPProxy) InitMetrics(r prometheus.Registerer) {
+	if r == nil || reflect.ValueOf(r).IsNil() {
+		return
+	}
+	r.MustRegister(upstreamsCollector{proxy: p})
+}
+
+// Shutdown stop accept new connections and wait while in-flight requests finished or ctx done.
+// Connections, which not finished before ctx done stay opened, call Close for force close them.
+func (p *HTTPProxy) Shutdown(ctx context.Context) error {
+	return p.httpServer.Shutdown(ctx)
+}
+
 func (p *HTTPProxy) Close() error {
 	return p.httpServer.Close()
 }
@@ -63,26 +101,74 @@ func (p *HTTPProxy) Close() error {
 func (p *HTTPProxy) Start() error {
 	if p.HTTPTransport != nil {
 		p.logger.Info("Set transport to reverse proxy")
-		p.httpReverseProxy.Transport = p.HTTPTransport
-	}
-
-	if p.EnableAccessLog {
-		p.httpReverseProxy.Transport = NewTransportLogger(p.httpReverseProxy.Transport)
 	}
-	p.logger.Info("Access log", zap.Bool("enabled", p.EnableAccessLog))
+	p.handlers.Store(proxyHandlers{director: p.Director, transport: p.HTTPTransport})
+	p.httpReverseProxy.Transport = roundTripperFunc(p.roundTrip)
+	p.httpReverseProxy.ErrorHandler = errorHandler
 
-	p.httpServer.Handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+	var handler http.Handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		defer getClientConn(request).resetDeadlines()
 		if !p.HandleHTTPValidation(writer, request) {
 			p.httpReverseProxy.ServeHTTP(writer, request)
 		}
 	})
+	if p.EnableAccessLog {
+		transportLogger := NewTransportLogger(p.httpReverseProxy.Transport)
+		transportLogger.AccessLog = p.AccessLog
+		p.httpReverseProxy.Transport = transportLogger
+		handler = p.accessLogHandler(handler)
+	}
+	p.logger.Info("Access log", zap.Bool("enabled", p.EnableAccessLog))
+
+	p.httpServer.Handler = handler
+	p.httpServer.ConnContext = withClientConn
 	p.httpServer.IdleTimeout = p.IdleTimeout
+	p.httpServer.ReadHeaderTimeout = p.ReadHeaderTimeout
+	p.httpServer.ReadTimeout = p.ReadTimeout
+	p.httpServer.WriteTimeout = p.WriteTimeout
+	p.httpServer.MaxHeaderBytes = p.MaxHeaderBytes
 
 	p.logger.Info("Http builtin reverse proxy start")
 	err := p.httpServer.Serve(p.listener)
 	return err
 }
 
+// accessLogHandler write access log record after request handled, include requests without backend
+// (http-01 validation). Transport logger add backend response to the record.
+func (p *HTTPProxy) accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx, err := p.GetContext(request)
+		log.DebugDPanic(zc.L(ctx), err, "Get connection context for access log")
+		logRequest := request.WithContext(contexthelper.CombineContext(ctx, request.Context()))
+
+		record := newAccessLogRecord(logRequest, time.Now())
+		record.upstream = ""
+
+		// reverse proxy abort handler by panic if copy of response body failed
+		defer func() {
+			recovered := recover()
+			record.duration = time.Since(record.start)
+			if recovered != nil && record.err == nil {
+				record.err = http.ErrAbortHandler
+			}
+			if record.statusCode == 0 {
+				// server send ok status if handler doesn't write response
+				record.statusCode = http.StatusOK
+			}
+			if record.durationWithoutBody == 0 {
+				record.durationWithoutBody = record.duration
+			}
+			p.AccessLog.write(logRequest, record)
+			if recovered != nil {
+				panic(recovered)
+			}
+		}()
+
+		request = request.WithContext(context.WithValue(request.Context(), accessLogRecordKey{}, record))
+		next.ServeHTTP(&accessLogResponseWriter{ResponseWriter: writer, record: record}, request)
+	})
+}
+
 func getContext(_ *http.Request) (context.Context, error) {
 	return zc.WithLogger(context.WithValue(context.Background(), contextlabel.ConnectionID, "conn-id-none"), zap.NewNop()), nil
 }
@@ -92,11 +178,36 @@ func (p *HTTPProxy) director(request *http.Request) {
 
 	logger := zc.L(ctx)
 	log.DebugDPanic(logger, err, "Get connection context for request")
-	*request = *request.WithContext(contexthelper.CombineContext(ctx, request.Context()))
 
 	if request.URL == nil {
 		request.URL = &url.URL{}
 	}
-	err = p.Director.Director(request)
+	// save path from client, because directors can rewrite it
+	ctx = context.WithValue(ctx, clientPathContextKey{}, request.URL.Path)
+	*request = *request.WithContext(contexthelper.CombineContext(ctx, request.Context()))
+
+	err = p.getHandlers().director.Director(request)
 	log.DebugPanic(logger, err, "Apply directors")
 }
+
+func (p *HTTPProxy) roundTrip(request *http.Request) (*http.Response, error) {
+	transport := p.getHandlers().transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	restoreXForwardedFor(request)
+	return transport.RoundTrip(request)
+}
+
+func (p *HTTPProxy) getHandlers() proxyHandlers {
+	if handlers, ok := p.handlers.Load().(proxyHandlers); ok {
+		return handlers
+	}
+	return proxyHandlers{director: p.Director, transport: p.HTTPTransport}
+}
+
+type roundTripperFunc func(request *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
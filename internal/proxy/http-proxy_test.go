@@ -196,3 +196,92 @@ func httpProxy(e *th.Env, dst string) (*HTTPProxy, string) {
 	})
 	return proxy, addr
 }
+
+func TestHttpProxy_Reload(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	server1 := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("1"))
+	}))
+	defer server1.Close()
+
+	server2 := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("2"))
+	}))
+	defer server2.Close()
+
+	proxy, addr := httpProxy(e, server1.URL)
+
+	get := func() string {
+		resp, err := http.Get(addr)
+		e.CmpNoError(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		e.CmpNoError(err)
+		e.CmpNoError(resp.Body.Close())
+		return string(body)
+	}
+
+	e.Cmp(get(), "1")
+
+	server2URL, err := url.Parse(server2.URL)
+	e.CmpNoError(err)
+	proxy.Reload(NewDirectorChain(DirectorHost(server2URL.Host), DirectorSetScheme(server2URL.Scheme)), nil)
+	e.Cmp(get(), "2")
+
+	proxy.Reload(NewDirectorChain(DirectorHost(server2URL.Host), DirectorSetScheme(server2URL.Scheme)),
+		roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusTeapot,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+				Request:    request,
+			}, nil
+		}))
+
+	resp, err := http.Get(addr)
+	e.CmpNoError(err)
+	e.CmpNoError(resp.Body.Close())
+	e.Cmp(resp.StatusCode, http.StatusTeapot)
+}
+
+func TestHttpProxy_Shutdown(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	requestStarted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(requestStarted)
+		time.Sleep(50 * time.Millisecond)
+		_, _ = writer.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	proxy, addr := httpProxy(e, server.URL)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(addr)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		results <- result{body: string(body), err: err}
+	}()
+
+	<-requestStarted
+	e.CmpNoError(proxy.Shutdown(ctx))
+
+	res := <-results
+	e.CmpNoError(res.err)
+	e.Cmp(res.body, "ok")
+
+	_, err := http.Get(addr)
+	e.CmpError(err)
+}
@@ -1,19 +1,31 @@
 package proxy
 
 import (
+	"math"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2"
 	"github.com/jonboulle/clockwork"
+	"github.com/rekby/lets-proxy2/internal/netlist"
 	"golang.org/x/time/rate"
 )
 
+type clientPathContextKey struct{}
+
 type RateLimiter struct {
-	rateLimit  int
-	timeWindow time.Duration
-	burst      int
+	// global is limit for requests, which don't match any rule, nil if the requests are not limited
+	global *rateLimit
+	rules  []rateLimitRule
+
+	exempt     netlist.List
+	ipv4Prefix int
+	ipv6Prefix int
 
 	clock clockwork.Clock
 	mx    sync.RWMutex
@@ -26,10 +38,58 @@ type RateLimitParams struct {
 	Burst      int
 	CacheSize  int
 	Clock      clockwork.Clock
+
+	// IPv4Prefix and IPv6Prefix aggregate clients to one limit by network prefix length (for example 24 and 64),
+	// 0 means limit by full address
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// Exempt is networks of clients without rate limit
+	Exempt netlist.List
+
+	// Rules is separate limits for hosts and path prefixes
+	Rules []RateLimitRule
+}
+
+// RateLimitRule is separate limit for requests to the host and path prefix. Empty Host or PathPrefix match any.
+// Most specific rule is used for request: with host, then with longer path prefix.
+// RateLimit 0 means without limit for matched requests.
+type RateLimitRule struct {
+	Host         string
+	PathPrefix   string
+	RateLimit    int
+	TimeWindowMs int
+	Burst        int
+}
+
+// RateLimitResult is state of client limit after request
+type RateLimitResult struct {
+	Allowed bool
+
+	// Limit is count of requests per Window
+	Limit  int
+	Window time.Duration
+
+	// Remaining is count of requests, allowed right now
+	Remaining int
+
+	// Reset is time until next request will be allowed
+	Reset time.Duration
+}
+
+type rateLimit struct {
+	rateLimit  int
+	timeWindow time.Duration
+	burst      int
+}
+
+type rateLimitRule struct {
+	RateLimitRule
+	limit *rateLimit
 }
 
 func NewRateLimiter(params RateLimitParams) (*RateLimiter, error) {
-	if params.RateLimit == 0 {
+	if params.RateLimit == 0 && len(params.Rules) == 0 {
 		return &RateLimiter{}, nil
 	}
 
@@ -38,13 +98,34 @@ func NewRateLimiter(params RateLimitParams) (*RateLimiter, error) {
 		return nil, err
 	}
 
+	rules := make([]rateLimitRule, 0, len(params.Rules))
+	for _, rule := range params.Rules {
+		item := rateLimitRule{RateLimitRule: rule}
+		item.Host = strings.ToLower(rule.Host)
+		if rule.RateLimit != 0 {
+			item.limit = newRateLimit(rule.RateLimit, time.Duration(rule.TimeWindowMs)*time.Millisecond, rule.Burst)
+		}
+		rules = append(rules, item)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		left, right := rules[i], rules[j]
+		if (left.Host == "") != (right.Host == "") {
+			return left.Host != ""
+		}
+		return len(left.PathPrefix) > len(right.PathPrefix)
+	})
+
 	self := &RateLimiter{
-		rateLimit:  params.RateLimit,
-		timeWindow: params.TimeWindow,
-		burst:      params.Burst,
+		rules:      rules,
+		exempt:     params.Exempt,
+		ipv4Prefix: params.IPv4Prefix,
+		ipv6Prefix: params.IPv6Prefix,
 		cache:      cache,
 		clock:      params.Clock,
 	}
+	if params.RateLimit != 0 {
+		self.global = newRateLimit(params.RateLimit, params.TimeWindow, params.Burst)
+	}
 
 	if self.clock == nil {
 		self.clock = clockwork.NewRealClock()
@@ -53,22 +134,115 @@ func NewRateLimiter(params RateLimitParams) (*RateLimiter, error) {
 	return self, nil
 }
 
+func newRateLimit(limit int, timeWindow time.Duration, burst int) *rateLimit {
+	if timeWindow <= 0 {
+		timeWindow = time.Second
+	}
+	if burst == 0 {
+		burst = limit
+	}
+	return &rateLimit{rateLimit: limit, timeWindow: timeWindow, burst: burst}
+}
+
 func (rl *RateLimiter) Allow(r *http.Request) bool {
-	if rl.rateLimit == 0 {
-		return true
+	return rl.Check(r).Allowed
+}
+
+// Check count request in limit of the client and return state of the limit
+func (rl *RateLimiter) Check(r *http.Request) RateLimitResult {
+	if rl.cache == nil {
+		return RateLimitResult{Allowed: true}
 	}
 	if r.Context().Err() != nil {
-		return false
+		return RateLimitResult{Allowed: false}
+	}
+
+	ip := clientIP(r)
+	if rl.exempt.ContainsAddr(ip) {
+		return RateLimitResult{Allowed: true}
+	}
+
+	keyPrefix, limit := rl.findLimit(r)
+	if limit == nil {
+		return RateLimitResult{Allowed: true}
 	}
 
-	return rl.getLimiter(r).AllowN(rl.clock.Now(), 1)
+	now := rl.clock.Now()
+	limiter := rl.getLimiter(keyPrefix+rl.clientKey(ip), limit)
+	res := RateLimitResult{
+		Allowed: limiter.AllowN(now, 1),
+		Limit:   limit.rateLimit,
+		Window:  limit.timeWindow,
+	}
+
+	tokens := limiter.TokensAt(now)
+	if tokens > 0 {
+		res.Remaining = int(tokens)
+	}
+	switch {
+	case tokens >= 1:
+		// pass
+	case limiter.Limit() > 0:
+		res.Reset = time.Duration((1 - tokens) / float64(limiter.Limit()) * float64(time.Second))
+	default:
+		res.Reset = limit.timeWindow
+	}
+	return res
 }
 
-func (rl *RateLimiter) getLimiter(r *http.Request) *rate.Limiter {
-	rl.mx.RLock()
-	ip := getIP(r)
+// findLimit return key prefix and limit for the request, limit is nil for requests without limit
+func (rl *RateLimiter) findLimit(r *http.Request) (string, *rateLimit) {
+	host := strings.ToLower(requestHost(r))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	path := clientPath(r)
 
-	limiter, ok := rl.cache.Get(ip)
+	for i := range rl.rules {
+		rule := &rl.rules[i]
+		if rule.Host != "" && rule.Host != host {
+			continue
+		}
+		if !hasPathPrefix(path, rule.PathPrefix) {
+			continue
+		}
+		return "rule-" + strconv.Itoa(i) + "-", rule.limit
+	}
+	return "", rl.global
+}
+
+// clientPath return path of request from client, before directors rewrite it
+func clientPath(r *http.Request) string {
+	if path, ok := r.Context().Value(clientPathContextKey{}).(string); ok {
+		return path
+	}
+	if r.URL == nil {
+		return ""
+	}
+	return r.URL.Path
+}
+
+// clientKey return ip or network of client for aggregate limits
+func (rl *RateLimiter) clientKey(addr string) string {
+	ip := netlist.ParseAddrIP(addr)
+	if ip == nil {
+		return addr
+	}
+
+	prefix, bits := rl.ipv6Prefix, net.IPv6len*8
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, prefix, bits = ip4, rl.ipv4Prefix, net.IPv4len*8
+	}
+	if prefix <= 0 || prefix >= bits {
+		return ip.String()
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+func (rl *RateLimiter) getLimiter(key string, limit *rateLimit) *rate.Limiter {
+	rl.mx.RLock()
+	limiter, ok := rl.cache.Get(key)
 	if ok {
 		rl.mx.RUnlock()
 		return limiter
@@ -79,15 +253,21 @@ func (rl *RateLimiter) getLimiter(r *http.Request) *rate.Limiter {
 	defer rl.mx.Unlock()
 
 	// we need to check cache again to avoid data race
-	limiter, ok = rl.cache.Get(ip)
+	limiter, ok = rl.cache.Get(key)
 	if !ok {
-		limiter = rate.NewLimiter(rate.Limit(float64(rl.rateLimit)/rl.timeWindow.Seconds()), rl.burst)
-		rl.cache.Add(ip, limiter)
+		limiter = rate.NewLimiter(rate.Limit(float64(limit.rateLimit)/limit.timeWindow.Seconds()), limit.burst)
+		rl.cache.Add(key, limiter)
 	}
 
 	return limiter
 }
 
-func getIP(r *http.Request) string {
-	return r.RemoteAddr
+// setHeaders set Retry-After and RateLimit-* headers to response, rejected by rate limit
+func (res RateLimitResult) setHeaders(header http.Header) {
+	reset := strconv.Itoa(int(math.Ceil(res.Reset.Seconds())))
+	header.Set("Retry-After", reset)
+	header.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	header.Set("RateLimit-Reset", reset)
+	header.Set("RateLimit-Policy", strconv.Itoa(res.Limit)+";w="+strconv.Itoa(int(math.Ceil(res.Window.Seconds()))))
 }
@@ -2,12 +2,18 @@ package proxy
 
 import (
 	"context"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/jonboulle/clockwork"
 	"github.com/maxatome/go-testdeep"
+	"github.com/rekby/lets-proxy2/internal/netlist"
+	"github.com/rekby/lets-proxy2/internal/th"
 )
 
 func TestRateLimiter_Allow(t *testing.T) {
@@ -159,3 +165,163 @@ func TestMaxRequestsPerSec(t *testing.T) {
 		})
 	}
 }
+
+func TestRateLimiter_Check(t *testing.T) {
+	newRequest := func(remoteAddr, url string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+
+	t.Run("limit by ip without port", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		limiter, err := NewRateLimiter(RateLimitParams{RateLimit: 1, TimeWindow: time.Second, CacheSize: 100})
+		td.CmpNoError(err)
+
+		td.True(limiter.Allow(newRequest("1.2.3.4:1000", "http://example.com")))
+		td.False(limiter.Allow(newRequest("1.2.3.4:1001", "http://example.com")))
+		td.True(limiter.Allow(newRequest("1.2.3.5:1000", "http://example.com")))
+	})
+
+	t.Run("aggregate networks", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		limiter, err := NewRateLimiter(RateLimitParams{
+			RateLimit: 1, TimeWindow: time.Second, CacheSize: 100, IPv4Prefix: 24, IPv6Prefix: 64,
+		})
+		td.CmpNoError(err)
+
+		td.True(limiter.Allow(newRequest("1.2.3.4:1000", "http://example.com")))
+		td.False(limiter.Allow(newRequest("1.2.3.5:1000", "http://example.com")))
+		td.True(limiter.Allow(newRequest("1.2.4.5:1000", "http://example.com")))
+
+		td.True(limiter.Allow(newRequest("[2001:db8::1]:1000", "http://example.com")))
+		td.False(limiter.Allow(newRequest("[2001:db8::2]:1000", "http://example.com")))
+		td.True(limiter.Allow(newRequest("[2001:db8:0:1::1]:1000", "http://example.com")))
+	})
+
+	t.Run("exempt networks", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		exempt, _ := netlist.Parse([]string{"10.0.0.0/8"})
+		limiter, err := NewRateLimiter(RateLimitParams{RateLimit: 1, TimeWindow: time.Second, CacheSize: 100, Exempt: exempt})
+		td.CmpNoError(err)
+
+		for i := 0; i < 3; i++ {
+			td.True(limiter.Allow(newRequest("10.0.0.1:1000", "http://example.com")))
+		}
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		limiter, err := NewRateLimiter(RateLimitParams{
+			CacheSize: 100,
+			Rules: []RateLimitRule{
+				{PathPrefix: "/api/", RateLimit: 1, TimeWindowMs: 1000},
+				{Host: "Example.com", PathPrefix: "/api/", RateLimit: 2, TimeWindowMs: 1000},
+				{Host: "example.com", PathPrefix: "/api/free/"},
+			},
+		})
+		td.CmpNoError(err)
+
+		td.True(limiter.Allow(newRequest("1.2.3.4:1000", "http://other.com/api/")))
+		td.False(limiter.Allow(newRequest("1.2.3.4:1000", "http://other.com/api/")))
+
+		td.True(limiter.Allow(newRequest("1.2.3.4:1000", "http://example.com:8080/api/")))
+		td.True(limiter.Allow(newRequest("1.2.3.4:1000", "http://example.com/api/")))
+		td.False(limiter.Allow(newRequest("1.2.3.4:1000", "http://example.com/api/")))
+
+		for i := 0; i < 3; i++ {
+			td.True(limiter.Allow(newRequest("1.2.3.4:1000", "http://example.com/api/free/")))
+			td.True(limiter.Allow(newRequest("1.2.3.4:1000", "http://other.com/")))
+		}
+	})
+
+	t.Run("rule path prefix on segment boundary", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		limiter, err := NewRateLimiter(RateLimitParams{
+			CacheSize: 100,
+			Rules:     []RateLimitRule{{PathPrefix: "/login", RateLimit: 1, TimeWindowMs: 1000}},
+		})
+		td.CmpNoError(err)
+
+		td.True(limiter.Allow(newRequest("1.2.3.4:1000", "http://example.com/login")))
+		td.False(limiter.Allow(newRequest("1.2.3.4:1000", "http://example.com/login/form")))
+		for i := 0; i < 3; i++ {
+			td.True(limiter.Allow(newRequest("1.2.3.4:1000", "http://example.com/loginhelp")))
+		}
+	})
+
+	t.Run("result", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		clock := clockwork.NewFakeClock()
+		limiter, err := NewRateLimiter(RateLimitParams{
+			RateLimit: 2, TimeWindow: 10 * time.Second, CacheSize: 100, Clock: clock,
+		})
+		td.CmpNoError(err)
+
+		td.Cmp(limiter.Check(newRequest("1.2.3.4:1000", "http://example.com")), RateLimitResult{
+			Allowed: true, Limit: 2, Window: 10 * time.Second, Remaining: 1,
+		})
+		td.Cmp(limiter.Check(newRequest("1.2.3.4:1000", "http://example.com")), RateLimitResult{
+			Allowed: true, Limit: 2, Window: 10 * time.Second, Reset: 5 * time.Second,
+		})
+		res := limiter.Check(newRequest("1.2.3.4:1000", "http://example.com"))
+		td.Cmp(res, RateLimitResult{Allowed: false, Limit: 2, Window: 10 * time.Second, Reset: 5 * time.Second})
+
+		header := make(http.Header)
+		res.setHeaders(header)
+		td.Cmp(header, http.Header{
+			"Retry-After":         {"5"},
+			"Ratelimit-Limit":     {"2"},
+			"Ratelimit-Remaining": {"0"},
+			"Ratelimit-Reset":     {"5"},
+			"Ratelimit-Policy":    {"2;w=10"},
+		})
+	})
+}
+
+func TestHTTPProxy_RateLimitRulesWithRoutes(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	var backendPaths []string
+	var mx sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mx.Lock()
+		backendPaths = append(backendPaths, request.URL.Path)
+		mx.Unlock()
+		_, _ = writer.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	e.CmpNoError(err)
+	routes, err := NewDirectorRoutes([]Route{
+		{Host: "example.com", PathPrefix: "/api", RewritePathPrefix: "/", Target: serverURL.Host},
+	})
+	e.CmpNoError(err)
+	rateLimiter, err := NewRateLimiter(RateLimitParams{
+		CacheSize: 100,
+		Rules:     []RateLimitRule{{PathPrefix: "/api/login", RateLimit: 1, TimeWindowMs: 1000}},
+	})
+	e.CmpNoError(err)
+
+	proxy, addr := httpProxy(e, server.URL)
+	proxy.Reload(NewDirectorChain(DirectorSetScheme(serverURL.Scheme), routes), Transport{RateLimiter: rateLimiter})
+
+	do := func(path string) int {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+path, nil)
+		e.CmpNoError(err)
+		req.Host = "example.com"
+		resp, err := http.DefaultClient.Do(req)
+		e.CmpNoError(err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	e.Cmp(do("/api/login"), http.StatusOK)
+	e.Cmp(do("/api/login"), http.StatusTooManyRequests)
+	e.Cmp(do("/api/login"), http.StatusTooManyRequests)
+	e.Cmp(do("/api/other"), http.StatusOK)
+	e.Cmp(backendPaths, []string{"/login", "/other"})
+}
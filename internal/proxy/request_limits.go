@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+var (
+	errRequestBodyTooLarge   = errors.New("request body too large")
+	errRequestReadTimeout    = errors.New("request body read timeout")
+	errResponseHeaderTimeout = errors.New("backend response header timeout")
+	errWriteTimeout          = errors.New("response write timeout")
+)
+
+// RequestLimits limit request to backend. Zero values mean no limit.
+type RequestLimits struct {
+	// MaxBodyBytes is max size of request body, bigger requests are rejected with 413 status
+	MaxBodyBytes int64
+
+	// ResponseHeaderTimeout limit time for receive response headers from backend, 504 status sent on timeout
+	ResponseHeaderTimeout time.Duration
+
+	// ReadTimeout limit time for read request body from client, 408 status sent on timeout.
+	// WriteTimeout limit time from start of backend request to end of response, connection to client closed
+	// on timeout. They set deadlines of client connection as timeouts of http server, but after route selected.
+	// They are used for routes only, global timeouts set to http server.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+type requestLimitsContextKey struct{}
+
+// merge return limits with not zero values of override
+func (l RequestLimits) merge(override RequestLimits) RequestLimits {
+	if override.MaxBodyBytes != 0 {
+		l.MaxBodyBytes = override.MaxBodyBytes
+	}
+	if override.ResponseHeaderTimeout != 0 {
+		l.ResponseHeaderTimeout = override.ResponseHeaderTimeout
+	}
+	if override.ReadTimeout != 0 {
+		l.ReadTimeout = override.ReadTimeout
+	}
+	if override.WriteTimeout != 0 {
+		l.WriteTimeout = override.WriteTimeout
+	}
+	return l
+}
+
+// withRequestLimits save limits of route to request context, they override limits of transport
+func withRequestLimits(request *http.Request, limits RequestLimits) {
+	if limits == (RequestLimits{}) {
+		return
+	}
+	*request = *request.WithContext(context.WithValue(request.Context(), requestLimitsContextKey{}, limits))
+}
+
+// requestLimits return limits of transport, overridden by limits of route
+func (t Transport) requestLimits(req *http.Request) RequestLimits {
+	if override, ok := req.Context().Value(requestLimitsContextKey{}).(RequestLimits); ok {
+		return t.Limits.merge(override)
+	}
+	return t.Limits
+}
+
+// limitBody return request with limited body size or error if content length more than limit
+func limitBody(req *http.Request, maxBytes int64) (*http.Request, *limitedBody, error) {
+	if maxBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return req, nil, nil
+	}
+	if req.ContentLength > maxBytes {
+		return nil, nil, xerrors.Errorf("content length %v more than %v: %w", req.ContentLength, maxBytes, errRequestBodyTooLarge)
+	}
+
+	body := &limitedBody{ReadCloser: req.Body, remaining: maxBytes}
+	res := new(http.Request)
+	*res = *req
+	res.Body = body
+	return res, body, nil
+}
+
+// limitedBody return errRequestBodyTooLarge after read more then remaining bytes
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		atomic.StoreInt32(&b.exceeded, 1)
+		return n - 1, errRequestBodyTooLarge
+	}
+	return n, err
+}
+
+func (b *limitedBody) isExceeded() bool {
+	return b != nil && atomic.LoadInt32(&b.exceeded) == 1
+}
+
+type clientConnContextKey struct{}
+
+// clientConn is connection of http server with client, routes set read and write deadlines to it
+type clientConn struct {
+	net.Conn
+	deadlinesChanged bool
+}
+
+// withClientConn save client connection to context of connection
+func withClientConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, clientConnContextKey{}, &clientConn{Conn: conn})
+}
+
+// getClientConn return connection of request for set deadlines or nil.
+// HTTP/2 connection shared by requests, so deadlines can be set for HTTP/1 requests only.
+func getClientConn(req *http.Request) *clientConn {
+	if req.ProtoMajor != 1 {
+		return nil
+	}
+	conn, _ := req.Context().Value(clientConnContextKey{}).(*clientConn)
+	return conn
+}
+
+// resetDeadlines remove deadlines of route after request, http server set own deadlines for next request
+func (c *clientConn) resetDeadlines() {
+	if c == nil || !c.deadlinesChanged {
+		return
+	}
+	c.deadlinesChanged = false
+	_ = c.SetReadDeadline(time.Time{})
+	_ = c.SetWriteDeadline(time.Time{})
+}
+
+// requestDeadlines limit time of request by read and write timeouts of route
+type requestDeadlines struct {
+	body         *deadlineBody
+	cancel       context.CancelFunc
+	writeTimer   *time.Timer
+	writeExpired int32
+}
+
+// withDeadlines set deadlines of client connection by read and write timeouts and return request,
+// which canceled on write timeout. Deadlines must be finished by finish method after response body closed.
+func withDeadlines(req *http.Request, readTimeout, writeTimeout time.Duration) (*http.Request, *requestDeadlines) {
+	conn := getClientConn(req)
+	now := time.Now()
+	res := req
+	var deadlines *requestDeadlines
+	if readTimeout > 0 && conn != nil && req.Body != nil && req.Body != http.NoBody {
+		_ = conn.SetReadDeadline(now.Add(readTimeout))
+		conn.deadlinesChanged = true
+		res = new(http.Request)
+		*res = *req
+		body := &deadlineBody{ReadCloser: req.Body, conn: conn}
+		res.Body = body
+		deadlines = &requestDeadlines{body: body}
+	}
+	if writeTimeout <= 0 {
+		return res, deadlines
+	}
+	if deadlines == nil {
+		deadlines = &requestDeadlines{}
+	}
+
+	if conn != nil {
+		_ = conn.SetWriteDeadline(now.Add(writeTimeout))
+		conn.deadlinesChanged = true
+	}
+	// write deadline of connection doesn't stop wait of backend response
+	ctx, cancel := context.WithCancel(res.Context())
+	deadlines.cancel = cancel
+	deadlines.writeTimer = time.AfterFunc(writeTimeout, func() {
+		atomic.StoreInt32(&deadlines.writeExpired, 1)
+		cancel()
+	})
+	return res.WithContext(ctx), deadlines
+}
+
+func (d *requestDeadlines) finish() {
+	if d == nil || d.writeTimer == nil {
+		return
+	}
+	d.writeTimer.Stop()
+	d.cancel()
+}
+
+// wrapError add reason to error of request, failed by read timeout or canceled by write timeout.
+// Transport can return error of broken connection instead of error of body read, so check state of body.
+func (d *requestDeadlines) wrapError(err error) error {
+	if err == nil || d == nil {
+		return err
+	}
+	if d.body.isExpired() && !errors.Is(err, errRequestReadTimeout) {
+		return xerrors.Errorf("%v: %w", err, errRequestReadTimeout)
+	}
+	if atomic.LoadInt32(&d.writeExpired) == 1 {
+		return xerrors.Errorf("%v: %w", err, errWriteTimeout)
+	}
+	return err
+}
+
+// deadlineBody remove read deadline of client connection after body read
+// and return errRequestReadTimeout if deadline exceeded
+type deadlineBody struct {
+	io.ReadCloser
+	conn    *clientConn
+	expired int32
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		_ = b.conn.SetReadDeadline(time.Time{})
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		atomic.StoreInt32(&b.expired, 1)
+		err = xerrors.Errorf("%v: %w", err, errRequestReadTimeout)
+	}
+	return n, err
+}
+
+func (b *deadlineBody) isExpired() bool {
+	return b != nil && atomic.LoadInt32(&b.expired) == 1
+}
+
+// errorReason return short reason of backend request error for logs
+func errorReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, errRequestBodyTooLarge):
+		return "request_body_too_large"
+	case errors.Is(err, errRequestReadTimeout):
+		return "request_read_timeout"
+	case errors.Is(err, errResponseHeaderTimeout):
+		return "backend_response_header_timeout"
+	case errors.Is(err, errWriteTimeout):
+		return "write_timeout"
+	case errors.Is(err, errTryTimeout):
+		return "backend_try_timeout"
+	case errors.Is(err, errNoAvailableUpstream):
+		return "no_available_upstream"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "backend_error"
+	}
+}
+
+// errorStatus return status code of response for failed backend request
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errRequestBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errRequestReadTimeout):
+		return http.StatusRequestTimeout
+	case errors.Is(err, errResponseHeaderTimeout), errors.Is(err, errTryTimeout), errors.Is(err, errWriteTimeout):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// errorHandler write response for failed backend request
+func errorHandler(writer http.ResponseWriter, request *http.Request, err error) {
+	status := errorStatus(err)
+	zc.L(request.Context()).Info("Backend request failed", zap.Int("status_code", status),
+		zap.String("reason", errorReason(err)), zap.Error(err))
+	writer.WriteHeader(status)
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestLimitBody(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	req := &http.Request{Body: io.NopCloser(strings.NewReader("1234")), ContentLength: 4}
+	_, _, err := limitBody(req, 3)
+	e.True(xerrors.Is(err, errRequestBodyTooLarge))
+
+	res, body, err := limitBody(req, 4)
+	e.CmpNoError(err)
+	content, err := io.ReadAll(res.Body)
+	e.CmpNoError(err)
+	e.Cmp(string(content), "1234")
+	e.False(body.isExceeded())
+
+	req = &http.Request{Body: io.NopCloser(strings.NewReader("12345")), ContentLength: -1}
+	res, body, err = limitBody(req, 4)
+	e.CmpNoError(err)
+	content, err = io.ReadAll(res.Body)
+	e.True(xerrors.Is(err, errRequestBodyTooLarge))
+	e.Cmp(string(content), "1234")
+	e.True(body.isExceeded())
+
+	res, body, err = limitBody(req, 0)
+	e.CmpNoError(err)
+	e.True(res == req)
+	e.False(body.isExceeded())
+}
+
+func TestRequestLimits(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	hangingStop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.Copy(io.Discard, request.Body)
+		if request.URL.Path == "/stream" {
+			_, _ = writer.Write([]byte("ok"))
+			writer.(http.Flusher).Flush()
+		}
+		if request.URL.Path == "/slow" || request.URL.Path == "/stream" {
+			select {
+			case <-hangingStop:
+			case <-request.Context().Done():
+			}
+		}
+		_, _ = writer.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer close(hangingStop)
+
+	serverURL, err := url.Parse(server.URL)
+	e.CmpNoError(err)
+	routes, err := NewDirectorRoutes([]Route{
+		{Host: "big.example.com", Target: serverURL.Host, MaxBodyBytes: 10, ResponseHeaderTimeoutSeconds: 1},
+		{Host: "read.example.com", Target: serverURL.Host, ReadTimeoutSeconds: 1, ResponseHeaderTimeoutSeconds: 5},
+		{Host: "write.example.com", Target: serverURL.Host, WriteTimeoutSeconds: 1},
+	})
+	e.CmpNoError(err)
+
+	proxy, addr := httpProxy(e, server.URL)
+	proxy.Reload(NewDirectorChain(DirectorHost(serverURL.Host), DirectorSetScheme(serverURL.Scheme), routes), Transport{
+		RateLimiter: &RateLimiter{},
+		Limits:      RequestLimits{MaxBodyBytes: 5, ResponseHeaderTimeout: 100 * time.Millisecond},
+	})
+
+	doBody := func(host, path string, body io.Reader, contentLength int64) (int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr+path, nil)
+		e.CmpNoError(err)
+		req.Host = host
+		req.Body = io.NopCloser(body)
+		req.ContentLength = contentLength
+		resp, err := http.DefaultClient.Do(req)
+		e.CmpNoError(err)
+		_, err = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, err
+	}
+	do := func(host, path, body string, contentLength int64) int {
+		status, err := doBody(host, path, strings.NewReader(body), contentLength)
+		e.CmpNoError(err)
+		return status
+	}
+
+	e.Cmp(do("example.com", "/", "12345", 5), http.StatusOK)
+	e.Cmp(do("example.com", "/", "123456", 6), http.StatusRequestEntityTooLarge)
+	e.Cmp(do("example.com", "/", "123456", -1), http.StatusRequestEntityTooLarge)
+	e.Cmp(do("big.example.com", "/", "123456", -1), http.StatusOK)
+	e.Cmp(do("big.example.com", "/", "12345678901", 11), http.StatusRequestEntityTooLarge)
+
+	start := time.Now()
+	e.Cmp(do("example.com", "/slow", "", 0), http.StatusGatewayTimeout)
+	e.True(time.Since(start) < time.Second)
+
+	e.Cmp(do("read.example.com", "/", "12345", 5), http.StatusOK)
+	bodyReader, bodyWriter := io.Pipe()
+	defer th.Close(bodyWriter)
+	go func() { _, _ = bodyWriter.Write([]byte("12")) }()
+	status, _ := doBody("read.example.com", "/", bodyReader, -1)
+	e.Cmp(status, http.StatusRequestTimeout)
+
+	// headers sent before write timeout, then connection closed
+	status, err = doBody("write.example.com", "/stream", strings.NewReader(""), 0)
+	e.Cmp(status, http.StatusOK)
+	e.CmpError(err)
+}
+
+func TestErrorReason(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.Cmp(errorReason(nil), "")
+	e.Cmp(errorReason(xerrors.Errorf("test: %w", errResponseHeaderTimeout)), "backend_response_header_timeout")
+	e.Cmp(errorReason(xerrors.Errorf("test: %w", errRequestBodyTooLarge)), "request_body_too_large")
+	e.Cmp(errorReason(xerrors.Errorf("test: %w", errRequestReadTimeout)), "request_read_timeout")
+	e.Cmp(errorReason(xerrors.Errorf("test: %w", errWriteTimeout)), "write_timeout")
+	e.Cmp(errorReason(xerrors.New("test")), "backend_error")
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// retryBufferBodySize is max size of request body, which buffered for retry
+	retryBufferBodySize = 64 * 1024
+
+	retryBudgetWindow = 10 * time.Second
+)
+
+var errTryTimeout = errors.New("try timeout")
+
+// RetryPolicy describe retries of failed requests to backends. Requests retried if they weren't sent
+// (backend connection failed) or if request is idempotent. Requests with body retried only if body
+// isn't bigger than retryBufferBodySize.
+type RetryPolicy struct {
+	// Count is max count of retries after first try
+	Count int
+
+	// TryTimeout limit time for receive response headers from backend by every try. 0 - without limit.
+	TryTimeout time.Duration
+
+	// Budget limit ratio of retries to requests, nil - without limit.
+	Budget *RetryBudget
+}
+
+func (p *RetryPolicy) enabled() bool {
+	return p != nil && p.Count > 0
+}
+
+func (p *RetryPolicy) tryTimeout() time.Duration {
+	if p == nil {
+		return 0
+	}
+	return p.TryTimeout
+}
+
+// RetryBudget limit count of retries, so retries can't multiply load on failed backends.
+// Retries allowed while they are less then Percent of requests or MinPerSecond in time window.
+type RetryBudget struct {
+	Percent      int
+	MinPerSecond int
+
+	clock       clockwork.Clock
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func NewRetryBudget(percent, minPerSecond int) *RetryBudget {
+	return &RetryBudget{Percent: percent, MinPerSecond: minPerSecond, clock: clockwork.NewRealClock()}
+}
+
+func (b *RetryBudget) countRequest() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rotateWindow()
+	b.requests++
+}
+
+func (b *RetryBudget) allowRetry() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rotateWindow()
+	limit := b.requests * b.Percent / 100
+	if minLimit := b.MinPerSecond * int(retryBudgetWindow/time.Second); limit < minLimit {
+		limit = minLimit
+	}
+	if b.retries >= limit {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// rotateWindow start new time window if current is expired, must be called with locked mu
+func (b *RetryBudget) rotateWindow() {
+	now := b.clock.Now()
+	if now.Sub(b.windowStart) < retryBudgetWindow {
+		return
+	}
+	b.windowStart = now
+	b.requests = 0
+	b.retries = 0
+}
+
+// prepareRetryBody return request with body, which can be read again by GetBody.
+// It returns false if request body can't be repeated.
+func prepareRetryBody(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return req, true
+	}
+	if req.ContentLength <= 0 || req.ContentLength > retryBufferBodySize {
+		return req, false
+	}
+
+	content, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+
+	res := new(http.Request)
+	*res = *req
+	res.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	if err != nil {
+		res.Body = io.NopCloser(errorReader{err: err})
+		return res, false
+	}
+	res.Body, _ = res.GetBody()
+	return res, true
+}
+
+// retryRequest return copy of request with new body for send it again
+func retryRequest(req *http.Request) (*http.Request, error) {
+	res := new(http.Request)
+	*res = *req
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, xerrors.Errorf("get request body for retry: %w", err)
+		}
+		res.Body = body
+	}
+	return res, nil
+}
+
+// canRetry return true if request can be sent again after the error:
+// request wasn't sent to backend or request is idempotent.
+func canRetry(req *http.Request, err error) bool {
+	if req.Context().Err() != nil || errors.Is(err, errNoAvailableUpstream) {
+		return false
+	}
+	return isDialError(err) || isIdempotentRequest(req)
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isIdempotentRequest check request method and idempotency key header same as net/http transport
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"golang.org/x/xerrors"
+)
+
+func TestRetryBudget(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	var nilBudget *RetryBudget
+	nilBudget.countRequest()
+	e.True(nilBudget.allowRetry())
+
+	clock := clockwork.NewFakeClock()
+	budget := NewRetryBudget(20, 0)
+	budget.clock = clock
+
+	e.False(budget.allowRetry())
+	for i := 0; i < 10; i++ {
+		budget.countRequest()
+	}
+	e.True(budget.allowRetry())
+	e.True(budget.allowRetry())
+	e.False(budget.allowRetry())
+
+	clock.Advance(retryBudgetWindow)
+	budget.countRequest()
+	e.False(budget.allowRetry())
+
+	budget = NewRetryBudget(0, 1)
+	budget.clock = clock
+	for i := 0; i < int(retryBudgetWindow/time.Second); i++ {
+		e.True(budget.allowRetry())
+	}
+	e.False(budget.allowRetry())
+}
+
+func TestIsIdempotentRequest(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete} {
+		e.True(isIdempotentRequest(&http.Request{Method: method}), method)
+	}
+	e.False(isIdempotentRequest(&http.Request{Method: http.MethodPost}))
+	e.False(isIdempotentRequest(&http.Request{Method: http.MethodPatch}))
+	e.True(isIdempotentRequest(&http.Request{Method: http.MethodPost, Header: http.Header{"Idempotency-Key": {"1"}}}))
+}
+
+func TestPrepareRetryBody(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	res, replayable := prepareRetryBody(req)
+	e.True(replayable)
+	e.True(res == req)
+
+	req = &http.Request{Body: io.NopCloser(strings.NewReader("test")), ContentLength: 4}
+	res, replayable = prepareRetryBody(req)
+	e.True(replayable)
+	for i := 0; i < 2; i++ {
+		retryReq, err := retryRequest(res)
+		e.CmpNoError(err)
+		content, _ := io.ReadAll(retryReq.Body)
+		e.Cmp(string(content), "test")
+	}
+
+	req = &http.Request{Body: io.NopCloser(strings.NewReader("test")), ContentLength: -1}
+	_, replayable = prepareRetryBody(req)
+	e.False(replayable)
+
+	req = &http.Request{Body: io.NopCloser(strings.NewReader("test")), ContentLength: retryBufferBodySize + 1}
+	_, replayable = prepareRetryBody(req)
+	e.False(replayable)
+}
+
+func TestTransport_Retry(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	backend := newUpstreamBackend(t, "backend")
+	stopped := newUpstreamBackend(t, "stopped")
+	stopped.Close()
+
+	hangingStop := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-hangingStop:
+		case <-request.Context().Done():
+		}
+	}))
+	defer hanging.Close()
+	defer close(hangingStop)
+
+	pools, err := NewUpstreamPools([]UpstreamPoolConfig{
+		{Name: "stopped", Targets: []string{stopped.Listener.Addr().String(), backend.Listener.Addr().String()}},
+		{Name: "hanging", Targets: []string{hanging.Listener.Addr().String(), backend.Listener.Addr().String()}},
+	}, false)
+	e.CmpNoError(err)
+
+	tr := Transport{
+		RateLimiter: &RateLimiter{},
+		Upstreams:   pools,
+		Retry:       &RetryPolicy{Count: 1, TryTimeout: 100 * time.Millisecond},
+	}
+
+	t.Run("not sent request retried to other upstream", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		req := upstreamRequest(ctx, "stopped", "1.1.1.1:1")
+		req.Method = http.MethodPost
+		req.Body = io.NopCloser(strings.NewReader("test"))
+		req.ContentLength = 4
+		e.Cmp(upstreamResponseName(e, tr, req), "backend")
+		e.Cmp(pools["stopped"].upstreams[0].failures, uint64(1))
+	})
+
+	t.Run("idempotent request retried after try timeout", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		e.Cmp(upstreamResponseName(e, tr, upstreamRequest(ctx, "hanging", "1.1.1.1:1")), "backend")
+		e.Cmp(pools["hanging"].upstreams[0].failures, uint64(1))
+	})
+
+	t.Run("sent not idempotent request doesn't retried", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		pools["hanging"].next = 0
+		req := upstreamRequest(ctx, "hanging", "1.1.1.1:1")
+		req.Method = http.MethodPost
+		_, err := tr.RoundTrip(req)
+		e.True(xerrors.Is(err, errTryTimeout))
+		e.Cmp(pools["hanging"].upstreams[1].requests, uint64(1))
+	})
+
+	t.Run("retry budget", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		tr := tr
+		tr.Retry = &RetryPolicy{Count: 1, Budget: NewRetryBudget(0, 0)}
+		pools["stopped"].next = 0
+		_, err := tr.RoundTrip(upstreamRequest(ctx, "stopped", "1.1.1.1:1"))
+		e.True(isDialError(err))
+	})
+
+	t.Run("retry same backend without pool", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		tr := tr
+		tr.Retry = &RetryPolicy{Count: 2}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+stopped.Listener.Addr().String(), nil)
+		_, err := tr.RoundTrip(req)
+		e.True(isDialError(err))
+	})
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+const defaultHTTPSPort = 443
+
+const (
+	routeWildcardPrefix = "*."
+	routeRegexpPrefix   = "~"
+)
+
+// match kinds of route host, ordered by priority
+const (
+	routeMatchExact = iota
+	routeMatchWildcard
+	routeMatchRegexp
+)
+
+// Route is rule for select backend by host of request.
+type Route struct {
+	// Host is exact host name (example.com), wildcard suffix (*.example.com - for any subdomain of example.com)
+	// or regexp with ~ prefix (~^api[0-9]+\.example\.com$).
+	Host string
+
+	// Target is backend address as host:port or host, port 80 (443 for https scheme) used if it isn't set.
+	Target string
+
+	// Scheme of backend requests: http or https. Empty mean same as for other requests.
+	Scheme string
+
+	// PathPrefix limit the route by requests with the path prefix. Empty - for all requests to host.
+	PathPrefix string
+
+	// RewritePathPrefix replace PathPrefix in path of backend request if not empty. "/" mean remove the prefix.
+	RewritePathPrefix string
+
+	// MaxBodyBytes and ResponseHeaderTimeoutSeconds override request limits of proxy if not zero.
+	MaxBodyBytes                 int64
+	ResponseHeaderTimeoutSeconds int
+
+	// ReadTimeoutSeconds and WriteTimeoutSeconds override read and write timeouts of http server for HTTP/1
+	// requests if not zero. Read header timeout and max header bytes are global only, because headers are read
+	// before route is known.
+	ReadTimeoutSeconds  int
+	WriteTimeoutSeconds int
+}
+
+type routeRule struct {
+	Route
+	matchKind  int
+	hostRegexp *regexp.Regexp
+}
+
+// DirectorRoutes select backend by host of request and optionally change scheme and path of request.
+// Exact host has priority over wildcard, wildcard over regexp. For wildcards longer suffix has priority.
+// Route with longer path prefix has priority for same host rules, first route in order win otherwise.
+// Request without matched route doesn't change.
+type DirectorRoutes []routeRule
+
+func NewDirectorRoutes(routes []Route) (DirectorRoutes, error) {
+	res := make(DirectorRoutes, 0, len(routes))
+	for index, route := range routes {
+		rule, err := newRouteRule(route)
+		if err != nil {
+			return nil, xerrors.Errorf("bad route %v (host '%v'): %w", index, route.Host, err)
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+func newRouteRule(route Route) (routeRule, error) {
+	rule := routeRule{Route: route}
+
+	rule.Host = strings.TrimSpace(rule.Host)
+	switch {
+	case rule.Host == "":
+		return rule, xerrors.New("empty host")
+	case strings.HasPrefix(rule.Host, routeRegexpPrefix):
+		var err error
+		rule.matchKind = routeMatchRegexp
+		rule.hostRegexp, err = regexp.Compile(strings.TrimPrefix(rule.Host, routeRegexpPrefix))
+		if err != nil {
+			return rule, xerrors.Errorf("compile host regexp: %w", err)
+		}
+	case strings.HasPrefix(rule.Host, routeWildcardPrefix):
+		rule.matchKind = routeMatchWildcard
+		rule.Host = normalizeRouteHost(strings.TrimPrefix(rule.Host, "*"))
+	default:
+		rule.matchKind = routeMatchExact
+		rule.Host = normalizeRouteHost(rule.Host)
+	}
+
+	rule.Scheme = strings.ToLower(strings.TrimSpace(rule.Scheme))
+	switch rule.Scheme {
+	case "", ProtocolHTTP, ProtocolHTTPS:
+		// pass
+	default:
+		return rule, xerrors.Errorf("unknown scheme '%v'", rule.Scheme)
+	}
+
+	rule.Target = strings.TrimSpace(rule.Target)
+	if rule.Target == "" {
+		return rule, xerrors.New("empty target")
+	}
+	if _, _, err := net.SplitHostPort(rule.Target); err != nil {
+		port := defaultHTTPPort
+		if rule.Scheme == ProtocolHTTPS {
+			port = defaultHTTPSPort
+		}
+		rule.Target = net.JoinHostPort(strings.Trim(rule.Target, "[]"), strconv.Itoa(port))
+	}
+
+	if rule.PathPrefix != "" && !strings.HasPrefix(rule.PathPrefix, "/") {
+		return rule, xerrors.Errorf("path prefix must start with '/': '%v'", rule.PathPrefix)
+	}
+	if rule.RewritePathPrefix != "" && !strings.HasPrefix(rule.RewritePathPrefix, "/") {
+		return rule, xerrors.Errorf("rewrite path prefix must start with '/': '%v'", rule.RewritePathPrefix)
+	}
+	return rule, nil
+}
+
+func (d DirectorRoutes) Director(request *http.Request) error {
+	ctx := request.Context()
+
+	if request.URL == nil {
+		request.URL = &url.URL{}
+	}
+
+	host := requestHost(request)
+	rule := d.match(host, request.URL.Path)
+	if rule == nil {
+		zc.L(ctx).Debug("Routes director no matches, skip.", zap.String("host", host))
+		return nil
+	}
+
+	request.URL.Host = rule.Target
+	if rule.Scheme != "" {
+		request.URL.Scheme = rule.Scheme
+	}
+	if rule.RewritePathPrefix != "" {
+		request.URL.Path = rewritePathPrefix(request.URL.Path, rule.PathPrefix, rule.RewritePathPrefix)
+		if request.URL.RawPath != "" {
+			request.URL.RawPath = rewritePathPrefix(request.URL.RawPath, rule.PathPrefix, rule.RewritePathPrefix)
+		}
+	}
+	withRequestLimits(request, RequestLimits{
+		MaxBodyBytes:          rule.MaxBodyBytes,
+		ResponseHeaderTimeout: time.Duration(rule.ResponseHeaderTimeoutSeconds) * time.Second,
+		ReadTimeout:           time.Duration(rule.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout:          time.Duration(rule.WriteTimeoutSeconds) * time.Second,
+	})
+	zc.L(ctx).Debug("Routes director set dest", zap.String("host", host), zap.String("route", rule.Route.Host),
+		zap.String("target", request.URL.Host), zap.String("scheme", request.URL.Scheme),
+		zap.String("path", request.URL.Path))
+	return nil
+}
+
+// match return best route for the host and path or nil
+func (d DirectorRoutes) match(host, path string) *routeRule {
+	var res *routeRule
+	for index := range d {
+		rule := &d[index]
+		if !hasPathPrefix(path, rule.PathPrefix) || !rule.matchHost(host) {
+			continue
+		}
+		if res == nil || rule.betterThan(res) {
+			res = rule
+		}
+	}
+	return res
+}
+
+func (r *routeRule) matchHost(host string) bool {
+	switch r.matchKind {
+	case routeMatchExact:
+		return host == r.Host
+	case routeMatchWildcard:
+		// r.Host is suffix with leading dot
+		return strings.HasSuffix(host, r.Host) && len(host) > len(r.Host)
+	default:
+		return r.hostRegexp.MatchString(host)
+	}
+}
+
+func (r *routeRule) betterThan(other *routeRule) bool {
+	switch {
+	case r.matchKind != other.matchKind:
+		return r.matchKind < other.matchKind
+	case r.matchKind == routeMatchWildcard && len(r.Host) != len(other.Host):
+		return len(r.Host) > len(other.Host)
+	default:
+		return len(r.PathPrefix) > len(other.PathPrefix)
+	}
+}
+
+// requestHost return lowercase host of request without port. It use tls server name if request has no host.
+func requestHost(request *http.Request) string {
+	host := request.Host
+	if host == "" && request.TLS != nil {
+		host = request.TLS.ServerName
+	}
+	if splittedHost, _, err := net.SplitHostPort(host); err == nil {
+		host = splittedHost
+	}
+	return normalizeRouteHost(host)
+}
+
+func normalizeRouteHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+}
+
+// hasPathPrefix return true if path starts with prefix on segment boundary:
+// prefix "/api" match "/api" and "/api/test", but not "/apiv2"
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	rest := path[len(prefix):]
+	return rest == "" || prefix == "" || strings.HasSuffix(prefix, "/") || strings.HasPrefix(rest, "/")
+}
+
+// rewritePathPrefix replace prefix of path to newPrefix, without double slash in place of join
+func rewritePathPrefix(path, prefix, newPrefix string) string {
+	rest := strings.TrimPrefix(path, prefix)
+	if strings.HasSuffix(newPrefix, "/") && strings.HasPrefix(rest, "/") {
+		rest = rest[1:]
+	}
+	return newPrefix + rest
+}
+
+var _ Director = DirectorRoutes{}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewDirectorRoutes(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	d, err := NewDirectorRoutes([]Route{
+		{Host: "Example.COM", Target: "1.2.3.4"},
+		{Host: "*.example.com", Target: "1.2.3.4", Scheme: "HTTPS"},
+		{Host: "~^api[0-9]+\\.example\\.com$", Target: "[::1]:90"},
+	})
+	e.CmpNoError(err)
+	e.Cmp(d[0].Host, "example.com")
+	e.Cmp(d[0].Target, "1.2.3.4:80")
+	e.Cmp(d[1].Host, ".example.com")
+	e.Cmp(d[1].Target, "1.2.3.4:443")
+	e.Cmp(d[1].Scheme, ProtocolHTTPS)
+	e.Cmp(d[2].Target, "[::1]:90")
+
+	badRoutes := []Route{
+		{Target: "1.2.3.4"},
+		{Host: "example.com"},
+		{Host: "example.com", Target: "1.2.3.4", Scheme: "ftp"},
+		{Host: "~(", Target: "1.2.3.4"},
+		{Host: "example.com", Target: "1.2.3.4", PathPrefix: "api"},
+		{Host: "example.com", Target: "1.2.3.4", RewritePathPrefix: "api"},
+	}
+	for _, route := range badRoutes {
+		_, err = NewDirectorRoutes([]Route{route})
+		e.CmpError(err, route)
+	}
+}
+
+func TestDirectorRoutes(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	d, err := NewDirectorRoutes([]Route{
+		{Host: "~^.*\\.example\\.com$", Target: "regexp:80"},
+		{Host: "*.example.com", Target: "wildcard:80"},
+		{Host: "*.sub.example.com", Target: "wildcard-sub:80"},
+		{Host: "example.com", Target: "exact:80"},
+		{Host: "example.com", Target: "exact-api:80", Scheme: ProtocolHTTPS, PathPrefix: "/api/", RewritePathPrefix: "/"},
+		{Host: "example.com", Target: "exact-v2:80", PathPrefix: "/v1", RewritePathPrefix: "/v2"},
+	})
+	e.CmpNoError(err)
+
+	table := []struct {
+		host       string
+		serverName string
+		path       string
+		resHost    string
+		resScheme  string
+		resPath    string
+	}{
+		{host: "other.com", path: "/test", resHost: "default:80", resScheme: ProtocolHTTP, resPath: "/test"},
+		{host: "example.com", path: "/test", resHost: "exact:80", resScheme: ProtocolHTTP, resPath: "/test"},
+		{host: "EXAMPLE.com:443", path: "/test", resHost: "exact:80", resScheme: ProtocolHTTP, resPath: "/test"},
+		{serverName: "example.com", path: "/test", resHost: "exact:80", resScheme: ProtocolHTTP, resPath: "/test"},
+		{host: "example.com", path: "/api/test", resHost: "exact-api:80", resScheme: ProtocolHTTPS, resPath: "/test"},
+		{host: "example.com", path: "/api", resHost: "exact:80", resScheme: ProtocolHTTP, resPath: "/api"},
+		{host: "example.com", path: "/v1/test", resHost: "exact-v2:80", resScheme: ProtocolHTTP, resPath: "/v2/test"},
+		{host: "example.com", path: "/v1", resHost: "exact-v2:80", resScheme: ProtocolHTTP, resPath: "/v2"},
+		{host: "example.com", path: "/v10/test", resHost: "exact:80", resScheme: ProtocolHTTP, resPath: "/v10/test"},
+		{host: "example.com", path: "/apiv2", resHost: "exact:80", resScheme: ProtocolHTTP, resPath: "/apiv2"},
+		{host: "a.example.com", path: "/", resHost: "wildcard:80", resScheme: ProtocolHTTP, resPath: "/"},
+		{host: "a.b.example.com", path: "/", resHost: "wildcard:80", resScheme: ProtocolHTTP, resPath: "/"},
+		{host: "a.sub.example.com", path: "/", resHost: "wildcard-sub:80", resScheme: ProtocolHTTP, resPath: "/"},
+		{host: "sub.example.com", path: "/", resHost: "wildcard:80", resScheme: ProtocolHTTP, resPath: "/"},
+	}
+
+	for _, test := range table {
+		req := &http.Request{Host: test.host, URL: &url.URL{Scheme: ProtocolHTTP, Host: "default:80", Path: test.path}}
+		if test.serverName != "" {
+			req.TLS = &tls.ConnectionState{ServerName: test.serverName}
+		}
+		req = req.WithContext(ctx)
+		e.CmpNoError(d.Director(req))
+		e.Cmp(req.URL.Host, test.resHost, test)
+		e.Cmp(req.URL.Scheme, test.resScheme, test)
+		e.Cmp(req.URL.Path, test.resPath, test)
+	}
+
+	d, err = NewDirectorRoutes([]Route{{Host: "~example", Target: "regexp:80"}})
+	e.CmpNoError(err)
+	req := (&http.Request{Host: "example.org", URL: &url.URL{Path: "/"}}).WithContext(ctx)
+	e.CmpNoError(d.Director(req))
+	e.Cmp(req.URL.Host, "regexp:80")
+}
+
+func TestRewritePathPrefix(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.Cmp(rewritePathPrefix("/api/test", "/api/", "/"), "/test")
+	e.Cmp(rewritePathPrefix("/api/test", "/api", "/"), "/test")
+	e.Cmp(rewritePathPrefix("/api/test", "/api", "/v2"), "/v2/test")
+	e.Cmp(rewritePathPrefix("/api", "/api", "/"), "/")
+	e.Cmp(rewritePathPrefix("/test", "", "/prefix/"), "/prefix/test")
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.True(hasPathPrefix("/test", ""))
+	e.True(hasPathPrefix("/api", "/api"))
+	e.True(hasPathPrefix("/api/test", "/api"))
+	e.True(hasPathPrefix("/api/test", "/api/"))
+	e.True(hasPathPrefix("/apiv2", "/"))
+	e.False(hasPathPrefix("/apiv2", "/api"))
+	e.False(hasPathPrefix("/api", "/api/"))
+	e.False(hasPathPrefix("/test", "/api"))
+}
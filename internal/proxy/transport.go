@@ -1,14 +1,20 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/xerrors"
 
+	"github.com/rekby/lets-proxy2/internal/proxyprotocol"
 	zc "github.com/rekby/zapcontext"
 )
 
@@ -17,11 +23,19 @@ var defaultHTTPTransport = defaultTransport()
 type Transport struct {
 	IgnoreHTTPSCertificate bool
 	RateLimiter            *RateLimiter
+	Upstreams              UpstreamPools
+	Retry                  *RetryPolicy
+
+	// BackendProxyProtocol is version of proxy protocol header, sent to backend. 0 - without header.
+	BackendProxyProtocol int
+
+	// Limits is default limits for requests, routes can override them
+	Limits RequestLimits
 }
 
 func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if !t.RateLimiter.Allow(req) {
-		return &http.Response{
+	if limit := t.RateLimiter.Check(req); !limit.Allowed {
+		resp := &http.Response{
 			Status:     "429 Too Many Requests",
 			StatusCode: http.StatusTooManyRequests,
 			Proto:      req.Proto,
@@ -29,27 +43,177 @@ func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			ProtoMinor: req.ProtoMinor,
 			Request:    req,
 			Header:     make(http.Header, 0),
-		}, nil
+			Body:       http.NoBody,
+		}
+		limit.setHeaders(resp.Header)
+		return resp, nil
+	}
+
+	limits := t.requestLimits(req)
+	req, body, err := limitBody(req, limits.MaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	req, deadlines := withDeadlines(req, limits.ReadTimeout, limits.WriteTimeout)
+
+	var resp *http.Response
+	if t.Retry.enabled() {
+		resp, err = t.roundTripWithRetries(req)
+	} else {
+		resp, _, err = t.roundTripTry(req, nil)
+	}
+	if err != nil {
+		deadlines.finish()
+		if body.isExceeded() {
+			return nil, xerrors.Errorf("%v: %w", err, errRequestBodyTooLarge)
+		}
+		return nil, deadlines.wrapError(err)
+	}
+	if deadlines != nil {
+		resp.Body = newFinishBody(resp.Body, deadlines.finish)
+	}
+	return resp, nil
+}
+
+// roundTripWithRetries send request and retry it by retry policy, retries go to other upstreams of pool if they exist
+func (t Transport) roundTripWithRetries(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	logger := zc.L(ctx)
+
+	t.Retry.Budget.countRequest()
+	req, replayable := prepareRetryBody(req)
+
+	var tried []*Upstream
+	tryReq := req
+	for try := 1; ; try++ {
+		resp, upstream, err := t.roundTripTry(tryReq, tried)
+		if err == nil {
+			return resp, nil
+		}
+		if upstream != nil {
+			tried = append(tried, upstream)
+		}
+
+		if try > t.Retry.Count || !replayable || !canRetry(req, err) {
+			return nil, err
+		}
+		if !t.Retry.Budget.allowRetry() {
+			logger.Warn("Retry budget exhausted, skip retry", zap.Error(err))
+			return nil, err
+		}
+
+		logger.Info("Retry request to backend", zap.Int("try", try+1), zap.String("host", req.URL.Host),
+			zap.NamedError("try_error", err))
+		tryReq, err = retryRequest(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// roundTripTry send request to backend or to upstream of pool, except upstreams from exclude if possible.
+// It returns upstream, if request was sent to upstream.
+func (t Transport) roundTripTry(req *http.Request, exclude []*Upstream) (*http.Response, *Upstream, error) {
+	if name, ok := upstreamName(req.URL.Host); ok {
+		return t.roundTripUpstream(req, name, exclude)
+	}
+	resp, err := t.send(req)
+	return resp, nil, err
+}
+
+// roundTripUpstream send request to upstream, selected from pool
+func (t Transport) roundTripUpstream(req *http.Request, poolName string, exclude []*Upstream) (*http.Response, *Upstream, error) {
+	ctx := req.Context()
+
+	pool := t.Upstreams[poolName]
+	if pool == nil {
+		return nil, nil, xerrors.Errorf("unknown upstream pool '%v'", poolName)
+	}
+	upstream, err := pool.Next(req, exclude...)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("select upstream of pool '%v': %w", poolName, err)
 	}
+	zc.L(ctx).Debug("Select upstream", zap.String("pool", poolName), zap.String("upstream", upstream.Address))
 
-	return t.getTransport(req).RoundTrip(req)
+	upstreamReq := new(http.Request)
+	*upstreamReq = *req
+	upstreamURL := *req.URL
+	upstreamURL.Host = upstream.Address
+	upstreamReq.URL = &upstreamURL
+
+	atomic.AddInt64(&upstream.inflight, 1)
+	finish := func() {
+		atomic.AddInt64(&upstream.inflight, -1)
+	}
+
+	resp, err := t.send(upstreamReq)
+	if ctx.Err() == nil {
+		// doesn't count requests, cancelled by client
+		pool.reportResult(ctx, upstream, err)
+	}
+	if err != nil {
+		finish()
+		return nil, upstream, err
+	}
+	resp.Body = newFinishBody(resp.Body, finish)
+	return resp, upstream, nil
+}
+
+// send request to backend, it limit time for receive response headers by try timeout of retry policy
+// and response header timeout of request limits
+func (t Transport) send(req *http.Request) (*http.Response, error) {
+	timeout, timeoutErr := t.Retry.tryTimeout(), errTryTimeout
+	headerTimeout := t.requestLimits(req).ResponseHeaderTimeout
+	if headerTimeout > 0 && (timeout <= 0 || headerTimeout < timeout) {
+		timeout, timeoutErr = headerTimeout, errResponseHeaderTimeout
+	}
+	if timeout <= 0 {
+		return t.getTransport(req).RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := t.getTransport(req).RoundTrip(req.WithContext(ctx))
+	timedOut := !timer.Stop()
+	if err == nil && timedOut {
+		_ = resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		if timedOut {
+			return nil, xerrors.Errorf("no response headers in %v (%v): %w", timeout, err, timeoutErr)
+		}
+		return nil, err
+	}
+
+	resp.Body = newFinishBody(resp.Body, cancel)
+	return resp, nil
 }
 
 func (t Transport) getTransport(req *http.Request) *http.Transport {
 	logger := zc.L(req.Context())
 
-	if req.URL.Scheme == ProtocolHTTP {
+	if req.URL.Scheme == ProtocolHTTP && t.BackendProxyProtocol == 0 {
 		logger.Debug("Use default http transport")
 		return defaultHTTPTransport
 	}
 
+	transport := defaultTransport()
+	if t.BackendProxyProtocol != 0 {
+		t.setProxyProtocol(transport, req)
+	}
+	if req.URL.Scheme == ProtocolHTTP {
+		logger.Debug("Use http transport with proxy protocol", zap.Int("proxy_protocol", t.BackendProxyProtocol))
+		return transport
+	}
+
 	host := req.Host
 	if strings.Contains(host, ":") { //strip port
 		parts := strings.SplitN(host, ":", 2)
 		host = parts[0]
 	}
 
-	transport := defaultTransport()
 	transport.TLSClientConfig = &tls.Config{ServerName: host}
 	transport.TLSClientConfig.InsecureSkipVerify = t.IgnoreHTTPSCertificate
 
@@ -62,6 +226,35 @@ func (t Transport) getTransport(req *http.Request) *http.Transport {
 	return transport
 }
 
+// setProxyProtocol set transport for send proxy protocol header with addresses of client connection before request.
+// Connections to backend doesn't reuse, because header describe one client connection.
+func (t Transport) setProxyProtocol(transport *http.Transport, req *http.Request) {
+	src, _ := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	var dst *net.TCPAddr
+	if localAddr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dst, _ = net.ResolveTCPAddr("tcp", localAddr.String())
+	}
+	header, headerErr := proxyprotocol.Header(t.BackendProxyProtocol, src, dst)
+
+	dial := transport.DialContext
+	transport.Proxy = nil
+	transport.DisableKeepAlives = true
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if headerErr != nil {
+			return nil, headerErr
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = conn.Write(header); err != nil {
+			_ = conn.Close()
+			return nil, xerrors.Errorf("write proxy protocol header: %w", err)
+		}
+		return conn, nil
+	}
+}
+
 func defaultTransport() *http.Transport {
 	// copy from go 1.10, need for compile with go 1.10 compiler
 	// https://github.com/golang/go/blob/b0cb374daf646454998bac7b393f3236a2ab6aca/src/net/http/transport.go#L40
@@ -79,3 +272,24 @@ func defaultTransport() *http.Transport {
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 }
+
+// finishBody call finish once when body closed, for example for count in flight requests
+type finishBody struct {
+	io.ReadCloser
+	once   sync.Once
+	finish func()
+}
+
+func newFinishBody(body io.ReadCloser, finish func()) io.ReadCloser {
+	if body == nil {
+		finish()
+		return nil
+	}
+	return &finishBody{ReadCloser: body, finish: finish}
+}
+
+func (b *finishBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.finish)
+	return err
+}
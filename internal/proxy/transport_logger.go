@@ -3,40 +3,42 @@ package proxy
 import (
 	"net/http"
 	"time"
-
-	"go.uber.org/zap"
-
-	"github.com/rekby/lets-proxy2/internal/log"
 )
 
 type TransportLogger struct {
 	Transport http.RoundTripper
+
+	// AccessLog is sink for records, if nil - records write to log of request context
+	AccessLog *AccessLog
 }
 
-func (t TransportLogger) RoundTrip(request *http.Request) (resp *http.Response, err error) {
-	start := time.Now()
+// RoundTrip send request and fill access log record of request with backend response.
+// Record of request, handled by HTTPProxy with enabled access log, written by proxy handler
+// after response sent to client. Else transport write record after response body closed,
+// then duration include body streaming and bytes_sent is size of backend response body.
+func (t TransportLogger) RoundTrip(request *http.Request) (*http.Response, error) {
+	if record, ok := request.Context().Value(accessLogRecordKey{}).(*accessLogRecord); ok {
+		// client ip detected by directors
+		record.clientIP = clientIP(request)
+		record.upstream = request.URL.Host
+		resp, err := t.Transport.RoundTrip(request)
+		record.setResponse(resp, err)
+		return resp, err
+	}
 
-	defer func() {
-		var respStatusCode int
-		var respContentLength int64
-		if resp != nil {
-			respStatusCode = resp.StatusCode
-			respContentLength = resp.ContentLength
-		}
-		log.InfoErrorCtx(request.Context(), err, "Request",
-			zap.Duration("duration_without_body", time.Since(start)),
-			zap.String("initiator_addr", request.RemoteAddr),
-			zap.String("metod", request.Method),
-			zap.String("host", request.Host),
-			zap.String("path", request.URL.Path),
-			zap.String("query", request.URL.RawQuery),
-			zap.Int("status_code", respStatusCode),
-			zap.Int64("request_content_length", request.ContentLength),
-			zap.Int64("resp_content_length", respContentLength),
-		)
-	}()
+	record := newAccessLogRecord(request, time.Now())
+	resp, err := t.Transport.RoundTrip(request)
+	record.setResponse(resp, err)
 
-	return t.Transport.RoundTrip(request)
+	finish := func() {
+		t.AccessLog.write(request, record)
+	}
+	if err != nil || resp == nil || resp.Body == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		finish()
+		return resp, err
+	}
+	resp.Body = &accessLogBody{ReadCloser: resp.Body, record: record, finish: finish}
+	return resp, err
 }
 
 func NewTransportLogger(transport http.RoundTripper) TransportLogger {
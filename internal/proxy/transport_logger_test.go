@@ -61,7 +61,7 @@ func TestTransportLogger(t *testing.T) {
 		return resResp, resErr
 	})
 
-	tl := TransportLogger{rtMock}
+	tl := TransportLogger{Transport: rtMock}
 
 	req := &http.Request{URL: &url.URL{}}
 	req = req.WithContext(ctx)
@@ -1,10 +1,17 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/rekby/lets-proxy2/internal/netlist"
+	"github.com/rekby/lets-proxy2/internal/proxyprotocol"
 	"github.com/rekby/lets-proxy2/internal/th"
 
 	"github.com/maxatome/go-testdeep"
@@ -58,5 +65,40 @@ func TestTransport_RoundTrip(t *testing.T) {
 
 		td.CmpNoError(err)
 		td.Cmp(resp.StatusCode, http.StatusTooManyRequests, "should return '429 Too Many Request'")
+		td.Cmp(resp.Header.Get("Retry-After"), "1")
+		td.Cmp(resp.Header.Get("RateLimit-Remaining"), "0")
 	})
 }
+
+func TestTransport_BackendProxyProtocol(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	e.CmpNoError(err)
+	trusted, _ := netlist.Parse([]string{"127.0.0.1"})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(request.RemoteAddr))
+	}))
+	server.Listener = proxyprotocol.NewListener(tcpListener, trusted)
+	server.Start()
+	defer server.Close()
+
+	for _, version := range []int{proxyprotocol.V1, proxyprotocol.V2} {
+		tr := Transport{RateLimiter: &RateLimiter{}, BackendProxyProtocol: version}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+		e.True(tr.getTransport(req) != defaultHTTPTransport)
+
+		reqCtx := context.WithValue(ctx, http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 443})
+		for i := 0; i < 2; i++ {
+			remoteAddr := fmt.Sprintf("1.2.3.4:%v", 1000+i)
+			req, _ := http.NewRequestWithContext(reqCtx, http.MethodGet, server.URL, nil)
+			req.RemoteAddr = remoteAddr
+			resp, err := tr.RoundTrip(req)
+			e.CmpNoError(err)
+			content, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			e.Cmp(string(content), remoteAddr, version)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// UpstreamTargetPrefix mark target as name of upstream pool instead of address, for example "upstream:app".
+const UpstreamTargetPrefix = "upstream:"
+
+// Balance methods of upstream pool
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn  = "least-conn"
+	BalanceIPHash     = "ip-hash"
+	BalanceCookieHash = "cookie-hash"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	upstreamRingReplicas       = 100
+)
+
+var errNoAvailableUpstream = errors.New("no available upstream")
+
+// UpstreamPoolConfig is config of upstream pool, targets of pool used by name with UpstreamTargetPrefix.
+//
+//nolint:lll
+type UpstreamPoolConfig struct {
+	Name    string
+	Targets []string
+
+	// Balance is method for select upstream: round-robin (default), least-conn, ip-hash or cookie-hash.
+	Balance string
+
+	// HashCookie is name of cookie for cookie-hash balance. Requests without the cookie balanced by client ip.
+	HashCookie string
+
+	// HealthCheckPath enable active health checks if not empty. Upstream is healthy if it responds with 2xx or 3xx status.
+	HealthCheckPath            string
+	HealthCheckScheme          string
+	HealthCheckHost            string
+	HealthCheckIntervalSeconds int
+	HealthCheckTimeoutSeconds  int
+
+	// MaxFails is count of consecutive failed requests for eject upstream on FailTimeoutSeconds. 0 - disable ejection.
+	MaxFails           int
+	FailTimeoutSeconds int
+}
+
+// Upstream is backend address of pool with its state
+type Upstream struct {
+	// must be first fields for 64-bit atomic operations on 32-bit platforms
+	inflight     int64
+	requests     uint64
+	failures     uint64
+	ejectedUntil int64 // unix nano
+
+	consecutiveFailures int32
+	unhealthy           int32 // 1 if last active health check failed
+
+	Address string
+}
+
+func (u *Upstream) available(now time.Time) bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0 && !u.ejected(now)
+}
+
+func (u *Upstream) ejected(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&u.ejectedUntil)
+}
+
+type upstreamRingNode struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// UpstreamPool select upstream for request by balance method and track health of upstreams
+// by active health checks and failures of requests.
+type UpstreamPool struct {
+	Name string
+
+	upstreams  []*Upstream
+	balance    string
+	hashCookie string
+	ring       []upstreamRingNode // sorted by hash, for consistent hash balance
+	next       uint32             // round robin counter
+
+	maxFails    int32
+	failTimeout time.Duration
+
+	healthCheckPath     string
+	healthCheckScheme   string
+	healthCheckHost     string
+	healthCheckInterval time.Duration
+	healthCheckClient   *http.Client
+	healthCheckStopMu   sync.Mutex
+	healthCheckStop     context.CancelFunc
+
+	clock clockwork.Clock
+}
+
+// NewUpstreamPool create pool from config. ignoreHTTPSCertificate used for health checks over https.
+func NewUpstreamPool(config UpstreamPoolConfig, ignoreHTTPSCertificate bool) (*UpstreamPool, error) {
+	pool := &UpstreamPool{
+		Name:                strings.TrimSpace(config.Name),
+		balance:             strings.ToLower(strings.TrimSpace(config.Balance)),
+		hashCookie:          strings.TrimSpace(config.HashCookie),
+		maxFails:            int32(config.MaxFails),
+		failTimeout:         time.Duration(config.FailTimeoutSeconds) * time.Second,
+		healthCheckPath:     config.HealthCheckPath,
+		healthCheckScheme:   strings.ToLower(strings.TrimSpace(config.HealthCheckScheme)),
+		healthCheckHost:     config.HealthCheckHost,
+		healthCheckInterval: time.Duration(config.HealthCheckIntervalSeconds) * time.Second,
+		clock:               clockwork.NewRealClock(),
+	}
+
+	if pool.Name == "" {
+		return nil, xerrors.New("empty upstream pool name")
+	}
+
+	switch pool.balance {
+	case "":
+		pool.balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn, BalanceIPHash:
+		// pass
+	case BalanceCookieHash:
+		if pool.hashCookie == "" {
+			return nil, xerrors.Errorf("upstream pool '%v' need HashCookie for cookie-hash balance", pool.Name)
+		}
+	default:
+		return nil, xerrors.Errorf("unknown balance method '%v' of upstream pool '%v'", config.Balance, pool.Name)
+	}
+
+	if len(config.Targets) == 0 {
+		return nil, xerrors.Errorf("upstream pool '%v' has no targets", pool.Name)
+	}
+	for _, target := range config.Targets {
+		target = strings.TrimSpace(target)
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(strings.Trim(target, "[]"), strconv.Itoa(defaultHTTPPort))
+		}
+		pool.upstreams = append(pool.upstreams, &Upstream{Address: target})
+	}
+	pool.initRing()
+
+	if pool.healthCheckPath != "" {
+		if !strings.HasPrefix(pool.healthCheckPath, "/") {
+			return nil, xerrors.Errorf("health check path of upstream pool '%v' must start with '/'", pool.Name)
+		}
+		switch pool.healthCheckScheme {
+		case "":
+			pool.healthCheckScheme = ProtocolHTTP
+		case ProtocolHTTP, ProtocolHTTPS:
+			// pass
+		default:
+			return nil, xerrors.Errorf("unknown health check scheme '%v' of upstream pool '%v'", config.HealthCheckScheme, pool.Name)
+		}
+		if pool.healthCheckInterval <= 0 {
+			pool.healthCheckInterval = defaultHealthCheckInterval
+		}
+		timeout := time.Duration(config.HealthCheckTimeoutSeconds) * time.Second
+		if timeout <= 0 {
+			timeout = defaultHealthCheckTimeout
+		}
+		transport := defaultTransport()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: ignoreHTTPSCertificate} //nolint:gosec
+		pool.healthCheckClient = &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	return pool, nil
+}
+
+func (p *UpstreamPool) initRing() {
+	p.ring = make([]upstreamRingNode, 0, len(p.upstreams)*upstreamRingReplicas)
+	for _, upstream := range p.upstreams {
+		for i := 0; i < upstreamRingReplicas; i++ {
+			p.ring = append(p.ring, upstreamRingNode{
+				hash:     hashString(upstream.Address + "#" + strconv.Itoa(i)),
+				upstream: upstream,
+			})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+}
+
+// Next select available upstream for request by balance method of pool.
+// It skips upstreams from exclude (tried before) while pool has other available upstreams.
+func (p *UpstreamPool) Next(req *http.Request, exclude ...*Upstream) (*Upstream, error) {
+	now := p.clock.Now()
+	available := func(upstream *Upstream) bool {
+		return upstream.available(now) && !containsUpstream(exclude, upstream)
+	}
+
+	upstream := p.selectUpstream(req, available)
+	if upstream == nil && len(exclude) > 0 {
+		upstream = p.selectUpstream(req, func(upstream *Upstream) bool {
+			return upstream.available(now)
+		})
+	}
+	if upstream == nil {
+		return nil, errNoAvailableUpstream
+	}
+	return upstream, nil
+}
+
+func (p *UpstreamPool) selectUpstream(req *http.Request, available func(upstream *Upstream) bool) *Upstream {
+	switch p.balance {
+	case BalanceLeastConn:
+		var res *Upstream
+		var resInflight int64
+		start := int(atomic.AddUint32(&p.next, 1))
+		for i := range p.upstreams {
+			upstream := p.upstreams[(start+i)%len(p.upstreams)]
+			if !available(upstream) {
+				continue
+			}
+			inflight := atomic.LoadInt64(&upstream.inflight)
+			if res == nil || inflight < resInflight {
+				res, resInflight = upstream, inflight
+			}
+		}
+		return res
+	case BalanceIPHash, BalanceCookieHash:
+		hash := hashString(p.hashKey(req))
+		start := sort.Search(len(p.ring), func(i int) bool {
+			return p.ring[i].hash >= hash
+		})
+		for i := range p.ring {
+			upstream := p.ring[(start+i)%len(p.ring)].upstream
+			if available(upstream) {
+				return upstream
+			}
+		}
+	default:
+		start := int(atomic.AddUint32(&p.next, 1) - 1)
+		for i := range p.upstreams {
+			upstream := p.upstreams[(start+i)%len(p.upstreams)]
+			if available(upstream) {
+				return upstream
+			}
+		}
+	}
+	return nil
+}
+
+func (p *UpstreamPool) hashKey(req *http.Request) string {
+	if p.balance == BalanceCookieHash {
+		if cookie, err := req.Cookie(p.hashCookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return clientIP(req)
+}
+
+// reportResult count result of request to upstream and eject upstream after MaxFails consecutive failures
+func (p *UpstreamPool) reportResult(ctx context.Context, upstream *Upstream, err error) {
+	atomic.AddUint64(&upstream.requests, 1)
+	if err == nil {
+		atomic.StoreInt32(&upstream.consecutiveFailures, 0)
+		return
+	}
+
+	atomic.AddUint64(&upstream.failures, 1)
+	fails := atomic.AddInt32(&upstream.consecutiveFailures, 1)
+	if p.maxFails > 0 && fails >= p.maxFails {
+		atomic.StoreInt64(&upstream.ejectedUntil, p.clock.Now().Add(p.failTimeout).UnixNano())
+		atomic.StoreInt32(&upstream.consecutiveFailures, 0)
+		zc.L(ctx).Warn("Upstream ejected after consecutive failures", zap.String("pool", p.Name),
+			zap.String("upstream", upstream.Address), zap.Int32("failures", fails),
+			zap.Duration("fail_timeout", p.failTimeout))
+	}
+}
+
+// startHealthChecks check upstreams every health check interval until ctx cancelled.
+func (p *UpstreamPool) startHealthChecks(ctx context.Context) {
+	if p.healthCheckClient == nil {
+		return
+	}
+
+	p.healthCheckStopMu.Lock()
+	if p.healthCheckStop != nil {
+		p.healthCheckStopMu.Unlock()
+		return
+	}
+	ctx, p.healthCheckStop = context.WithCancel(ctx)
+	p.healthCheckStopMu.Unlock()
+
+	logger := zc.L(ctx)
+	go func() {
+		defer log.HandlePanic(logger)
+
+		ticker := p.clock.NewTicker(p.healthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			p.checkHealth(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.Chan():
+			}
+		}
+	}()
+}
+
+func (p *UpstreamPool) stopHealthChecks() {
+	p.healthCheckStopMu.Lock()
+	defer p.healthCheckStopMu.Unlock()
+
+	if p.healthCheckStop != nil {
+		p.healthCheckStop()
+	}
+}
+
+// checkHealth check all upstreams of pool concurrently
+func (p *UpstreamPool) checkHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		go func(upstream *Upstream) {
+			defer wg.Done()
+			defer log.HandlePanic(zc.L(ctx))
+
+			p.setHealthy(ctx, upstream, p.checkUpstreamHealth(ctx, upstream))
+		}(upstream)
+	}
+	wg.Wait()
+}
+
+func (p *UpstreamPool) checkUpstreamHealth(ctx context.Context, upstream *Upstream) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		p.healthCheckScheme+"://"+upstream.Address+p.healthCheckPath, nil)
+	if err != nil {
+		return err
+	}
+	if p.healthCheckHost != "" {
+		req.Host = p.healthCheckHost
+	}
+
+	resp, err := p.healthCheckClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return xerrors.Errorf("bad health check status: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *UpstreamPool) setHealthy(ctx context.Context, upstream *Upstream, checkErr error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	var unhealthy int32
+	if checkErr != nil {
+		unhealthy = 1
+	}
+	if atomic.SwapInt32(&upstream.unhealthy, unhealthy) == unhealthy {
+		return
+	}
+
+	logger := zc.L(ctx).With(zap.String("pool", p.Name), zap.String("upstream", upstream.Address))
+	if checkErr == nil {
+		logger.Info("Upstream health check passed, upstream is healthy")
+	} else {
+		logger.Warn("Upstream health check failed, upstream is unhealthy", zap.Error(checkErr))
+	}
+}
+
+// UpstreamPools is upstream pools by name
+type UpstreamPools map[string]*UpstreamPool
+
+// NewUpstreamPools create pools from configs, names of pools must be unique.
+func NewUpstreamPools(configs []UpstreamPoolConfig, ignoreHTTPSCertificate bool) (UpstreamPools, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	res := make(UpstreamPools, len(configs))
+	for _, config := range configs {
+		pool, err := NewUpstreamPool(config, ignoreHTTPSCertificate)
+		if err != nil {
+			return nil, err
+		}
+		if _, exist := res[pool.Name]; exist {
+			return nil, xerrors.Errorf("duplicate upstream pool name '%v'", pool.Name)
+		}
+		res[pool.Name] = pool
+	}
+	return res, nil
+}
+
+// Start run active health checks of pools until Stop called or ctx cancelled.
+func (pools UpstreamPools) Start(ctx context.Context) {
+	for _, pool := range pools {
+		pool.startHealthChecks(ctx)
+	}
+}
+
+// Stop active health checks of pools. Pools still can be used for select upstream after stop.
+func (pools UpstreamPools) Stop() {
+	for _, pool := range pools {
+		pool.stopHealthChecks()
+	}
+}
+
+// sortedNames return names of pools in alphabet order
+func (pools UpstreamPools) sortedNames() []string {
+	res := make([]string, 0, len(pools))
+	for name := range pools {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// upstreamName return name of upstream pool from target or false if target is not upstream pool
+func upstreamName(target string) (string, bool) {
+	if !strings.HasPrefix(target, UpstreamTargetPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(target, UpstreamTargetPrefix), true
+}
+
+// containsUpstream return true if upstreams contains the upstream
+func containsUpstream(upstreams []*Upstream, upstream *Upstream) bool {
+	for _, item := range upstreams {
+		if item == upstream {
+			return true
+		}
+	}
+	return false
+}
+
+// hashString return fnv hash with murmur3 finalizer, because fnv doesn't mix last bytes of similar keys
+// (ip addresses) to high bits
+func hashString(s string) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(s))
+
+	res := hash.Sum32()
+	res ^= res >> 16
+	res *= 0x85ebca6b
+	res ^= res >> 13
+	res *= 0xc2b2ae35
+	res ^= res >> 16
+	return res
+}
+
+var (
+	upstreamHealthyDesc = prometheus.NewDesc("upstream_healthy",
+		"Upstream passed last active health check (1) or not (0)", []string{"pool", "upstream"}, nil)
+	upstreamEjectedDesc = prometheus.NewDesc("upstream_ejected",
+		"Upstream ejected after consecutive failures (1) or not (0)", []string{"pool", "upstream"}, nil)
+	upstreamInflightDesc = prometheus.NewDesc("upstream_inflight",
+		"In flight requests to upstream", []string{"pool", "upstream"}, nil)
+	upstreamRequestsDesc = prometheus.NewDesc("upstream_requests_total",
+		"Count of requests to upstream", []string{"pool", "upstream"}, nil)
+	upstreamFailuresDesc = prometheus.NewDesc("upstream_failures_total",
+		"Count of failed requests to upstream", []string{"pool", "upstream"}, nil)
+)
+
+// upstreamsCollector export state of upstream pools of current proxy transport.
+// Pools replaced on config reload, so state read on every collect.
+type upstreamsCollector struct {
+	proxy *HTTPProxy
+}
+
+func (c upstreamsCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- upstreamHealthyDesc
+	descs <- upstreamEjectedDesc
+	descs <- upstreamInflightDesc
+	descs <- upstreamRequestsDesc
+	descs <- upstreamFailuresDesc
+}
+
+func (c upstreamsCollector) Collect(metrics chan<- prometheus.Metric) {
+	transport, ok := c.proxy.getHandlers().transport.(Transport)
+	if !ok {
+		return
+	}
+
+	boolValue := func(v bool) float64 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+
+	for _, name := range transport.Upstreams.sortedNames() {
+		pool := transport.Upstreams[name]
+		now := pool.clock.Now()
+		for _, upstream := range pool.upstreams {
+			labels := []string{pool.Name, upstream.Address}
+			metrics <- prometheus.MustNewConstMetric(upstreamHealthyDesc, prometheus.GaugeValue,
+				boolValue(atomic.LoadInt32(&upstream.unhealthy) == 0), labels...)
+			metrics <- prometheus.MustNewConstMetric(upstreamEjectedDesc, prometheus.GaugeValue,
+				boolValue(upstream.ejected(now)), labels...)
+			metrics <- prometheus.MustNewConstMetric(upstreamInflightDesc, prometheus.GaugeValue,
+				float64(atomic.LoadInt64(&upstream.inflight)), labels...)
+			metrics <- prometheus.MustNewConstMetric(upstreamRequestsDesc, prometheus.CounterValue,
+				float64(atomic.LoadUint64(&upstream.requests)), labels...)
+			metrics <- prometheus.MustNewConstMetric(upstreamFailuresDesc, prometheus.CounterValue,
+				float64(atomic.LoadUint64(&upstream.failures)), labels...)
+		}
+	}
+}
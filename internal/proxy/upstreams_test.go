@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+// newUpstreamBackend start backend, which respond with the name
+func newUpstreamBackend(t *testing.T, name string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		_, _ = writer.Write([]byte(name))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func upstreamRequest(ctx context.Context, pool string, remoteAddr string) *http.Request {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+	req.URL.Host = UpstreamTargetPrefix + pool // as set by directors
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func upstreamResponseName(e *th.Env, tr Transport, req *http.Request) string {
+	resp, err := tr.RoundTrip(req)
+	e.CmpNoError(err)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	content, err := io.ReadAll(resp.Body)
+	e.CmpNoError(err)
+	return string(content)
+}
+
+func TestNewUpstreamPool(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	pool, err := NewUpstreamPool(UpstreamPoolConfig{Name: "app", Targets: []string{"1.2.3.4", "[::1]:81"}}, false)
+	e.CmpNoError(err)
+	e.Cmp(pool.balance, BalanceRoundRobin)
+	e.Cmp(pool.upstreams[0].Address, "1.2.3.4:80")
+	e.Cmp(pool.upstreams[1].Address, "[::1]:81")
+	e.Len(pool.ring, 2*upstreamRingReplicas)
+	e.Nil(pool.healthCheckClient)
+
+	pool, err = NewUpstreamPool(UpstreamPoolConfig{Name: "app", Targets: []string{"1.2.3.4:80"},
+		HealthCheckPath: "/health"}, false)
+	e.CmpNoError(err)
+	e.Cmp(pool.healthCheckScheme, ProtocolHTTP)
+	e.Cmp(pool.healthCheckInterval, defaultHealthCheckInterval)
+	e.Cmp(pool.healthCheckClient.Timeout, defaultHealthCheckTimeout)
+
+	badConfigs := []UpstreamPoolConfig{
+		{Targets: []string{"1.2.3.4:80"}},
+		{Name: "app"},
+		{Name: "app", Targets: []string{"1.2.3.4:80"}, Balance: "random"},
+		{Name: "app", Targets: []string{"1.2.3.4:80"}, Balance: BalanceCookieHash},
+		{Name: "app", Targets: []string{"1.2.3.4:80"}, HealthCheckPath: "health"},
+		{Name: "app", Targets: []string{"1.2.3.4:80"}, HealthCheckPath: "/health", HealthCheckScheme: "ftp"},
+	}
+	for _, config := range badConfigs {
+		_, err = NewUpstreamPool(config, false)
+		e.CmpError(err, config)
+	}
+
+	_, err = NewUpstreamPools([]UpstreamPoolConfig{
+		{Name: "app", Targets: []string{"1.2.3.4:80"}},
+		{Name: "app", Targets: []string{"1.2.3.5:80"}},
+	}, false)
+	e.CmpError(err)
+}
+
+func TestUpstreamPoolBalance(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	backend1 := newUpstreamBackend(t, "backend1")
+	backend2 := newUpstreamBackend(t, "backend2")
+	targets := []string{backend1.Listener.Addr().String(), backend2.Listener.Addr().String()}
+
+	pools, err := NewUpstreamPools([]UpstreamPoolConfig{
+		{Name: "rr", Targets: targets},
+		{Name: "least", Targets: targets, Balance: BalanceLeastConn},
+		{Name: "ip", Targets: targets, Balance: BalanceIPHash},
+		{Name: "cookie", Targets: targets, Balance: BalanceCookieHash, HashCookie: "session"},
+	}, false)
+	e.CmpNoError(err)
+	tr := Transport{RateLimiter: &RateLimiter{}, Upstreams: pools}
+
+	t.Run("round-robin", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+		e.Cmp(upstreamResponseName(e, tr, upstreamRequest(ctx, "rr", "1.1.1.1:1")), "backend1")
+		e.Cmp(upstreamResponseName(e, tr, upstreamRequest(ctx, "rr", "1.1.1.1:1")), "backend2")
+		e.Cmp(upstreamResponseName(e, tr, upstreamRequest(ctx, "rr", "1.1.1.1:1")), "backend1")
+		e.Cmp(pools["rr"].upstreams[0].requests, uint64(2))
+		e.Cmp(pools["rr"].upstreams[1].requests, uint64(1))
+	})
+
+	t.Run("least-conn", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		// response body not closed - request in flight
+		resp, err := tr.RoundTrip(upstreamRequest(ctx, "least", "1.1.1.1:1"))
+		e.CmpNoError(err)
+		e.Cmp(pools["least"].upstreams[0].inflight+pools["least"].upstreams[1].inflight, int64(1))
+		busy := pools["least"].upstreams[0]
+		free := "backend2"
+		if busy.inflight == 0 {
+			busy = pools["least"].upstreams[1]
+			free = "backend1"
+		}
+
+		for i := 0; i < 3; i++ {
+			e.Cmp(upstreamResponseName(e, tr, upstreamRequest(ctx, "least", "1.1.1.1:1")), free)
+		}
+
+		e.CmpNoError(resp.Body.Close())
+		e.Cmp(busy.inflight, int64(0))
+	})
+
+	t.Run("ip-hash", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		names := map[string]bool{}
+		for i := 0; i < 20; i++ {
+			ip := fmt.Sprintf("10.0.0.%v", i)
+			first := upstreamResponseName(e, tr, upstreamRequest(ctx, "ip", ip+":1"))
+			e.Cmp(upstreamResponseName(e, tr, upstreamRequest(ctx, "ip", ip+":2")), first)
+			names[first] = true
+		}
+		e.Len(names, 2)
+	})
+
+	t.Run("cookie-hash", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+
+		names := map[string]bool{}
+		for i := 0; i < 20; i++ {
+			session := strings.Repeat("s", i+1)
+			req := upstreamRequest(ctx, "cookie", "1.1.1.1:1")
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+			first := upstreamResponseName(e, tr, req)
+
+			req = upstreamRequest(ctx, "cookie", "2.2.2.2:1")
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+			e.Cmp(upstreamResponseName(e, tr, req), first)
+			names[first] = true
+		}
+		e.Len(names, 2)
+	})
+
+	t.Run("unknown pool", func(t *testing.T) {
+		e, _, flush := th.NewEnv(t)
+		defer flush()
+		_, err := tr.RoundTrip(upstreamRequest(ctx, "unknown", "1.1.1.1:1"))
+		e.CmpError(err)
+	})
+}
+
+func TestUpstreamPoolPassiveEjection(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	backend := newUpstreamBackend(t, "backend")
+	stopped := newUpstreamBackend(t, "stopped")
+	stopped.Close()
+
+	pools, err := NewUpstreamPools([]UpstreamPoolConfig{{
+		Name:               "app",
+		Targets:            []string{stopped.Listener.Addr().String(), backend.Listener.Addr().String()},
+		MaxFails:           2,
+		FailTimeoutSeconds: 30,
+	}}, false)
+	e.CmpNoError(err)
+	pool := pools["app"]
+	clock := clockwork.NewFakeClock()
+	pool.clock = clock
+	tr := Transport{RateLimiter: &RateLimiter{}, Upstreams: pools}
+
+	_, err = tr.RoundTrip(upstreamRequest(ctx, "app", "1.1.1.1:1"))
+	e.CmpError(err)
+	e.Cmp(upstreamResponseName(e, tr, upstreamRequest(ctx, "app", "1.1.1.1:1")), "backend")
+	e.False(pool.upstreams[0].ejected(clock.Now()))
+
+	_, err = tr.RoundTrip(upstreamRequest(ctx, "app", "1.1.1.1:1"))
+	e.CmpError(err)
+	e.True(pool.upstreams[0].ejected(clock.Now()))
+	e.Cmp(pool.upstreams[0].failures, uint64(2))
+
+	for i := 0; i < 3; i++ {
+		e.Cmp(upstreamResponseName(e, tr, upstreamRequest(ctx, "app", "1.1.1.1:1")), "backend")
+	}
+
+	clock.Advance(31 * time.Second)
+	e.False(pool.upstreams[0].ejected(clock.Now()))
+
+	atomic.StoreInt32(&pool.upstreams[1].unhealthy, 1)
+	_, err = tr.RoundTrip(upstreamRequest(ctx, "app", "1.1.1.1:1"))
+	e.CmpError(err)
+	atomic.StoreInt64(&pool.upstreams[0].ejectedUntil, clock.Now().Add(time.Second).UnixNano())
+	_, err = pool.Next(upstreamRequest(ctx, "app", "1.1.1.1:1"))
+	e.Cmp(err, errNoAvailableUpstream)
+}
+
+func TestUpstreamPoolHealthChecks(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	var healthy int32 = 1
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/health" && request.Host == "check.example" && atomic.LoadInt32(&healthy) == 1 {
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	pool, err := NewUpstreamPool(UpstreamPoolConfig{
+		Name:            "app",
+		Targets:         []string{backend.Listener.Addr().String()},
+		HealthCheckPath: "/health",
+		HealthCheckHost: "check.example",
+	}, false)
+	e.CmpNoError(err)
+	upstream := pool.upstreams[0]
+
+	pool.checkHealth(ctx)
+	e.True(upstream.available(time.Now()))
+
+	atomic.StoreInt32(&healthy, 0)
+	pool.checkHealth(ctx)
+	e.False(upstream.available(time.Now()))
+
+	atomic.StoreInt32(&healthy, 1)
+	clock := clockwork.NewFakeClock()
+	pool.clock = clock
+	pools := UpstreamPools{"app": pool}
+	pools.Start(ctx)
+	defer pools.Stop()
+
+	// first check start immediately
+	e.True(waitUpstreamState(upstream, true))
+
+	atomic.StoreInt32(&healthy, 0)
+	clock.BlockUntil(1)
+	clock.Advance(defaultHealthCheckInterval)
+	e.True(waitUpstreamState(upstream, false))
+}
+
+func waitUpstreamState(upstream *Upstream, available bool) bool {
+	for i := 0; i < 100; i++ {
+		if upstream.available(time.Now()) == available {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestUpstreamsCollector(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	c := Config{
+		DefaultTarget: UpstreamTargetPrefix + "app",
+		Upstreams:     []UpstreamPoolConfig{{Name: "app", Targets: []string{"1.2.3.4:80", "1.2.3.5:80"}}},
+	}
+	p := &HTTPProxy{}
+	e.CmpNoError(c.Apply(ctx, p))
+
+	registry := prometheus.NewRegistry()
+	p.InitMetrics(registry)
+	p.InitMetrics(nil)
+
+	families, err := registry.Gather()
+	e.CmpNoError(err)
+
+	names := map[string]int{}
+	for _, family := range families {
+		names[family.GetName()] = len(family.GetMetric())
+	}
+	e.Cmp(names, map[string]int{
+		"upstream_healthy":        2,
+		"upstream_ejected":        2,
+		"upstream_inflight":       2,
+		"upstream_requests_total": 2,
+		"upstream_failures_total": 2,
+	})
+}
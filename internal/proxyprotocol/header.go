@@ -0,0 +1,233 @@
+// Package proxyprotocol read and write PROXY protocol v1 and v2 headers:
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Versions of protocol
+const (
+	V1 = 1
+	V2 = 2
+)
+
+const (
+	v1Prefix       = "PROXY "
+	v1MaxLength    = 107
+	v2HeaderLength = 16
+
+	v2CommandLocal = 0x20
+	v2CommandProxy = 0x21
+
+	v2FamilyUnspec = 0x00
+	v2FamilyTCP4   = 0x11
+	v2FamilyTCP6   = 0x21
+
+	v2AddressesTCP4Length = 12
+	v2AddressesTCP6Length = 36
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrNoHeader returned if connection data doesn't start with PROXY protocol header
+var ErrNoHeader = xerrors.New("no proxy protocol header")
+
+// ParseVersion parse version from config: v1, v2 or empty for disabled protocol (0).
+func ParseVersion(s string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return V1, nil
+	case "v2", "2":
+		return V2, nil
+	default:
+		return 0, xerrors.Errorf("unknown proxy protocol version '%v'", s)
+	}
+}
+
+// ReadHeader read v1 or v2 header from reader. It returns nil addresses for LOCAL (v2) and UNKNOWN (v1) headers,
+// receiver must use addresses of connection in the case.
+func ReadHeader(r *bufio.Reader) (src, dst *net.TCPAddr, err error) {
+	start, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("read proxy protocol header: %w", err)
+	}
+	if string(start) == v1Prefix {
+		return readHeaderV1(r)
+	}
+
+	start, err = r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(start, v2Signature) {
+		return readHeaderV2(r)
+	}
+	return nil, nil, ErrNoHeader
+}
+
+func readHeaderV1(r *bufio.Reader) (src, dst *net.TCPAddr, err error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		var b byte
+		b, err = r.ReadByte()
+		if err != nil {
+			return nil, nil, xerrors.Errorf("read proxy protocol v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, xerrors.New("proxy protocol v1 header without line end")
+	}
+
+	parts := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(parts) != 6 || parts[1] != "TCP4" && parts[1] != "TCP6" {
+		return nil, nil, xerrors.Errorf("bad proxy protocol v1 header: '%v'", strings.TrimSpace(string(line)))
+	}
+
+	src, err = parseV1Addr(parts[2], parts[4], parts[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err = parseV1Addr(parts[3], parts[5], parts[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(ipS, portS string, ipv4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipS)
+	if ip == nil || (ip.To4() != nil) != ipv4 {
+		return nil, xerrors.Errorf("bad ip address in proxy protocol v1 header: '%v'", ipS)
+	}
+	port, err := strconv.ParseUint(portS, 10, 16)
+	if err != nil {
+		return nil, xerrors.Errorf("bad port in proxy protocol v1 header '%v': %w", portS, err)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readHeaderV2(r *bufio.Reader) (src, dst *net.TCPAddr, err error) {
+	header := make([]byte, v2HeaderLength)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, nil, xerrors.Errorf("read proxy protocol v2 header: %w", err)
+	}
+	command, family := header[12], header[13]
+	data := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, nil, xerrors.Errorf("read proxy protocol v2 addresses: %w", err)
+	}
+
+	switch command {
+	case v2CommandLocal:
+		return nil, nil, nil
+	case v2CommandProxy:
+		// pass
+	default:
+		return nil, nil, xerrors.Errorf("unknown proxy protocol v2 version and command: 0x%x", command)
+	}
+
+	var ipLength int
+	switch family {
+	case v2FamilyUnspec:
+		return nil, nil, nil
+	case v2FamilyTCP4:
+		ipLength = net.IPv4len
+	case v2FamilyTCP6:
+		ipLength = net.IPv6len
+	default:
+		// other families (udp, unix) are not used for tcp connections, handle as unknown addresses
+		return nil, nil, nil
+	}
+	if len(data) < 2*ipLength+4 {
+		return nil, nil, xerrors.New("short proxy protocol v2 addresses block")
+	}
+
+	src = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[:ipLength]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLength:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[ipLength:2*ipLength]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLength+2:])),
+	}
+	return src, dst, nil
+}
+
+// Header return header of the version for connection from src to dst.
+// It returns UNKNOWN (v1) or LOCAL (v2) header if src or dst is nil or addresses have different ip families.
+func Header(version int, src, dst *net.TCPAddr) ([]byte, error) {
+	switch version {
+	case V1:
+		return headerV1(src, dst), nil
+	case V2:
+		return headerV2(src, dst), nil
+	default:
+		return nil, xerrors.Errorf("unknown proxy protocol version: %v", version)
+	}
+}
+
+func headerV1(src, dst *net.TCPAddr) []byte {
+	ipv4, ok := addressesFamily(src, dst)
+	if !ok {
+		return []byte(v1Prefix + "UNKNOWN\r\n")
+	}
+
+	protocol, srcIP, dstIP := "TCP6", src.IP.To16(), dst.IP.To16()
+	if ipv4 {
+		protocol, srcIP, dstIP = "TCP4", src.IP.To4(), dst.IP.To4()
+	}
+	return []byte(fmt.Sprintf("%v%v %v %v %v %v\r\n", v1Prefix, protocol, srcIP, dstIP, src.Port, dst.Port))
+}
+
+func headerV2(src, dst *net.TCPAddr) []byte {
+	res := append([]byte(nil), v2Signature...)
+
+	ipv4, ok := addressesFamily(src, dst)
+	if !ok {
+		return append(res, v2CommandLocal, v2FamilyUnspec, 0, 0)
+	}
+
+	family, addressesLength, srcIP, dstIP := byte(v2FamilyTCP6), v2AddressesTCP6Length, src.IP.To16(), dst.IP.To16()
+	if ipv4 {
+		family, addressesLength, srcIP, dstIP = v2FamilyTCP4, v2AddressesTCP4Length, src.IP.To4(), dst.IP.To4()
+	}
+	res = append(res, v2CommandProxy, family)
+	res = appendUint16(res, uint16(addressesLength))
+	res = append(res, srcIP...)
+	res = append(res, dstIP...)
+	res = appendUint16(res, uint16(src.Port))
+	res = appendUint16(res, uint16(dst.Port))
+	return res
+}
+
+// addressesFamily return true if both addresses are ipv4, ok is false if addresses can't be used in header
+func addressesFamily(src, dst *net.TCPAddr) (ipv4 bool, ok bool) {
+	if src == nil || dst == nil || src.IP == nil || dst.IP == nil {
+		return false, false
+	}
+	srcIPv4, dstIPv4 := src.IP.To4() != nil, dst.IP.To4() != nil
+	if srcIPv4 != dstIPv4 {
+		return false, false
+	}
+	return srcIPv4, true
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
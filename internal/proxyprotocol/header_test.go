@@ -0,0 +1,105 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseVersion(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	for s, version := range map[string]int{"": 0, "v1": V1, "V2": V2, "2": V2} {
+		res, err := ParseVersion(s)
+		e.CmpNoError(err)
+		e.Cmp(res, version)
+	}
+	_, err := ParseVersion("v3")
+	e.CmpError(err)
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	table := []struct {
+		src, dst *net.TCPAddr
+		v1       string
+	}{
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+			dst: &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443},
+			v1:  "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		},
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000},
+			dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80},
+			v1:  "PROXY TCP6 2001:db8::1 2001:db8::2 1000 80\r\n",
+		},
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000},
+			dst: &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 80},
+			v1:  "PROXY UNKNOWN\r\n",
+		},
+		{
+			src: nil,
+			dst: &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 80},
+			v1:  "PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for _, test := range table {
+		header, err := Header(V1, test.src, test.dst)
+		e.CmpNoError(err)
+		e.Cmp(string(header), test.v1)
+
+		for _, version := range []int{V1, V2} {
+			header, err = Header(version, test.src, test.dst)
+			e.CmpNoError(err)
+			reader := bufio.NewReader(bytes.NewReader(append(header, "data"...)))
+			src, dst, err := ReadHeader(reader)
+			e.CmpNoError(err)
+			if test.v1 == "PROXY UNKNOWN\r\n" {
+				e.Nil(src)
+				e.Nil(dst)
+			} else {
+				e.Cmp(src.String(), test.src.String())
+				e.Cmp(dst.String(), test.dst.String())
+			}
+			rest, _ := reader.Peek(4)
+			e.Cmp(string(rest), "data")
+		}
+	}
+
+	_, err := Header(3, nil, nil)
+	e.CmpError(err)
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	bad := []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 1.2.3.4 1.2.3.5 1000\r\n",
+		"PROXY TCP4 1.2.3.4 1.2.3.5 1000 100000\r\n",
+		"PROXY TCP4 ::1 1.2.3.5 1000 80\r\n",
+		"PROXY TCP4 1.2.3.4 1.2.3.5 1000 80\n",
+		"PROXY " + strings.Repeat("A", 200),
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04abcd",
+		"\r\n\r\n\x00\r\nQUIT\n\x22\x11\x00\x00",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x10abcd",
+	}
+	for _, header := range bad {
+		_, _, err := ReadHeader(bufio.NewReader(strings.NewReader(header)))
+		e.CmpError(err, header)
+	}
+
+	_, _, err := ReadHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n")))
+	e.Cmp(err, ErrNoHeader)
+}
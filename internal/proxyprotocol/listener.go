@@ -0,0 +1,93 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/netlist"
+)
+
+// DefaultHeaderTimeout is time for receive header from accepted connection
+const DefaultHeaderTimeout = 5 * time.Second
+
+// Listener read PROXY protocol header from connections of trusted sources and replace remote address
+// of connections by source address from header. Connections from trusted sources must start with header.
+// Connections from other sources used as is.
+type Listener struct {
+	net.Listener
+	Trusted       netlist.List
+	HeaderTimeout time.Duration
+}
+
+// NewListener wrap listener for accept PROXY protocol headers from trusted networks.
+func NewListener(listener net.Listener, trusted netlist.List) *Listener {
+	return &Listener{Listener: listener, Trusted: trusted, HeaderTimeout: DefaultHeaderTimeout}
+}
+
+// Accept return connection, which read header on first Read or RemoteAddr call,
+// so slow clients doesn't block accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.Trusted.ContainsAddr(conn.RemoteAddr().String()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, headerTimeout: l.HeaderTimeout}, nil
+}
+
+// Conn is connection from trusted source, which start with PROXY protocol header.
+type Conn struct {
+	net.Conn
+
+	headerTimeout time.Duration
+	once          sync.Once
+	reader        *bufio.Reader
+	remoteAddr    net.Addr
+	err           error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr return source address from header, or address of connection if header has no addresses.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// HeaderError return error of read header, nil if header read successfully.
+func (c *Conn) HeaderError() error {
+	c.once.Do(c.readHeader)
+	return c.err
+}
+
+func (c *Conn) readHeader() {
+	c.reader = bufio.NewReader(c.Conn)
+	if c.headerTimeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+		defer func() {
+			_ = c.Conn.SetReadDeadline(time.Time{})
+		}()
+	}
+
+	src, _, err := ReadHeader(c.reader)
+	if err != nil {
+		c.err = err
+		return
+	}
+	if src != nil {
+		c.remoteAddr = src
+	}
+}
@@ -0,0 +1,72 @@
+package proxyprotocol
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/netlist"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestListener(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	e.CmpNoError(err)
+	defer func() { _ = tcpListener.Close() }()
+
+	trusted, _ := netlist.Parse([]string{"127.0.0.0/8"})
+	listener := NewListener(tcpListener, trusted)
+	listener.HeaderTimeout = 100 * time.Millisecond
+
+	send := func(data string) net.Conn {
+		conn, err := net.Dial("tcp", tcpListener.Addr().String())
+		e.CmpNoError(err)
+		_, err = conn.Write([]byte(data))
+		e.CmpNoError(err)
+		return conn
+	}
+
+	client := send("PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\r\nhello")
+	conn, err := listener.Accept()
+	e.CmpNoError(err)
+	e.Cmp(conn.RemoteAddr().String(), "1.2.3.4:1000")
+	e.Cmp(conn.LocalAddr().String(), tcpListener.Addr().String())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	e.CmpNoError(err)
+	e.Cmp(string(buf), "hello")
+	_ = conn.Close()
+	_ = client.Close()
+
+	client = send("PROXY UNKNOWN\r\n")
+	conn, err = listener.Accept()
+	e.CmpNoError(err)
+	e.Cmp(conn.RemoteAddr().String(), client.LocalAddr().String())
+	e.CmpNoError(conn.(*Conn).HeaderError())
+	_ = conn.Close()
+	_ = client.Close()
+
+	client = send("hello")
+	conn, err = listener.Accept()
+	e.CmpNoError(err)
+	_, err = conn.Read(buf)
+	e.CmpError(err)
+	e.Cmp(conn.RemoteAddr().String(), client.LocalAddr().String())
+	_ = conn.Close()
+	_ = client.Close()
+
+	// untrusted source - connection as is
+	listener.Trusted = nil
+	client = send("PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\r\n")
+	conn, err = listener.Accept()
+	e.CmpNoError(err)
+	_, isProxyConn := conn.(*Conn)
+	e.False(isProxyConn)
+	e.Cmp(conn.RemoteAddr().String(), client.LocalAddr().String())
+	_ = conn.Close()
+	_ = client.Close()
+}
@@ -16,6 +16,8 @@ const (
 	passwordArgName     = "password"
 )
 
+var defaultAllowedMethods = []string{http.MethodGet, http.MethodHead}
+
 type Config struct {
 	AllowedNetworks    []string
 	Password           string
@@ -28,6 +30,13 @@ type SecretHandler struct {
 	password           string
 	logger             *zap.Logger
 	next               http.Handler
+	allowedMethods     []string
+}
+
+// WithMethods return copy of handler, which allow the http methods instead of default GET and HEAD.
+func (m SecretHandler) WithMethods(methods ...string) SecretHandler {
+	m.allowedMethods = methods
+	return m
 }
 
 func (m SecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -81,7 +90,7 @@ func (m SecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+	if !m.isMethodAllowed(r.Method) {
 		http.Error(w, "Bad method", http.StatusMethodNotAllowed)
 		return
 	}
@@ -90,6 +99,19 @@ func (m SecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	m.next.ServeHTTP(w, r)
 }
 
+func (m SecretHandler) isMethodAllowed(method string) bool {
+	allowedMethods := m.allowedMethods
+	if allowedMethods == nil {
+		allowedMethods = defaultAllowedMethods
+	}
+	for _, allowed := range allowedMethods {
+		if method == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 func New(logger *zap.Logger, config Config, next http.Handler) SecretHandler {
 	localLogger := logger.Named("create_secret_handler")
 	var allowedNetworksIP []net.IPNet
@@ -135,3 +135,33 @@ func TestPassword(t *testing.T) {
 	nextCalled = false
 	_ = resp.Body.Close()
 }
+
+func TestSecretHandler_WithMethods(t *testing.T) {
+	td := testdeep.NewT(t)
+	mt := minimock.NewController(td)
+	defer mt.Finish()
+
+	nextHandler := NewHandlerMock(mt)
+	nextHandler.ServeHTTPMock.Set(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusOK)
+	})
+
+	secretHandler := New(th.Logger(td), Config{AllowEmptyPassword: true}, nextHandler)
+
+	check := func(h SecretHandler, method string, status int) {
+		t.Helper()
+		respWriter := httptest.NewRecorder()
+		h.ServeHTTP(respWriter, httptest.NewRequest(method, "http://test", nil))
+		resp := respWriter.Result()
+		td.Cmp(resp.StatusCode, status, method)
+		_ = resp.Body.Close()
+	}
+
+	check(secretHandler, http.MethodGet, http.StatusOK)
+	check(secretHandler, http.MethodPost, http.StatusMethodNotAllowed)
+
+	secretHandler = secretHandler.WithMethods(http.MethodGet, http.MethodPost)
+	check(secretHandler, http.MethodGet, http.StatusOK)
+	check(secretHandler, http.MethodPost, http.StatusOK)
+	check(secretHandler, http.MethodDelete, http.StatusMethodNotAllowed)
+}
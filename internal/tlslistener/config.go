@@ -3,45 +3,80 @@ package tlslistener
 import (
 	"context"
 	"net"
+	"time"
 
 	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/netlist"
+	"github.com/rekby/lets-proxy2/internal/proxyprotocol"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
+	"golang.org/x/xerrors"
 )
 
 type Config struct {
 	TLSAddresses  []string
 	TCPAddresses  []string
 	MinTLSVersion string
+
+	// ProxyProtocolAddresses is addresses from TLSAddresses and TCPAddresses, which accept PROXY protocol header
+	// from ProxyProtocolTrustedNetworks
+	ProxyProtocolAddresses       []string
+	ProxyProtocolTrustedNetworks []string
+
+	MaxConnections           int
+	MaxConnectionsPerIP      int
+	HandshakeTimeoutSeconds  int
+	HandshakesPerSecondPerIP int
 }
 
-func (c Config) Apply(ctx context.Context, l *ListenersHandler) error {
+// Apply start listen configured addresses. If process started with inherited listeners (see InheritListenersEnv)
+// it use inherited listeners for same addresses instead of bind new sockets.
+func (c Config) Apply(ctx context.Context, l *ListenersHandler) (err error) {
 	logger := zc.L(ctx)
 
 	var tlsListeners = make([]net.Listener, 0, len(c.TLSAddresses))
+	var tcpListeners = make([]net.Listener, 0, len(c.TCPAddresses))
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, listener := range append(tlsListeners, tcpListeners...) {
+			_ = listener.Close()
+		}
+	}()
+
+	proxyProtocolTrusted, err := c.proxyProtocolTrusted()
+	if err != nil {
+		return err
+	}
+
 	for _, addr := range c.TLSAddresses { //nolint:wsl
-		listener, err := net.Listen("tcp", addr)
+		listener, err := listen(ctx, addr)
 		log.DebugError(logger, err, "Start listen tls binding", zap.String("address", addr))
 		if err != nil {
 			return err
 		}
 
-		tlsListeners = append(tlsListeners, listener)
+		tlsListeners = append(tlsListeners, c.wrapProxyProtocol(ctx, listener, addr, proxyProtocolTrusted))
 	}
 
-	var tcpListeners = make([]net.Listener, 0, len(c.TCPAddresses))
-
 	for _, addr := range c.TCPAddresses {
-		listener, err := net.Listen("tcp", addr)
+		listener, err := listen(ctx, addr)
 		log.DebugError(logger, err, "Start listen tcp binding", zap.String("address", addr))
 		if err != nil {
 			return err
 		}
 
-		tcpListeners = append(tcpListeners, listener)
+		tcpListeners = append(tcpListeners, c.wrapProxyProtocol(ctx, listener, addr, proxyProtocolTrusted))
 	}
 	l.ListenersForHandleTLS = tlsListeners
 	l.Listeners = tcpListeners
+	l.Limits = ConnectionLimits{
+		MaxConnections:           c.MaxConnections,
+		MaxConnectionsPerIP:      c.MaxConnectionsPerIP,
+		HandshakeTimeout:         time.Duration(c.HandshakeTimeoutSeconds) * time.Second,
+		HandshakesPerSecondPerIP: c.HandshakesPerSecondPerIP,
+	}
 
 	if tlsVersion, err := ParseTLSVersion(c.MinTLSVersion); err == nil {
 		l.MinTLSVersion = tlsVersion
@@ -52,3 +87,43 @@ func (c Config) Apply(ctx context.Context, l *ListenersHandler) error {
 
 	return nil
 }
+
+// proxyProtocolTrusted check proxy protocol settings and return trusted networks
+func (c Config) proxyProtocolTrusted() (netlist.List, error) {
+	if len(c.ProxyProtocolAddresses) == 0 {
+		return nil, nil
+	}
+
+	for _, addr := range c.ProxyProtocolAddresses {
+		if !containsString(c.TLSAddresses, addr) && !containsString(c.TCPAddresses, addr) {
+			return nil, xerrors.Errorf("proxy protocol address '%v' isn't listen address", addr)
+		}
+	}
+
+	trusted, err := netlist.Parse(c.ProxyProtocolTrustedNetworks)
+	if err != nil {
+		return nil, xerrors.Errorf("parse proxy protocol trusted networks: %w", err)
+	}
+	if len(trusted) == 0 {
+		return nil, xerrors.New("proxy protocol needs trusted networks")
+	}
+	return trusted, nil
+}
+
+func (c Config) wrapProxyProtocol(ctx context.Context, listener net.Listener, addr string, trusted netlist.List) net.Listener {
+	if !containsString(c.ProxyProtocolAddresses, addr) {
+		return listener
+	}
+	zc.L(ctx).Info("Accept proxy protocol", zap.String("address", addr),
+		zap.Strings("trusted_networks", c.ProxyProtocolTrustedNetworks))
+	return proxyprotocol.NewListener(listener, trusted)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
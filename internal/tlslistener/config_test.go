@@ -3,7 +3,9 @@ package tlslistener
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/rekby/lets-proxy2/internal/proxyprotocol"
 	"github.com/rekby/lets-proxy2/internal/th"
 
 	"github.com/maxatome/go-testdeep"
@@ -90,3 +92,47 @@ func getFreePorts(ip string, cnt int) []string {
 	}
 	return res
 }
+
+func TestConfig_ApplyProxyProtocol(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	const addr = "127.0.0.1"
+	ports := getFreePorts(addr, 2)
+
+	l := &ListenersHandler{}
+	c := &Config{
+		TCPAddresses:           []string{addr + ":" + ports[0]},
+		ProxyProtocolAddresses: []string{addr + ":" + ports[0]},
+	}
+	td.CmpError(c.Apply(ctx, l))
+
+	c.ProxyProtocolTrustedNetworks = []string{"bad"}
+	td.CmpError(c.Apply(ctx, l))
+
+	c.ProxyProtocolTrustedNetworks = []string{"10.0.0.0/8"}
+	c.ProxyProtocolAddresses = []string{addr + ":" + ports[1]}
+	td.CmpError(c.Apply(ctx, l))
+
+	c = &Config{
+		TCPAddresses:                 []string{addr + ":" + ports[0]},
+		TLSAddresses:                 []string{addr + ":" + ports[1]},
+		ProxyProtocolAddresses:       []string{addr + ":" + ports[1]},
+		ProxyProtocolTrustedNetworks: []string{"10.0.0.0/8"},
+		MaxConnectionsPerIP:          10,
+		HandshakeTimeoutSeconds:      5,
+	}
+	td.CmpNoError(c.Apply(ctx, l))
+	td.Cmp(l.Limits, ConnectionLimits{MaxConnectionsPerIP: 10, HandshakeTimeout: 5 * time.Second})
+	defer func() {
+		_ = l.Listeners[0].Close()
+		_ = l.ListenersForHandleTLS[0].Close()
+	}()
+
+	_, isProxyProtocol := l.Listeners[0].(*proxyprotocol.Listener)
+	td.False(isProxyProtocol)
+	_, isProxyProtocol = l.ListenersForHandleTLS[0].(*proxyprotocol.Listener)
+	td.True(isProxyProtocol)
+}
@@ -0,0 +1,172 @@
+package tlslistener
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// InheritListenersEnv contains comma separated config addresses of listeners, passed from parent process
+// for zero-downtime upgrade. Listener with index i in the list has file descriptor 3+i.
+const InheritListenersEnv = "LETS_PROXY_INHERIT_LISTENERS"
+
+const firstInheritFD = 3
+
+// inheritFile return file of inherited listener with the index
+var inheritFile = func(index int, name string) *os.File {
+	return os.NewFile(uintptr(firstInheritFD+index), name)
+}
+
+var listenRegistry = struct {
+	mu sync.Mutex
+
+	inheritParsed bool
+	inherited     map[string][]net.Listener
+
+	opened []*addressListener
+}{}
+
+// addressListener remember address from config, for handoff listener to new process.
+type addressListener struct {
+	net.Listener
+	address string
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (l *addressListener) Close() error {
+	l.closeOnce.Do(func() {
+		listenRegistry.mu.Lock()
+		for i, item := range listenRegistry.opened {
+			if item == l {
+				listenRegistry.opened = append(listenRegistry.opened[:i], listenRegistry.opened[i+1:]...)
+				break
+			}
+		}
+		listenRegistry.mu.Unlock()
+
+		l.closeErr = l.Listener.Close()
+	})
+	return l.closeErr
+}
+
+// Listen start listen the address for other servers of the process (admin api, profiler, etc.):
+// listener inherited from parent process and passed to new process on upgrade as tls and tcp listeners of config.
+// It must be called before CloseUnusedInheritedListeners.
+func Listen(ctx context.Context, address string) (net.Listener, error) {
+	return listen(ctx, address)
+}
+
+// listen use listener, inherited from parent process, or start listen the address.
+func listen(ctx context.Context, address string) (net.Listener, error) {
+	listenRegistry.mu.Lock()
+	defer listenRegistry.mu.Unlock()
+
+	parseInheritedListeners(ctx)
+
+	var listener net.Listener
+	if inherited := listenRegistry.inherited[address]; len(inherited) > 0 {
+		listener = inherited[0]
+		listenRegistry.inherited[address] = inherited[1:]
+		zc.L(ctx).Info("Use listener from parent process", zap.String("address", address))
+	} else {
+		var err error
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &addressListener{Listener: listener, address: address}
+	listenRegistry.opened = append(listenRegistry.opened, res)
+	return res, nil
+}
+
+// must be called with locked listenRegistry.mu
+func parseInheritedListeners(ctx context.Context) {
+	if listenRegistry.inheritParsed {
+		return
+	}
+	listenRegistry.inheritParsed = true
+	listenRegistry.inherited = make(map[string][]net.Listener)
+
+	env := os.Getenv(InheritListenersEnv)
+	if env == "" {
+		return
+	}
+
+	logger := zc.L(ctx)
+	for i, address := range strings.Split(env, ",") {
+		f := inheritFile(i, address)
+		listener, err := net.FileListener(f)
+		log.DebugError(logger, err, "Restore inherited listener", zap.String("address", address),
+			zap.Int("fd", firstInheritFD+i))
+		_ = f.Close()
+		if err != nil {
+			continue
+		}
+		listenRegistry.inherited[address] = append(listenRegistry.inherited[address], listener)
+	}
+}
+
+// CloseUnusedInheritedListeners close listeners from parent process, which not used by config.
+// It must be called after apply all listen configs.
+func CloseUnusedInheritedListeners(ctx context.Context) {
+	listenRegistry.mu.Lock()
+	defer listenRegistry.mu.Unlock()
+
+	parseInheritedListeners(ctx)
+
+	for address, listeners := range listenRegistry.inherited {
+		for _, listener := range listeners {
+			err := listener.Close()
+			log.DebugError(zc.L(ctx), err, "Close unused inherited listener", zap.String("address", address))
+		}
+	}
+	listenRegistry.inherited = make(map[string][]net.Listener)
+}
+
+// ListenerFiles return duplicates of file descriptors of all opened listeners and value for InheritListenersEnv
+// for pass it to new process. Caller must close the files.
+func ListenerFiles() (files []*os.File, env string, err error) {
+	listenRegistry.mu.Lock()
+	defer listenRegistry.mu.Unlock()
+
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	addresses := make([]string, 0, len(listenRegistry.opened))
+	for _, listener := range listenRegistry.opened {
+		fileListener, ok := listener.Listener.(filer)
+		if !ok {
+			err = xerrors.Errorf("listener for address '%v' can't be passed to other process", listener.address)
+			break
+		}
+
+		var f *os.File
+		f, err = fileListener.File()
+		if err != nil {
+			err = xerrors.Errorf("get file of listener for address '%v': %w", listener.address, err)
+			break
+		}
+		files = append(files, f)
+		addresses = append(addresses, listener.address)
+	}
+
+	if err != nil {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		return nil, "", err
+	}
+	return files, strings.Join(addresses, ","), nil
+}
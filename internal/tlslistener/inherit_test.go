@@ -0,0 +1,86 @@
+package tlslistener
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func resetListenRegistry() {
+	listenRegistry.mu.Lock()
+	defer listenRegistry.mu.Unlock()
+
+	listenRegistry.inheritParsed = false
+	listenRegistry.inherited = nil
+	listenRegistry.opened = nil
+}
+
+func TestInheritListeners(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	resetListenRegistry()
+	defer resetListenRegistry()
+
+	const address = "127.0.0.1:0"
+
+	parentListener, err := listen(ctx, address)
+	e.CmpNoError(err)
+
+	unusedListener, err := listen(ctx, "127.0.0.1:0")
+	e.CmpNoError(err)
+	e.CmpNoError(unusedListener.Close())
+
+	files, env, err := ListenerFiles()
+	e.CmpNoError(err)
+	e.Len(files, 1)
+	e.Cmp(env, address)
+
+	// emulate new process
+	resetListenRegistry()
+	t.Setenv(InheritListenersEnv, env+",127.0.0.1:1")
+
+	unusedParentListener, err := net.Listen("tcp", "127.0.0.1:0")
+	e.CmpNoError(err)
+	unusedFile, err := unusedParentListener.(*net.TCPListener).File()
+	e.CmpNoError(err)
+	e.CmpNoError(unusedParentListener.Close())
+
+	oldInheritFile := inheritFile
+	defer func() { inheritFile = oldInheritFile }()
+	inheritFile = func(index int, name string) *os.File {
+		if index < len(files) {
+			return files[index]
+		}
+		return unusedFile
+	}
+
+	childListener, err := listen(ctx, address)
+	e.CmpNoError(err)
+	defer th.Close(childListener)
+	e.Cmp(childListener.Addr().String(), parentListener.Addr().String())
+
+	CloseUnusedInheritedListeners(ctx)
+	listenRegistry.mu.Lock()
+	e.Len(listenRegistry.inherited, 0)
+	listenRegistry.mu.Unlock()
+
+	// parent stop listen, but child accept connections on same socket
+	e.CmpNoError(parentListener.Close())
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := childListener.Accept()
+		if err == nil {
+			err = conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, err := net.Dial("tcp", childListener.Addr().String())
+	e.CmpNoError(err)
+	e.CmpNoError(<-accepted)
+	e.CmpNoError(conn.Close())
+}
@@ -0,0 +1,161 @@
+package tlslistener
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2"
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	"github.com/rekby/lets-proxy2/internal/metrics"
+)
+
+// Reasons of rejected connections for metrics
+const (
+	rejectMaxConnections      = "max_connections"
+	rejectMaxConnectionsPerIP = "max_connections_per_ip"
+	rejectHandshakeRate       = "handshake_rate"
+	rejectHandshakeTimeout    = "handshake_timeout"
+)
+
+// handshakeLimitersCacheSize is max count of ip addresses, which handshakes rate is tracked
+const handshakeLimitersCacheSize = 100000
+
+// ConnectionLimits protect from connections and handshakes flood. Zero values mean no limit.
+type ConnectionLimits struct {
+	// MaxConnections is max count of opened connections from all clients
+	MaxConnections int
+
+	// MaxConnectionsPerIP is max count of opened connections from one ip
+	MaxConnectionsPerIP int
+
+	// HandshakeTimeout is max time of tls handshake
+	HandshakeTimeout time.Duration
+
+	// HandshakesPerSecondPerIP is max rate of tls handshakes from one ip
+	HandshakesPerSecondPerIP int
+}
+
+type connectionLimiter struct {
+	limits ConnectionLimits
+	clock  clockwork.Clock
+
+	mu               sync.Mutex
+	connections      int
+	connectionsPerIP map[string]int
+
+	handshakes *lru.Cache[string, *rate.Limiter]
+	rejected   *prometheus.CounterVec
+}
+
+func newConnectionLimiter(limits ConnectionLimits, r prometheus.Registerer) *connectionLimiter {
+	res := &connectionLimiter{
+		limits:           limits,
+		clock:            clockwork.NewRealClock(),
+		connectionsPerIP: make(map[string]int),
+		rejected:         metrics.CounterVec(r, "rejected_conn", "rejected tcp connections", "reason"),
+	}
+	if limits.HandshakesPerSecondPerIP > 0 {
+		res.handshakes, _ = lru.New[string, *rate.Limiter](handshakeLimitersCacheSize)
+	}
+	return res
+}
+
+// acquire reserve place for new connection in global limit. Caller must call release after close the connection.
+func (l *connectionLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.MaxConnections > 0 && l.connections >= l.limits.MaxConnections {
+		l.reject(rejectMaxConnections)
+		return false
+	}
+	l.connections++
+	return true
+}
+
+func (l *connectionLimiter) release() {
+	l.mu.Lock()
+	l.connections--
+	l.mu.Unlock()
+}
+
+// acquireIP reserve place for new connection from the ip. Caller must call releaseIP after close the connection.
+func (l *connectionLimiter) acquireIP(ip string) bool {
+	if l.limits.MaxConnectionsPerIP <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.connectionsPerIP[ip] >= l.limits.MaxConnectionsPerIP {
+		l.reject(rejectMaxConnectionsPerIP)
+		return false
+	}
+	l.connectionsPerIP[ip]++
+	return true
+}
+
+func (l *connectionLimiter) releaseIP(ip string) {
+	if l.limits.MaxConnectionsPerIP <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.connectionsPerIP[ip]--
+	if l.connectionsPerIP[ip] <= 0 {
+		delete(l.connectionsPerIP, ip)
+	}
+}
+
+func (l *connectionLimiter) allowHandshake(ip string) bool {
+	if l.handshakes == nil {
+		return true
+	}
+
+	limiter, ok := l.handshakes.Get(ip)
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(l.limits.HandshakesPerSecondPerIP), l.limits.HandshakesPerSecondPerIP)
+		if exist, _ := l.handshakes.ContainsOrAdd(ip, limiter); exist {
+			if cached, ok := l.handshakes.Get(ip); ok {
+				limiter = cached
+			}
+		}
+	}
+
+	if limiter.AllowN(l.clock.Now(), 1) {
+		return true
+	}
+	l.reject(rejectHandshakeRate)
+	return false
+}
+
+func (l *connectionLimiter) reject(reason string) {
+	l.rejected.WithLabelValues(reason).Inc()
+}
+
+// limitedConn release places in limits of connectionLimiter once, when connection closed
+type limitedConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitedConn) Close() error {
+	c.releaseOnce.Do(c.release)
+	return c.Conn.Close()
+}
+
+func connIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
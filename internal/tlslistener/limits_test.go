@@ -0,0 +1,99 @@
+package tlslistener
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	limiter := newConnectionLimiter(ConnectionLimits{MaxConnections: 2, MaxConnectionsPerIP: 1}, nil)
+	td.True(limiter.acquire())
+	td.True(limiter.acquire())
+	td.False(limiter.acquire())
+	limiter.release()
+	td.True(limiter.acquire())
+
+	td.True(limiter.acquireIP("1.2.3.4"))
+	td.False(limiter.acquireIP("1.2.3.4"))
+	td.True(limiter.acquireIP("1.2.3.5"))
+	limiter.releaseIP("1.2.3.4")
+	td.True(limiter.acquireIP("1.2.3.4"))
+	limiter.releaseIP("1.2.3.4")
+	limiter.releaseIP("1.2.3.5")
+	td.Len(limiter.connectionsPerIP, 0)
+
+	limiter = newConnectionLimiter(ConnectionLimits{}, nil)
+	for i := 0; i < 10; i++ {
+		td.True(limiter.acquire())
+		td.True(limiter.acquireIP("1.2.3.4"))
+		td.True(limiter.allowHandshake("1.2.3.4"))
+	}
+
+	clock := clockwork.NewFakeClock()
+	limiter = newConnectionLimiter(ConnectionLimits{HandshakesPerSecondPerIP: 2}, nil)
+	limiter.clock = clock
+	td.True(limiter.allowHandshake("1.2.3.4"))
+	td.True(limiter.allowHandshake("1.2.3.4"))
+	td.False(limiter.allowHandshake("1.2.3.4"))
+	td.True(limiter.allowHandshake("1.2.3.5"))
+	clock.Advance(time.Second / 2)
+	td.True(limiter.allowHandshake("1.2.3.4"))
+	td.False(limiter.allowHandshake("1.2.3.4"))
+}
+
+func TestListenersHandler_Limits(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	// wait while connection handlers finish logging
+	defer time.Sleep(time.Second / 10)
+
+	td := testdeep.NewT(t)
+
+	td.FailureIsFatal()
+	listenerForTLS, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	td.CmpNoError(err)
+	td.FailureIsFatal(false)
+
+	proxy := ListenersHandler{
+		GetCertificate:        dummyGetCertificate,
+		ListenersForHandleTLS: []net.Listener{listenerForTLS},
+		Limits:                ConnectionLimits{MaxConnectionsPerIP: 1, HandshakeTimeout: 100 * time.Millisecond},
+	}
+	td.CmpNoError(proxy.Start(ctx, nil))
+	defer func() { _ = proxy.Close() }()
+
+	isClosed := func(conn net.Conn, timeout time.Duration) bool {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		_, err := conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	conn1, err := net.Dial("tcp", listenerForTLS.Addr().String())
+	td.CmpNoError(err)
+	defer func() { _ = conn1.Close() }()
+
+	// wait while first connection registered
+	time.Sleep(20 * time.Millisecond)
+
+	conn2, err := net.Dial("tcp", listenerForTLS.Addr().String())
+	td.CmpNoError(err)
+	defer func() { _ = conn2.Close() }()
+	td.True(isClosed(conn2, time.Second), "rejected by connections per ip limit")
+
+	td.True(isClosed(conn1, time.Second), "closed by handshake timeout")
+
+	conn3, err := net.Dial("tcp", listenerForTLS.Addr().String())
+	td.CmpNoError(err)
+	defer func() { _ = conn3.Close() }()
+	td.False(isClosed(conn3, 20*time.Millisecond), "place released after close")
+}
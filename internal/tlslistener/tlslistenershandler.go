@@ -8,6 +8,7 @@ import (
 	"net"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/rekby/lets-proxy2/internal/metrics"
 	"golang.org/x/xerrors"
@@ -35,6 +36,9 @@ type ListenersHandler struct {
 
 	NextProtos []string
 
+	// Limits protect from connections flood, must be set before Start
+	Limits ConnectionLimits
+
 	ctx           context.Context
 	ctxCancelFunc func()
 	tlsConfig     tls.Config
@@ -47,6 +51,8 @@ type ListenersHandler struct {
 
 	connectionHandleStart  metrics.ProcessStartFunc
 	connectionHandleFinish metrics.ProcessFinishFunc
+
+	limiter *connectionLimiter
 }
 
 type contextInfo struct {
@@ -59,8 +65,15 @@ func (p *ListenersHandler) Accept() (net.Conn, error) {
 	return p.connListenProxy.Accept()
 }
 
+// Close stop accept new connections. Accepted connections doesn't close.
 func (p *ListenersHandler) Close() error {
 	p.ctxCancelFunc()
+	for _, listener := range p.ListenersForHandleTLS {
+		_ = listener.Close()
+	}
+	for _, listener := range p.Listeners {
+		_ = listener.Close()
+	}
 	return p.connListenProxy.Close()
 }
 
@@ -72,36 +85,37 @@ func (p *ListenersHandler) Start(ctx context.Context, r prometheus.Registerer) e
 	p.logger = zc.L(ctx)
 	p.init()
 	p.initMetrics(r)
+	p.limiter = newConnectionLimiter(p.Limits, r)
 
 	p.ctx, p.ctxCancelFunc = context.WithCancel(ctx)
 
-	listenerClosed := make(chan struct{})
+	listenersCount := len(p.ListenersForHandleTLS) + len(p.Listeners)
+	listenerClosed := make(chan struct{}, listenersCount)
 
 	logger := zc.L(ctx)
 	logger.Info("StartAutoRenew handleListeners")
 
 	for _, listenerForTLS := range p.ListenersForHandleTLS {
 		// handlepanic: in handleConnections
-		go handleConnections(ctx, listenerForTLS, p.handleTCPTLSConnection, listenerClosed)
+		go handleConnections(p.ctx, listenerForTLS, p.limiter, p.handleTCPTLSConnection, listenerClosed)
 	}
 
 	for _, listener := range p.Listeners {
 		// handlepanic: in handleConnections
-		go handleConnections(ctx, listener, p.handleTCPConnection, listenerClosed)
+		go handleConnections(p.ctx, listener, p.limiter, p.handleTCPConnection, listenerClosed)
 	}
 
 	go func() {
 		defer log.HandlePanic(logger)
 
-		listenersCount := len(p.ListenersForHandleTLS) + len(p.Listeners)
 		for i := 0; i < listenersCount; i++ {
 			select {
-			case <-ctx.Done():
+			case <-p.ctx.Done():
 				return
 			case <-listenerClosed:
 			}
 		}
-		if ctx.Err() == nil {
+		if p.ctx.Err() == nil {
 			logger.Warn("All listeners closed. Close Listener handler.")
 			_ = p.Close()
 		}
@@ -110,7 +124,8 @@ func (p *ListenersHandler) Start(ctx context.Context, r prometheus.Registerer) e
 	return nil
 }
 
-func handleConnections(ctx context.Context, l net.Listener, handleFunc func(ctx context.Context, conn net.Conn), listenerClosed chan<- struct{}) {
+func handleConnections(ctx context.Context, l net.Listener, limiter *connectionLimiter,
+	handleFunc func(ctx context.Context, conn net.Conn), listenerClosed chan<- struct{}) {
 	logger := zc.L(ctx)
 	defer log.HandlePanic(logger)
 
@@ -127,8 +142,14 @@ func handleConnections(ctx context.Context, l net.Listener, handleFunc func(ctx
 			listenerClosed <- struct{}{}
 			return
 		}
+		if !limiter.acquire() {
+			logger.Debug("Reject connection: max connections", zap.Stringer("remote_addr", conn.RemoteAddr()))
+			_ = conn.Close()
+			continue
+		}
+
 		// handlepanic: in handleFunc
-		go handleFunc(ctx, conn)
+		go handleFunc(ctx, &limitedConn{Conn: conn, release: limiter.release})
 	}
 }
 
@@ -206,7 +227,30 @@ func (p *ListenersHandler) GetConnectionContext(remoteAddr, localAddr string) (c
 	return nil, errors.New("not found registered connection")
 }
 
+// acquireIP check per ip limit for the connection and close it if limit exceeded
+func (p *ListenersHandler) acquireIP(conn net.Conn) bool {
+	ip := connIP(conn)
+	if !p.limiter.acquireIP(ip) {
+		p.logger.Debug("Reject connection: max connections per ip", zap.String("ip", ip))
+		_ = conn.Close()
+		return false
+	}
+
+	if limited, ok := conn.(*limitedConn); ok {
+		releaseGlobal := limited.release
+		limited.release = func() {
+			p.limiter.releaseIP(ip)
+			releaseGlobal()
+		}
+	}
+	return true
+}
+
 func (p *ListenersHandler) handleTCPConnection(ctx context.Context, conn net.Conn) {
+	if !p.acquireIP(conn) {
+		return
+	}
+
 	contextConn := p.registerConnection(conn, false)
 	logger := zc.L(contextConn.Context)
 
@@ -223,6 +267,15 @@ func (p *ListenersHandler) handleTCPConnection(ctx context.Context, conn net.Con
 }
 
 func (p *ListenersHandler) handleTCPTLSConnection(ctx context.Context, conn net.Conn) {
+	if !p.acquireIP(conn) {
+		return
+	}
+	if !p.limiter.allowHandshake(connIP(conn)) {
+		p.logger.Debug("Reject connection: handshakes rate", zap.Stringer("remote_addr", conn.RemoteAddr()))
+		_ = conn.Close()
+		return
+	}
+
 	contextConn := p.registerConnection(conn, true)
 	logger := zc.L(contextConn.Context)
 
@@ -230,8 +283,20 @@ func (p *ListenersHandler) handleTCPTLSConnection(ctx context.Context, conn net.
 		zap.String("local_addr", conn.LocalAddr().String()))
 
 	tlsConn := tls.Server(contextConn, &p.tlsConfig)
+	if p.Limits.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(p.Limits.HandshakeTimeout))
+	}
 	err := tlsConn.Handshake()
 	log.DebugInfo(logger, err, "TLS Handshake")
+	if p.Limits.HandshakeTimeout > 0 {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			p.limiter.reject(rejectHandshakeTimeout)
+			_ = tlsConn.Close()
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+	}
 
 	err = p.connListenProxy.Put(tlsConn)
 	if err != nil {